@@ -0,0 +1,739 @@
+// Package client speaks the relay's websocket protocol from Go. It logs
+// in, keeps the connection alive across drops by resuming or reconnecting
+// and reattaching sessions, and turns frames into typed events. It is meant for
+// bots, integration tests and tooling; payloads are passed through as-is,
+// so end-to-end encryption is the caller's job.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frame is the relay's wire format.
+type Frame struct {
+	T    string          `json:"t"`
+	SID  string          `json:"sid,omitempty"`
+	C    bool            `json:"c,omitempty"`
+	P    int             `json:"p,omitempty"`
+	SH   string          `json:"sh,omitempty"`
+	To   string          `json:"to,omitempty"`
+	ID   string          `json:"id,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+	Seq  uint64          `json:"seq,omitempty"` // number of a relayed frame within the session
+	TS   int64           `json:"ts,omitempty"`  // relay time of a numbered frame in Unix milliseconds
+	N    uint64          `json:"n,omitempty"`   // stream number on resumable connections
+}
+
+const (
+	// The server pings every 10s, so a silent connection is dead.
+	defaultPingTimeout = 35 * time.Second
+	defaultMinBackoff  = 500 * time.Millisecond
+	defaultMaxBackoff  = 30 * time.Second
+	defaultEventBuffer = 256
+	authTimeout        = 10 * time.Second
+	writeTimeout       = 5 * time.Second
+)
+
+var (
+	ErrClosed       = errors.New("client closed")
+	ErrDisconnected = errors.New("connection lost before the server answered")
+	ErrNotDelivered = errors.New("no session member received the message")
+	ErrBuffered     = errors.New("the message is held for members that dropped and may still resume")
+	ErrDenied       = errors.New("connection request denied")
+)
+
+// TokenSource returns a fresh OAuth token. It is called when the server
+// rejects the stored session token, typically because it expired.
+type TokenSource func(ctx context.Context) (string, error)
+
+// Option configures a Client built by Dial.
+type Option func(*Client)
+
+// WithTokenSource refreshes the login token when AUTH fails.
+func WithTokenSource(ts TokenSource) Option {
+	return func(c *Client) { c.tokenSource = ts }
+}
+
+// WithPairwiseIDs asks the server for pairwise peer IDs.
+func WithPairwiseIDs() Option {
+	return func(c *Client) { c.pairwise = true }
+}
+
+// WithRelayOnly asks the server to strip non-relay ICE candidates.
+func WithRelayOnly() Option {
+	return func(c *Client) { c.relayOnly = true }
+}
+
+// WithResume asks the server to hold the connection's sessions and buffer
+// its frames across short drops, so a reconnect resumes where it left off
+// instead of reattaching.
+func WithResume() Option {
+	return func(c *Client) { c.resume = true }
+}
+
+// WithBackoff sets the reconnect delay, which doubles from min to max
+// after each failed attempt.
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Client) { c.minBackoff, c.maxBackoff = min, max }
+}
+
+// WithoutReconnect closes the client when the connection drops.
+func WithoutReconnect() Option {
+	return func(c *Client) { c.reconnect = false }
+}
+
+// WithPingTimeout sets how long the reader waits for any frame or
+// WebSocket ping before treating the connection as dead.
+func WithPingTimeout(d time.Duration) Option {
+	return func(c *Client) { c.pingTimeout = d }
+}
+
+// WithDialer replaces websocket.DefaultDialer.
+func WithDialer(d *websocket.Dialer) Option {
+	return func(c *Client) { c.dialer = d }
+}
+
+// WithEventBuffer sets the capacity of the Events channel.
+func WithEventBuffer(n int) Option {
+	return func(c *Client) { c.eventBuffer = n }
+}
+
+// Client is a logged-in connection to the relay. Its methods are safe for
+// concurrent use. Events must be drained, or the reader stalls.
+type Client struct {
+	url         string
+	tokenSource TokenSource
+	pairwise    bool
+	relayOnly   bool
+	resume      bool
+	reconnect   bool
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	pingTimeout time.Duration
+	dialer      *websocket.Dialer
+	eventBuffer int
+
+	token       string
+	email       string
+	accountID   string
+	resumeToken string
+	lastN       uint64 // highest stream number handled
+	conn        *websocket.Conn
+	sessions    map[string]bool
+	pending     map[string]chan Frame
+	mu          sync.Mutex
+	writeMu     sync.Mutex
+	ids         atomic.Uint64
+
+	events    chan Event
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Dial connects to url and logs in with token, an OAuth token or a
+// session token from an earlier login.
+func Dial(ctx context.Context, url, token string, opts ...Option) (*Client, error) {
+	c := &Client{
+		url:         url,
+		token:       token,
+		reconnect:   true,
+		minBackoff:  defaultMinBackoff,
+		maxBackoff:  defaultMaxBackoff,
+		pingTimeout: defaultPingTimeout,
+		dialer:      websocket.DefaultDialer,
+		eventBuffer: defaultEventBuffer,
+		sessions:    make(map[string]bool),
+		pending:     make(map[string]chan Frame),
+		closing:     make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.events = make(chan Event, max(c.eventBuffer, 1))
+
+	conn, err := c.login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	go c.run(conn)
+	return c, nil
+}
+
+// Events delivers everything the server sends except PING and the answers
+// consumed by Connect and Send. It is closed after Close, or when the
+// connection is lost for good.
+func (c *Client) Events() <-chan Event { return c.events }
+
+// Email is the account the server authenticated.
+func (c *Client) Email() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.email
+}
+
+// KeyLogAccountID is the ID the relay's key transparency log records this
+// account's public keys under, for finding them in /kt/entries.
+func (c *Client) KeyLogAccountID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.accountID
+}
+
+// Token is the current session token.
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// ConnectRequest is the data of a CONNECT_REQ.
+type ConnectRequest struct {
+	TargetEmail  string `json:"targetEmail"`
+	PublicKey    string `json:"publicKey"`
+	SenderName   string `json:"senderName,omitempty"`
+	SenderAvatar string `json:"senderAvatar,omitempty"`
+	EphemeralKey string `json:"ephemeralKey,omitempty"`
+}
+
+// ConnectResult is the answer to a CONNECT_REQ. Queued requests are
+// answered later with a JoinAccept or JoinDenied event.
+type ConnectResult struct {
+	SID    string
+	Queued bool
+	Accept *JoinAccept
+}
+
+// Connect sends a connection request and waits until the target accepts,
+// denies (ErrDenied) or the request is queued for an offline target.
+func (c *Client) Connect(ctx context.Context, req ConnectRequest) (*ConnectResult, error) {
+	data, _ := json.Marshal(req)
+	r, err := c.request(ctx, Frame{T: "CONNECT_REQ", Data: data})
+	if err != nil {
+		return nil, err
+	}
+	switch r.T {
+	case "JOIN_ACCEPT":
+		a := parseJoinAccept(r)
+		return &ConnectResult{SID: r.SID, Accept: &a}, nil
+	case "JOIN_DENIED":
+		return &ConnectResult{SID: r.SID}, ErrDenied
+	default:
+		return &ConnectResult{SID: r.SID, Queued: true}, nil
+	}
+}
+
+// Accept answers a JoinRequest and joins the session.
+func (c *Client) Accept(sid, publicKey string) error {
+	data, _ := json.Marshal(map[string]string{"publicKey": publicKey})
+	if err := c.write(Frame{T: "JOIN_ACCEPT", SID: sid, Data: data}); err != nil {
+		return err
+	}
+	c.track(sid)
+	return nil
+}
+
+// Deny declines a JoinRequest.
+func (c *Client) Deny(sid string) error {
+	return c.write(Frame{T: "JOIN_DENY", SID: sid})
+}
+
+// Reattach rejoins a session from an earlier connection. Sessions joined
+// through this client are reattached automatically after a reconnect.
+func (c *Client) Reattach(sid string) error {
+	c.track(sid)
+	return c.write(Frame{T: "REATTACH", SID: sid})
+}
+
+// Send relays payload to every other member of sid and waits for the
+// server's delivery acknowledgement. It returns ErrNotDelivered when no
+// member was online, and ErrBuffered when the only members it went to had
+// dropped and the server holds it in case they resume.
+func (c *Client) Send(ctx context.Context, sid, payload string) error {
+	return c.SendTo(ctx, sid, "", payload)
+}
+
+// SendTo is Send addressed to the single member with peer ID to.
+func (c *Client) SendTo(ctx context.Context, sid, to, payload string) error {
+	data, _ := json.Marshal(map[string]string{"payload": payload})
+	r, err := c.request(ctx, Frame{T: "MSG", SID: sid, To: to, C: true, Data: data})
+	if err != nil {
+		return err
+	}
+	if r.T == "DELIVERED_FAILED" {
+		var d struct {
+			Buffered bool `json:"buffered"`
+		}
+		json.Unmarshal(r.Data, &d)
+		if d.Buffered {
+			return ErrBuffered
+		}
+		return ErrNotDelivered
+	}
+	return nil
+}
+
+// SyncResult is the answer to a SYNC. Gap is true when some MSGs after
+// After are no longer held by the relay; Count of them follow as Message
+// events.
+type SyncResult struct {
+	After  uint64 `json:"after"`
+	Latest uint64 `json:"latest"`
+	Gap    bool   `json:"gap"`
+	Count  int    `json:"count"`
+}
+
+// Sync asks the relay to resend the MSGs in sid numbered after after. The
+// replayed MSGs arrive as Message events following the answer.
+func (c *Client) Sync(ctx context.Context, sid string, after uint64) (*SyncResult, error) {
+	data, _ := json.Marshal(map[string]uint64{"after": after})
+	r, err := c.request(ctx, Frame{T: "SYNC", SID: sid, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	var res SyncResult
+	if err := json.Unmarshal(r.Data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Quota is one account quota in a QuotaStatus. A zero Limit means no limit.
+type Quota struct {
+	Limit int64 `json:"limit"`
+	Used  int64 `json:"used"`
+}
+
+// QuotaStatus is the account's tier and its quotas by name: dailyBytes,
+// sessions, pendingRequests and storedBytes.
+type QuotaStatus struct {
+	Tier    string           `json:"tier"`
+	ResetAt int64            `json:"resetAt"` // when dailyBytes starts over, in Unix milliseconds
+	Quotas  map[string]Quota `json:"quotas"`
+}
+
+// Quota asks the relay for the account's quota usage. Going over a quota
+// fails the frame with an *Error whose Code is QUOTA_EXCEEDED.
+func (c *Client) Quota(ctx context.Context) (*QuotaStatus, error) {
+	r, err := c.request(ctx, Frame{T: "QUOTA"})
+	if err != nil {
+		return nil, err
+	}
+	var st QuotaStatus
+	if err := json.Unmarshal(r.Data, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Report flags the member of sid with peer ID peer, as it appeared in the
+// JoinRequest or JoinAccept, for review by the relay's operators. It
+// returns the report's ID.
+func (c *Client) Report(ctx context.Context, sid, peer, reason string) (string, error) {
+	data, _ := json.Marshal(map[string]string{"emailHash": peer, "reason": reason})
+	r, err := c.request(ctx, Frame{T: "REPORT", SID: sid, Data: data})
+	if err != nil {
+		return "", err
+	}
+	var d struct {
+		ReportID string `json:"reportId"`
+	}
+	if err := json.Unmarshal(r.Data, &d); err != nil {
+		return "", err
+	}
+	return d.ReportID, nil
+}
+
+// SendFrame writes f without waiting for an answer.
+func (c *Client) SendFrame(f Frame) error {
+	return c.write(f)
+}
+
+// Close disconnects and stops reconnecting.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		c.writeMu.Lock()
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeTimeout))
+		c.writeMu.Unlock()
+		conn.Close()
+	}
+	<-c.done
+	return nil
+}
+
+func (c *Client) track(sid string) {
+	c.mu.Lock()
+	c.sessions[sid] = true
+	c.mu.Unlock()
+}
+
+func (c *Client) isClosing() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) write(f Frame) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		if c.isClosing() {
+			return ErrClosed
+		}
+		return ErrDisconnected
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return conn.WriteJSON(f)
+}
+
+// request sends f with a fresh id and waits for the first frame echoing
+// it. An ERROR answer is returned as *Error.
+func (c *Client) request(ctx context.Context, f Frame) (Frame, error) {
+	f.ID = fmt.Sprintf("c%d", c.ids.Add(1))
+	ch := make(chan Frame, 1)
+	c.mu.Lock()
+	c.pending[f.ID] = ch
+	c.mu.Unlock()
+	forget := func() {
+		c.mu.Lock()
+		delete(c.pending, f.ID)
+		c.mu.Unlock()
+	}
+
+	if err := c.write(f); err != nil {
+		forget()
+		return Frame{}, err
+	}
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return Frame{}, ErrDisconnected
+		}
+		if r.T == "ERROR" {
+			return r, parseError(r)
+		}
+		return r, nil
+	case <-ctx.Done():
+		forget()
+		return Frame{}, ctx.Err()
+	case <-c.closing:
+		return Frame{}, ErrClosed
+	}
+}
+
+func (c *Client) failPending() {
+	c.mu.Lock()
+	for _, ch := range c.pending {
+		close(ch)
+	}
+	c.pending = make(map[string]chan Frame)
+	c.mu.Unlock()
+}
+
+func (c *Client) emit(e Event) {
+	select {
+	case c.events <- e:
+	case <-c.closing:
+	}
+}
+
+// login dials and sends AUTH, asking the TokenSource for a new token once
+// if the current one is rejected.
+func (c *Client) login(ctx context.Context) (*websocket.Conn, error) {
+	conn, _, err := c.dialer.DialContext(ctx, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := c.Token()
+	refreshed := false
+	for {
+		err := c.auth(ctx, conn, token)
+		if err == nil {
+			return conn, nil
+		}
+		var pe *Error
+		if refreshed || c.tokenSource == nil || !errors.As(err, &pe) || pe.Code != "AUTH_FAILED" {
+			conn.Close()
+			return nil, err
+		}
+		if token, err = c.tokenSource(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		refreshed = true
+	}
+}
+
+func (c *Client) auth(ctx context.Context, conn *websocket.Conn, token string) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(authTimeout)
+	}
+	conn.SetReadDeadline(deadline)
+	conn.SetWriteDeadline(deadline)
+	data, _ := json.Marshal(map[string]any{
+		"token":       token,
+		"pairwiseIds": c.pairwise,
+		"relayOnly":   c.relayOnly,
+		"resumable":   c.resume,
+	})
+	if err := conn.WriteJSON(Frame{T: "AUTH", Data: data}); err != nil {
+		return err
+	}
+	for {
+		var f Frame
+		if err := conn.ReadJSON(&f); err != nil {
+			return err
+		}
+		switch f.T {
+		case "AUTH_SUCCESS":
+			var d struct {
+				Email       string `json:"email"`
+				Token       string `json:"token"`
+				AccountID   string `json:"ktAccountId"`
+				ResumeToken string `json:"resumeToken"`
+			}
+			json.Unmarshal(f.Data, &d)
+			c.mu.Lock()
+			changed := d.Token != c.token
+			c.email, c.token, c.accountID = d.Email, d.Token, d.AccountID
+			c.resumeToken, c.lastN = d.ResumeToken, f.N
+			c.mu.Unlock()
+			if changed && strings.HasPrefix(d.Token, "sess:") {
+				c.emit(TokenRefreshed{Token: d.Token})
+			}
+			return nil
+		case "ERROR":
+			return parseError(f)
+		}
+	}
+}
+
+func (c *Client) run(conn *websocket.Conn) {
+	defer close(c.done)
+	defer close(c.events)
+	for {
+		err := c.read(conn)
+		c.failPending()
+		if c.isClosing() {
+			return
+		}
+		c.emit(Disconnected{Err: err})
+		if !c.reconnect {
+			return
+		}
+		var resumed bool
+		if conn, resumed = c.redial(); conn == nil {
+			return
+		}
+		c.emit(Reconnected{Resumed: resumed})
+	}
+}
+
+// read handles frames until the connection fails. Every frame and every
+// WebSocket ping pushes the read deadline out by pingTimeout.
+func (c *Client) read(conn *websocket.Conn) error {
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(c.pingTimeout))
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeTimeout))
+		var ne net.Error
+		if errors.Is(err, websocket.ErrCloseSent) || errors.As(err, &ne) {
+			// As in gorilla's default handler, a failed pong surfaces
+			// as a read error instead.
+			return nil
+		}
+		return err
+	})
+	for {
+		conn.SetReadDeadline(time.Now().Add(c.pingTimeout))
+		var f Frame
+		if err := conn.ReadJSON(&f); err != nil {
+			c.mu.Lock()
+			if c.conn == conn {
+				c.conn = nil
+			}
+			c.mu.Unlock()
+			conn.Close()
+			return err
+		}
+		if f.T == "PING" { // legacy heartbeat frame
+			continue
+		}
+		if f.N != 0 {
+			c.mu.Lock()
+			seen := f.N <= c.lastN
+			if !seen {
+				c.lastN = f.N
+			}
+			c.mu.Unlock()
+			if seen {
+				continue
+			}
+		}
+		c.handle(f)
+	}
+}
+
+func (c *Client) handle(f Frame) {
+	if f.T == "JOIN_ACCEPT" {
+		c.track(f.SID)
+	}
+	if f.ID != "" {
+		c.mu.Lock()
+		ch, ok := c.pending[f.ID]
+		delete(c.pending, f.ID)
+		c.mu.Unlock()
+		if ok {
+			ch <- f
+			switch f.T {
+			case "DELIVERED", "DELIVERED_FAILED", "ERROR":
+				return
+			}
+		}
+	}
+	c.emit(toEvent(f))
+}
+
+// redial reconnects with jittered exponential backoff. It resumes the
+// dropped connection when it can, and otherwise logs in again and
+// reattaches every known session. It gives up when the client is closed or
+// the server rejects the login outright or the account is banned.
+func (c *Client) redial() (*websocket.Conn, bool) {
+	backoff := c.minBackoff
+	for {
+		wait := backoff/2 + rand.N(backoff/2+1)
+		select {
+		case <-c.closing:
+			return nil, false
+		case <-time.After(wait):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+		go func() {
+			select {
+			case <-c.closing:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		conn, err := c.resumeConn(ctx)
+		if conn != nil {
+			cancel()
+			c.mu.Lock()
+			if c.isClosing() {
+				c.mu.Unlock()
+				conn.Close()
+				return nil, false
+			}
+			c.conn = conn
+			c.mu.Unlock()
+			return conn, true
+		}
+		if err == nil {
+			conn, err = c.login(ctx)
+		}
+		cancel()
+		if err == nil {
+			c.mu.Lock()
+			if c.isClosing() {
+				c.mu.Unlock()
+				conn.Close()
+				return nil, false
+			}
+			c.conn = conn
+			sids := make([]string, 0, len(c.sessions))
+			for sid := range c.sessions {
+				sids = append(sids, sid)
+			}
+			c.mu.Unlock()
+			for _, sid := range sids {
+				c.write(Frame{T: "REATTACH", SID: sid})
+			}
+			return conn, false
+		}
+		var pe *Error
+		if errors.As(err, &pe) && (pe.Code == "AUTH_FAILED" || pe.Code == "ACCOUNT_BANNED") {
+			c.emit(ServerError{Err: pe})
+			return nil, false
+		}
+		backoff = min(2*backoff, c.maxBackoff)
+	}
+}
+
+// resumeConn dials and sends RESUME with the stored resume token. It
+// returns no connection and no error when there is nothing to resume or the
+// server refused, which leaves the caller to log in again.
+func (c *Client) resumeConn(ctx context.Context) (*websocket.Conn, error) {
+	c.mu.Lock()
+	token, last := c.resumeToken, c.lastN
+	c.mu.Unlock()
+	if token == "" {
+		return nil, nil
+	}
+	conn, _, err := c.dialer.DialContext(ctx, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(authTimeout)
+	}
+	conn.SetReadDeadline(deadline)
+	conn.SetWriteDeadline(deadline)
+	data, _ := json.Marshal(map[string]any{"token": token, "last": last})
+	if err := conn.WriteJSON(Frame{T: "RESUME", Data: data}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for {
+		var f Frame
+		if err := conn.ReadJSON(&f); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		switch f.T {
+		case "RESUMED":
+			var d struct {
+				ResumeToken string `json:"resumeToken"`
+			}
+			json.Unmarshal(f.Data, &d)
+			c.mu.Lock()
+			c.resumeToken = d.ResumeToken
+			c.mu.Unlock()
+			return conn, nil
+		case "ERROR":
+			conn.Close()
+			pe := parseError(f)
+			if pe.Code != "RESUME_FAILED" {
+				return nil, pe
+			}
+			c.mu.Lock()
+			c.resumeToken = ""
+			c.mu.Unlock()
+			return nil, nil
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"relay/server"
+)
+
+func newTestRelay(t *testing.T, opts ...server.Option) (*server.Server, string) {
+	t.Helper()
+	s := server.New(append([]server.Option{server.WithRateLimits(map[string][]server.RateRule{})}, opts...)...)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func dial(t *testing.T, url, token string, opts ...Option) *Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, url, token, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// next returns the first event of type E, skipping others.
+func next[E Event](t *testing.T, c *Client) E {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-c.Events():
+			if !ok {
+				t.Fatal("events closed")
+			}
+			if want, ok := e.(E); ok {
+				return want
+			}
+		case <-timeout:
+			var zero E
+			t.Fatalf("timed out waiting for %T", zero)
+		}
+	}
+}
+
+func TestConnectAcceptAndDeliveredMessage(t *testing.T) {
+	s, url := newTestRelay(t)
+	alice := dial(t, url, s.IssueSessionToken("alice@example.com"))
+	bob := dial(t, url, s.IssueSessionToken("bob@example.com"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result := make(chan *ConnectResult, 1)
+	go func() {
+		r, err := alice.Connect(ctx, ConnectRequest{TargetEmail: "bob@example.com", PublicKey: "keyA"})
+		if err != nil {
+			t.Error(err)
+		}
+		result <- r
+	}()
+
+	req := next[JoinRequest](t, bob)
+	if req.Email != "alice@example.com" || req.PublicKey != "keyA" {
+		t.Fatalf("unexpected join request %+v", req)
+	}
+	if err := bob.Accept(req.SID, "keyB"); err != nil {
+		t.Fatal(err)
+	}
+	r := <-result
+	if r == nil || r.SID != req.SID || r.Accept == nil || r.Accept.PublicKey != "keyB" {
+		t.Fatalf("unexpected connect result %+v", r)
+	}
+
+	if err := alice.Send(ctx, r.SID, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if m := next[Message](t, bob); m.Payload != "hello" || m.SID != r.SID {
+		t.Fatalf("unexpected message %+v", m)
+	}
+
+	var pe *Error
+	if err := alice.SendTo(ctx, r.SID, "nobody", "x"); !errors.As(err, &pe) || pe.Code != "UNKNOWN_RECIPIENT" {
+		t.Fatalf("expected UNKNOWN_RECIPIENT, got %v", err)
+	}
+}
+
+func TestConnectToOfflineTargetIsQueued(t *testing.T) {
+	s, url := newTestRelay(t)
+	alice := dial(t, url, s.IssueSessionToken("alice@example.com"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := alice.Connect(ctx, ConnectRequest{TargetEmail: "bob@example.com", PublicKey: "keyA"})
+	var pe *Error
+	if !errors.As(err, &pe) || pe.Code != "USER_OFFLINE" {
+		t.Fatalf("expected USER_OFFLINE, got %v", err)
+	}
+}
+
+func TestReconnectReattachesSessions(t *testing.T) {
+	s, url := newTestRelay(t)
+	alice := dial(t, url, s.IssueSessionToken("alice@example.com"), WithBackoff(10*time.Millisecond, 50*time.Millisecond))
+	bob := dial(t, url, s.IssueSessionToken("bob@example.com"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		req := next[JoinRequest](t, bob)
+		bob.Accept(req.SID, "keyB")
+	}()
+	r, err := alice.Connect(ctx, ConnectRequest{TargetEmail: "bob@example.com", PublicKey: "keyA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice.mu.Lock()
+	alice.conn.UnderlyingConn().Close()
+	alice.mu.Unlock()
+	next[Disconnected](t, alice)
+	next[Reconnected](t, alice)
+	next[PeerOnline](t, bob)
+
+	if err := bob.Send(ctx, r.SID, "welcome back"); err != nil {
+		t.Fatal(err)
+	}
+	if m := next[Message](t, alice); m.Payload != "welcome back" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+}
+
+func TestRejectedSessionTokenIsRefreshed(t *testing.T) {
+	_, url := newTestRelay(t, server.WithAuthVerifier(server.AuthVerifierFunc(func(token string) (string, error) {
+		if token != "oauth-ok" {
+			return "", errors.New("bad token")
+		}
+		return "carol@example.com", nil
+	})))
+
+	refreshes := 0
+	carol := dial(t, url, "sess:1:carol@example.com:forged", WithTokenSource(func(context.Context) (string, error) {
+		refreshes++
+		return "oauth-ok", nil
+	}))
+	if refreshes != 1 || carol.Email() != "carol@example.com" {
+		t.Fatalf("refreshes=%d email=%q", refreshes, carol.Email())
+	}
+	if tr := next[TokenRefreshed](t, carol); !strings.HasPrefix(tr.Token, "sess:") || tr.Token != carol.Token() {
+		t.Fatalf("unexpected refreshed token %q", tr.Token)
+	}
+}
+
+func TestWebSocketPingsKeepIdleClientConnected(t *testing.T) {
+	s, url := newTestRelay(t, server.WithHeartbeat(20*time.Millisecond, 2))
+	alice := dial(t, url, s.IssueSessionToken("alice@example.com"), WithPingTimeout(100*time.Millisecond))
+
+	// No frames flow, only control pings, for several ping timeouts.
+	select {
+	case e := <-alice.Events():
+		t.Fatalf("unexpected event %T %+v", e, e)
+	case <-time.After(400 * time.Millisecond):
+	}
+}
+
+func TestResumeReplaysMessagesMissedWhileDisconnected(t *testing.T) {
+	s, url := newTestRelay(t)
+	alice := dial(t, url, s.IssueSessionToken("alice@example.com"), WithResume(), WithBackoff(200*time.Millisecond, time.Second))
+	bob := dial(t, url, s.IssueSessionToken("bob@example.com"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		req := next[JoinRequest](t, bob)
+		bob.Accept(req.SID, "keyB")
+	}()
+	r, err := alice.Connect(ctx, ConnectRequest{TargetEmail: "bob@example.com", PublicKey: "keyA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice.mu.Lock()
+	alice.conn.UnderlyingConn().Close()
+	alice.mu.Unlock()
+	next[Disconnected](t, alice)
+	for _, p := range []string{"one", "two"} {
+		// ErrBuffered unless alice has already resumed.
+		if err := bob.Send(ctx, r.SID, p); err != nil && !errors.Is(err, ErrBuffered) {
+			t.Fatalf("send while alice was away: %v", err)
+		}
+	}
+
+	if rc := next[Reconnected](t, alice); !rc.Resumed {
+		t.Fatal("reconnected without resuming")
+	}
+	for _, want := range []string{"one", "two"} {
+		if m := next[Message](t, alice); m.Payload != want {
+			t.Fatalf("got %q, want %q", m.Payload, want)
+		}
+	}
+	if err := alice.Send(ctx, r.SID, "back"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncReplaysNumberedMessages(t *testing.T) {
+	s, url := newTestRelay(t)
+	alice := dial(t, url, s.IssueSessionToken("alice@example.com"))
+	bob := dial(t, url, s.IssueSessionToken("bob@example.com"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		req := next[JoinRequest](t, bob)
+		bob.Accept(req.SID, "keyB")
+	}()
+	r, err := alice.Connect(ctx, ConnectRequest{TargetEmail: "bob@example.com", PublicKey: "keyA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"one", "two"} {
+		if err := alice.Send(ctx, r.SID, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := next[Message](t, bob)
+	if first.Seq != 1 || first.Time.IsZero() {
+		t.Fatalf("unnumbered message %+v", first)
+	}
+	next[Message](t, bob)
+
+	res, err := bob.Sync(ctx, r.SID, first.Seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Gap || res.Latest != 2 || res.Count != 1 {
+		t.Fatalf("unexpected sync result %+v", res)
+	}
+	if m := next[Message](t, bob); m.Seq != 2 || m.Payload != "two" {
+		t.Fatalf("replayed %+v", m)
+	}
+}
+
+func TestQuotaReportsUsageAndExceededErrors(t *testing.T) {
+	s, url := newTestRelay(t, server.WithQuotas(server.NewQuotas(map[string]server.QuotaLimits{
+		server.DefaultTier: {DailyBytes: 8},
+	}, nil)))
+	alice := dial(t, url, s.IssueSessionToken("alice@example.com"))
+	bob := dial(t, url, s.IssueSessionToken("bob@example.com"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		req := next[JoinRequest](t, bob)
+		bob.Accept(req.SID, "keyB")
+	}()
+	r, err := alice.Connect(ctx, ConnectRequest{TargetEmail: "bob@example.com", PublicKey: "keyA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.Send(ctx, r.SID, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	var pe *Error
+	if err := alice.Send(ctx, r.SID, "again"); !errors.As(err, &pe) || pe.Code != "QUOTA_EXCEEDED" || pe.Details["quota"] != "dailyBytes" {
+		t.Fatalf("expected QUOTA_EXCEEDED, got %v", err)
+	}
+	st, err := alice.Quota(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Tier != "default" || st.Quotas["dailyBytes"] != (Quota{Limit: 8, Used: 7}) || st.Quotas["sessions"].Used != 1 {
+		t.Fatalf("unexpected quota status %+v", st)
+	}
+}
+
+func TestReportAndBan(t *testing.T) {
+	m := server.NewModeration()
+	s, url := newTestRelay(t, server.WithModeration(m))
+	alice := dial(t, url, s.IssueSessionToken("alice@example.com"))
+	bob := dial(t, url, s.IssueSessionToken("bob@example.com"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		req := next[JoinRequest](t, bob)
+		bob.Accept(req.SID, "keyB")
+	}()
+	r, err := alice.Connect(ctx, ConnectRequest{TargetEmail: "bob@example.com", PublicKey: "keyA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := alice.Report(ctx, r.SID, r.Accept.EmailHash, "spam")
+	if err != nil || id == "" {
+		t.Fatalf("report = %q, %v", id, err)
+	}
+	if reports := m.Reports(false); len(reports) != 1 || reports[0].Target != "bob@example.com" || reports[0].ID != id {
+		t.Fatalf("unexpected reports %+v", reports)
+	}
+	if _, err := alice.Report(ctx, r.SID, "nobody", "spam"); err == nil {
+		t.Fatal("report about a stranger accepted")
+	}
+
+	m.Restrict("ops", "carol@example.com", server.ActionBan, time.Time{}, "spam", id)
+	var pe *Error
+	if _, err := Dial(ctx, url, s.IssueSessionToken("carol@example.com")); !errors.As(err, &pe) || pe.Code != "ACCOUNT_BANNED" {
+		t.Fatalf("banned account dialed: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Event is delivered on Client.Events. The concrete types below cover the
+// frames a chat client handles; everything else arrives as RawFrame.
+type Event interface{ event() }
+
+// JoinRequest is a CONNECT_REQ from another account, to be answered with
+// Accept or Deny.
+type JoinRequest struct {
+	SID          string
+	Email        string
+	PublicKey    string
+	Name         string
+	Pseudonym    string
+	EmailHash    string
+	EphemeralKey string
+	KeyLogIndex  int
+}
+
+// JoinAccept reports that a peer accepted a connection request.
+type JoinAccept struct {
+	SID         string
+	Email       string
+	PublicKey   string
+	Name        string
+	Pseudonym   string
+	EmailHash   string
+	KeyLogIndex int
+}
+
+// JoinDenied reports that a peer declined a connection request.
+type JoinDenied struct{ SID string }
+
+// ConnectQueued reports that the target was offline and the request was
+// queued for its next login.
+type ConnectQueued struct{ SID string }
+
+// Message is an MSG relayed from a session member. From is the peer ID the
+// server presents for the sender. Seq numbers the frames of a session in
+// relay order, for use with Sync.
+type Message struct {
+	SID     string
+	From    string
+	Payload string
+	Seq     uint64
+	Time    time.Time
+}
+
+// PeerOnline and PeerOffline track session members coming and going.
+type PeerOnline struct{ SID, Peer string }
+type PeerOffline struct{ SID, Peer string }
+
+// ServerError is an ERROR frame that no pending request was waiting for.
+type ServerError struct{ Err *Error }
+
+// Disconnected is sent when the connection drops. With reconnect enabled
+// it is followed by Reconnected once the client is back.
+type Disconnected struct{ Err error }
+
+// Reconnected is sent after a new connection authenticated and every known
+// session was reattached, or, when Resumed, after the server took the
+// connection back and replayed what it missed.
+type Reconnected struct{ Resumed bool }
+
+// TokenRefreshed carries a new session token from AUTH_SUCCESS. Store it to
+// log in again without the OAuth flow.
+type TokenRefreshed struct{ Token string }
+
+// RawFrame is any frame without a typed event, such as RTC_*, CALL_* or
+// PREKEY_LOW.
+type RawFrame struct{ Frame Frame }
+
+func (JoinRequest) event()    {}
+func (JoinAccept) event()     {}
+func (JoinDenied) event()     {}
+func (ConnectQueued) event()  {}
+func (Message) event()        {}
+func (PeerOnline) event()     {}
+func (PeerOffline) event()    {}
+func (ServerError) event()    {}
+func (Disconnected) event()   {}
+func (Reconnected) event()    {}
+func (TokenRefreshed) event() {}
+func (RawFrame) event()       {}
+
+// Error is the data of an ERROR frame.
+type Error struct {
+	Code       string         `json:"code"`
+	Message    string         `json:"message"`
+	Retryable  bool           `json:"retryable"`
+	RetryAfter int64          `json:"retryAfter,omitempty"`
+	Frame      string         `json:"frame,omitempty"`
+	RequestID  string         `json:"requestId,omitempty"`
+	Details    map[string]any `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func parseError(f Frame) *Error {
+	e := &Error{}
+	if err := json.Unmarshal(f.Data, e); err != nil || e.Code == "" {
+		e.Code, e.Message = "INTERNAL", "malformed ERROR frame"
+	}
+	return e
+}
+
+type peerData struct {
+	PublicKey    string `json:"publicKey"`
+	Email        string `json:"email"`
+	Name         string `json:"name"`
+	Pseudonym    string `json:"pseudonym"`
+	EmailHash    string `json:"emailHash"`
+	EphemeralKey string `json:"ephemeralKey"`
+	KeyLogIndex  int    `json:"keyLogIndex"`
+}
+
+func parseJoinAccept(f Frame) JoinAccept {
+	var d peerData
+	json.Unmarshal(f.Data, &d)
+	return JoinAccept{
+		SID:         f.SID,
+		Email:       d.Email,
+		PublicKey:   d.PublicKey,
+		Name:        d.Name,
+		Pseudonym:   d.Pseudonym,
+		EmailHash:   d.EmailHash,
+		KeyLogIndex: d.KeyLogIndex,
+	}
+}
+
+// toEvent converts a frame the reader did not consume into an Event.
+func toEvent(f Frame) Event {
+	switch f.T {
+	case "JOIN_REQUEST":
+		var d peerData
+		json.Unmarshal(f.Data, &d)
+		return JoinRequest{
+			SID:          f.SID,
+			Email:        d.Email,
+			PublicKey:    d.PublicKey,
+			Name:         d.Name,
+			Pseudonym:    d.Pseudonym,
+			EmailHash:    d.EmailHash,
+			EphemeralKey: d.EphemeralKey,
+			KeyLogIndex:  d.KeyLogIndex,
+		}
+	case "JOIN_ACCEPT":
+		return parseJoinAccept(f)
+	case "JOIN_DENIED":
+		return JoinDenied{SID: f.SID}
+	case "CONNECT_QUEUED":
+		return ConnectQueued{SID: f.SID}
+	case "MSG":
+		var d struct {
+			Payload string `json:"payload"`
+		}
+		json.Unmarshal(f.Data, &d)
+		return Message{SID: f.SID, From: f.SH, Payload: d.Payload, Seq: f.Seq, Time: time.UnixMilli(f.TS)}
+	case "PEER_ONLINE":
+		return PeerOnline{SID: f.SID, Peer: f.SH}
+	case "PEER_OFFLINE":
+		return PeerOffline{SID: f.SID, Peer: f.SH}
+	case "ERROR":
+		return ServerError{Err: parseError(f)}
+	}
+	return RawFrame{Frame: f}
+}
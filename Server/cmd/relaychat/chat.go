@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"relay/client"
+)
+
+const chatHelp = `Type a message and press enter to send it to the current session.
+  /sessions         list sessions
+  /switch SID|EMAIL change the current session
+  /connect EMAIL    send a connection request
+  /accept, /deny    answer the oldest connection request
+  /quit`
+
+// runner turns client events into terminal output, as text lines or, for
+// scripts, one JSON object per line.
+type runner struct {
+	st         *state
+	c          *client.Client
+	out        io.Writer
+	json       bool
+	autoAccept bool
+
+	asm     *assembler
+	keys    map[string]cipher.AEAD
+	pending []client.JoinRequest
+	current string
+	mu      sync.Mutex
+}
+
+// outEvent is the JSON form of what listen prints.
+type outEvent struct {
+	Event     string `json:"event"`
+	SID       string `json:"sid,omitempty"`
+	From      string `json:"from,omitempty"`
+	ID        string `json:"id,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Text      string `json:"text,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func newRunner(st *state, c *client.Client, out io.Writer, asJSON bool) *runner {
+	return &runner{st: st, c: c, out: out, json: asJSON, asm: newAssembler(), keys: make(map[string]cipher.AEAD)}
+}
+
+func (r *runner) print(ev outEvent, format string, args ...any) {
+	if r.json {
+		b, _ := json.Marshal(ev)
+		fmt.Fprintf(r.out, "%s\n", b)
+		return
+	}
+	fmt.Fprintf(r.out, format+"\n", args...)
+}
+
+func (r *runner) drain(ctx context.Context) {
+	for {
+		select {
+		case e, ok := <-r.c.Events():
+			if !ok {
+				return
+			}
+			r.handle(e)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *runner) handle(e client.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch e := e.(type) {
+	case client.Message:
+		r.message(e)
+	case client.JoinRequest:
+		if r.autoAccept {
+			if err := r.accept(e); err != nil {
+				r.print(outEvent{Event: "error", SID: e.SID, Error: err.Error()}, "! %v", err)
+			}
+			return
+		}
+		r.pending = append(r.pending, e)
+		r.print(outEvent{Event: "join_request", SID: e.SID, From: e.Email},
+			"* %s wants to connect. /accept or /deny", peerLabel(e.Name, e.Email))
+	case client.JoinAccept:
+		r.remember(e.SID, e.Email, e.PublicKey, e.Name)
+		r.print(outEvent{Event: "join_accept", SID: e.SID, From: e.Email},
+			"* %s accepted, session %s", peerLabel(e.Name, e.Email), e.SID)
+	case client.JoinDenied:
+		r.print(outEvent{Event: "join_denied", SID: e.SID}, "* connection request %s was denied", e.SID)
+	case client.PeerOnline:
+		if s := r.st.Sessions[e.SID]; s != nil {
+			r.print(outEvent{Event: "peer_online", SID: e.SID, From: s.Peer}, "* %s is online", s.Peer)
+		}
+	case client.PeerOffline:
+		if s := r.st.Sessions[e.SID]; s != nil {
+			r.print(outEvent{Event: "peer_offline", SID: e.SID, From: s.Peer}, "* %s went offline", s.Peer)
+		}
+	case client.TokenRefreshed:
+		r.st.Token = e.Token
+		r.st.save()
+	case client.Disconnected:
+		r.print(outEvent{Event: "disconnected", Error: fmt.Sprint(e.Err)}, "* disconnected, reconnecting...")
+	case client.Reconnected:
+		if e.Resumed {
+			r.print(outEvent{Event: "resumed"}, "* reconnected, caught up on missed messages")
+		} else {
+			r.print(outEvent{Event: "reconnected"}, "* reconnected")
+		}
+	case client.ServerError:
+		r.print(outEvent{Event: "error", Error: e.Err.Error()}, "! %v", e.Err)
+	}
+}
+
+func (r *runner) message(m client.Message) {
+	s := r.st.Sessions[m.SID]
+	if s == nil {
+		r.print(outEvent{Event: "error", SID: m.SID, Error: "message in unknown session"}, "! message in unknown session %s", m.SID)
+		return
+	}
+	aead, err := r.key(m.SID)
+	if err == nil {
+		var plaintext []byte
+		if plaintext, err = open(aead, m.Payload); err == nil {
+			if t, ok := r.asm.add(m.SID, plaintext); ok {
+				ts := time.UnixMilli(t.Timestamp).Format(time.TimeOnly)
+				r.print(outEvent{Event: "message", SID: m.SID, From: s.Peer, ID: t.ID, Type: t.Type, Text: t.Text, Timestamp: t.Timestamp},
+					"[%s] %s: %s", ts, peerLabel(s.PeerName, s.Peer), t.Text)
+			}
+			return
+		}
+	}
+	r.print(outEvent{Event: "error", SID: m.SID, From: s.Peer, Error: "cannot decrypt: " + err.Error()}, "! cannot decrypt message from %s: %v", s.Peer, err)
+}
+
+// key returns the session's AES-GCM key. The caller holds r.mu.
+func (r *runner) key(sid string) (cipher.AEAD, error) {
+	if k, ok := r.keys[sid]; ok {
+		return k, nil
+	}
+	s := r.st.Sessions[sid]
+	if s == nil {
+		return nil, fmt.Errorf("unknown session %s", sid)
+	}
+	k, err := sessionKey(r.st.priv, s.PeerKey)
+	if err != nil {
+		return nil, err
+	}
+	r.keys[sid] = k
+	return k, nil
+}
+
+// remember stores a session. The caller holds r.mu.
+func (r *runner) remember(sid, peer, peerKey, name string) {
+	if _, ok := r.st.Sessions[sid]; !ok {
+		r.st.Sessions[sid] = &session{Peer: strings.ToLower(peer), PeerKey: peerKey, PeerName: name, CreatedAt: time.Now()}
+		r.st.save()
+	}
+	if r.current == "" {
+		r.current = sid
+	}
+}
+
+// accept answers req and stores the session. The caller holds r.mu.
+func (r *runner) accept(req client.JoinRequest) error {
+	if err := r.c.Accept(req.SID, publicKeyB64(r.st.priv)); err != nil {
+		return err
+	}
+	r.remember(req.SID, req.Email, req.PublicKey, req.Name)
+	r.print(outEvent{Event: "joined", SID: req.SID, From: req.Email}, "* connected to %s, session %s", req.Email, req.SID)
+	return nil
+}
+
+// connect sends a connection request and returns the new session, or ""
+// when the request was queued.
+func (r *runner) connect(ctx context.Context, email string) (string, error) {
+	res, err := r.c.Connect(ctx, client.ConnectRequest{TargetEmail: email, PublicKey: publicKeyB64(r.st.priv)})
+	if errors.Is(err, client.ErrDenied) {
+		return "", fmt.Errorf("%s denied the request", email)
+	}
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if res.Queued {
+		r.print(outEvent{Event: "queued", SID: res.SID}, "* %s is offline; the request is queued", email)
+		return "", nil
+	}
+	r.remember(res.SID, res.Accept.Email, res.Accept.PublicKey, res.Accept.Name)
+	r.current = res.SID
+	return res.SID, nil
+}
+
+func (r *runner) send(ctx context.Context, sid, text string) error {
+	r.mu.Lock()
+	aead, err := r.key(sid)
+	peer := ""
+	if s := r.st.Sessions[sid]; s != nil {
+		peer = s.Peer
+	}
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, plaintext := range textMessages(text) {
+		payload, err := seal(aead, plaintext)
+		if err != nil {
+			return err
+		}
+		if err := r.c.Send(ctx, sid, payload); err != nil {
+			if errors.Is(err, client.ErrNotDelivered) {
+				return fmt.Errorf("%s is offline, message not delivered", peer)
+			}
+			if errors.Is(err, client.ErrBuffered) {
+				return fmt.Errorf("%s is reconnecting, message held until they resume", peer)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func cmdChat(ctx context.Context, st *state, args []string) error {
+	c, err := dial(ctx, st)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := reattachAll(st, c); err != nil {
+		return err
+	}
+	r := newRunner(st, c, os.Stdout, false)
+	if len(args) == 1 {
+		sid, ok := st.find(args[0])
+		if !ok {
+			return fmt.Errorf("no session for %q", args[0])
+		}
+		r.current = sid
+	}
+	go r.drain(ctx)
+	fmt.Printf("Logged in as %s.\n%s\n", c.Email(), chatHelp)
+
+	lines := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(os.Stdin)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+		close(lines)
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case line, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			if quit := r.command(ctx, strings.TrimSpace(line)); quit {
+				return nil
+			}
+		}
+	}
+}
+
+// command runs one line of chat input and reports whether to quit.
+func (r *runner) command(ctx context.Context, line string) bool {
+	if line == "" {
+		return false
+	}
+	cmd, arg, _ := strings.Cut(line, " ")
+	var err error
+	switch cmd {
+	case "/quit":
+		return true
+	case "/help":
+		fmt.Fprintln(r.out, chatHelp)
+	case "/sessions":
+		r.mu.Lock()
+		err = cmdSessions(r.st, r.out)
+		r.mu.Unlock()
+	case "/switch":
+		r.mu.Lock()
+		if sid, ok := r.st.find(arg); ok {
+			r.current = sid
+			fmt.Fprintf(r.out, "* talking to %s\n", r.st.Sessions[sid].Peer)
+		} else {
+			err = fmt.Errorf("no session for %q", arg)
+		}
+		r.mu.Unlock()
+	case "/connect":
+		// The JoinAccept event reports the new session.
+		_, err = r.connect(ctx, arg)
+	case "/accept", "/deny":
+		r.mu.Lock()
+		if len(r.pending) == 0 {
+			err = errors.New("no pending connection requests")
+		} else {
+			req := r.pending[0]
+			r.pending = r.pending[1:]
+			if cmd == "/accept" {
+				err = r.accept(req)
+			} else {
+				err = r.c.Deny(req.SID)
+			}
+		}
+		r.mu.Unlock()
+	default:
+		r.mu.Lock()
+		sid := r.current
+		r.mu.Unlock()
+		if sid == "" {
+			err = errors.New("no session selected: /switch or /connect first")
+		} else {
+			err = r.send(ctx, sid, line)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(r.out, "!", err)
+	}
+	return false
+}
+
+func peerLabel(name, email string) string {
+	if name == "" {
+		return email
+	}
+	return name
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The app derives one AES-256-GCM key per session with WebCrypto ECDH on
+// P-256 between the two identity keys, which uses the raw shared secret
+// as the key. Public keys travel as base64 uncompressed points. A payload
+// is base64(iv || AES-GCM(gzip(plaintext))) with a 12-byte iv.
+
+const ivSize = 12
+
+func newIdentity() (*ecdh.PrivateKey, error) {
+	return ecdh.P256().GenerateKey(rand.Reader)
+}
+
+func publicKeyB64(priv *ecdh.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes())
+}
+
+func sessionKey(priv *ecdh.PrivateKey, peerPubB64 string) (cipher.AEAD, error) {
+	raw, err := base64.StdEncoding.DecodeString(peerPubB64)
+	if err != nil {
+		return nil, fmt.Errorf("peer key: %w", err)
+	}
+	pub, err := ecdh.P256().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("peer key: %w", err)
+	}
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext []byte) (string, error) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(plaintext)
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	iv := make([]byte, ivSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(iv, iv, gz.Bytes(), nil)), nil
+}
+
+func open(aead cipher.AEAD, payload string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < ivSize {
+		return nil, errors.New("payload too short")
+	}
+	compressed, err := aead.Open(nil, raw[:ivSize], raw[ivSize:], nil)
+	if err != nil {
+		return nil, err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// Produced by the app's code path in Node: WebCrypto ECDH P-256 deriveKey
+// to AES-GCM 256, pako-compatible gzip, then iv || ciphertext in base64.
+const (
+	appPrivD   = "VzAy0ySkTsr1iWhoI3kGGOUtffj7T_Kt_GZtqz0m3wc"
+	appPeerPub = "BKTY4KNn2IF6S3HBavEbxvZ5JxQ+Od0iXwouB7Ij6oxs3yjnam0s1bmg5E6I0Bt71IXn9KvbVy9Jp1SAQf7Zzvc="
+	appPayload = "sO9GY2v8vUA/lEi9old9QrUKfV/4irJAabCJql45kN0u0s/vV8nwCuHyq6z/jEx5b9M2fWGLrcf64ltY4vbfnBji+jdmEYWXRpsIDELRIj8x+EOyxjjO2nwIX31YORYfktSgnQR8TWcoZt7DPv/jtyS2mumd/EKveaDzeSnWzO4jFzDk08ODeRveK5aRJy7C9MmbGRTKGHs="
+)
+
+func TestOpensAppPayload(t *testing.T) {
+	d, _ := base64.RawURLEncoding.DecodeString(appPrivD)
+	priv, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := sessionKey(priv, appPeerPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := open(aead, appPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, ok := newAssembler().add("sid", plaintext)
+	if !ok || msg.Type != "TEXT" || msg.Text != "hello from the app" || msg.Timestamp != 1760000000000 {
+		t.Fatalf("unexpected message %+v from %s", msg, plaintext)
+	}
+}
+
+func TestSealOpenBetweenPeers(t *testing.T) {
+	alice, _ := newIdentity()
+	bob, _ := newIdentity()
+	toBob, _ := sessionKey(alice, publicKeyB64(bob))
+	fromAlice, _ := sessionKey(bob, publicKeyB64(alice))
+
+	long := strings.Repeat("é", textChunkChars+5)
+	asm := newAssembler()
+	var got *textMessage
+	for _, m := range textMessages(long) {
+		payload, err := seal(toBob, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := open(fromAlice, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg, ok := asm.add("sid", plaintext); ok {
+			got = msg
+		}
+	}
+	if got == nil || got.Text != long || got.Type != "TEXT" {
+		t.Fatal("chunked text did not round-trip")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Google's OAuth 2.0 device authorization grant (RFC 8628). The client ID
+// must be a "TVs and Limited Input devices" client listed in the relay's
+// GOOGLE_CLIENT_IDS.
+const (
+	deviceCodeURL = "https://oauth2.googleapis.com/device/code"
+	tokenURL      = "https://oauth2.googleapis.com/token"
+)
+
+type deviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+// deviceLogin prints a code for the user to enter on another device and
+// polls until they approve, returning the Google ID token.
+func deviceLogin(ctx context.Context, clientID, clientSecret string, out io.Writer) (string, error) {
+	var dc deviceCode
+	if err := postForm(ctx, deviceCodeURL, url.Values{
+		"client_id": {clientID},
+		"scope":     {"openid email"},
+	}, &dc); err != nil {
+		return "", err
+	}
+	fmt.Fprintf(out, "Open %s and enter the code %s\n", dc.VerificationURL, dc.UserCode)
+
+	interval := time.Duration(max(dc.Interval, 5)) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(dc.ExpiresIn)*time.Second)
+	defer cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return "", errors.New("device login expired")
+		case <-time.After(interval):
+		}
+		var tok struct {
+			IDToken string `json:"id_token"`
+			Error   string `json:"error"`
+		}
+		err := postForm(ctx, tokenURL, url.Values{
+			"client_id":     {clientID},
+			"client_secret": {clientSecret},
+			"device_code":   {dc.DeviceCode},
+			"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+		}, &tok)
+		switch {
+		case tok.IDToken != "":
+			return tok.IDToken, nil
+		case tok.Error == "authorization_pending":
+		case tok.Error == "slow_down":
+			interval += 5 * time.Second
+		case tok.Error != "":
+			return "", fmt.Errorf("device login: %s", tok.Error)
+		case err != nil:
+			return "", err
+		}
+	}
+}
+
+// postForm decodes the JSON body into dst whatever the status, since the
+// token endpoint reports pending approval as a 428 with an error field.
+func postForm(ctx context.Context, endpoint string, form url.Values, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(dst); err != nil {
+		return fmt.Errorf("%s: %s", endpoint, resp.Status)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", endpoint, resp.Status)
+	}
+	return nil
+}
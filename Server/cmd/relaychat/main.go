@@ -0,0 +1,228 @@
+// Command relaychat is a terminal client for the relay. It chats end to end
+// encrypted with the app, and has a headless mode for scripts:
+//
+//	relaychat login -token sess:...        store a session token
+//	relaychat login -device -client-id ID -client-secret SECRET
+//	relaychat sessions                     list known sessions
+//	relaychat connect alice@example.com    send a connection request
+//	relaychat chat [sid|email]             interactive chat
+//	relaychat send sid|email text...       send one message ("-" reads stdin)
+//	relaychat listen [-json] [-accept]     print incoming messages
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"relay/client"
+)
+
+const usage = `usage: relaychat [-server URL] [-state DIR] <command> [args]
+
+commands:
+  login     -token TOKEN | -device -client-id ID -client-secret SECRET
+  sessions  list known sessions
+  connect   EMAIL
+  chat      [SID|EMAIL]
+  send      SID|EMAIL TEXT...  (TEXT "-" reads stdin)
+  listen    [-json] [-accept]
+`
+
+func main() {
+	fs := flag.NewFlagSet("relaychat", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	server := fs.String("server", os.Getenv("RELAY_URL"), "relay websocket URL")
+	stateDir := fs.String("state", defaultStateDir(), "state directory")
+	fs.Parse(os.Args[1:])
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	st, err := loadState(*stateDir)
+	if err != nil {
+		fatal(err)
+	}
+	if *server != "" {
+		st.Server = *server
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "login":
+		err = cmdLogin(ctx, st, args)
+	case "sessions":
+		err = cmdSessions(st, os.Stdout)
+	case "connect":
+		err = cmdConnect(ctx, st, args)
+	case "chat":
+		err = cmdChat(ctx, st, args)
+	case "send":
+		err = cmdSend(ctx, st, args)
+	case "listen":
+		err = cmdListen(ctx, st, args)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "relaychat:", err)
+	os.Exit(1)
+}
+
+func cmdLogin(ctx context.Context, st *state, args []string) error {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	token := fs.String("token", "", "session token (sess:...) or Google ID token")
+	device := fs.Bool("device", false, "log in with the Google device flow")
+	clientID := fs.String("client-id", os.Getenv("RELAYCHAT_CLIENT_ID"), "OAuth client ID for -device")
+	clientSecret := fs.String("client-secret", os.Getenv("RELAYCHAT_CLIENT_SECRET"), "OAuth client secret for -device")
+	fs.Parse(args)
+
+	switch {
+	case *device:
+		if *clientID == "" {
+			return errors.New("-device needs -client-id")
+		}
+		id, err := deviceLogin(ctx, *clientID, *clientSecret, os.Stderr)
+		if err != nil {
+			return err
+		}
+		st.Token = id
+	case *token != "":
+		st.Token = *token
+	default:
+		return errors.New("login needs -token or -device")
+	}
+
+	// Exchange the token for a session token and check it works.
+	c, err := dial(ctx, st)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	fmt.Fprintln(os.Stderr, "Logged in as", c.Email())
+	return nil
+}
+
+func cmdSessions(st *state, out io.Writer) error {
+	if len(st.Sessions) == 0 {
+		fmt.Fprintln(out, "no sessions")
+		return nil
+	}
+	for _, sid := range st.sortedSIDs() {
+		s := st.Sessions[sid]
+		name := s.Peer
+		if s.PeerName != "" {
+			name = fmt.Sprintf("%s <%s>", s.PeerName, s.Peer)
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\n", sid, name, s.CreatedAt.Format(time.DateOnly))
+	}
+	return nil
+}
+
+func cmdConnect(ctx context.Context, st *state, args []string) error {
+	if len(args) != 1 {
+		return errors.New("connect needs an email")
+	}
+	c, err := dial(ctx, st)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	sid, err := newRunner(st, c, os.Stdout, false).connect(ctx, args[0])
+	if err == nil && sid != "" {
+		fmt.Printf("* connected to %s, session %s\n", args[0], sid)
+	}
+	return err
+}
+
+func cmdSend(ctx context.Context, st *state, args []string) error {
+	if len(args) < 2 {
+		return errors.New("send needs a session and a text")
+	}
+	sid, ok := st.find(args[0])
+	if !ok {
+		return fmt.Errorf("no session for %q", args[0])
+	}
+	text := strings.Join(args[1:], " ")
+	if text == "-" {
+		raw, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		text = strings.TrimRight(string(raw), "\n")
+	}
+
+	c, err := dial(ctx, st)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.Reattach(sid); err != nil {
+		return err
+	}
+	r := newRunner(st, c, os.Stdout, false)
+	go r.drain(ctx)
+	return r.send(ctx, sid, text)
+}
+
+func cmdListen(ctx context.Context, st *state, args []string) error {
+	fs := flag.NewFlagSet("listen", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print one JSON object per event")
+	accept := fs.Bool("accept", false, "accept every connection request")
+	fs.Parse(args)
+
+	c, err := dial(ctx, st)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := reattachAll(st, c); err != nil {
+		return err
+	}
+	r := newRunner(st, c, os.Stdout, *asJSON)
+	r.autoAccept = *accept
+	r.drain(ctx)
+	return ctx.Err()
+}
+
+func dial(ctx context.Context, st *state) (*client.Client, error) {
+	if st.Server == "" {
+		return nil, errors.New("no server: pass -server or set RELAY_URL")
+	}
+	if st.Token == "" {
+		return nil, errors.New("not logged in: run relaychat login")
+	}
+	dctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	c, err := client.Dial(dctx, st.Server, st.Token, client.WithResume())
+	if err != nil {
+		return nil, err
+	}
+	st.Token = c.Token()
+	return c, st.save()
+}
+
+func reattachAll(st *state, c *client.Client) error {
+	for sid := range st.Sessions {
+		if err := c.Reattach(sid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// textChunkChars matches TEXT_CHUNK_SIZE_CHARS in the app: longer texts
+// are split into TEXT_CHUNK messages.
+const textChunkChars = 12000
+
+// appMessage is the plaintext inside an encrypted MSG payload.
+type appMessage struct {
+	T    string     `json:"t"`
+	Data appMsgData `json:"data"`
+}
+
+type appMsgData struct {
+	Type        string `json:"type"`
+	Text        string `json:"text,omitempty"`
+	ID          string `json:"id,omitempty"`
+	Timestamp   int64  `json:"timestamp,omitempty"`
+	ChunkIndex  int    `json:"chunkIndex,omitempty"`
+	TotalChunks int    `json:"totalChunks,omitempty"`
+	ChunkType   string `json:"chunkType,omitempty"`
+	TextChunk   string `json:"textChunk,omitempty"`
+}
+
+func newMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// textMessages encodes text as the plaintexts the app sends for it.
+func textMessages(text string) [][]byte {
+	id, ts := newMessageID(), time.Now().UnixMilli()
+	if utf8.RuneCountInString(text) <= textChunkChars {
+		b, _ := json.Marshal(appMessage{T: "MSG", Data: appMsgData{Type: "TEXT", Text: text, ID: id, Timestamp: ts}})
+		return [][]byte{b}
+	}
+	runes := []rune(text)
+	total := (len(runes) + textChunkChars - 1) / textChunkChars
+	out := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		part := runes[i*textChunkChars : min((i+1)*textChunkChars, len(runes))]
+		b, _ := json.Marshal(appMessage{T: "MSG", Data: appMsgData{
+			Type:        "TEXT_CHUNK",
+			ID:          id,
+			ChunkIndex:  i,
+			TotalChunks: total,
+			ChunkType:   "TEXT",
+			TextChunk:   string(part),
+			Timestamp:   ts,
+		}})
+		out = append(out, b)
+	}
+	return out
+}
+
+// textMessage is a decoded text for display.
+type textMessage struct {
+	ID        string
+	Type      string
+	Text      string
+	Timestamp int64
+}
+
+// assembler turns decrypted plaintexts into texts, joining TEXT_CHUNK
+// parts. Other message types (calls, files, profile sync) are ignored.
+type assembler struct {
+	chunks map[string][]string
+}
+
+func newAssembler() *assembler {
+	return &assembler{chunks: make(map[string][]string)}
+}
+
+func (a *assembler) add(sid string, plaintext []byte) (*textMessage, bool) {
+	var m appMessage
+	if err := json.Unmarshal(plaintext, &m); err != nil {
+		return nil, false
+	}
+	d := m.Data
+	switch d.Type {
+	case "TEXT", "GIF":
+		return &textMessage{ID: d.ID, Type: d.Type, Text: d.Text, Timestamp: d.Timestamp}, true
+	case "TEXT_CHUNK":
+		if d.ID == "" || d.TotalChunks <= 0 || d.TotalChunks > 10000 || d.ChunkIndex < 0 || d.ChunkIndex >= d.TotalChunks {
+			return nil, false
+		}
+		key := sid + "/" + d.ID
+		parts := a.chunks[key]
+		if len(parts) != d.TotalChunks {
+			parts = make([]string, d.TotalChunks)
+		}
+		parts[d.ChunkIndex] = d.TextChunk
+		a.chunks[key] = parts
+		text := ""
+		for _, p := range parts {
+			if p == "" {
+				return nil, false
+			}
+			text += p
+		}
+		delete(a.chunks, key)
+		return &textMessage{ID: d.ID, Type: d.ChunkType, Text: text, Timestamp: d.Timestamp}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// state is everything relaychat keeps between runs, in state.json under
+// the state directory. It holds the identity private key, so it is
+// written with mode 0600.
+type state struct {
+	Server   string              `json:"server,omitempty"`
+	Token    string              `json:"token,omitempty"`
+	Identity string              `json:"identity"` // base64 P-256 private scalar
+	Sessions map[string]*session `json:"sessions"`
+
+	path string
+	priv *ecdh.PrivateKey
+}
+
+type session struct {
+	Peer      string    `json:"peer"`
+	PeerKey   string    `json:"peerKey"`
+	PeerName  string    `json:"peerName,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func defaultStateDir() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "relaychat")
+	}
+	return ".relaychat"
+}
+
+// loadState reads dir/state.json, creating an identity on first use.
+func loadState(dir string) (*state, error) {
+	st := &state{path: filepath.Join(dir, "state.json"), Sessions: make(map[string]*session)}
+	raw, err := os.ReadFile(st.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		priv, err := newIdentity()
+		if err != nil {
+			return nil, err
+		}
+		st.priv = priv
+		st.Identity = base64.StdEncoding.EncodeToString(priv.Bytes())
+		return st, st.save()
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, st); err != nil {
+		return nil, err
+	}
+	if st.Sessions == nil {
+		st.Sessions = make(map[string]*session)
+	}
+	d, err := base64.StdEncoding.DecodeString(st.Identity)
+	if err != nil {
+		return nil, err
+	}
+	if st.priv, err = ecdh.P256().NewPrivateKey(d); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (st *state) save() error {
+	if err := os.MkdirAll(filepath.Dir(st.path), 0700); err != nil {
+		return err
+	}
+	raw, _ := json.MarshalIndent(st, "", "  ")
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+// find resolves a session ID or a peer email to a session ID.
+func (st *state) find(ref string) (string, bool) {
+	if _, ok := st.Sessions[ref]; ok {
+		return ref, true
+	}
+	ref = strings.ToLower(strings.TrimSpace(ref))
+	var newest string
+	for sid, s := range st.Sessions {
+		if s.Peer == ref && (newest == "" || s.CreatedAt.After(st.Sessions[newest].CreatedAt)) {
+			newest = sid
+		}
+	}
+	return newest, newest != ""
+}
+
+func (st *state) sortedSIDs() []string {
+	sids := make([]string, 0, len(st.Sessions))
+	for sid := range st.Sessions {
+		sids = append(sids, sid)
+	}
+	sort.Slice(sids, func(i, j int) bool {
+		return st.Sessions[sids[i]].CreatedAt.Before(st.Sessions[sids[j]].CreatedAt)
+	})
+	return sids
+}
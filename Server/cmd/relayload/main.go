@@ -0,0 +1,244 @@
+// Command relayload simulates many authenticated clients against a running
+// relay and reports latency percentiles, error rates and the relay's
+// resource usage:
+//
+//	relayload -url ws://localhost:9000/ -clients 2000 -duration 2m \
+//	    -mix burst=70,call=10,connect=5,churn=15 -storm 30s -out run.json
+//	relayload ... -compare run.json
+//
+// Clients log in with session tokens signed with AUTH_SESSION_SECRET, so
+// no OAuth is involved. They work in pairs that share a session; on every
+// turn one side of each pair runs a scenario from the mix.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"relay/server"
+)
+
+func main() {
+	var (
+		cfg     config
+		mixFlag string
+		secret  string
+		out     string
+		compare string
+	)
+	flag.StringVar(&cfg.url, "url", "ws://localhost:9000/", "relay websocket URL")
+	flag.StringVar(&cfg.metricsURL, "metrics", "", "relay metrics URL (default: /metrics on the relay)")
+	flag.StringVar(&cfg.metricsToken, "metrics-token", os.Getenv("METRICS_TOKEN"), "bearer token for the metrics URL")
+	flag.StringVar(&secret, "secret", os.Getenv("AUTH_SESSION_SECRET"), "the relay's AUTH_SESSION_SECRET, to sign session tokens")
+	flag.StringVar(&cfg.prefix, "prefix", "load", "account prefix; accounts are PREFIX-N@load.test")
+	flag.IntVar(&cfg.clients, "clients", 1000, "number of simulated clients, in pairs")
+	flag.DurationVar(&cfg.duration, "duration", time.Minute, "how long to run the mix after setup")
+	flag.DurationVar(&cfg.ramp, "ramp", 10*time.Second, "spread the initial connects over this long")
+	flag.DurationVar(&cfg.think, "think", time.Second, "mean pause between a pair's scenarios")
+	flag.IntVar(&cfg.burst, "burst", 10, "messages per burst")
+	flag.IntVar(&cfg.size, "size", 256, "message payload size in bytes")
+	flag.StringVar(&mixFlag, "mix", "burst=70,call=10,connect=5,churn=15", "scenario weights")
+	flag.DurationVar(&cfg.storm, "storm", 0, "drop connections every interval to force a reconnect storm (0 disables)")
+	flag.Float64Var(&cfg.stormFraction, "storm-fraction", 0.5, "fraction of clients each storm drops")
+	flag.DurationVar(&cfg.timeout, "timeout", 10*time.Second, "how long to wait for any one answer")
+	flag.StringVar(&out, "out", "", "write the report as JSON to this file")
+	flag.StringVar(&compare, "compare", "", "compare with a report written by an earlier -out")
+	flag.Parse()
+
+	err := func() error {
+		var err error
+		if cfg.mix, err = parseMix(mixFlag); err != nil {
+			return err
+		}
+		if secret == "" {
+			return errors.New("-secret or AUTH_SESSION_SECRET is required")
+		}
+		if cfg.clients < 2 {
+			return errors.New("-clients must be at least 2")
+		}
+		cfg.secret = server.SessionSecret(secret)
+		if cfg.metricsURL == "" {
+			cfg.metricsURL = metricsURL(cfg.url)
+		}
+		var base *report
+		if compare != "" {
+			if base, err = loadReport(compare); err != nil {
+				return err
+			}
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		r := run(ctx, &cfg)
+		r.write(os.Stdout)
+		if base != nil {
+			r.compare(os.Stdout, base)
+		}
+		if out != "" {
+			return r.save(out)
+		}
+		return nil
+	}()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "relayload:", err)
+		os.Exit(1)
+	}
+}
+
+// metricsURL turns ws://host/path into http://host/metrics.
+func metricsURL(ws string) string {
+	u, err := url.Parse(ws)
+	if err != nil {
+		return ""
+	}
+	u.Scheme = strings.Replace(u.Scheme, "ws", "http", 1)
+	u.Path, u.RawQuery = "/metrics", ""
+	return u.String()
+}
+
+// run connects every client over the ramp, pairs them into sessions, runs
+// the mix for the configured duration and returns the report. Interrupting
+// it still reports what was measured.
+func run(ctx context.Context, cfg *config) *report {
+	st := newStats()
+	mon := &monitor{url: cfg.metricsURL, token: cfg.metricsToken}
+	r := &report{
+		Started: time.Now(),
+		Config: reportConfig{
+			URL:     cfg.url,
+			Clients: cfg.clients,
+			Mix:     cfg.mix.String(),
+			Think:   cfg.think.String(),
+			Burst:   cfg.burst,
+			Size:    cfg.size,
+		},
+	}
+	if cfg.storm > 0 {
+		r.Config.Storm, r.Config.StormFraction = cfg.storm.String(), cfg.stormFraction
+	}
+
+	if s, err := scrape(ctx, cfg.metricsURL, cfg.metricsToken); err == nil {
+		mon.add(s)
+	} else {
+		fmt.Fprintln(os.Stderr, "relayload: no server metrics:", err)
+	}
+	mctx, stopMonitor := context.WithCancel(ctx)
+	defer stopMonitor()
+	go mon.run(mctx, 2*time.Second)
+
+	signer := server.New(server.WithSessionSecret(cfg.secret))
+	clients := make([]*simClient, cfg.clients/2*2)
+	for i := range clients {
+		email := fmt.Sprintf("%s-%d@load.test", cfg.prefix, i)
+		sc, err := newSimClient(cfg, st, email, signer.IssueSessionToken(email))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "relayload:", err)
+			return r
+		}
+		clients[i] = sc
+	}
+	defer closeAll(clients)
+
+	// Connect everyone, then open one session per pair.
+	var wg sync.WaitGroup
+	for i, sc := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-time.After(cfg.ramp * time.Duration(i) / time.Duration(len(clients))):
+				sc.dial(ctx)
+			case <-ctx.Done():
+			}
+		}()
+	}
+	wg.Wait()
+
+	var pairs []*simClient
+	var pmu sync.Mutex
+	for i := 0; i < len(clients); i += 2 {
+		a, b := clients[i], clients[i+1]
+		a.peer, b.peer = b, a
+		if a.client() == nil || b.client() == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sid, err := a.connect(ctx)
+			if err != nil {
+				return
+			}
+			a.sid, b.sid = sid, sid
+			pmu.Lock()
+			pairs = append(pairs, a)
+			pmu.Unlock()
+		}()
+	}
+	wg.Wait()
+	fmt.Fprintf(os.Stderr, "relayload: %d pairs connected, running for %s\n", len(pairs), cfg.duration)
+
+	start := time.Now()
+	rctx, cancel := context.WithTimeout(ctx, cfg.duration)
+	defer cancel()
+	for _, a := range pairs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.run(rctx)
+		}()
+	}
+	if cfg.storm > 0 {
+		go storms(rctx, cfg, clients)
+	}
+	wg.Wait()
+
+	// Scrape before disconnecting so the peaks reflect the load.
+	if s, err := scrape(context.Background(), cfg.metricsURL, cfg.metricsToken); err == nil {
+		mon.add(s)
+	}
+	r.Duration = time.Since(start).Seconds()
+	r.Ops = st.report()
+	r.Server = mon.report()
+	return r
+}
+
+// storms drops a random fraction of connections at every interval, all at
+// once, as a relay restart or a network blip would.
+func storms(ctx context.Context, cfg *config, clients []*simClient) {
+	t := time.NewTicker(cfg.storm)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			for _, sc := range clients {
+				if rand.Float64() < cfg.stormFraction {
+					sc.drop()
+				}
+			}
+		}
+	}
+}
+
+func closeAll(clients []*simClient) {
+	var wg sync.WaitGroup
+	for _, sc := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sc.close()
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"relay/server"
+)
+
+func TestRunCoversEveryScenario(t *testing.T) {
+	secret := server.SessionSecret("load test")
+	ts := httptest.NewServer(server.New(server.WithSessionSecret(secret), server.WithMetricsToken("load-test-metrics-token")))
+	defer ts.Close()
+
+	m, err := parseMix("burst=1,call=1,connect=1,churn=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/"
+	cfg := &config{
+		url:           url,
+		metricsURL:    metricsURL(url),
+		metricsToken:  "load-test-metrics-token",
+		secret:        secret,
+		prefix:        "t",
+		clients:       6,
+		duration:      2 * time.Second,
+		ramp:          100 * time.Millisecond,
+		think:         50 * time.Millisecond,
+		burst:         3,
+		size:          64,
+		mix:           m,
+		storm:         700 * time.Millisecond,
+		stormFraction: 1,
+		timeout:       2 * time.Second,
+	}
+	r := run(context.Background(), cfg)
+
+	if got := r.Ops[opConnect].Count; got < 6 {
+		t.Errorf("%d connects, want at least 6", got)
+	}
+	for _, op := range []string{opConnectReq, opMsgAck, opMsgE2E, opCallSetup, opRTC, opReconnect} {
+		if r.Ops[op].Count == 0 {
+			t.Errorf("no successful %s: %+v", op, r.Ops[op])
+		}
+	}
+	if r.Server == nil || r.Server.PeakClients < 6 || r.Server.Frames == 0 {
+		t.Errorf("server usage not reported: %+v", r.Server)
+	}
+}
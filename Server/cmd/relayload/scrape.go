@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverReport is the relay's resource usage during the run, read from
+// its /metrics endpoint.
+type serverReport struct {
+	PeakClients     float64 `json:"peakClients"`
+	PeakSessions    float64 `json:"peakSessions"`
+	PeakGoroutines  float64 `json:"peakGoroutines"`
+	PeakHeapBytes   float64 `json:"peakHeapBytes"`
+	PeakMemoryBytes float64 `json:"peakMemoryBytes"`
+	CPUSeconds      float64 `json:"cpuSeconds"`
+	CPUCores        float64 `json:"cpuCores"`
+	Frames          float64 `json:"frames"`
+	FrameErrors     float64 `json:"frameErrors"`
+	RateLimited     float64 `json:"rateLimited"`
+}
+
+// sample is one scrape, summed over labels: relay_frames_total{frame="MSG"}
+// and relay_frames_total{frame="AUTH"} both count towards
+// relay_frames_total.
+type sample map[string]float64
+
+func scrape(ctx context.Context, url, token string) (sample, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	s := make(sample)
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		series, value, ok := strings.Cut(sc.Text(), " ")
+		if !ok || strings.HasPrefix(series, "#") {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		name, _, _ := strings.Cut(series, "{")
+		s[name] += v
+	}
+	return s, sc.Err()
+}
+
+// monitor scrapes the relay every interval, keeping the first sample and
+// the peak of every gauge.
+type monitor struct {
+	url   string
+	token string
+	mu    sync.Mutex
+	first sample
+	last  sample
+	peak  sample
+	at    [2]time.Time
+}
+
+func (m *monitor) add(s sample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if m.first == nil {
+		m.first, m.peak = s, make(sample)
+		m.at[0] = now
+	}
+	m.last, m.at[1] = s, now
+	for k, v := range s {
+		m.peak[k] = max(m.peak[k], v)
+	}
+}
+
+func (m *monitor) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if s, err := scrape(ctx, m.url, m.token); err == nil {
+				m.add(s)
+			}
+		}
+	}
+}
+
+// report is nil when the relay was never reachable.
+func (m *monitor) report() *serverReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.first == nil {
+		return nil
+	}
+	delta := func(name string) float64 { return m.last[name] - m.first[name] }
+	r := &serverReport{
+		PeakClients:     m.peak["relay_clients"],
+		PeakSessions:    m.peak["relay_sessions"],
+		PeakGoroutines:  m.peak["go_goroutines"],
+		PeakHeapBytes:   m.peak["go_heap_bytes"],
+		PeakMemoryBytes: m.peak["go_memory_bytes"],
+		CPUSeconds:      delta("process_cpu_seconds_total"),
+		Frames:          delta("relay_frames_total"),
+		FrameErrors:     delta("relay_frame_errors_total"),
+		RateLimited:     delta("relay_rate_limited_total"),
+	}
+	if wall := m.at[1].Sub(m.at[0]).Seconds(); wall > 0 {
+		r.CPUCores = r.CPUSeconds / wall
+	}
+	return r
+}
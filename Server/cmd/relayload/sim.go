@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	mrand "math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"relay/client"
+
+	"github.com/gorilla/websocket"
+)
+
+// Operations reported by a run.
+const (
+	opConnect    = "connect"     // websocket dial and AUTH
+	opConnectReq = "connect_req" // CONNECT_REQ until JOIN_ACCEPT
+	opMsgAck     = "msg_ack"     // MSG until DELIVERED
+	opMsgE2E     = "msg_e2e"     // MSG until the peer reads it
+	opCallSetup  = "call_setup"  // CALL_START until CALL_ACCEPT
+	opRTC        = "rtc_answer"  // RTC_OFFER until RTC_ANSWER
+	opReconnect  = "reconnect"   // dropped connection until logged in again
+)
+
+// Scenarios a pair picks from on every turn, weighted by -mix.
+const (
+	scBurst   = "burst"
+	scCall    = "call"
+	scConnect = "connect"
+	scChurn   = "churn"
+)
+
+type config struct {
+	url           string
+	metricsURL    string
+	metricsToken  string
+	secret        []byte
+	prefix        string
+	clients       int
+	duration      time.Duration
+	ramp          time.Duration
+	think         time.Duration
+	burst         int
+	size          int
+	mix           mix
+	storm         time.Duration
+	stormFraction float64
+	timeout       time.Duration
+}
+
+// mix is a weighted list of scenarios, written burst=70,call=10,...
+type mix struct {
+	names   []string
+	weights []int
+	total   int
+}
+
+func parseMix(s string) (mix, error) {
+	var m mix
+	for _, part := range strings.Split(s, ",") {
+		name, w, ok := strings.Cut(strings.TrimSpace(part), "=")
+		weight, err := strconv.Atoi(w)
+		if !ok || err != nil || weight < 0 {
+			return mix{}, fmt.Errorf("bad mix entry %q, want name=weight", part)
+		}
+		switch name {
+		case scBurst, scCall, scConnect, scChurn:
+		default:
+			return mix{}, fmt.Errorf("unknown scenario %q", name)
+		}
+		m.names = append(m.names, name)
+		m.weights = append(m.weights, weight)
+		m.total += weight
+	}
+	if m.total == 0 {
+		return mix{}, fmt.Errorf("mix %q has no weight", s)
+	}
+	return m, nil
+}
+
+func (m mix) pick() string {
+	n := mrand.IntN(m.total)
+	for i, w := range m.weights {
+		if n < w {
+			return m.names[i]
+		}
+		n -= w
+	}
+	return m.names[len(m.names)-1]
+}
+
+func (m mix) String() string {
+	parts := make([]string, len(m.names))
+	for i := range m.names {
+		parts[i] = fmt.Sprintf("%s=%d", m.names[i], m.weights[i])
+	}
+	return strings.Join(parts, ",")
+}
+
+// simClient is one simulated user. Its relay connection is replaced on
+// churn, so the current one is read under mu.
+type simClient struct {
+	cfg    *config
+	stats  *stats
+	email  string
+	token  string
+	pub    string
+	pad    string
+	peer   *simClient
+	sid    string
+	mu     sync.Mutex
+	c      *client.Client
+	conn   net.Conn
+	calls  waiters
+	offers waiters
+}
+
+func newSimClient(cfg *config, st *stats, email, token string) (*simClient, error) {
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pad := make([]byte, cfg.size*3/4)
+	rand.Read(pad)
+	return &simClient{
+		cfg:   cfg,
+		stats: st,
+		email: email,
+		token: token,
+		pub:   base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()),
+		pad:   base64.StdEncoding.EncodeToString(pad),
+	}, nil
+}
+
+func (sc *simClient) client() *client.Client {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.c
+}
+
+// dial logs in and starts handling events. The dialer remembers the TCP
+// connection so a reconnect storm can cut it from under the client.
+func (sc *simClient) dial(ctx context.Context) error {
+	d := *websocket.DefaultDialer
+	d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err == nil {
+			sc.mu.Lock()
+			sc.conn = conn
+			sc.mu.Unlock()
+		}
+		return conn, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, sc.cfg.timeout)
+	defer cancel()
+	start := time.Now()
+	c, err := client.Dial(ctx, sc.cfg.url, sc.token, client.WithDialer(&d), client.WithEventBuffer(1024))
+	sc.stats.record(opConnect, start, err)
+	if err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	sc.c = c
+	sc.mu.Unlock()
+	go sc.handle(c)
+	return nil
+}
+
+// drop closes the TCP connection without a websocket close, the way a
+// network failure or a relay restart looks to the client.
+func (sc *simClient) drop() {
+	sc.mu.Lock()
+	conn := sc.conn
+	sc.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func (sc *simClient) close() {
+	if c := sc.client(); c != nil {
+		c.Close()
+	}
+}
+
+// handle plays the passive side of every scenario: it accepts connection
+// requests and calls, answers offers and timestamps incoming messages.
+func (sc *simClient) handle(c *client.Client) {
+	var dropped time.Time
+	for e := range c.Events() {
+		switch e := e.(type) {
+		case client.JoinRequest:
+			if err := c.Accept(e.SID, sc.pub); err != nil {
+				sc.stats.fail("JOIN_ACCEPT", err)
+			}
+		case client.Message:
+			if sent, ok := parsePayload(e.Payload); ok {
+				sc.stats.ok(opMsgE2E, time.Since(sent))
+			}
+		case client.RawFrame:
+			f := e.Frame
+			switch f.T {
+			case "CALL_START":
+				c.SendFrame(client.Frame{T: "CALL_ACCEPT", SID: f.SID})
+			case "CALL_ACCEPT":
+				sc.calls.done(f.SID)
+			case "RTC_OFFER":
+				c.SendFrame(client.Frame{T: "RTC_ANSWER", SID: f.SID, Data: sc.sdp()})
+			case "RTC_ANSWER":
+				sc.offers.done(f.SID)
+			}
+		case client.ServerError:
+			frame := e.Err.Frame
+			if frame == "" {
+				frame = "ERROR"
+			}
+			sc.stats.failCode(frame, e.Err.Code)
+		case client.Disconnected:
+			dropped = time.Now()
+		case client.Reconnected:
+			sc.stats.ok(opReconnect, time.Since(dropped))
+		}
+	}
+}
+
+func (sc *simClient) payload() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 10) + "." + sc.pad
+}
+
+func parsePayload(p string) (time.Time, bool) {
+	ts, _, _ := strings.Cut(p, ".")
+	ns, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+func (sc *simClient) sdp() json.RawMessage {
+	data, _ := json.Marshal(map[string]string{"sdp": sc.pad})
+	return data
+}
+
+// connect opens a session to the peer, who accepts from its event loop.
+func (sc *simClient) connect(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, sc.cfg.timeout)
+	defer cancel()
+	start := time.Now()
+	res, err := sc.client().Connect(ctx, client.ConnectRequest{TargetEmail: sc.peer.email, PublicKey: sc.pub})
+	if err == nil && res.Queued {
+		err = fmt.Errorf("%w: request queued", client.ErrNotDelivered)
+	}
+	sc.stats.record(opConnectReq, start, err)
+	if err != nil {
+		return "", err
+	}
+	return res.SID, nil
+}
+
+// run drives the pair from this side until ctx ends, one scenario per
+// turn with a jittered think time in between.
+func (sc *simClient) run(ctx context.Context) {
+	for {
+		think := sc.cfg.think/2 + mrand.N(sc.cfg.think+1)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(think):
+		}
+		switch sc.cfg.mix.pick() {
+		case scBurst:
+			sc.burst(ctx)
+		case scCall:
+			sc.call(ctx)
+		case scConnect:
+			sc.connect(ctx)
+		case scChurn:
+			sc.churn(ctx)
+		}
+	}
+}
+
+func (sc *simClient) burst(ctx context.Context) {
+	c := sc.client()
+	for range sc.cfg.burst {
+		if ctx.Err() != nil {
+			return
+		}
+		sctx, cancel := context.WithTimeout(ctx, sc.cfg.timeout)
+		start := time.Now()
+		err := c.Send(sctx, sc.sid, sc.payload())
+		cancel()
+		sc.stats.record(opMsgAck, start, err)
+	}
+}
+
+// call rings the peer, waits for the answer, exchanges an offer, answer
+// and a few ICE candidates, then hangs up.
+func (sc *simClient) call(ctx context.Context) {
+	c := sc.client()
+	accepted := sc.calls.add(sc.sid)
+	start := time.Now()
+	if err := c.SendFrame(client.Frame{T: "CALL_START", SID: sc.sid, Data: json.RawMessage(`{"mode":"audio"}`)}); err != nil {
+		sc.calls.done(sc.sid)
+		sc.stats.fail(opCallSetup, err)
+		return
+	}
+	defer c.SendFrame(client.Frame{T: "CALL_END", SID: sc.sid})
+	if err := sc.wait(ctx, accepted); err != nil {
+		sc.stats.fail(opCallSetup, err)
+		return
+	}
+	sc.stats.ok(opCallSetup, time.Since(start))
+
+	answered := sc.offers.add(sc.sid)
+	start = time.Now()
+	if err := c.SendFrame(client.Frame{T: "RTC_OFFER", SID: sc.sid, Data: sc.sdp()}); err != nil {
+		sc.offers.done(sc.sid)
+		sc.stats.fail(opRTC, err)
+		return
+	}
+	err := sc.wait(ctx, answered)
+	sc.stats.record(opRTC, start, err)
+	for i := range 3 {
+		ice, _ := json.Marshal(map[string]any{"candidate": fmt.Sprintf("candidate:%d 1 udp 2122260223 10.0.0.%d 5000%d typ host", i, i+1, i), "sdpMLineIndex": 0})
+		c.SendFrame(client.Frame{T: "RTC_ICE", SID: sc.sid, Data: ice})
+	}
+}
+
+func (sc *simClient) wait(ctx context.Context, done <-chan struct{}) error {
+	t := time.NewTimer(sc.cfg.timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-t.C:
+		return errTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// churn logs one side of the pair out and back in on a new connection,
+// the way an app restart does.
+func (sc *simClient) churn(ctx context.Context) {
+	who := sc
+	if mrand.IntN(2) == 0 {
+		who = sc.peer
+	}
+	who.close()
+	if err := who.dial(ctx); err != nil {
+		return
+	}
+	who.client().Reattach(sc.sid)
+}
+
+// waiters hands out a channel per key that is closed when the awaited
+// frame arrives.
+type waiters struct {
+	mu sync.Mutex
+	m  map[string]chan struct{}
+}
+
+func (w *waiters) add(key string) <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.m == nil {
+		w.m = make(map[string]chan struct{})
+	}
+	ch := make(chan struct{})
+	w.m[key] = ch
+	return ch
+}
+
+func (w *waiters) done(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if ch, ok := w.m[key]; ok {
+		close(ch)
+		delete(w.m, key)
+	}
+}
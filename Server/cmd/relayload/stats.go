@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"relay/client"
+)
+
+// stats collects every latency sample and error per operation. Samples are
+// kept whole so the percentiles are exact; a few million durations fit
+// comfortably in memory.
+type stats struct {
+	mu  sync.Mutex
+	ops map[string]*opStats
+}
+
+type opStats struct {
+	samples []time.Duration
+	errors  map[string]int
+}
+
+func newStats() *stats {
+	return &stats{ops: make(map[string]*opStats)}
+}
+
+func (s *stats) op(name string) *opStats {
+	o := s.ops[name]
+	if o == nil {
+		o = &opStats{errors: make(map[string]int)}
+		s.ops[name] = o
+	}
+	return o
+}
+
+// ok records a successful operation that took d.
+func (s *stats) ok(name string, d time.Duration) {
+	s.mu.Lock()
+	o := s.op(name)
+	o.samples = append(o.samples, d)
+	s.mu.Unlock()
+}
+
+// fail records a failed operation under the error's code.
+func (s *stats) fail(name string, err error) {
+	s.failCode(name, errorCode(err))
+}
+
+func (s *stats) failCode(name, code string) {
+	s.mu.Lock()
+	s.op(name).errors[code]++
+	s.mu.Unlock()
+}
+
+// record is ok or fail depending on err.
+func (s *stats) record(name string, start time.Time, err error) {
+	if err != nil {
+		s.fail(name, err)
+		return
+	}
+	s.ok(name, time.Since(start))
+}
+
+// errorCode maps an error to a short stable label, so runs can be compared
+// by code rather than by message.
+func errorCode(err error) string {
+	var pe *client.Error
+	var ne net.Error
+	switch {
+	case errors.As(err, &pe):
+		return pe.Code
+	case errors.Is(err, client.ErrNotDelivered):
+		return "NOT_DELIVERED"
+	case errors.Is(err, client.ErrBuffered):
+		return "BUFFERED"
+	case errors.Is(err, client.ErrDenied):
+		return "DENIED"
+	case errors.Is(err, client.ErrDisconnected), errors.Is(err, client.ErrClosed):
+		return "DISCONNECTED"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errTimeout):
+		return "TIMEOUT"
+	case errors.As(err, &ne):
+		return "NETWORK"
+	}
+	return "OTHER"
+}
+
+var errTimeout = errors.New("timed out")
+
+// report is the result of one run. Its JSON form is what -out writes and
+// -compare reads, so fields are only ever added.
+type report struct {
+	Started  time.Time           `json:"started"`
+	Duration float64             `json:"durationSeconds"`
+	Config   reportConfig        `json:"config"`
+	Ops      map[string]opReport `json:"ops"`
+	Server   *serverReport       `json:"server,omitempty"`
+}
+
+type reportConfig struct {
+	URL           string  `json:"url"`
+	Clients       int     `json:"clients"`
+	Mix           string  `json:"mix"`
+	Think         string  `json:"think"`
+	Burst         int     `json:"burst"`
+	Size          int     `json:"size"`
+	Storm         string  `json:"storm,omitempty"`
+	StormFraction float64 `json:"stormFraction,omitempty"`
+}
+
+// opReport holds one operation's counts and latency percentiles in
+// milliseconds.
+type opReport struct {
+	Count     int            `json:"count"`
+	Errors    int            `json:"errors"`
+	ErrorRate float64        `json:"errorRate"`
+	Codes     map[string]int `json:"codes,omitempty"`
+	P50       float64        `json:"p50"`
+	P90       float64        `json:"p90"`
+	P99       float64        `json:"p99"`
+	P999      float64        `json:"p999"`
+	Max       float64        `json:"max"`
+}
+
+func (s *stats) report() map[string]opReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]opReport, len(s.ops))
+	for name, o := range s.ops {
+		samples := slices.Clone(o.samples)
+		slices.Sort(samples)
+		r := opReport{Count: len(samples)}
+		for code, n := range o.errors {
+			r.Errors += n
+			if r.Codes == nil {
+				r.Codes = make(map[string]int)
+			}
+			r.Codes[code] = n
+		}
+		if total := r.Count + r.Errors; total > 0 {
+			r.ErrorRate = float64(r.Errors) / float64(total)
+		}
+		if len(samples) > 0 {
+			r.P50 = ms(percentile(samples, 0.50))
+			r.P90 = ms(percentile(samples, 0.90))
+			r.P99 = ms(percentile(samples, 0.99))
+			r.P999 = ms(percentile(samples, 0.999))
+			r.Max = ms(samples[len(samples)-1])
+		}
+		out[name] = r
+	}
+	return out
+}
+
+// percentile uses the nearest-rank method on sorted samples.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p+0.5) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func (r *report) write(w io.Writer) {
+	fmt.Fprintf(w, "%d clients for %.0fs, mix %s\n\n", r.Config.Clients, r.Duration, r.Config.Mix)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\tcount\terrors\terr%\tp50 ms\tp90 ms\tp99 ms\tp99.9 ms\tmax ms\t")
+	for _, name := range sortedKeys(r.Ops) {
+		o := r.Ops[name]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.2f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t\n",
+			name, o.Count, o.Errors, 100*o.ErrorRate, o.P50, o.P90, o.P99, o.P999, o.Max)
+	}
+	tw.Flush()
+
+	for _, name := range sortedKeys(r.Ops) {
+		if codes := r.Ops[name].Codes; len(codes) > 0 {
+			fmt.Fprintf(w, "\n%s errors:", name)
+			for _, code := range sortedKeys(codes) {
+				fmt.Fprintf(w, " %s=%d", code, codes[code])
+			}
+		}
+	}
+	fmt.Fprintln(w)
+
+	if s := r.Server; s != nil {
+		fmt.Fprintf(w, "\nserver: peak %.0f clients, %.0f sessions, %.0f goroutines, %.1f MiB heap, %.1f MiB total\n",
+			s.PeakClients, s.PeakSessions, s.PeakGoroutines, s.PeakHeapBytes/(1<<20), s.PeakMemoryBytes/(1<<20))
+		fmt.Fprintf(w, "server: %.1f CPU seconds (%.2f cores), %.0f frames, %.0f frame errors, %.0f rate limited\n",
+			s.CPUSeconds, s.CPUCores, s.Frames, s.FrameErrors, s.RateLimited)
+	}
+}
+
+// compare prints how each operation's error rate and p50/p99 moved from
+// the baseline run to r.
+func (r *report) compare(w io.Writer, base *report) {
+	fmt.Fprintf(w, "\ncompared with %s:\n", base.Started.Format(time.DateTime))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\terr%\tp50 ms\tp99 ms\t")
+	for _, name := range sortedKeys(r.Ops) {
+		o, b := r.Ops[name], base.Ops[name]
+		fmt.Fprintf(tw, "%s\t%.2f → %.2f\t%.1f → %.1f (%s)\t%.1f → %.1f (%s)\t\n", name,
+			100*b.ErrorRate, 100*o.ErrorRate,
+			b.P50, o.P50, change(b.P50, o.P50),
+			b.P99, o.P99, change(b.P99, o.P99))
+	}
+	tw.Flush()
+	if s, b := r.Server, base.Server; s != nil && b != nil {
+		fmt.Fprintf(w, "server: %.2f → %.2f cores (%s), %.1f → %.1f MiB heap (%s)\n",
+			b.CPUCores, s.CPUCores, change(b.CPUCores, s.CPUCores),
+			b.PeakHeapBytes/(1<<20), s.PeakHeapBytes/(1<<20), change(b.PeakHeapBytes, s.PeakHeapBytes))
+	}
+}
+
+func change(from, to float64) string {
+	if from == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.0f%%", 100*(to-from)/from)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func loadReport(path string) (*report, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r report
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &r, nil
+}
+
+func (r *report) save(path string) error {
+	raw, _ := json.MarshalIndent(r, "", "  ")
+	return os.WriteFile(path, append(raw, '\n'), 0644)
+}
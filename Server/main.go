@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"relay/server"
+)
+
+func main() {
+	if err := godotenv.Load(); err != nil {
+		log.Println("⚠️ No .env file found, relying on environment variables")
+	}
+	if os.Getenv("TURN_SECRET") == "" {
+		log.Fatal("❌ TURN_SECRET is not set")
+	}
+
+	f, err := os.OpenFile("connections.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.Fatalf("error opening file: %v", err)
+	}
+	defer f.Close()
+
+	opts, err := server.OptionsFromEnv()
+	if err != nil {
+		log.Fatalf("error loading config: %v", err)
+	}
+	s := server.New(append(opts, server.WithLogger(log.New(f, "", 0)))...)
+	if err := s.Start(":9000"); err != nil {
+		log.Fatalf("error starting server: %v", err)
+	}
+	log.Println("✅ Secure E2E Relay Server running on :9000")
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("error shutting down: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const maxAdminBodyBytes = 16 * 1024
+
+// loadAdminTokens reads ADMIN_TOKENS, a comma-separated list of
+// operator:token pairs. The operator name is what the audit log records.
+func loadAdminTokens() (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv("ADMIN_TOKENS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, token, ok := strings.Cut(pair, ":")
+		if !ok || name == "" || len(token) < 16 {
+			return nil, fmt.Errorf("invalid ADMIN_TOKENS entry for %q: want operator:token with a token of 16+ characters", name)
+		}
+		tokens[token] = name
+	}
+	return tokens, nil
+}
+
+// loadMetricsToken reads METRICS_TOKEN, the bearer token for /metrics.
+func loadMetricsToken() (string, error) {
+	token := strings.TrimSpace(os.Getenv("METRICS_TOKEN"))
+	if token != "" && len(token) < 16 {
+		return "", fmt.Errorf("METRICS_TOKEN must be at least 16 characters")
+	}
+	return token, nil
+}
+
+// operator returns the operator whose bearer token r carries.
+func (s *Server) operator(r *http.Request) (string, bool) {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	for token, name := range s.adminTokens {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// admin wraps an /admin/ handler with the bearer token check.
+func (s *Server) admin(h func(w http.ResponseWriter, r *http.Request, actor string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := s.operator(r)
+		if !ok {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "admin token required"})
+			return
+		}
+		h(w, r, actor)
+	}
+}
+
+func readAdminBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBodyBytes)).Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "invalid JSON body"})
+		return false
+	}
+	return true
+}
+
+// GET /admin/reports?all=true
+func (s *Server) handleAdminReports(w http.ResponseWriter, r *http.Request, actor string) {
+	writeJSON(w, http.StatusOK, map[string]any{"reports": s.moderation.Reports(r.URL.Query().Get("all") == "true")})
+}
+
+// POST /admin/reports/{id}/resolve {"reason"}
+func (s *Server) handleAdminResolve(w http.ResponseWriter, r *http.Request, actor string) {
+	var d struct {
+		Reason string `json:"reason"`
+	}
+	if !readAdminBody(w, r, &d) {
+		return
+	}
+	if d.Reason == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "reason is required"})
+		return
+	}
+	e, ok := s.moderation.Resolve(actor, r.PathValue("id"), d.Reason)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "no open report with that id"})
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
+
+// GET /admin/restrictions
+func (s *Server) handleAdminRestrictions(w http.ResponseWriter, r *http.Request, actor string) {
+	writeJSON(w, http.StatusOK, map[string]any{"restrictions": s.moderation.Restrictions()})
+}
+
+// POST /admin/restrictions {"email","action","for","reason","report"}
+func (s *Server) handleAdminRestrict(w http.ResponseWriter, r *http.Request, actor string) {
+	var d struct {
+		Email  string   `json:"email"`
+		Action string   `json:"action"`
+		For    Duration `json:"for"`
+		Reason string   `json:"reason"`
+		Report string   `json:"report"`
+	}
+	if !readAdminBody(w, r, &d) {
+		return
+	}
+	if d.Email == "" || d.Reason == "" || d.For < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "email and reason are required"})
+		return
+	}
+	var until time.Time
+	if d.For > 0 {
+		until = s.now().Add(time.Duration(d.For))
+	}
+	e, err := s.moderation.Restrict(actor, d.Email, d.Action, until, d.Reason, d.Report)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	s.metrics.Inc("relay_moderation_actions_total", "action", e.Action)
+	log.Printf("[Server] %s of %s by %s", e.Action, emailHash(e.Email), actor)
+	s.enforce(e.Email)
+	writeJSON(w, http.StatusOK, e)
+}
+
+// POST /admin/restrictions/{email}/lift {"reason"}
+func (s *Server) handleAdminLift(w http.ResponseWriter, r *http.Request, actor string) {
+	var d struct {
+		Reason string `json:"reason"`
+	}
+	if !readAdminBody(w, r, &d) {
+		return
+	}
+	if d.Reason == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "reason is required"})
+		return
+	}
+	e, ok := s.moderation.Lift(actor, r.PathValue("email"), d.Reason)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "no restriction in force on that account"})
+		return
+	}
+	s.metrics.Inc("relay_moderation_actions_total", "action", e.Action)
+	writeJSON(w, http.StatusOK, e)
+}
+
+// GET /admin/audit
+func (s *Server) handleAdminAudit(w http.ResponseWriter, r *http.Request, actor string) {
+	writeJSON(w, http.StatusOK, map[string]any{"entries": s.moderation.Audit()})
+}
+
+// registerMetrics serves /metrics to holders of the metrics token or an
+// admin token. The counters show who is busy and how the relay is
+// configured, so they are not public.
+func (s *Server) registerMetrics(mux *http.ServeMux) {
+	if s.metricsToken == "" && len(s.adminTokens) == 0 {
+		return
+	}
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		metricsOK := s.metricsToken != "" && subtle.ConstantTimeCompare([]byte(got), []byte(s.metricsToken)) == 1
+		if _, adminOK := s.operator(r); !metricsOK && !adminOK {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "metrics token required"})
+			return
+		}
+		s.metrics.ServeHTTP(w, r)
+	})
+}
+
+// registerAdmin serves the moderation API under /admin/ when operators
+// are configured.
+func (s *Server) registerAdmin(mux *http.ServeMux) {
+	if len(s.adminTokens) == 0 {
+		return
+	}
+	mux.HandleFunc("GET /admin/reports", s.admin(s.handleAdminReports))
+	mux.HandleFunc("POST /admin/reports/{id}/resolve", s.admin(s.handleAdminResolve))
+	mux.HandleFunc("GET /admin/restrictions", s.admin(s.handleAdminRestrictions))
+	mux.HandleFunc("POST /admin/restrictions", s.admin(s.handleAdminRestrict))
+	mux.HandleFunc("POST /admin/restrictions/{email}/lift", s.admin(s.handleAdminLift))
+	mux.HandleFunc("GET /admin/audit", s.admin(s.handleAdminAudit))
+}
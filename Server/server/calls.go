@@ -0,0 +1,424 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCallRingTimeout = 45 * time.Second
+	maxCallModeLength      = 32
+
+	callRinging = "ringing"
+	callActive  = "active"
+	callEnded   = "ended"
+)
+
+// Call is the relay's view of a call in one session. It only tracks who is
+// ringing and who has picked up; media and its keys never pass through here.
+type Call struct {
+	id      string
+	sid     string
+	caller  string
+	mode    string
+	state   string
+	started time.Time
+	joined  map[string]bool
+	ringing map[string]bool
+	timer   *time.Timer
+}
+
+// callEvent is a frame produced by a state change, addressed to an account.
+// from names the account whose peer ID goes in sh, and queue holds the frame
+// for the next AUTH when the recipient is offline.
+type callEvent struct {
+	to    string
+	from  string
+	frame Frame
+	queue bool
+}
+
+// Calls tracks at most one call per session and at most one joined call
+// per account. State changes return the events to deliver so nothing is
+// sent while mu is held; ring timeouts deliver through dispatch.
+type Calls struct {
+	ringTimeout time.Duration
+	dispatch    func([]callEvent)
+	metrics     *Metrics
+	bySID       map[string]*Call
+	byAccount   map[string]*Call
+	mu          sync.Mutex
+}
+
+func NewCalls(ringTimeout time.Duration, dispatch func([]callEvent), metrics *Metrics) *Calls {
+	cs := &Calls{
+		ringTimeout: ringTimeout,
+		dispatch:    dispatch,
+		metrics:     metrics,
+		bySID:       make(map[string]*Call),
+		byAccount:   make(map[string]*Call),
+	}
+	metrics.Gauge("relay_calls", func() float64 {
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+		return float64(len(cs.bySID))
+	})
+	return cs
+}
+
+// loadCallRingTimeout reads CALL_RING_TIMEOUT.
+func loadCallRingTimeout() (time.Duration, error) {
+	v := os.Getenv("CALL_RING_TIMEOUT")
+	if v == "" {
+		return defaultCallRingTimeout, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid CALL_RING_TIMEOUT: %q", v)
+	}
+	return d, nil
+}
+
+func callData(c *Call, extra map[string]any) json.RawMessage {
+	m := map[string]any{"callId": c.id}
+	for k, v := range extra {
+		m[k] = v
+	}
+	data, _ := json.Marshal(m)
+	return data
+}
+
+// Start rings every other member of sid. Members already in a call are
+// answered with CALL_BUSY on their behalf. A CALL_START that races one from
+// another member of the same session is taken as an accept.
+func (cs *Calls) Start(id, sid, caller, mode, payload string, members []string) ([]callEvent, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if c := cs.bySID[sid]; c != nil {
+		if c.ringing[caller] {
+			return cs.accept(c, caller, payload)
+		}
+		return nil, NewError(ErrCallInProgress, "Call already in progress")
+	}
+	if cs.byAccount[caller] != nil {
+		return nil, NewError(ErrAlreadyInCall, "Already in a call")
+	}
+
+	c := &Call{
+		id:      id,
+		sid:     sid,
+		caller:  caller,
+		mode:    mode,
+		state:   callRinging,
+		started: time.Now(),
+		joined:  map[string]bool{caller: true},
+		ringing: make(map[string]bool),
+	}
+	cs.bySID[sid] = c
+	cs.byAccount[caller] = c
+
+	var events []callEvent
+	for _, m := range members {
+		if m == caller {
+			continue
+		}
+		if cs.byAccount[m] != nil {
+			events = append(events, callEvent{to: caller, from: m, frame: Frame{T: "CALL_BUSY", SID: sid, Data: callData(c, nil)}})
+			continue
+		}
+		c.ringing[m] = true
+		events = append(events, callEvent{to: m, from: caller, frame: cs.ring(c, payload)})
+	}
+	if len(c.ringing) == 0 {
+		return append(events, cs.end(c, "busy")...), nil
+	}
+
+	events = append(events, callEvent{to: caller, frame: Frame{T: "CALL_RINGING", SID: sid, Data: callData(c, map[string]any{
+		"ringTimeout": cs.ringTimeout.Milliseconds(),
+	})}})
+	c.timer = time.AfterFunc(cs.ringTimeout, func() { cs.timeout(c) })
+	return events, nil
+}
+
+func (cs *Calls) ring(c *Call, payload string) Frame {
+	extra := map[string]any{
+		"mode":      c.mode,
+		"startedAt": c.started.UnixMilli(),
+	}
+	if payload != "" {
+		extra["payload"] = payload
+	}
+	return Frame{T: "CALL_START", SID: c.sid, Data: callData(c, extra)}
+}
+
+// Accept joins account to the call it is being rung for.
+func (cs *Calls) Accept(sid, account, payload string) ([]callEvent, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c := cs.bySID[sid]
+	if c == nil || !c.ringing[account] {
+		return nil, NewError(ErrNoCall, "No call to accept")
+	}
+	return cs.accept(c, account, payload)
+}
+
+func (cs *Calls) accept(c *Call, account, payload string) ([]callEvent, error) {
+	if other := cs.byAccount[account]; other != nil && other != c {
+		return nil, NewError(ErrAlreadyInCall, "Already in a call")
+	}
+	delete(c.ringing, account)
+	c.joined[account] = true
+	cs.byAccount[account] = c
+	c.state = callActive
+
+	extra := map[string]any{}
+	if payload != "" {
+		extra["payload"] = payload
+	}
+	var events []callEvent
+	for m := range c.joined {
+		if m != account {
+			events = append(events, callEvent{to: m, from: account, frame: Frame{T: "CALL_ACCEPT", SID: c.sid, Data: callData(c, extra)}})
+		}
+	}
+	if len(c.ringing) == 0 && c.timer != nil {
+		c.timer.Stop()
+	}
+	return events, nil
+}
+
+// Busy records that account, while being rung, is busy elsewhere.
+func (cs *Calls) Busy(sid, account string) ([]callEvent, error) {
+	return cs.leave(sid, account, "busy")
+}
+
+// End hangs up, declines or cancels depending on where account stands.
+func (cs *Calls) End(sid, account string) ([]callEvent, error) {
+	return cs.leave(sid, account, "")
+}
+
+func (cs *Calls) leave(sid, account, reason string) ([]callEvent, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c := cs.bySID[sid]
+	if c == nil || (!c.joined[account] && !c.ringing[account]) {
+		return nil, NewError(ErrNoCall, "No call in progress")
+	}
+	return cs.remove(c, account, reason), nil
+}
+
+// remove takes account out of c and ends the call when nobody is left to
+// talk to.
+func (cs *Calls) remove(c *Call, account, reason string) []callEvent {
+	var events []callEvent
+	if c.ringing[account] {
+		delete(c.ringing, account)
+		if reason == "" {
+			reason = "declined"
+		}
+		frameType := "CALL_LEFT"
+		if reason == "busy" {
+			frameType = "CALL_BUSY"
+		}
+		for m := range c.joined {
+			events = append(events, callEvent{to: m, from: account, frame: Frame{T: frameType, SID: c.sid, Data: callData(c, map[string]any{"reason": reason})}})
+		}
+	} else {
+		delete(c.joined, account)
+		delete(cs.byAccount, account)
+		if reason == "" {
+			reason = "hangup"
+			if c.state == callRinging {
+				reason = "cancelled"
+			}
+		}
+		for m := range c.joined {
+			events = append(events, callEvent{to: m, from: account, frame: Frame{T: "CALL_LEFT", SID: c.sid, Data: callData(c, map[string]any{"reason": reason})}})
+		}
+	}
+
+	alone := len(c.joined) == 1 && (c.state == callActive || len(c.ringing) == 0)
+	if len(c.joined) > 0 && !alone {
+		return events
+	}
+	return append(events, cs.end(c, reason)...)
+}
+
+// Disconnect drops account from every call it had joined. Calls it is only
+// being rung for keep ringing so it can still pick up after reconnecting.
+func (cs *Calls) Disconnect(account string) []callEvent {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c := cs.byAccount[account]
+	if c == nil {
+		return nil
+	}
+	return cs.remove(c, account, "disconnected")
+}
+
+// Ringing returns CALL_START frames for calls still ringing account, for
+// delivery right after it authenticates.
+func (cs *Calls) Ringing(account string) []callEvent {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var events []callEvent
+	for _, c := range cs.bySID {
+		if c.ringing[account] {
+			events = append(events, callEvent{to: account, from: c.caller, frame: cs.ring(c, "")})
+		}
+	}
+	return events
+}
+
+func (cs *Calls) timeout(c *Call) {
+	cs.mu.Lock()
+	if cs.bySID[c.sid] != c || len(c.ringing) == 0 {
+		cs.mu.Unlock()
+		return
+	}
+	var events []callEvent
+	if c.state == callRinging {
+		events = cs.end(c, "timeout")
+	} else {
+		events = cs.miss(c)
+	}
+	cs.mu.Unlock()
+	cs.dispatch(events)
+}
+
+// miss stops ringing everyone who has not answered. Offline members get
+// CALL_MISSED on their next AUTH.
+func (cs *Calls) miss(c *Call) []callEvent {
+	var events []callEvent
+	for m := range c.ringing {
+		events = append(events, callEvent{to: m, from: c.caller, queue: true, frame: Frame{T: "CALL_MISSED", SID: c.sid, Data: callData(c, map[string]any{
+			"mode":      c.mode,
+			"startedAt": c.started.UnixMilli(),
+		})}})
+		cs.metrics.Inc("relay_calls_missed_total")
+	}
+	c.ringing = make(map[string]bool)
+	return events
+}
+
+func (cs *Calls) end(c *Call, reason string) []callEvent {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.state = callEnded
+	delete(cs.bySID, c.sid)
+
+	events := cs.miss(c)
+	for m := range c.joined {
+		delete(cs.byAccount, m)
+		events = append(events, callEvent{to: m, frame: Frame{T: "CALL_END", SID: c.sid, Data: callData(c, map[string]any{"reason": reason})}})
+	}
+	return events
+}
+
+// dispatchCall delivers call events, numbering each in its session and
+// adding the sender's peer ID as seen by each recipient. Events for offline
+// recipients that are not queued are dropped before they take a seq.
+// Online recipients get the event queued under sess.mu, so it cannot
+// overtake a frame numbered before it.
+func (s *Server) dispatchCall(events []callEvent) {
+	for _, e := range events {
+		c := s.state.account(e.to)
+		if c == nil && !e.queue {
+			continue
+		}
+
+		f := e.frame
+		if e.from != "" {
+			pairwise := false
+			if c != nil {
+				pairwise = c.wantsPairwise()
+			}
+			f.SH = s.peerID(e.from, e.to, pairwise)
+		}
+		sess := s.state.session(f.SID)
+		if sess == nil {
+			if c == nil {
+				s.offline.Push(e.to, f)
+			} else {
+				s.post(c, f)
+			}
+			continue
+		}
+		sess.mu.Lock()
+		s.number(sess, &f)
+		if c != nil {
+			s.post(c, f)
+		}
+		sess.mu.Unlock()
+		if c == nil {
+			s.offline.Push(e.to, f)
+		}
+	}
+}
+
+func (s *Server) handleCall(client *Client, frame Frame) error {
+	var d struct {
+		Mode    string `json:"mode"`
+		Payload string `json:"payload"`
+	}
+	if len(frame.Data) > 0 {
+		if err := json.Unmarshal(frame.Data, &d); err != nil {
+			return NewError(ErrInvalidFrame, "Invalid call frame")
+		}
+	}
+	if len(d.Mode) > maxCallModeLength || len(d.Payload) > maxEncryptedDataBytes {
+		return NewError(ErrInvalidFrame, "Invalid call frame")
+	}
+
+	sess := s.state.session(frame.SID)
+
+	var members []string
+	sess.mu.Lock()
+	for m := range sess.members {
+		members = append(members, m)
+	}
+	sess.mu.Unlock()
+
+	account := normalizeEmail(client.email)
+	// The opaque payload is relayed to the other members like an MSG's. It
+	// is charged up front so the quota holds against concurrent sends, and
+	// refunded when the call state refuses the request.
+	var charged int64
+	if d.Payload != "" && len(members) > 1 {
+		charged = int64(len(d.Payload)) * int64(len(members)-1)
+		if pe := s.quotas.chargeRelay(account, charged); pe != nil {
+			return pe
+		}
+	}
+	var (
+		events []callEvent
+		err    error
+	)
+	switch frame.T {
+	case "CALL_START":
+		events, err = s.calls.Start(s.newID(), frame.SID, account, d.Mode, d.Payload, members)
+	case "CALL_ACCEPT":
+		events, err = s.calls.Accept(frame.SID, account, d.Payload)
+	case "CALL_BUSY":
+		events, err = s.calls.Busy(frame.SID, account)
+	case "CALL_END":
+		events, err = s.calls.End(frame.SID, account)
+	}
+	if err != nil {
+		if charged > 0 {
+			s.quotas.refundRelay(account, charged)
+		}
+		return err
+	}
+	s.dispatchCall(events)
+	return nil
+}
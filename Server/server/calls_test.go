@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCallBusyAndDecline(t *testing.T) {
+	cs := NewCalls(time.Minute, func([]callEvent) {}, NewMetrics())
+	members := []string{"alice@example.com", "bob@example.com"}
+
+	if _, err := cs.Start("c1", "s1", "alice@example.com", "audio", "", members); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.Accept("s1", "bob@example.com", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Carol rings bob while he is talking to alice.
+	events, err := cs.Start("c2", "s2", "carol@example.com", "video", "", []string{"carol@example.com", "bob@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].frame.T != "CALL_BUSY" || events[0].from != "bob@example.com" || events[1].frame.T != "CALL_END" {
+		t.Fatalf("expected CALL_BUSY then CALL_END for carol, got %+v", events)
+	}
+	if !strings.Contains(string(events[1].frame.Data), `"reason":"busy"`) {
+		t.Fatalf("unexpected end reason: %s", events[1].frame.Data)
+	}
+
+	if _, err := cs.End("s1", "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.Start("c3", "s2", "carol@example.com", "video", "", []string{"carol@example.com", "bob@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	events, err = cs.End("s2", "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := events[len(events)-1]
+	if last.to != "carol@example.com" || last.frame.T != "CALL_END" || !strings.Contains(string(last.frame.Data), `"reason":"declined"`) {
+		t.Fatalf("expected carol to see a declined call, got %+v", events)
+	}
+	if len(cs.bySID) != 0 || len(cs.byAccount) != 0 {
+		t.Fatalf("ended calls still tracked: %d sessions, %d accounts", len(cs.bySID), len(cs.byAccount))
+	}
+}
+
+func TestCallRingTimeoutQueuesMissedCall(t *testing.T) {
+	s := newTestServer(WithCallRingTimeout(100 * time.Millisecond))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	alice, err := connectClient(url, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := connectClient(url, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, err := establishSession(alice, bob, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.Close()
+	expectFrame(t, alice, "PEER_OFFLINE")
+
+	alice.WriteJSON(Frame{T: "CALL_START", SID: sid, Data: json.RawMessage(`{"mode":"video"}`)})
+	expectFrame(t, alice, "CALL_RINGING")
+	end := expectFrame(t, alice, "CALL_END")
+	if !strings.Contains(string(end.Data), `"reason":"timeout"`) {
+		t.Fatalf("expected a ring timeout, got %s", end.Data)
+	}
+
+	bob, err = connectClient(url, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	missed := expectFrame(t, bob, "CALL_MISSED")
+	if missed.SID != sid || missed.SH == "" || !strings.Contains(string(missed.Data), `"mode":"video"`) {
+		t.Fatalf("unexpected CALL_MISSED: %+v", missed)
+	}
+	if got := s.metrics.Counter("relay_calls_missed_total"); got != 1 {
+		t.Fatalf("expected 1 missed call, got %d", got)
+	}
+}
+
+func TestUndeliveredCallEventsTakeNoSeq(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	alice, bob, sid, err := connectPair(url, "callseq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob.Close()
+	offline := expectFrame(t, alice, "PEER_OFFLINE")
+
+	// The CALL_START for offline bob is neither sent nor queued.
+	alice.WriteJSON(Frame{T: "CALL_START", SID: sid, Data: json.RawMessage(`{"mode":"audio"}`)})
+	if ring := expectFrame(t, alice, "CALL_RINGING"); ring.Seq != offline.Seq+1 {
+		t.Fatalf("CALL_RINGING seq %d after PEER_OFFLINE seq %d", ring.Seq, offline.Seq)
+	}
+}
+
+func TestCrashedCallerStopsRinging(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	alice, err := connectClient(url, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := connectClient(url, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	sid, err := establishSession(alice, bob, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice.WriteJSON(Frame{T: "CALL_START", SID: sid, Data: json.RawMessage(`{"mode":"audio","payload":"opaque"}`)})
+	ring := expectFrame(t, bob, "CALL_START")
+	if ring.SH == "" || !strings.Contains(string(ring.Data), `"payload":"opaque"`) {
+		t.Fatalf("unexpected CALL_START: %+v", ring)
+	}
+
+	alice.Close()
+	expectFrame(t, bob, "PEER_OFFLINE")
+	expectFrame(t, bob, "CALL_MISSED")
+
+	bob.WriteJSON(Frame{T: "CALL_ACCEPT", SID: sid})
+	if f := expectFrame(t, bob, "ERROR"); !strings.Contains(string(f.Data), "No call to accept") {
+		t.Fatalf("unexpected error: %s", f.Data)
+	}
+}
+
+func TestRejectedSecondDeviceKeepsCallUp(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	alice, bob, sid, err := connectPair(url, "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	defer bob.Close()
+
+	alice.WriteJSON(Frame{T: "CALL_START", SID: sid, Data: json.RawMessage(`{"mode":"audio"}`)})
+	expectFrame(t, alice, "CALL_RINGING")
+	expectFrame(t, bob, "CALL_START")
+	bob.WriteJSON(Frame{T: "CALL_ACCEPT", SID: sid})
+	expectFrame(t, alice, "CALL_ACCEPT")
+
+	second, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := getTestSessionToken("device_a@example.com")
+	second.WriteJSON(Frame{T: "AUTH", Data: json.RawMessage(`{"token":"` + token + `"}`)})
+	if f := expectFrame(t, second, "ERROR"); !strings.Contains(string(f.Data), string(ErrAlreadyLoggedIn)) {
+		t.Fatalf("expected ALREADY_LOGGED_IN, got %s", f.Data)
+	}
+	// The server closes the rejected connection; wait for its teardown.
+	if _, _, err := second.ReadMessage(); err == nil {
+		t.Fatal("rejected connection stayed open")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	alice.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"still here"}`)})
+	if f, err := readMSG(bob); err != nil || f.T != "MSG" {
+		t.Fatalf("expected the call to survive the rejected login, bob got %+v (%v)", f, err)
+	}
+}
+
+func TestOutsiderCannotJoinInvitedSession(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	alice, bob, sid, err := connectPair(url, "invite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	defer bob.Close()
+	mallory, err := connectClient(url, "mallory@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mallory.Close()
+
+	for _, typ := range []string{"REATTACH", "JOIN_ACCEPT", "JOIN_DENY"} {
+		mallory.WriteJSON(Frame{T: typ, SID: sid, Data: json.RawMessage(`{}`)})
+		if f := expectFrame(t, mallory, "ERROR"); !strings.Contains(string(f.Data), string(ErrNotMember)) {
+			t.Fatalf("%s by an outsider: %s", typ, f.Data)
+		}
+	}
+
+	// Only the invited pair is rung.
+	alice.WriteJSON(Frame{T: "CALL_START", SID: sid, Data: json.RawMessage(`{"mode":"audio"}`)})
+	expectFrame(t, bob, "CALL_START")
+	alice.WriteJSON(Frame{T: "CALL_END", SID: sid})
+	mallory.WriteJSON(Frame{T: "QUOTA"})
+	expectFrame(t, mallory, "QUOTA_STATUS") // and no CALL_START before it
+}
+
+func expectFrame(t *testing.T, conn *websocket.Conn, want string) *Frame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	f, err := readMSG(conn)
+	if err != nil {
+		t.Fatalf("waiting for %s: %v", want, err)
+	}
+	if f.T != want {
+		t.Fatalf("expected %s, got %s %s", want, f.T, f.Data)
+	}
+	return f
+}
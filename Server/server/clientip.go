@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// TrustedProxies decides which peers may tell us the real client address,
+// either through X-Forwarded-For / Forwarded or the PROXY protocol.
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// ParseTrustedProxies accepts a comma-separated list of CIDRs or bare IPs.
+func ParseTrustedProxies(list string) (*TrustedProxies, error) {
+	tp := &TrustedProxies{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", item)
+			}
+			tp.prefixes = append(tp.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", item)
+		}
+		tp.prefixes = append(tp.prefixes, p.Masked())
+	}
+	return tp, nil
+}
+
+func loadTrustedProxies() (*TrustedProxies, error) {
+	return ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+}
+
+func (tp *TrustedProxies) Trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range tp.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// FromProxy reports whether r arrived directly from a trusted proxy.
+func (tp *TrustedProxies) FromProxy(r *http.Request) bool {
+	remote, ok := parseHostAddr(r.RemoteAddr)
+	return ok && tp.Trusted(remote)
+}
+
+// parseHostAddr parses "ip", "ip:port", "[ipv6]" or "[ipv6]:port".
+func parseHostAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// forwardedFor returns the hop addresses from Forwarded (RFC 7239) or, if
+// absent, X-Forwarded-For, ordered client first. Obfuscated and "unknown"
+// hops come back as invalid addresses so they still occupy their position.
+func forwardedFor(h http.Header) []netip.Addr {
+	var hops []netip.Addr
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, v := range values {
+			for _, elem := range strings.Split(v, ",") {
+				for _, pair := range strings.Split(elem, ";") {
+					k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if !ok || !strings.EqualFold(k, "for") {
+						continue
+					}
+					addr, _ := parseHostAddr(strings.Trim(val, `"`))
+					hops = append(hops, addr)
+				}
+			}
+		}
+		return hops
+	}
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, item := range strings.Split(v, ",") {
+			addr, _ := parseHostAddr(item)
+			hops = append(hops, addr)
+		}
+	}
+	return hops
+}
+
+// ClientIP returns the address of the client that originated r. Forwarding
+// headers are only honoured when the direct peer is a trusted proxy, and the
+// chain is walked from the right so a client cannot spoof its own entry.
+func (tp *TrustedProxies) ClientIP(r *http.Request) string {
+	remote, ok := parseHostAddr(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !tp.Trusted(remote) {
+		return remote.String()
+	}
+
+	client := remote
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !hops[i].IsValid() {
+			break
+		}
+		client = hops[i]
+		if !tp.Trusted(client) {
+			break
+		}
+	}
+	return client.String()
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tp, err := ParseTrustedProxies("10.0.0.0/8, 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		remote string
+		header http.Header
+		want   string
+	}{
+		{"direct ipv4", "203.0.113.7:5555", nil, "203.0.113.7"},
+		{"direct ipv6", "[2001:db8::99]:5555", nil, "2001:db8::99"},
+		{"untrusted peer cannot spoof", "203.0.113.7:5555",
+			http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:443",
+			http.Header{"X-Forwarded-For": {"198.51.100.4"}}, "198.51.100.4"},
+		{"spoofed leftmost entry ignored", "10.1.2.3:443",
+			http.Header{"X-Forwarded-For": {"1.2.3.4, 198.51.100.4, 10.9.9.9"}}, "198.51.100.4"},
+		{"forwarded ipv6 via trusted ipv6 proxy", "[2001:db8::1]:443",
+			http.Header{"Forwarded": {`for="[2001:db8:cafe::17]:4711";proto=https`}}, "2001:db8:cafe::17"},
+		{"forwarded wins over xff", "10.1.2.3:443",
+			http.Header{"Forwarded": {"for=192.0.2.60"}, "X-Forwarded-For": {"1.2.3.4"}}, "192.0.2.60"},
+		{"obfuscated hop stops the walk", "10.1.2.3:443",
+			http.Header{"Forwarded": {"for=192.0.2.60, for=_hidden"}}, "10.1.2.3"},
+	}
+	for _, tc := range cases {
+		r := &http.Request{RemoteAddr: tc.remote, Header: tc.header}
+		if r.Header == nil {
+			r.Header = http.Header{}
+		}
+		if got := tp.ClientIP(r); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, fam byte, addr []byte) []byte {
+		b := append([]byte{}, proxyV2Signature...)
+		b = append(b, 0x20|cmd, fam, 0, 0)
+		binary.BigEndian.PutUint16(b[14:], uint16(len(addr)))
+		return append(b, addr...)
+	}
+	v4Block := []byte{192, 0, 2, 1, 10, 0, 0, 1, 0x1f, 0x90, 0x23, 0x28}
+	v6Block := make([]byte, 36)
+	copy(v6Block, net.ParseIP("2001:db8::5"))
+	binary.BigEndian.PutUint16(v6Block[32:], 1234)
+
+	cases := []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 56324 443\r\nGET"), "192.0.2.1:56324"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::5 2001:db8::1 1234 443\r\nGET"), "[2001:db8::5]:1234"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\nGET"), ""},
+		{"v2 inet", append(v2(1, 0x11, v4Block), "GET"...), "192.0.2.1:8080"},
+		{"v2 inet6", append(v2(1, 0x21, v6Block), "GET"...), "[2001:db8::5]:1234"},
+		{"v2 local", append(v2(0, 0x00, nil), "GET"...), ""},
+	}
+	for _, tc := range cases {
+		r := bufio.NewReader(bytes.NewReader(tc.input))
+		addr, err := readProxyHeader(r)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+		if rest, _ := r.ReadString(0); rest != "GET" {
+			t.Errorf("%s: header not fully consumed, left %q", tc.name, rest)
+		}
+	}
+
+	if _, err := readProxyHeader(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))); err == nil {
+		t.Fatal("missing header accepted from trusted proxy")
+	}
+}
+
+func TestProxyListenerRewritesRemoteAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp, _ := ParseTrustedProxies("127.0.0.1")
+	pl := newProxyListener(ln, tp)
+	defer pl.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write([]byte("PROXY TCP4 198.51.100.9 127.0.0.1 4000 9000\r\nhello"))
+		c.Close()
+	}()
+
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.RemoteAddr().String(); got != "198.51.100.9:4000" {
+		t.Fatalf("RemoteAddr = %s", got)
+	}
+	buf := make([]byte, 5)
+	if _, err := c.Read(buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("payload after header = %q (%v)", buf, err)
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SessionSecret derives the token signing key from an AUTH_SESSION_SECRET
+// value, so tools can mint session tokens the standalone relay accepts.
+func SessionSecret(seed string) []byte {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(seed)))
+	return sum[:]
+}
+
+// OptionsFromEnv builds the options the standalone relay runs with from the
+// environment variables documented in .example.env. The caller adds its
+// own logger.
+func OptionsFromEnv() ([]Option, error) {
+	secret := SessionSecret(os.Getenv("AUTH_SESSION_SECRET"))
+	opts := []Option{
+		WithSessionSecret(secret),
+		WithProxyProtocol(os.Getenv("PROXY_PROTOCOL") == "true"),
+		WithRelayOnlyICE(os.Getenv("ICE_RELAY_ONLY") == "true"),
+		WithFrameTrace(os.Getenv("FRAME_TRACE") == "true"),
+	}
+	if ids := strings.TrimSpace(os.Getenv("GOOGLE_CLIENT_IDS")); ids != "" {
+		opts = append(opts, WithAuthVerifier(NewGoogleVerifier(strings.Split(ids, ",")...)))
+	}
+
+	keyLog, err := loadKeyLog()
+	if err != nil {
+		return nil, fmt.Errorf("loading key log: %w", err)
+	}
+	pseudonyms, err := loadPseudonyms(secret)
+	if err != nil {
+		return nil, fmt.Errorf("loading pseudonym config: %w", err)
+	}
+	rules, err := loadRateRules()
+	if err != nil {
+		return nil, fmt.Errorf("loading rate limits: %w", err)
+	}
+	ringTimeout, err := loadCallRingTimeout()
+	if err != nil {
+		return nil, fmt.Errorf("loading call config: %w", err)
+	}
+	interval, missed, err := loadHeartbeat()
+	if err != nil {
+		return nil, fmt.Errorf("loading heartbeat config: %w", err)
+	}
+	resumeWindow, resumeFrames, err := loadResume()
+	if err != nil {
+		return nil, fmt.Errorf("loading resume config: %w", err)
+	}
+	syncFrames, syncAge, err := loadSyncRetention()
+	if err != nil {
+		return nil, fmt.Errorf("loading sync config: %w", err)
+	}
+	quotas, err := loadQuotas()
+	if err != nil {
+		return nil, fmt.Errorf("loading quotas: %w", err)
+	}
+	moderation, err := loadModeration()
+	if err != nil {
+		return nil, fmt.Errorf("loading moderation log: %w", err)
+	}
+	adminTokens, err := loadAdminTokens()
+	if err != nil {
+		return nil, fmt.Errorf("loading admin tokens: %w", err)
+	}
+	metricsToken, err := loadMetricsToken()
+	if err != nil {
+		return nil, fmt.Errorf("loading metrics token: %w", err)
+	}
+	proxies, err := loadTrustedProxies()
+	if err != nil {
+		return nil, fmt.Errorf("loading trusted proxies: %w", err)
+	}
+	turnPool, err := loadTurnPool(secret)
+	if err != nil {
+		return nil, fmt.Errorf("loading TURN servers: %w", err)
+	}
+	opts = append(opts,
+		WithKeyLog(keyLog),
+		WithPseudonyms(pseudonyms),
+		WithRateLimits(rules),
+		WithCallRingTimeout(ringTimeout),
+		WithHeartbeat(interval, missed),
+		WithResume(resumeWindow, resumeFrames),
+		WithSyncRetention(syncFrames, syncAge),
+		WithQuotas(quotas),
+		WithModeration(moderation),
+		WithAdminTokens(adminTokens),
+		WithMetricsToken(metricsToken),
+		WithTrustedProxies(proxies),
+		WithTurnPool(turnPool),
+	)
+
+	turnCfg, err := loadTurnConfig()
+	if err != nil {
+		return nil, fmt.Errorf("loading TURN config: %w", err)
+	}
+	if turnCfg != nil {
+		opts = append(opts, WithEmbeddedTurn(*turnCfg))
+	}
+	sfuCfg, err := loadSFUConfig()
+	if err != nil {
+		return nil, fmt.Errorf("loading SFU config: %w", err)
+	}
+	if sfuCfg != nil {
+		opts = append(opts, WithSFU(*sfuCfg))
+	}
+	return opts, nil
+}
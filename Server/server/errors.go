@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ErrorCode identifies an ERROR frame. Codes are part of the protocol:
+// once published they are never renamed or reused, and clients should
+// branch on them rather than on the message.
+type ErrorCode string
+
+const (
+	ErrAuthRequired      ErrorCode = "AUTH_REQUIRED"
+	ErrAuthFailed        ErrorCode = "AUTH_FAILED"
+	ErrAlreadyLoggedIn   ErrorCode = "ALREADY_LOGGED_IN"
+	ErrRateLimited       ErrorCode = "RATE_LIMITED"
+	ErrInvalidFrame      ErrorCode = "INVALID_FRAME"
+	ErrInvalidSessionID  ErrorCode = "INVALID_SESSION_ID"
+	ErrPayloadTooLarge   ErrorCode = "PAYLOAD_TOO_LARGE"
+	ErrNotMember         ErrorCode = "NOT_A_MEMBER"
+	ErrUnknownRecipient  ErrorCode = "UNKNOWN_RECIPIENT"
+	ErrUserOffline       ErrorCode = "USER_OFFLINE"
+	ErrQueueFull         ErrorCode = "QUEUE_FULL"
+	ErrInvalidToken      ErrorCode = "INVALID_DELIVERY_TOKEN"
+	ErrUnknownPseudonym  ErrorCode = "UNKNOWN_PSEUDONYM"
+	ErrNoPreKeys         ErrorCode = "NO_PREKEYS"
+	ErrTurnUnavailable   ErrorCode = "TURN_UNAVAILABLE"
+	ErrSFUDisabled       ErrorCode = "SFU_DISABLED"
+	ErrSFUUnavailable    ErrorCode = "SFU_UNAVAILABLE"
+	ErrSFUNotJoined      ErrorCode = "SFU_NOT_JOINED"
+	ErrNegotiationFailed ErrorCode = "NEGOTIATION_FAILED"
+	ErrCallInProgress    ErrorCode = "CALL_IN_PROGRESS"
+	ErrAlreadyInCall     ErrorCode = "ALREADY_IN_CALL"
+	ErrNoCall            ErrorCode = "NO_CALL"
+	ErrResumeFailed      ErrorCode = "RESUME_FAILED"
+	ErrQuotaExceeded     ErrorCode = "QUOTA_EXCEEDED"
+	ErrAccountSuspended  ErrorCode = "ACCOUNT_SUSPENDED"
+	ErrAccountBanned     ErrorCode = "ACCOUNT_BANNED"
+	ErrInternal          ErrorCode = "INTERNAL"
+)
+
+// ErrorSpec documents one code in the registry.
+type ErrorSpec struct {
+	Code        ErrorCode `json:"code"`
+	Retryable   bool      `json:"retryable"`
+	Description string    `json:"description"`
+}
+
+// errorRegistry lists every code the relay sends. GET /errors serves it so
+// clients can check the contract they were built against.
+var errorRegistry = map[ErrorCode]ErrorSpec{
+	ErrAuthRequired:      {Description: "The frame needs a successful AUTH first."},
+	ErrAuthFailed:        {Description: "The AUTH token was rejected."},
+	ErrAlreadyLoggedIn:   {Description: "The account is connected on another device; the connection is closed."},
+	ErrRateLimited:       {Retryable: true, Description: "A rate limit was hit; retry after retryAfter ms."},
+	ErrInvalidFrame:      {Description: "The frame's data is malformed or fails validation."},
+	ErrInvalidSessionID:  {Description: "The sid is missing or too long."},
+	ErrPayloadTooLarge:   {Description: "The payload is over the size limit."},
+	ErrNotMember:         {Description: "The sender is not a member of the session."},
+	ErrUnknownRecipient:  {Description: "No session member matches the to field."},
+	ErrUserOffline:       {Retryable: true, Description: "The target is offline and has no prekeys to queue a request against."},
+	ErrQueueFull:         {Retryable: true, Description: "The recipient's offline queue is full."},
+	ErrInvalidToken:      {Description: "The sealed-sender delivery token is invalid, expired or revoked."},
+	ErrUnknownPseudonym:  {Description: "No session member has that pseudonym."},
+	ErrNoPreKeys:         {Description: "The target has not published prekeys."},
+	ErrTurnUnavailable:   {Retryable: true, Description: "No healthy TURN server is available."},
+	ErrSFUDisabled:       {Description: "The SFU is not enabled on this relay."},
+	ErrSFUUnavailable:    {Retryable: true, Description: "The SFU could not add the participant."},
+	ErrSFUNotJoined:      {Description: "The sender has not joined the SFU for the session."},
+	ErrNegotiationFailed: {Description: "The SFU could not apply the session description or candidate."},
+	ErrCallInProgress:    {Description: "The session already has a call."},
+	ErrAlreadyInCall:     {Description: "The sender has already joined another call."},
+	ErrNoCall:            {Description: "There is no call the frame applies to."},
+	ErrResumeFailed:      {Description: "The resume token is unknown or expired, or the frames the client missed are no longer buffered; AUTH and REATTACH instead."},
+	ErrQuotaExceeded:     {Description: "An account quota would be exceeded; details name the quota, tier, limit and usage. The daily relay quota sets retryAfter to its reset."},
+	ErrAccountSuspended:  {Retryable: true, Description: "The account is suspended until details.until; the connection is closed."},
+	ErrAccountBanned:     {Description: "The account is banned, until details.until when set; the connection is closed."},
+	ErrInternal:          {Retryable: true, Description: "An unexpected server error."},
+}
+
+// ErrorCodes returns the registry sorted by code.
+func ErrorCodes() []ErrorSpec {
+	specs := make([]ErrorSpec, 0, len(errorRegistry))
+	for code, spec := range errorRegistry {
+		spec.Code = code
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Code < specs[j].Code })
+	return specs
+}
+
+func serveErrorCodes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ErrorCodes())
+}
+
+// ProtocolError is the data of an ERROR frame. Frame and RequestID are
+// filled in from the frame that caused it when it is sent.
+type ProtocolError struct {
+	Code       ErrorCode      `json:"code"`
+	Message    string         `json:"message"`
+	Retryable  bool           `json:"retryable"`
+	RetryAfter int64          `json:"retryAfter,omitempty"`
+	Frame      string         `json:"frame,omitempty"`
+	RequestID  string         `json:"requestId,omitempty"`
+	Details    map[string]any `json:"details,omitempty"`
+}
+
+func NewError(code ErrorCode, message string) *ProtocolError {
+	return &ProtocolError{Code: code, Message: message, Retryable: errorRegistry[code].Retryable}
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Message
+}
+
+// WithDetail returns a copy of e with key set in Details.
+func (e *ProtocolError) WithDetail(key string, value any) *ProtocolError {
+	c := *e
+	c.Details = make(map[string]any, len(e.Details)+1)
+	for k, v := range e.Details {
+		c.Details[k] = v
+	}
+	c.Details[key] = value
+	return &c
+}
+
+// WithRetryAfter returns a copy of e that tells the client when to retry.
+func (e *ProtocolError) WithRetryAfter(d time.Duration) *ProtocolError {
+	c := *e
+	c.Retryable = true
+	c.RetryAfter = d.Milliseconds() + 1
+	return &c
+}
+
+// errorFrame builds the ERROR reply to req. Errors that are not a
+// *ProtocolError are logged and reported as INTERNAL without their text.
+func errorFrame(req Frame, err error) Frame {
+	var pe *ProtocolError
+	if !errors.As(err, &pe) {
+		log.Printf("[Server] Internal error handling %s: %v", req.T, err)
+		pe = NewError(ErrInternal, "Internal error")
+	}
+	data := *pe
+	data.Frame = req.T
+	data.RequestID = req.ID
+	raw, _ := json.Marshal(data)
+	return Frame{T: "ERROR", SID: req.SID, To: req.To, ID: req.ID, Data: raw}
+}
+
+func (s *Server) sendError(c *Client, req Frame, err error) error {
+	return s.send(c, errorFrame(req, err))
+}
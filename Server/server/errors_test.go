@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestErrorRegistryIsComplete keeps the registry and the code constants in
+// step, and checks every NewError call in the package names a constant.
+func TestErrorRegistryIsComplete(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(fi fs.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	declared := map[ErrorCode]bool{}
+	for _, f := range pkgs["server"].Files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.ValueSpec:
+				if id, ok := n.Type.(*ast.Ident); ok && id.Name == "ErrorCode" {
+					for _, v := range n.Values {
+						lit := v.(*ast.BasicLit)
+						code, _ := strconv.Unquote(lit.Value)
+						if declared[ErrorCode(code)] {
+							t.Errorf("code %s declared twice", code)
+						}
+						declared[ErrorCode(code)] = true
+					}
+				}
+			case *ast.CallExpr:
+				if fn, ok := n.Fun.(*ast.Ident); ok && fn.Name == "NewError" {
+					if id, ok := n.Args[0].(*ast.Ident); !ok || !strings.HasPrefix(id.Name, "Err") {
+						t.Errorf("%s: NewError must be given a code constant", fset.Position(n.Pos()))
+					}
+				}
+			}
+			return true
+		})
+	}
+
+	for code := range declared {
+		if _, ok := errorRegistry[code]; !ok {
+			t.Errorf("code %s is not in the registry", code)
+		}
+	}
+	for code, spec := range errorRegistry {
+		if !declared[code] {
+			t.Errorf("registry lists undeclared code %s", code)
+		}
+		if spec.Description == "" {
+			t.Errorf("code %s has no description", code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	serveErrorCodes(rec, httptest.NewRequest("GET", "/errors", nil))
+	var served []ErrorSpec
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil || len(served) != len(errorRegistry) {
+		t.Fatalf("GET /errors served %d codes (%v), want %d", len(served), err, len(errorRegistry))
+	}
+}
+
+func TestErrorFrameEchoesRequest(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	alice, err := connectClient(url, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	alice.WriteJSON(Frame{T: "MSG", SID: "s1", ID: "req-7", To: "nobody", Data: json.RawMessage(`{"payload":"x"}`)})
+	f := expectFrame(t, alice, "ERROR")
+	var pe ProtocolError
+	if err := json.Unmarshal(f.Data, &pe); err != nil {
+		t.Fatal(err)
+	}
+	if f.ID != "req-7" || pe.Code != ErrUnknownRecipient || pe.Frame != "MSG" || pe.RequestID != "req-7" || pe.Retryable {
+		t.Fatalf("unexpected error frame: %s %s", f.ID, f.Data)
+	}
+	if pe.Details["to"] != "nobody" || pe.Message != "Recipient is not a member of this session" {
+		t.Fatalf("unexpected details: %s", f.Data)
+	}
+
+	alice.WriteJSON(Frame{T: "AUTH", ID: "req-8", Data: json.RawMessage(`{"token":"sess:1:x:bad"}`)})
+	f = expectFrame(t, alice, "ERROR")
+	json.Unmarshal(f.Data, &pe)
+	if pe.Code != ErrAuthFailed || pe.RequestID != "req-8" {
+		t.Fatalf("unexpected auth error: %s", f.Data)
+	}
+}
+
+func TestRateLimitErrorIsRetryable(t *testing.T) {
+	pe := errorFrame(Frame{T: "MSG", SID: "s"}, rateLimitError("MSG", 250*time.Millisecond))
+	var data ProtocolError
+	json.Unmarshal(pe.Data, &data)
+	if data.Code != ErrRateLimited || !data.Retryable || data.RetryAfter != 251 || data.Frame != "MSG" {
+		t.Fatalf("unexpected rate limit error: %s", pe.Data)
+	}
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// MSG and SEALED_MSG are relayed without decoding the payload: msgPayload
+// finds it in the inbound data, appendMsgFrame copies it once into a pooled
+// buffer, and relay queues those bytes for every recipient that sees the same
+// sender ID.
+
+var frameBufs = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// maxPooledFrame keeps buffers grown by one large payload out of the pool.
+const maxPooledFrame = 64 * 1024
+
+var errNotObject = errors.New("data is not a JSON object")
+
+// msgPayload returns the "payload" field of a MSG's data as it appears on
+// the wire, quotes and escapes included, sliced from data. It is nil when
+// the field is absent or null, and an error when data is not a JSON object
+// or the payload is not a string. Payloads that are not valid UTF-8 are
+// rejected too: they go out unchanged in text frames, which browsers close
+// the connection over.
+func msgPayload(data []byte) ([]byte, error) {
+	if !json.Valid(data) {
+		return nil, errNotObject
+	}
+	i := skipSpace(data, 0)
+	if data[i] != '{' {
+		return nil, errNotObject
+	}
+	var payload []byte
+	i = skipSpace(data, i+1)
+	for data[i] != '}' {
+		keyEnd := skipString(data, i)
+		key := data[i+1 : keyEnd-1]
+		i = skipSpace(data, keyEnd)
+		i = skipSpace(data, i+1) // ':'
+		valEnd := skipValue(data, i)
+		if bytes.EqualFold(key, []byte("payload")) {
+			switch data[i] {
+			case '"':
+				payload = data[i:valEnd]
+				if !utf8.Valid(payload) {
+					return nil, errors.New("payload is not valid UTF-8")
+				}
+			case 'n':
+				payload = nil
+			default:
+				return nil, errors.New("payload is not a string")
+			}
+		}
+		i = skipSpace(data, valEnd)
+		if data[i] == ',' {
+			i = skipSpace(data, i+1)
+		}
+	}
+	return payload, nil
+}
+
+// payloadLen returns the length of the string the quoted payload decodes
+// to, which is what the size limit applies to. Lone surrogates count as the
+// U+FFFD they decode to.
+func payloadLen(quoted []byte) int {
+	n := 0
+	for i := 1; i < len(quoted)-1; i++ {
+		if quoted[i] != '\\' {
+			n++
+			continue
+		}
+		i++
+		if quoted[i] != 'u' {
+			n++
+			continue
+		}
+		r := hexRune(quoted[i+1 : i+5])
+		i += 4
+		if utf16.IsSurrogate(r) {
+			if i+6 < len(quoted) && quoted[i+1] == '\\' && quoted[i+2] == 'u' {
+				if pair := utf16.DecodeRune(r, hexRune(quoted[i+3:i+7])); pair != utf8.RuneError {
+					n += utf8.RuneLen(pair)
+					i += 6
+					continue
+				}
+			}
+			r = utf8.RuneError
+		}
+		n += utf8.RuneLen(r)
+	}
+	return n
+}
+
+// hexRune decodes the four hex digits of a \u escape.
+func hexRune(h []byte) rune {
+	var r rune
+	for _, c := range h {
+		switch {
+		case c <= '9':
+			r = r<<4 | rune(c-'0')
+		case c >= 'a':
+			r = r<<4 | rune(c-'a'+10)
+		default:
+			r = r<<4 | rune(c-'A'+10)
+		}
+	}
+	return r
+}
+
+// The skip helpers walk JSON that json.Valid has already accepted, so they
+// only need to find where each token ends.
+
+func skipSpace(data []byte, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\n' || data[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// skipString returns the index just past the string starting at data[i].
+func skipString(data []byte, i int) int {
+	for i++; data[i] != '"'; i++ {
+		if data[i] == '\\' {
+			i++
+		}
+	}
+	return i + 1
+}
+
+// skipValue returns the index just past the value starting at data[i].
+func skipValue(data []byte, i int) int {
+	switch data[i] {
+	case '"':
+		return skipString(data, i)
+	case '{', '[':
+		depth := 0
+		for {
+			switch data[i] {
+			case '"':
+				i = skipString(data, i)
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+			i++
+		}
+	default:
+		for ; i < len(data); i++ {
+			switch data[i] {
+			case ',', '}', ']', ' ', '\t', '\n', '\r':
+				return i
+			}
+		}
+		return i
+	}
+}
+
+// relayedMsg is an outbound MSG. payload is already a JSON string.
+type relayedMsg struct {
+	sid     string
+	seq     uint64
+	ts      int64
+	payload []byte
+}
+
+// appendMsgFrame encodes m, as seen by a recipient shown sender ID sh, in
+// the same shape WriteJSON would give Frame.
+func appendMsgFrame(buf *bytes.Buffer, m relayedMsg, sh string) {
+	buf.WriteString(`{"t":"MSG","sid":`)
+	appendJSONString(buf, m.sid)
+	if sh != "" {
+		buf.WriteString(`,"sh":`)
+		appendJSONString(buf, sh)
+	}
+	if m.seq != 0 {
+		buf.WriteString(`,"seq":`)
+		buf.Write(strconv.AppendUint(buf.AvailableBuffer(), m.seq, 10))
+		buf.WriteString(`,"ts":`)
+		buf.Write(strconv.AppendInt(buf.AvailableBuffer(), m.ts, 10))
+	}
+	buf.WriteString(`,"data":{"payload":`)
+	buf.Write(m.payload)
+	buf.WriteString(`}}`)
+}
+
+func appendJSONString(buf *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+	buf.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < 0x20:
+			buf.WriteString(`\u00`)
+			buf.WriteByte(hex[c>>4])
+			buf.WriteByte(hex[c&0xf])
+		case c < utf8.RuneSelf:
+			buf.WriteByte(c)
+		default:
+			r, size := utf8.DecodeRuneInString(s[i:])
+			buf.WriteRune(r) // invalid bytes become U+FFFD, as in encoding/json
+			i += size
+			continue
+		}
+		i++
+	}
+	buf.WriteByte('"')
+}
+
+// relay queues m for every target, labelled with the sender ID shFor gives
+// each one, and returns the pending writes. It does not block, so callers
+// relay under sess.mu, which keeps MSGs in seq order, and wait after.
+// Each distinct label is encoded once; when several targets share it they
+// get the same websocket.PreparedMessage, so the frame is also framed once.
+func (s *Server) relay(targets []*Client, m relayedMsg, shFor func(*Client) string) delivery {
+	buf := frameBufs.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledFrame {
+			frameBufs.Put(buf)
+		}
+	}()
+
+	labels := make([]string, len(targets))
+	for i, c := range targets {
+		labels[i] = shFor(c)
+	}
+	sent := make([]bool, len(targets))
+	d := make(delivery, 0, len(targets))
+	for i, c := range targets {
+		if sent[i] {
+			continue
+		}
+		buf.Reset()
+		appendMsgFrame(buf, m, labels[i])
+		frame := bytes.Clone(buf.Bytes())
+
+		shared := 0
+		for j := i + 1; j < len(targets); j++ {
+			if labels[j] == labels[i] {
+				shared++
+			}
+		}
+		if shared == 0 {
+			sent[i] = true
+			d = append(d, queued{c, s.queue(c, frame, nil)})
+			continue
+		}
+		pm, err := websocket.NewPreparedMessage(websocket.TextMessage, frame)
+		if err != nil {
+			continue
+		}
+		for j := i; j < len(targets); j++ {
+			if sent[j] || labels[j] != labels[i] {
+				continue
+			}
+			sent[j] = true
+			d = append(d, queued{targets[j], s.queue(targets[j], frame, pm)})
+		}
+	}
+	return d
+}
+
+// delivery is a frame queued for several clients.
+type delivery []queued
+
+type queued struct {
+	c    *Client
+	done <-chan error
+}
+
+// wait blocks until every write is done. delivered reports whether any
+// succeeded, and buffered whether the frame was held for a parked target
+// that may still resume.
+func (d delivery) wait() (delivered, buffered bool) {
+	for _, q := range d {
+		switch err := <-q.done; {
+		case err == nil:
+			delivered = true
+		case errors.Is(err, errBuffered):
+			buffered = true
+		default:
+			log.Printf("[Error] Failed to send to %s: %v", q.c.id, err)
+		}
+	}
+	return delivered, buffered
+}
+
+// ack answers a MSG or SEALED_MSG sent with c: true. A message that only
+// reached parked recipients is not delivered yet, so it gets
+// DELIVERED_FAILED with buffered set: it arrives if they resume in time.
+func (s *Server) ack(client *Client, frame Frame, m relayedMsg, delivered, buffered bool) {
+	ack := Frame{T: "DELIVERED", SID: frame.SID, ID: frame.ID, Seq: m.seq, TS: m.ts}
+	if !delivered {
+		ack.T = "DELIVERED_FAILED"
+		if buffered {
+			ack.Data = json.RawMessage(`{"buffered":true}`)
+		}
+	}
+	s.send(client, ack)
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMsgPayload(t *testing.T) {
+	cases := []struct {
+		data    string
+		payload string
+		err     bool
+	}{
+		{data: `{"payload":"abc"}`, payload: `"abc"`},
+		{data: ` { "id" : 1 , "payload" : "a\"b\\" } `, payload: `"a\"b\\"`},
+		{data: `{"meta":{"x":["}",{"payload":1}]},"payload":"ok","n":-1.5e3}`, payload: `"ok"`},
+		{data: `{"Payload":"folded"}`, payload: `"folded"`},
+		{data: `{"payload":"first","payload":"last"}`, payload: `"last"`},
+		{data: `{"other":true}`},
+		{data: `{"payload":null}`},
+		{data: `{}`},
+		{data: `{"payload":42}`, err: true},
+		{data: `{"payload":{"a":"b"}}`, err: true},
+		{data: `["payload","abc"]`, err: true},
+		{data: `"payload"`, err: true},
+		{data: `{"payload":"abc"`, err: true},
+		{data: "{\"payload\":\"ab\xff\xfe\"}", err: true},
+		{data: ``, err: true},
+	}
+	for _, c := range cases {
+		got, err := msgPayload([]byte(c.data))
+		if (err != nil) != c.err {
+			t.Errorf("msgPayload(%s) error = %v, want error %v", c.data, err, c.err)
+			continue
+		}
+		if string(got) != c.payload {
+			t.Errorf("msgPayload(%s) = %s, want %s", c.data, got, c.payload)
+		}
+	}
+}
+
+func TestPayloadLenMatchesDecoding(t *testing.T) {
+	for _, quoted := range []string{
+		`""`, `"abc"`, `"a\"b\\c\n"`, `"\u00e9\u4e16"`, `"ünï😀"`,
+		`"\ud83d\ude00"`, `"\ud83d"`, `"\ud83dx"`, `"\ude00\ud83d"`, `"\ud83d\u0041"`, `"\uD83D\uDE00"`,
+	} {
+		var decoded string
+		if err := json.Unmarshal([]byte(quoted), &decoded); err != nil {
+			t.Fatalf("%s: %v", quoted, err)
+		}
+		if got := payloadLen([]byte(quoted)); got != len(decoded) {
+			t.Errorf("payloadLen(%s) = %d, want %d", quoted, got, len(decoded))
+		}
+	}
+}
+
+func TestMsgPayloadDoesNotCopy(t *testing.T) {
+	data := []byte(`{"payload":"abc"}`)
+	got, _ := msgPayload(data)
+	if &got[0] != &data[len(`{"payload":`)] {
+		t.Fatal("payload was copied out of the frame data")
+	}
+}
+
+func TestAppendMsgFrameDecodesLikeFrame(t *testing.T) {
+	for _, sid := range []string{"sid-1", `q"uo\te`, "ctl\n\x01", "ünï😀", "bad\xffutf8"} {
+		var buf bytes.Buffer
+		appendMsgFrame(&buf, relayedMsg{sid: sid, seq: 7, ts: 1700000000123, payload: []byte(`"pAy"`)}, "sender")
+
+		var got Frame
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatalf("sid %q: %v in %s", sid, err, buf.Bytes())
+		}
+		wantJSON, _ := json.Marshal(Frame{T: "MSG", SID: sid, SH: "sender", Seq: 7, TS: 1700000000123, Data: json.RawMessage(`{"payload":"pAy"}`)})
+		var want Frame
+		json.Unmarshal(wantJSON, &want)
+
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("sid %q: got %+v, want %+v", sid, got, want)
+		}
+	}
+}
+
+func TestMsgFanoutLabelsEachRecipient(t *testing.T) {
+	s := newTestServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	sender, err := connectClient(wsUrl, "sender@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	sender.WriteJSON(Frame{T: "REATTACH", SID: "group"})
+
+	emails := []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"}
+	members := make([]*websocket.Conn, len(emails))
+	for i, email := range emails {
+		connect := connectClient
+		if i%2 == 1 {
+			connect = connectPairwiseClient
+		}
+		if members[i], err = connect(wsUrl, email); err != nil {
+			t.Fatal(err)
+		}
+		defer members[i].Close()
+		members[i].WriteJSON(Frame{T: "REATTACH", SID: "group"})
+		if err := expectNext(sender, "PEER_ONLINE"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sender.WriteJSON(Frame{T: "MSG", SID: "group", Data: json.RawMessage(`{"payload":"c2VjcmV0"}`)})
+	for i, m := range members {
+		want := emailHash("sender@example.com")
+		if i%2 == 1 {
+			want = s.pseudonyms.Pairwise("sender@example.com", emails[i])
+		}
+		var msg *Frame
+		for msg == nil || msg.T != "MSG" {
+			if msg, err = readMSG(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if msg.SH != want {
+			t.Errorf("%s got SH %q, want %q", emails[i], msg.SH, want)
+		}
+		if string(msg.Data) != `{"payload":"c2VjcmV0"}` {
+			t.Errorf("%s got data %s", emails[i], msg.Data)
+		}
+	}
+}
+
+func TestSealedMsgFanoutIsAnonymous(t *testing.T) {
+	s := newTestServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	members := make([]*websocket.Conn, 3)
+	for i := range members {
+		c, err := connectClient(wsUrl, fmt.Sprintf("sealed_%d@example.com", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.WriteJSON(Frame{T: "REATTACH", SID: "sealed-group"})
+		members[i] = c
+	}
+	for range members[1:] {
+		if err := expectNext(members[0], "PEER_ONLINE"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tokens := issueTokens(t, s.deliveryTokens, "sealed-group", 1)
+
+	anon, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anon.Close()
+	anon.WriteJSON(Frame{T: "SEALED_MSG", SID: "sealed-group", Data: json.RawMessage(fmt.Sprintf(`{"payload":"c2VhbGVk","token":"%s"}`, tokens[0]))})
+	for i, m := range members {
+		var msg *Frame
+		for msg == nil || msg.T != "MSG" {
+			if msg, err = readMSG(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if msg.SH != "" || string(msg.Data) != `{"payload":"c2VhbGVk"}` {
+			t.Errorf("member %d got %+v", i, msg)
+		}
+	}
+}
+
+func TestStalledRecipientDoesNotHoldUpSession(t *testing.T) {
+	s := newTestServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	conns := make([]*websocket.Conn, 3)
+	for i, email := range []string{"alice@example.com", "bob@example.com", "carol@example.com"} {
+		c, err := connectClient(wsUrl, email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.WriteJSON(Frame{T: "REATTACH", SID: "stall"})
+		for _, peer := range conns[:i] {
+			if err := expectNext(peer, "PEER_ONLINE"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		conns[i] = c
+	}
+	alice, bob := conns[0], conns[1]
+
+	// Holding carol's write lock stands in for a write that never returns.
+	carol := s.state.account("carol@example.com")
+	carol.mu.Lock()
+	defer carol.mu.Unlock()
+
+	for _, p := range []string{"one", "two"} {
+		alice.WriteJSON(Frame{T: "MSG", SID: "stall", Data: json.RawMessage(`{"payload":"` + p + `"}`)})
+	}
+	bob.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []string{"one", "two"} {
+		var msg *Frame
+		for msg == nil || msg.T != "MSG" {
+			var err error
+			if msg, err = readMSG(bob); err != nil {
+				t.Fatalf("bob waiting for %q: %v", want, err)
+			}
+		}
+		if string(msg.Data) != `{"payload":"`+want+`"}` {
+			t.Fatalf("bob got %s, want %q", msg.Data, want)
+		}
+	}
+}
+
+func TestEmptyMsgIsInvalidFrame(t *testing.T) {
+	ts := setupTestServer()
+	defer ts.Close()
+	alice, bob, sid, err := connectPair("ws"+strings.TrimPrefix(ts.URL, "http"), "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	defer bob.Close()
+
+	for _, data := range []string{`{"payload":""}`, `{"payload":null}`, `{}`} {
+		alice.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(data)})
+		if f := expectFrame(t, alice, "ERROR"); !strings.Contains(string(f.Data), string(ErrInvalidFrame)) {
+			t.Fatalf("MSG %s answered with %s", data, f.Data)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// googleClientIDs are the OAuth clients of the shipped apps.
+var googleClientIDs = []string{
+	"588653192623-aqs0s01hv62pbp5p7pe3r0h7mce8m10l.apps.googleusercontent.com", // Web/Electron
+	"588653192623-d7tehqbc6ghd7uim7kd90fdner7hmhf5.apps.googleusercontent.com", // Old Android
+	"588653192623-3lkl6bqaa77lk1g3l89uideuqf083g1o.apps.googleusercontent.com", // New Android (CryptNode)
+}
+
+// GoogleVerifier checks ID tokens against Google's tokeninfo endpoint and
+// accepts the shipped apps' client IDs. It is the default AuthVerifier.
+var GoogleVerifier = NewGoogleVerifier()
+
+// NewGoogleVerifier is GoogleVerifier that also accepts tokens issued to
+// clientIDs, such as the device-flow client of the terminal client.
+func NewGoogleVerifier(clientIDs ...string) AuthVerifier {
+	valid := make(map[string]bool)
+	for _, id := range append(googleClientIDs, clientIDs...) {
+		valid[id] = true
+	}
+	return AuthVerifierFunc(func(token string) (string, error) {
+		return verifyGoogleToken(token, valid)
+	})
+}
+
+func verifyGoogleToken(token string, validClients map[string]bool) (string, error) {
+	resp, err := http.Get("https://oauth2.googleapis.com/tokeninfo?id_token=" + token)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("invalid token")
+	}
+
+	var claims struct {
+		Email string `json:"email"`
+		Aud   string `json:"aud"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return "", err
+	}
+
+	if !validClients[claims.Aud] {
+		return "", fmt.Errorf("invalid token audience: %s", claims.Aud)
+	}
+
+	return claims.Email, nil
+}
@@ -0,0 +1,591 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+func (s *Server) handleAuth(client *Client, frame Frame) error {
+	var d struct {
+		Token       string `json:"token"`
+		PairwiseIDs bool   `json:"pairwiseIds"`
+		RelayOnly   bool   `json:"relayOnly"`
+		LegacyPing  bool   `json:"legacyPing"`
+		Resumable   bool   `json:"resumable"`
+	}
+	json.Unmarshal(frame.Data, &d)
+	d.Token = strings.TrimSpace(d.Token)
+
+	if !strings.HasPrefix(d.Token, "sess:") {
+		if ok, retryAfter := s.limiter.Allow("AUTH", LimitKeys{IP: client.ip}); !ok {
+			return closeAfter(NewError(ErrRateLimited, "Too many login attempts. Try again later.").WithRetryAfter(retryAfter))
+		}
+	}
+
+	email, sessionToken, err := s.verifyAuthToken(d.Token)
+	if err != nil {
+		log.Printf("[Server] Auth failed for %s from %s: %v", client.id, client.ip, err)
+		return NewError(ErrAuthFailed, "Auth failed")
+	}
+	if r, restricted := s.moderation.Restricted(email); restricted {
+		s.metrics.Inc("relay_auth_restricted_total", "action", r.Action)
+		return closeAfter(s.restrictionError(r))
+	}
+	if !s.state.claimAccount(email, client) {
+		// A parked connection only holds the account until it resumes, and
+		// a fresh AUTH means it will not.
+		holder := s.state.account(email)
+		if holder == nil || !s.expire(holder, 0) || !s.state.claimAccount(email, client) {
+			return closeAfter(NewError(ErrAlreadyLoggedIn, "Already logged in on another device"))
+		}
+	}
+	// Only the connection holding the account gets its email, so teardown
+	// of a rejected second device leaves the account's calls alone.
+	client.mu.Lock()
+	client.email = email
+	client.mu.Unlock()
+	client.pairwise.Store(d.PairwiseIDs)
+	client.relayOnly.Store(d.RelayOnly)
+	client.legacyPing.Store(d.LegacyPing)
+
+	resp := map[string]string{
+		"email":       email,
+		"token":       sessionToken,
+		"ktAccountId": s.keyLog.AccountID(email),
+	}
+	if d.Resumable && s.resumeWindow > 0 {
+		st := newStream(s.resumeFrames)
+		s.state.addResume(st.token, client)
+		resp["resumeToken"] = st.token
+		client.mu.Lock()
+		client.stream = st
+		client.mu.Unlock()
+	}
+	respBytes, _ := json.Marshal(resp)
+	s.send(client, Frame{T: "AUTH_SUCCESS", Data: json.RawMessage(respBytes)})
+
+	queued := s.offline.Drain(email)
+	for _, f := range queued {
+		s.send(client, f)
+	}
+	s.releaseQueued(queued)
+	s.dispatchCall(s.calls.Ringing(normalizeEmail(email)))
+	s.notifyPreKeysLow(client)
+	return nil
+}
+
+func (s *Server) handleConnectReq(client *Client, frame Frame) error {
+	var d struct {
+		TargetEmail     string `json:"targetEmail"`
+		PublicKey       string `json:"publicKey"`
+		SenderEmail     string `json:"senderEmail"`
+		SenderEmailHash string `json:"senderEmailHash"`
+		SenderName      string `json:"senderName"`
+		SenderAvatar    string `json:"senderAvatar"`
+		SenderNameVer   int    `json:"senderNameVer"`
+		SenderAvatarVer int    `json:"senderAvatarVer"`
+		EphemeralKey    string `json:"ephemeralKey"`
+		SignedPreKeyID  *int   `json:"signedPreKeyId"`
+		OneTimePreKeyID *int   `json:"oneTimePreKeyId"`
+	}
+	json.Unmarshal(frame.Data, &d)
+	d.TargetEmail = normalizeEmail(d.TargetEmail)
+
+	s.logConnection(client.email, d.TargetEmail)
+
+	targetClient := s.state.account(d.TargetEmail)
+	if targetClient == nil && (d.EphemeralKey == "" || !s.preKeys.Has(d.TargetEmail)) {
+		return NewError(ErrUserOffline, "User not online")
+	}
+
+	sid := s.newID()
+	if err := s.admitSession(client, sid); err != nil {
+		return err
+	}
+	var queued int64
+	if targetClient == nil {
+		queued = int64(len(frame.Data))
+	}
+	if pe := s.quotas.addPending(client.email, sid, queued, s.preKeys.Size(client.email)); pe != nil {
+		return pe
+	}
+
+	sess := newSession(sid, client)
+	sess.owner = client.email
+	sess.invited = d.TargetEmail
+	sess.connectID = frame.ID
+	s.state.addSession(sess)
+
+	joinReq := map[string]any{
+		"publicKey":     d.PublicKey,
+		"name":          d.SenderName,
+		"avatar":        d.SenderAvatar,
+		"nameVersion":   d.SenderNameVer,
+		"avatarVersion": d.SenderAvatarVer,
+	}
+	if targetClient != nil {
+		s.identityFields(joinReq, client.email, d.TargetEmail, targetClient.wantsPairwise())
+	} else {
+		s.identityFields(joinReq, client.email, d.TargetEmail, false)
+	}
+	if d.PublicKey != "" {
+		joinReq["keyLogIndex"] = s.keyLog.Record(client.email, d.PublicKey)
+	}
+	if d.EphemeralKey != "" {
+		joinReq["ephemeralKey"] = d.EphemeralKey
+		joinReq["signedPreKeyId"] = d.SignedPreKeyID
+		joinReq["oneTimePreKeyId"] = d.OneTimePreKeyID
+	}
+	joinReqData, _ := json.Marshal(joinReq)
+	joinFrame := Frame{
+		T:    "JOIN_REQUEST",
+		SID:  sid,
+		Data: json.RawMessage(joinReqData),
+	}
+
+	if targetClient != nil {
+		s.send(targetClient, joinFrame)
+	} else if s.offline.Push(d.TargetEmail, joinFrame) {
+		s.send(client, Frame{T: "CONNECT_QUEUED", SID: sid, ID: frame.ID})
+	} else {
+		s.quotas.answered(client.email, sid)
+		s.sendError(client, frame, NewError(ErrQueueFull, "Recipient queue full"))
+	}
+	return nil
+}
+
+func (s *Server) handleJoinAccept(client *Client, frame Frame) error {
+	if sess := s.state.session(frame.SID); sess != nil {
+		if err := s.admitSession(client, frame.SID); err != nil {
+			return err
+		}
+		sess.mu.Lock()
+		if !sess.admits(client.email) {
+			sess.mu.Unlock()
+			return NewError(ErrNotMember, "Not a member of this session")
+		}
+		sess.add(client)
+		var req struct {
+			PublicKey       string `json:"publicKey"`
+			SenderEmail     string `json:"senderEmail"`
+			SenderEmailHash string `json:"senderEmailHash"`
+			SenderName      string `json:"senderName"`
+			SenderAvatar    string `json:"senderAvatar"`
+			SenderNameVer   int    `json:"senderNameVer"`
+			SenderAvatarVer int    `json:"senderAvatarVer"`
+		}
+		_ = json.Unmarshal(frame.Data, &req)
+		accept := map[string]any{
+			"publicKey":     req.PublicKey,
+			"name":          req.SenderName,
+			"avatar":        req.SenderAvatar,
+			"nameVersion":   req.SenderNameVer,
+			"avatarVersion": req.SenderAvatarVer,
+		}
+		if req.PublicKey != "" {
+			accept["keyLogIndex"] = s.keyLog.Record(client.email, req.PublicKey)
+		}
+		acceptFor := func(viewer string, pairwise bool) Frame {
+			s.identityFields(accept, client.email, viewer, pairwise)
+			joinData, _ := json.Marshal(accept)
+			delete(accept, "email")
+			delete(accept, "emailHash")
+			return Frame{
+				T:    "JOIN_ACCEPT",
+				SID:  frame.SID,
+				ID:   sess.answerID(viewer),
+				Data: json.RawMessage(joinData),
+			}
+		}
+		peers := sess.others(client.id)
+		frames := make([]Frame, len(peers))
+		for i, c := range peers {
+			frames[i] = acceptFor(c.email, c.wantsPairwise())
+		}
+		var queued *Frame
+		if len(peers) == 0 && sess.owner != "" && sess.owner != client.email {
+			f := acceptFor(sess.owner, false)
+			queued = &f
+		}
+		owner := sess.owner
+		sess.mu.Unlock()
+
+		if owner != "" && owner != client.email {
+			s.quotas.answered(owner, frame.SID)
+		}
+		for i, c := range peers {
+			s.send(c, frames[i])
+		}
+		if queued != nil {
+			s.offline.Push(owner, *queued)
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleJoinDeny(client *Client, frame Frame) error {
+	if sess := s.state.session(frame.SID); sess != nil {
+		sess.mu.Lock()
+		if !sess.admits(client.email) {
+			sess.mu.Unlock()
+			return NewError(ErrNotMember, "Not a member of this session")
+		}
+		peers := sess.others(client.id)
+		ids := make([]string, len(peers))
+		for i, c := range peers {
+			ids[i] = sess.answerID(c.email)
+		}
+		owner := sess.owner
+		sess.mu.Unlock()
+
+		if owner != "" && owner != client.email {
+			s.quotas.answered(owner, frame.SID)
+		}
+		for i, c := range peers {
+			s.send(c, Frame{T: "JOIN_DENIED", SID: frame.SID, ID: ids[i]})
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleReattach(client *Client, frame Frame) error {
+	if err := s.admitSession(client, frame.SID); err != nil {
+		return err
+	}
+	sess, _ := s.state.sessionOrCreate(frame.SID, client)
+
+	sess.mu.Lock()
+	if !sess.admits(client.email) {
+		sess.mu.Unlock()
+		return NewError(ErrNotMember, "Not a member of this session")
+	}
+	sess.add(client)
+	peers := sess.others(client.id)
+	online := Frame{T: "PEER_ONLINE", SID: frame.SID}
+	s.number(sess, &online)
+	present := make([]Frame, len(peers))
+	for i := range peers {
+		present[i] = Frame{T: "PEER_ONLINE", SID: frame.SID}
+		s.number(sess, &present[i])
+	}
+	for i, c := range peers {
+		online.SH = s.peerID(client.email, c.email, c.wantsPairwise())
+		s.post(c, online)
+		present[i].SH = s.peerID(c.email, client.email, client.wantsPairwise())
+		s.post(client, present[i])
+	}
+	sess.mu.Unlock()
+
+	log.Printf(
+		"[Server] Client %s reattached to session %s",
+		client.id,
+		frame.SID,
+	)
+	return nil
+}
+
+func (s *Server) handleMsg(client *Client, frame Frame) error {
+	payload, err := msgPayload(frame.Data)
+	if err != nil {
+		return NewError(ErrInvalidFrame, "Invalid message format")
+	}
+	if n := payloadLen(payload); n == 0 {
+		return NewError(ErrInvalidFrame, "Empty message payload")
+	} else if n > maxEncryptedDataBytes {
+		return NewError(ErrPayloadTooLarge, "Message payload too large")
+	}
+	if err := s.admitSession(client, frame.SID); err != nil {
+		return err
+	}
+	sess, created := s.state.sessionOrCreate(frame.SID, client)
+	if created {
+		log.Printf("[Server] Auto-created session %s from MSG", frame.SID)
+	}
+
+	sess.mu.Lock()
+	targets, err := s.recipients(sess, client, frame.To)
+	if err == nil {
+		err = s.chargeRelay(client, payload, len(targets))
+	}
+	if err != nil {
+		sess.mu.Unlock()
+		return err
+	}
+	m := s.numberMsg(sess, frame.SID, payload)
+	pending := s.relay(targets, m, s.peerIDs(client.email))
+	e := historyEntry{seq: m.seq, ts: m.ts, from: normalizeEmail(client.email), payload: payload}
+	if frame.To != "" {
+		for _, c := range targets {
+			e.to = append(e.to, normalizeEmail(c.email))
+		}
+	}
+	s.keepMsg(sess, e)
+	sess.mu.Unlock()
+
+	log.Printf("[Server] Relayed MSG in %s to %d recipients", frame.SID, len(targets))
+	// Only an ack needs the writes to finish; otherwise a slow recipient
+	// would hold up the sender's next frame.
+	if frame.C {
+		delivered, buffered := pending.wait()
+		s.ack(client, frame, m, delivered, buffered)
+	}
+	return nil
+}
+
+// handleGetDeliveryTokens hands out the signing key when called without
+// blinded nonces, and blind-signs them under the key they name otherwise.
+func (s *Server) handleGetDeliveryTokens(client *Client, frame Frame) error {
+	var d struct {
+		KeyID   string   `json:"keyId"`
+		Blinded []string `json:"blinded"`
+	}
+	if len(frame.Data) > 0 {
+		if err := json.Unmarshal(frame.Data, &d); err != nil {
+			return NewError(ErrInvalidFrame, "Invalid delivery token request")
+		}
+	}
+	if len(d.Blinded) > deliveryTokensPerIssue {
+		return NewError(ErrInvalidFrame, fmt.Sprintf("At most %d blinded tokens per request", deliveryTokensPerIssue))
+	}
+	resp := map[string]any{"rate": maxSealedMsgsPerToken}
+	if len(d.Blinded) == 0 {
+		key, err := s.deliveryTokens.Key()
+		if err != nil {
+			return NewError(ErrInternal, "Delivery tokens unavailable")
+		}
+		resp["key"] = key
+	} else {
+		sigs, err := s.deliveryTokens.Sign(d.KeyID, d.Blinded)
+		if errors.Is(err, errUnknownDeliveryKey) {
+			return NewError(ErrInvalidToken, "Delivery key expired or revoked")
+		}
+		if err != nil {
+			return NewError(ErrInvalidFrame, "Invalid blinded token")
+		}
+		resp["keyId"] = d.KeyID
+		resp["signatures"] = sigs
+	}
+	respBytes, _ := json.Marshal(resp)
+	s.send(client, Frame{T: "DELIVERY_TOKENS", SID: frame.SID, Data: json.RawMessage(respBytes)})
+	return nil
+}
+
+func (s *Server) handleSealedMsg(client *Client, frame Frame) error {
+	var sealed struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(frame.Data, &sealed); err != nil {
+		return NewError(ErrInvalidFrame, "Invalid message format")
+	}
+	payload, err := msgPayload(frame.Data)
+	if err != nil {
+		return NewError(ErrInvalidFrame, "Invalid message format")
+	}
+	tokenID, err := s.deliveryTokens.Verify(frame.SID, sealed.Token)
+	if err != nil {
+		return NewError(ErrInvalidToken, "Invalid delivery token")
+	}
+	if ok, retryAfter := s.limiter.Allow("SEALED_MSG", LimitKeys{Token: tokenID, Session: frame.SID}); !ok {
+		return rateLimitError(frame.T, retryAfter)
+	}
+	if n := payloadLen(payload); n == 0 {
+		return NewError(ErrInvalidFrame, "Empty message payload")
+	} else if n > maxEncryptedDataBytes {
+		return NewError(ErrPayloadTooLarge, "Message payload too large")
+	}
+
+	var (
+		pending delivery
+		m       relayedMsg
+	)
+	if sess := s.state.session(frame.SID); sess != nil {
+		sess.mu.Lock()
+		// The relay does not know the sender, so only the sending
+		// connection is skipped: the sender's own attached connection gets
+		// the message back and drops it by the ID inside the payload.
+		targets := sess.others(client.id)
+		if pe := s.quotas.chargeRelay(sealedQuotaKey(frame.SID), int64(len(payload))*int64(len(targets))); pe != nil {
+			sess.mu.Unlock()
+			return pe
+		}
+		m = s.numberMsg(sess, frame.SID, payload)
+		pending = s.relay(targets, m, func(*Client) string { return "" })
+		s.keepMsg(sess, historyEntry{seq: m.seq, ts: m.ts, payload: payload})
+		sess.mu.Unlock()
+	}
+
+	if frame.C {
+		delivered, buffered := pending.wait()
+		s.ack(client, frame, m, delivered, buffered)
+	}
+	return nil
+}
+
+func (s *Server) handleResolvePseudonym(client *Client, frame Frame) error {
+	var d struct {
+		Pseudonym string `json:"pseudonym"`
+	}
+	json.Unmarshal(frame.Data, &d)
+
+	sess := s.state.session(frame.SID)
+
+	var match *Client
+	if sess != nil {
+		sess.mu.Lock()
+		for _, c := range sess.clients {
+			if c.id != client.id && s.pseudonyms.Pairwise(c.email, client.email) == d.Pseudonym {
+				match = c
+			}
+		}
+		sess.mu.Unlock()
+	}
+	if match == nil {
+		return NewError(ErrUnknownPseudonym, "Unknown pseudonym")
+	}
+	respBytes, _ := json.Marshal(map[string]string{
+		"pseudonym": d.Pseudonym,
+		"email":     normalizeEmail(match.email),
+	})
+	s.send(client, Frame{T: "PSEUDONYM_RESOLVED", SID: frame.SID, Data: json.RawMessage(respBytes)})
+	return nil
+}
+
+func (s *Server) handleRTC(client *Client, frame Frame) error {
+	sess := s.state.session(frame.SID)
+
+	if sess == nil {
+		return nil
+	}
+
+	sess.mu.Lock()
+	targets, err := s.recipients(sess, client, frame.To)
+	if err != nil {
+		sess.mu.Unlock()
+		return err
+	}
+	relayFrame := Frame{T: frame.T, SID: frame.SID}
+	s.number(sess, &relayFrame)
+	var (
+		stripped json.RawMessage
+		forward  bool
+		checked  bool
+	)
+	for _, c := range targets {
+		relayFrame.Data = frame.Data
+		if s.requireRelay(client, c) {
+			if !checked {
+				stripped, forward = s.stripNonRelay(frame.T, frame.Data)
+				checked = true
+			}
+			if !forward {
+				continue
+			}
+			relayFrame.Data = stripped
+		}
+		relayFrame.SH = s.peerID(client.email, c.email, c.wantsPairwise())
+		s.post(c, relayFrame)
+	}
+	sess.mu.Unlock()
+	return nil
+}
+
+func (s *Server) handlePreKeyUpload(client *Client, frame Frame) error {
+	var d struct {
+		IdentityKey    string          `json:"identityKey"`
+		SignedPreKey   SignedPreKey    `json:"signedPreKey"`
+		OneTimePreKeys []OneTimePreKey `json:"oneTimePreKeys"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || len(d.OneTimePreKeys) > maxOneTimePreKeys {
+		return NewError(ErrInvalidFrame, "Invalid prekey upload")
+	}
+	if pe := s.quotas.checkStored(client.email, s.preKeys.Size(client.email), int64(len(frame.Data))); pe != nil {
+		return pe
+	}
+	count, err := s.preKeys.Upload(client.email, d.IdentityKey, d.SignedPreKey, d.OneTimePreKeys)
+	if err != nil {
+		log.Printf("[Server] Rejected prekey upload from %s: %v", client.id, err)
+		return NewError(ErrInvalidFrame, "Invalid prekey upload")
+	}
+	respBytes, _ := json.Marshal(map[string]int{"remaining": count})
+	s.send(client, Frame{T: "PREKEY_UPLOADED", Data: json.RawMessage(respBytes)})
+	s.notifyPreKeysLow(client)
+	return nil
+}
+
+func (s *Server) handlePreKeyFetch(client *Client, frame Frame) error {
+	var d struct {
+		TargetEmail string `json:"targetEmail"`
+	}
+	json.Unmarshal(frame.Data, &d)
+	target := normalizeEmail(d.TargetEmail)
+
+	bundle, ok := s.preKeys.Fetch(target)
+	if !ok {
+		return NewError(ErrNoPreKeys, "No prekeys published")
+	}
+	bundle.EmailHash = s.peerID(target, client.email, client.wantsPairwise())
+	bundleBytes, _ := json.Marshal(bundle)
+	s.send(client, Frame{T: "PREKEY_BUNDLE", Data: json.RawMessage(bundleBytes)})
+
+	if bundle.Remaining < preKeyLowWatermark {
+		s.notifyPreKeysLow(s.state.account(target))
+	}
+	return nil
+}
+
+func (s *Server) handleGetTurnCreds(client *Client, frame Frame) error {
+	var hints struct {
+		Region     string   `json:"region"`
+		Transports []string `json:"transports"`
+	}
+	if len(frame.Data) > 0 {
+		json.Unmarshal(frame.Data, &hints)
+	}
+	relayOnly := s.requireRelay(client)
+	if frame.SID != "" {
+		sess := s.state.session(frame.SID)
+
+		member := false
+		if sess != nil {
+			sess.mu.Lock()
+			_, member = sess.clients[client.id]
+			for _, c := range sess.clients {
+				relayOnly = relayOnly || s.requireRelay(c)
+			}
+			sess.mu.Unlock()
+		}
+		if !member {
+			return NewError(ErrNotMember, "Not a member of this session")
+		}
+	}
+	if hints.Region == "" {
+		_, hints.Region = client.addr()
+	}
+
+	creds, ttl := s.turnPool.Issue(client.email, frame.SID, hints.Region, hints.Transports)
+	if len(creds) == 0 {
+		return NewError(ErrTurnUnavailable, "No TURN servers available")
+	}
+	// The top-level fields mirror the first entry for clients that
+	// predate iceServers.
+	resp := map[string]any{
+		"urls":       creds[0].URLs,
+		"username":   creds[0].Username,
+		"credential": creds[0].Credential,
+		"ttl":        int(ttl.Seconds()),
+		"iceServers": creds,
+	}
+	if relayOnly {
+		resp["iceTransportPolicy"] = "relay"
+	}
+
+	respBytes, _ := json.Marshal(resp)
+	s.send(client, Frame{
+		T:    "TURN_CREDS",
+		Data: json.RawMessage(respBytes),
+	})
+	return nil
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultHeartbeatInterval = 10 * time.Second
+	defaultHeartbeatMissed   = 3
+	heartbeatWriteTimeout    = 2 * time.Second
+)
+
+// heartbeat pings c's connection ws with a WebSocket ping control frame
+// every interval until done is closed, plus a legacy PING frame for clients
+// that asked for one at AUTH. It never waits for the pong itself: readTimeout bounds
+// how long the read loop waits for a pong or any frame, so a half-open
+// connection is evicted once it misses s.heartbeatMissed pings.
+func (s *Server) heartbeat(c *Client, ws *websocket.Conn, done <-chan struct{}) {
+	t := time.NewTicker(s.heartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(heartbeatWriteTimeout)); err != nil {
+			// A failed write means the connection is gone; closing it
+			// unblocks the read loop, which cleans up.
+			ws.Close()
+			return
+		}
+		if c.wantsLegacyPing() {
+			s.send(c, Frame{T: "PING"})
+		}
+	}
+}
+
+// readTimeout is how long a connection may stay silent, pongs included,
+// before it is evicted.
+func (s *Server) readTimeout() time.Duration {
+	return s.heartbeatInterval * time.Duration(s.heartbeatMissed+1)
+}
+
+func (s *Server) extendReadDeadline(ws *websocket.Conn) {
+	ws.SetReadDeadline(time.Now().Add(s.readTimeout()))
+}
+
+func (c *Client) wantsLegacyPing() bool {
+	return c.legacyPing.Load()
+}
+
+// loadHeartbeat reads HEARTBEAT_INTERVAL and HEARTBEAT_MISSED_PONGS.
+func loadHeartbeat() (time.Duration, int, error) {
+	interval, missed := defaultHeartbeatInterval, defaultHeartbeatMissed
+	if v := os.Getenv("HEARTBEAT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return 0, 0, fmt.Errorf("invalid HEARTBEAT_INTERVAL: %q", v)
+		}
+		interval = d
+	}
+	if v := os.Getenv("HEARTBEAT_MISSED_PONGS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("invalid HEARTBEAT_MISSED_PONGS: %q", v)
+		}
+		missed = n
+	}
+	return interval, missed, nil
+}
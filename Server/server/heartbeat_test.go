@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHeartbeatEvictsPeerThatStopsAnsweringPings(t *testing.T) {
+	s := newTestServer(WithHeartbeat(20*time.Millisecond, 2))
+	server := httptest.NewServer(s)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// A half-open connection: frames still arrive, but pongs never leave.
+	dead, err := connectClient(url, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	dead.SetPingHandler(func(string) error { return nil })
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := dead.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("unresponsive connection was not evicted")
+	}
+	// The account is free again instead of locked out.
+	again, err := connectClient(url, "alice@example.com")
+	if err != nil {
+		t.Fatalf("login after eviction: %v", err)
+	}
+	again.Close()
+	if n := s.metrics.Counter("relay_heartbeat_evictions_total"); n != 1 {
+		t.Fatalf("relay_heartbeat_evictions_total = %d, want 1", n)
+	}
+}
+
+func TestHeartbeatKeepsAnsweringPeerAndSendsLegacyPing(t *testing.T) {
+	server := httptest.NewServer(newTestServer(WithHeartbeat(20*time.Millisecond, 2)))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pings := 0
+	conn.SetPingHandler(func(data string) error {
+		pings++
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	auth, _ := json.Marshal(map[string]any{"token": getTestSessionToken("bob@example.com"), "legacyPing": true})
+	conn.WriteJSON(Frame{T: "AUTH", Data: auth})
+	expectFrame(t, conn, "AUTH_SUCCESS")
+
+	// Well past the eviction timeout, the connection is still served and
+	// legacy PING frames keep coming.
+	deadline := time.Now().Add(300 * time.Millisecond)
+	legacy := 0
+	for time.Now().Before(deadline) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var f Frame
+		if err := conn.ReadJSON(&f); err != nil {
+			t.Fatalf("connection dropped after %d pings: %v", pings, err)
+		}
+		if f.T == "PING" {
+			legacy++
+		}
+	}
+	if pings < 5 || legacy < 5 {
+		t.Fatalf("got %d pings and %d PING frames", pings, legacy)
+	}
+}
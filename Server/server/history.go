@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultSyncFrames = 64
+	defaultSyncAge    = 10 * time.Minute
+	maxHistoryBytes   = 256 * 1024
+)
+
+// history numbers the frames relayed in one session and keeps the recent
+// MSGs so members can SYNC what they missed. Other frames take numbers but
+// are not kept. It is guarded by Session.mu.
+type history struct {
+	seq     uint64 // last number handed out
+	lost    uint64 // newest MSG no longer kept
+	entries []historyEntry
+	bytes   int
+}
+
+type historyEntry struct {
+	seq     uint64
+	ts      int64    // server time in Unix milliseconds
+	from    string   // sender's email; empty for sealed sender
+	to      []string // recipients' emails when the MSG was unicast
+	payload []byte   // nil when the payload was too large to keep
+}
+
+// visibleTo reports whether the MSG was relayed to email, which joined the
+// session after frame joined.
+func (e *historyEntry) visibleTo(email string, joined uint64) bool {
+	if e.from == email || e.seq <= joined {
+		return false
+	}
+	return e.to == nil || slices.Contains(e.to, email)
+}
+
+// next hands out the sequence number for a new frame.
+func (h *history) next() uint64 {
+	h.seq++
+	return h.seq
+}
+
+// keep records a relayed MSG, then drops entries over the frame, byte and
+// age limits.
+func (h *history) keep(e historyEntry, frames int, cutoff int64) {
+	if frames == 0 {
+		h.lost = e.seq
+	} else {
+		if len(e.payload) > maxHistoryBytes {
+			e.payload = nil
+		}
+		h.entries = append(h.entries, e)
+		h.bytes += len(e.payload)
+	}
+	for len(h.entries) > 0 && (len(h.entries) > frames || h.bytes > maxHistoryBytes || h.entries[0].ts < cutoff) {
+		h.lost = h.entries[0].seq
+		h.bytes -= len(h.entries[0].payload)
+		h.entries[0] = historyEntry{}
+		h.entries = h.entries[1:]
+	}
+}
+
+// since returns the kept MSGs numbered above after that were relayed to
+// email, which joined the session after frame joined, and whether any
+// relayed to it may be missing from them. MSGs that are no longer kept
+// count as missing, whoever they were sent to.
+func (h *history) since(after uint64, email string, joined uint64, cutoff int64) ([]historyEntry, bool) {
+	if after > h.seq {
+		// The session was numbered afresh, as after a relay restart.
+		return nil, true
+	}
+	var out []historyEntry
+	lost := h.lost
+	gap := false
+	for _, e := range h.entries {
+		if e.ts < cutoff {
+			lost = e.seq
+			continue
+		}
+		if e.seq <= after || !e.visibleTo(email, joined) {
+			continue
+		}
+		if e.payload == nil {
+			gap = true
+			continue
+		}
+		out = append(out, e)
+	}
+	if max(after, joined) < lost {
+		gap = true
+	}
+	return out, gap
+}
+
+// numberMsg stamps the next MSG in sess with its sequence number and the
+// server time. The caller holds sess.mu.
+func (s *Server) numberMsg(sess *Session, sid string, payload []byte) relayedMsg {
+	return relayedMsg{sid: sid, seq: sess.hist.next(), ts: s.now().UnixMilli(), payload: payload}
+}
+
+// number stamps f, relayed in sess, with the session's next sequence
+// number and the server time. The caller holds sess.mu.
+func (s *Server) number(sess *Session, f *Frame) {
+	f.Seq = sess.hist.next()
+	f.TS = s.now().UnixMilli()
+}
+
+// keepMsg adds a relayed MSG to sess's history. The caller holds sess.mu.
+func (s *Server) keepMsg(sess *Session, e historyEntry) {
+	sess.hist.keep(e, s.syncFrames, s.now().Add(-s.syncAge).UnixMilli())
+}
+
+// handleSync replays the MSGs in frame.SID after data.after that the
+// client was sent and the relay still holds. SYNC_RESULT comes first and
+// says whether some are gone; the MSGs follow in order.
+func (s *Server) handleSync(client *Client, frame Frame) error {
+	var d struct {
+		After uint64 `json:"after"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil {
+		return NewError(ErrInvalidFrame, "Invalid sync request")
+	}
+	sess := s.state.session(frame.SID)
+	if sess == nil {
+		return NewError(ErrNotMember, "Not a member of this session")
+	}
+	viewer := normalizeEmail(client.email)
+	cutoff := s.now().Add(-s.syncAge).UnixMilli()
+
+	// Queueing the replay under sess.mu keeps newer MSGs from overtaking it.
+	sess.mu.Lock()
+	joined, ok := sess.members[viewer]
+	if !ok {
+		sess.mu.Unlock()
+		return NewError(ErrNotMember, "Not a member of this session")
+	}
+	entries, gap := sess.hist.since(d.After, viewer, joined, cutoff)
+	result, _ := json.Marshal(map[string]any{
+		"after":  d.After,
+		"latest": sess.hist.seq,
+		"gap":    gap,
+		"count":  len(entries),
+	})
+	s.post(client, Frame{T: "SYNC_RESULT", SID: frame.SID, ID: frame.ID, Data: json.RawMessage(result)})
+	to := []*Client{client}
+	var replay delivery
+	for _, e := range entries {
+		shFor := func(*Client) string { return "" }
+		if e.from != "" {
+			shFor = s.peerIDs(e.from)
+		}
+		replay = append(replay, s.relay(to, relayedMsg{sid: frame.SID, seq: e.seq, ts: e.ts, payload: e.payload}, shFor)...)
+	}
+	sess.mu.Unlock()
+
+	replay.wait()
+	return nil
+}
+
+// loadSyncRetention reads SYNC_RETAIN_FRAMES and SYNC_RETAIN_FOR.
+func loadSyncRetention() (int, time.Duration, error) {
+	frames, age := defaultSyncFrames, defaultSyncAge
+	if v := os.Getenv("SYNC_RETAIN_FRAMES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid SYNC_RETAIN_FRAMES: %q", v)
+		}
+		frames = n
+	}
+	if v := os.Getenv("SYNC_RETAIN_FOR"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return 0, 0, fmt.Errorf("invalid SYNC_RETAIN_FOR: %q", v)
+		}
+		age = d
+	}
+	return frames, age, nil
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHistorySinceFiltersAndReportsGaps(t *testing.T) {
+	var h history
+	add := func(from string, to []string, payload string) {
+		e := historyEntry{seq: h.next(), ts: 100, from: from, to: to, payload: []byte(payload)}
+		if payload == "" {
+			e.payload = nil
+		}
+		h.keep(e, 4, 0)
+	}
+	add("a", nil, `"1"`)
+	add("b", nil, `"2"`)
+	add("a", []string{"c"}, `"3"`) // unicast to c
+	h.next()                       // a frame that is numbered but not kept, such as RTC_ICE
+	add("a", nil, `"5"`)
+	add("a", nil, `"6"`) // pushes 1 out
+
+	seqs := func(es []historyEntry) []uint64 {
+		var out []uint64
+		for _, e := range es {
+			out = append(out, e.seq)
+		}
+		return out
+	}
+	cases := []struct {
+		viewer string
+		joined uint64
+		after  uint64
+		want   string
+		gap    bool
+	}{
+		{"b", 0, 1, "[5 6]", false},
+		{"c", 0, 1, "[2 3 5 6]", false},
+		{"b", 0, 0, "[5 6]", true}, // 1 is gone
+		{"b", 0, 6, "[]", false},
+		{"b", 0, 9, "[]", true},     // numbered afresh
+		{"d", 3, 0, "[5 6]", false}, // joined after 3: nothing earlier, and 1 was never its
+	}
+	for _, c := range cases {
+		got, gap := h.since(c.after, c.viewer, c.joined, 0)
+		if fmt.Sprint(seqs(got)) != c.want || gap != c.gap {
+			t.Errorf("since(%d) for %s = %v gap=%v, want %s gap=%v", c.after, c.viewer, seqs(got), gap, c.want, c.gap)
+		}
+	}
+
+	add("a", nil, "") // too large to keep
+	if _, gap := h.since(6, "b", 0, 0); !gap {
+		t.Error("an unkept payload was not reported as a gap")
+	}
+	if got, gap := h.since(1, "b", 0, 200); len(got) != 0 || !gap {
+		t.Errorf("expired entries replayed: %v gap=%v", seqs(got), gap)
+	}
+}
+
+func TestHistoryKeepsNothingWhenDisabled(t *testing.T) {
+	var h history
+	h.keep(historyEntry{seq: h.next(), payload: []byte(`"x"`)}, 0, 0)
+	if len(h.entries) != 0 || h.seq != 1 {
+		t.Fatalf("entries=%d seq=%d", len(h.entries), h.seq)
+	}
+	if _, gap := h.since(0, "b", 0, 0); !gap {
+		t.Fatal("missed MSG not reported as a gap")
+	}
+}
+
+// numbered reads the next MSG and returns its seq, ts and payload.
+func numbered(t *testing.T, conn *websocket.Conn) (uint64, int64, string) {
+	t.Helper()
+	f := expectFrame(t, conn, "MSG")
+	var d struct{ Payload string }
+	json.Unmarshal(f.Data, &d)
+	return f.Seq, f.TS, d.Payload
+}
+
+func TestMsgNumberingAndSync(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := newTestServer(WithClock(func() time.Time { return now }))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	alice, err := connectClient(wsUrl, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := connectClient(wsUrl, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	sid, err := establishSession(alice, bob, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice.WriteJSON(Frame{T: "MSG", SID: sid, C: true, ID: "m1", Data: json.RawMessage(`{"payload":"one"}`)})
+	if ack := expectFrame(t, alice, "DELIVERED"); ack.Seq != 1 || ack.TS != now.UnixMilli() {
+		t.Fatalf("DELIVERED without the MSG's number: %+v", ack)
+	}
+	if seq, ts, p := numbered(t, bob); seq != 1 || ts != now.UnixMilli() || p != "one" {
+		t.Fatalf("first MSG seq=%d ts=%d payload=%q", seq, ts, p)
+	}
+	bob.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"two"}`)})
+	if seq, _, _ := numbered(t, alice); seq != 2 {
+		t.Fatalf("second MSG seq=%d", seq)
+	}
+	alice.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"three"}`)})
+	numbered(t, bob)
+
+	bob.WriteJSON(Frame{T: "SYNC", SID: sid, ID: "s1", Data: json.RawMessage(`{"after":0}`)})
+	res := expectFrame(t, bob, "SYNC_RESULT")
+	var d struct {
+		After, Latest uint64
+		Gap           bool
+		Count         int
+	}
+	json.Unmarshal(res.Data, &d)
+	if res.ID != "s1" || d.Latest != 3 || d.Gap || d.Count != 2 {
+		t.Fatalf("unexpected SYNC_RESULT %+v %s", res, res.Data)
+	}
+	for _, want := range []struct {
+		seq     uint64
+		payload string
+	}{{1, "one"}, {3, "three"}} {
+		f := expectFrame(t, bob, "MSG")
+		if f.Seq != want.seq || f.SH != emailHash("alice@example.com") || !strings.Contains(string(f.Data), want.payload) {
+			t.Fatalf("replayed %+v, want seq %d", f, want.seq)
+		}
+	}
+
+	now = now.Add(defaultSyncAge + time.Second)
+	bob.WriteJSON(Frame{T: "SYNC", SID: sid, Data: json.RawMessage(`{"after":1}`)})
+	json.Unmarshal(expectFrame(t, bob, "SYNC_RESULT").Data, &d)
+	if !d.Gap || d.Count != 0 {
+		t.Fatalf("expired history not reported as a gap: %+v", d)
+	}
+}
+
+func TestSyncRequiresMembership(t *testing.T) {
+	ts := setupTestServer()
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+	alice, bob, sid, err := connectPair(wsUrl, "sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	defer bob.Close()
+	eve, err := connectClient(wsUrl, "eve@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eve.Close()
+
+	eve.WriteJSON(Frame{T: "SYNC", SID: sid, Data: json.RawMessage(`{"after":0}`)})
+	if f := expectFrame(t, eve, "ERROR"); !strings.Contains(string(f.Data), string(ErrNotMember)) {
+		t.Fatalf("non-member SYNC answered with %s", f.Data)
+	}
+}
+
+func TestSyncSkipsMessagesFromBeforeJoining(t *testing.T) {
+	ts := setupTestServer()
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+	conns := make([]*websocket.Conn, 3)
+	for i, name := range []string{"alice", "bob", "mallory"} {
+		c, err := connectClient(wsUrl, name+"@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns[i] = c
+	}
+	alice, bob, mallory := conns[0], conns[1], conns[2]
+
+	sid := "open-group"
+	alice.WriteJSON(Frame{T: "REATTACH", SID: sid})
+	bob.WriteJSON(Frame{T: "REATTACH", SID: sid})
+	online := expectFrame(t, alice, "PEER_ONLINE")
+	expectFrame(t, bob, "PEER_ONLINE")
+	if online.Seq == 0 || online.TS == 0 {
+		t.Fatalf("PEER_ONLINE not numbered: %+v", online)
+	}
+	alice.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"secret-before-mallory"}`)})
+	if seq, _, _ := numbered(t, bob); seq <= online.Seq {
+		t.Fatalf("MSG seq %d not after PEER_ONLINE seq %d", seq, online.Seq)
+	}
+	alice.WriteJSON(Frame{T: "RTC_ICE", SID: sid, Data: json.RawMessage(`{"candidate":""}`)})
+	if ice := expectFrame(t, bob, "RTC_ICE"); ice.Seq == 0 {
+		t.Fatalf("RTC_ICE not numbered: %+v", ice)
+	}
+
+	mallory.WriteJSON(Frame{T: "REATTACH", SID: sid})
+	expectFrame(t, mallory, "PEER_ONLINE")
+	expectFrame(t, mallory, "PEER_ONLINE")
+	mallory.WriteJSON(Frame{T: "SYNC", SID: sid, Data: json.RawMessage(`{"after":0}`)})
+	res := expectFrame(t, mallory, "SYNC_RESULT")
+	if !strings.Contains(string(res.Data), `"count":0`) || !strings.Contains(string(res.Data), `"gap":false`) {
+		t.Fatalf("late joiner was offered earlier traffic: %s", res.Data)
+	}
+	alice.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"after"}`)})
+	if _, _, p := numbered(t, mallory); p != "after" {
+		t.Fatalf("late joiner got %q", p)
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Under the relay-only ICE policy the relay forwards only TURN relay
+// candidates between peers, so neither side learns the other's host or
+// server-reflexive address. It applies when the server enforces it for
+// everyone (ICE_RELAY_ONLY) or when either end of a frame asked for it
+// at AUTH.
+
+func (c *Client) wantsRelayOnly() bool {
+	return c.relayOnly.Load()
+}
+
+func (s *Server) requireRelay(clients ...*Client) bool {
+	if s.relayOnly {
+		return true
+	}
+	for _, c := range clients {
+		if c.wantsRelayOnly() {
+			return true
+		}
+	}
+	return false
+}
+
+// candidateType returns the typ field of an ICE candidate attribute value.
+func candidateType(candidate string) string {
+	fields := strings.Fields(candidate)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "typ" {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// scrubCandidate keeps relay candidates and blanks their related address,
+// which for a relay candidate is the client's server-reflexive address.
+func scrubCandidate(candidate string) (string, bool) {
+	if candidateType(candidate) != "relay" {
+		return "", false
+	}
+	fields := strings.Fields(candidate)
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "raddr":
+			fields[i+1] = "0.0.0.0"
+		case "rport":
+			fields[i+1] = "0"
+		}
+	}
+	return strings.Join(fields, " "), true
+}
+
+// stripSDP drops non-relay candidates from an SDP and replaces the
+// connection and origin addresses, which carry the default candidate's IP.
+// It returns the number of candidates removed.
+func stripSDP(sdp string) (string, int) {
+	eol := "\r\n"
+	if !strings.Contains(sdp, eol) {
+		eol = "\n"
+	}
+	lines := strings.Split(sdp, eol)
+	out := lines[:0]
+	removed := 0
+	for _, l := range lines {
+		switch {
+		case strings.HasPrefix(l, "a=candidate:"):
+			scrubbed, ok := scrubCandidate(strings.TrimPrefix(l, "a="))
+			if !ok {
+				removed++
+				continue
+			}
+			l = "a=" + scrubbed
+		case strings.HasPrefix(l, "c=IN "):
+			l = "c=IN IP4 0.0.0.0"
+		case strings.HasPrefix(l, "a=rtcp:"):
+			l = "a=rtcp:9 IN IP4 0.0.0.0"
+		case strings.HasPrefix(l, "o="):
+			if f := strings.Fields(l); len(f) == 6 {
+				f[4], f[5] = "IP4", "0.0.0.0"
+				l = strings.Join(f, " ")
+			}
+		}
+		out = append(out, l)
+	}
+	return strings.Join(out, eol), removed
+}
+
+// stripNonRelay rewrites the data of an RTC_OFFER, RTC_ANSWER or RTC_ICE
+// frame for the relay-only policy. forward is false when the frame carried
+// only a non-relay candidate and should be dropped. Data the relay cannot
+// read, such as end-to-end encrypted signaling, goes through unchanged: the
+// client enforces the policy for it by passing the iceTransportPolicy from
+// TURN_CREDS to its RTCPeerConnection, which then never gathers a
+// non-relay candidate.
+func (s *Server) stripNonRelay(frameType string, data json.RawMessage) (out json.RawMessage, forward bool) {
+	var m map[string]any
+	if err := json.Unmarshal(data, &m); err != nil {
+		s.metrics.Inc("relay_ice_opaque_forwarded_total")
+		return data, true
+	}
+
+	if frameType == "RTC_ICE" {
+		candidate, ok := m["candidate"].(string)
+		if !ok {
+			s.metrics.Inc("relay_ice_opaque_forwarded_total")
+			return data, true
+		}
+		if candidate == "" {
+			// End of candidates.
+			return data, true
+		}
+		scrubbed, ok := scrubCandidate(candidate)
+		if !ok {
+			s.metrics.Inc("relay_ice_candidates_stripped_total")
+			return nil, false
+		}
+		m["candidate"] = scrubbed
+	} else {
+		sdp, ok := m["sdp"].(string)
+		if !ok {
+			s.metrics.Inc("relay_ice_opaque_forwarded_total")
+			return data, true
+		}
+		stripped, removed := stripSDP(sdp)
+		s.metrics.Add(uint64(removed), "relay_ice_candidates_stripped_total")
+		m["sdp"] = stripped
+	}
+	out, _ = json.Marshal(m)
+	return out, true
+}
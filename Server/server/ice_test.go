@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testOffer = "v=0\r\n" +
+	"o=- 4611 2 IN IP4 192.168.1.20\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 54321 UDP/TLS/RTP/SAVPF 111\r\n" +
+	"c=IN IP4 203.0.113.7\r\n" +
+	"a=rtcp:54322 IN IP4 203.0.113.7\r\n" +
+	"a=candidate:1 1 udp 2122260223 192.168.1.20 54321 typ host generation 0\r\n" +
+	"a=candidate:2 1 udp 1686052607 203.0.113.7 54321 typ srflx raddr 192.168.1.20 rport 54321\r\n" +
+	"a=candidate:3 1 udp 41885439 198.51.100.9 61000 typ relay raddr 203.0.113.7 rport 54321\r\n" +
+	"a=mid:0\r\n"
+
+func TestStripSDPKeepsOnlyRelayCandidates(t *testing.T) {
+	out, removed := stripSDP(testOffer)
+	if removed != 2 {
+		t.Fatalf("expected 2 candidates removed, got %d", removed)
+	}
+	for _, leak := range []string{"192.168.1.20", "203.0.113.7"} {
+		if strings.Contains(out, leak) {
+			t.Fatalf("SDP still contains %s:\n%s", leak, out)
+		}
+	}
+	if !strings.Contains(out, "a=candidate:3 1 udp 41885439 198.51.100.9 61000 typ relay raddr 0.0.0.0 rport 0\r\n") {
+		t.Fatalf("relay candidate missing or not scrubbed:\n%s", out)
+	}
+	if !strings.HasSuffix(out, "a=mid:0\r\n") {
+		t.Fatal("line endings not preserved")
+	}
+}
+
+func connectRelayOnly(url, email string) (*websocket.Conn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.WriteJSON(Frame{T: "AUTH", Data: json.RawMessage(fmt.Sprintf(`{"token":%q,"relayOnly":true}`, getTestSessionToken(email)))})
+	if f, err := readMSG(conn); err != nil || f.T != "AUTH_SUCCESS" {
+		conn.Close()
+		return nil, fmt.Errorf("auth failed: %v %v", f, err)
+	}
+	return conn, nil
+}
+
+func TestRelayOnlyPolicyStripsForwardedICE(t *testing.T) {
+	s := newTestServer(WithTurnPool(NewTurnPool([]TurnEndpoint{
+		{ID: "t1", Host: "turn.example", Port: 3478, Secrets: TurnSecrets{{ID: "1", Secret: "s"}}},
+	}, time.Minute, time.Minute, testSecret)))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	alice, err := connectRelayOnly(url, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := connectClient(url, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	sid, err := establishSession(alice, bob, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob did not opt in, but alice did, so bob's candidates are filtered
+	// on their way to her too.
+	bob.WriteJSON(Frame{T: "RTC_ICE", SID: sid, Data: json.RawMessage(`{"candidate":"candidate:1 1 udp 2122260223 10.0.0.2 5000 typ host","sdpMid":"0"}`)})
+	bob.WriteJSON(Frame{T: "RTC_ICE", SID: sid, Data: json.RawMessage(`{"candidate":"candidate:3 1 udp 41885439 198.51.100.9 61000 typ relay raddr 10.0.0.2 rport 5000","sdpMid":"0"}`)})
+	got := expectFrame(t, alice, "RTC_ICE")
+	var cand struct {
+		Candidate string `json:"candidate"`
+		SDPMid    string `json:"sdpMid"`
+	}
+	json.Unmarshal(got.Data, &cand)
+	if candidateType(cand.Candidate) != "relay" || strings.Contains(cand.Candidate, "10.0.0.2") || cand.SDPMid != "0" {
+		t.Fatalf("unexpected candidate forwarded: %s", got.Data)
+	}
+
+	offer, _ := json.Marshal(map[string]string{"type": "offer", "sdp": testOffer})
+	alice.WriteJSON(Frame{T: "RTC_OFFER", SID: sid, Data: offer})
+	got = expectFrame(t, bob, "RTC_OFFER")
+	if strings.Contains(string(got.Data), "typ host") || strings.Contains(string(got.Data), "203.0.113.7") {
+		t.Fatalf("offer forwarded with non-relay addresses: %s", got.Data)
+	}
+
+	// Encrypted signaling cannot be stripped, so it goes through as sent and
+	// the clients enforce relay-only through iceTransportPolicy.
+	alice.WriteJSON(Frame{T: "RTC_ANSWER", SID: sid, Data: json.RawMessage(`"ciphertext"`)})
+	if got = expectFrame(t, bob, "RTC_ANSWER"); string(got.Data) != `"ciphertext"` {
+		t.Fatalf("encrypted answer altered: %s", got.Data)
+	}
+	bob.WriteJSON(Frame{T: "RTC_ICE", SID: sid, Data: json.RawMessage(`{"payload":"sealed-candidate"}`)})
+	if got = expectFrame(t, alice, "RTC_ICE"); string(got.Data) != `{"payload":"sealed-candidate"}` {
+		t.Fatalf("encrypted candidate altered: %s", got.Data)
+	}
+	if got := s.metrics.Counter("relay_ice_candidates_stripped_total"); got != 3 {
+		t.Fatalf("expected 3 stripped candidates, got %d", got)
+	}
+	if got := s.metrics.Counter("relay_ice_opaque_forwarded_total"); got != 2 {
+		t.Fatalf("expected 2 opaque frames forwarded, got %d", got)
+	}
+
+	bob.WriteJSON(Frame{T: "GET_TURN_CREDS", SID: sid})
+	got = expectFrame(t, bob, "TURN_CREDS")
+	if !strings.Contains(string(got.Data), `"iceTransportPolicy":"relay"`) {
+		t.Fatalf("TURN creds do not signal relay-only: %s", got.Data)
+	}
+	bob.WriteJSON(Frame{T: "GET_TURN_CREDS"})
+	got = expectFrame(t, bob, "TURN_CREDS")
+	if strings.Contains(string(got.Data), "iceTransportPolicy") {
+		t.Fatalf("relay-only signalled outside a relay-only session: %s", got.Data)
+	}
+}
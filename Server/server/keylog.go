@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"relay/transparency"
+
+	crand "crypto/rand"
+)
+
+const maxKeyLogEntriesPerPage = 1000
+
+// KeyLog records every public key the relay forwards in JOIN_REQUEST and
+// JOIN_ACCEPT in a transparency.Log and publishes signed tree heads over it.
+// Entries name accounts by an HMAC keyed from the signing key rather than
+// emailHash, so the published log is not a directory of who uses the relay.
+type KeyLog struct {
+	tree   *transparency.Log
+	signer ed25519.PrivateKey
+	idKey  []byte
+	latest map[string]int
+	file   *os.File
+	now    func() time.Time
+	mu     sync.Mutex
+}
+
+func NewKeyLog(signer ed25519.PrivateKey) *KeyLog {
+	if signer == nil {
+		_, signer, _ = ed25519.GenerateKey(crand.Reader)
+	}
+	h := hmac.New(sha256.New, signer.Seed())
+	h.Write([]byte("kt-account-id"))
+	return &KeyLog{
+		tree:   transparency.NewLog(),
+		signer: signer,
+		idKey:  h.Sum(nil),
+		latest: make(map[string]int),
+		now:    time.Now,
+	}
+}
+
+// loadKeyLog builds the key log from KT_SIGNING_KEY (hex ed25519 seed) and
+// replays and appends to KT_LOG_FILE when set. A persisted log needs the
+// signing key too: account IDs are keyed from it, so with an ephemeral key
+// the entries replayed after a restart would name accounts nobody has.
+func loadKeyLog() (*KeyLog, error) {
+	path := os.Getenv("KT_LOG_FILE")
+	var signer ed25519.PrivateKey
+	if seedHex := strings.TrimSpace(os.Getenv("KT_SIGNING_KEY")); seedHex != "" {
+		seed, err := hex.DecodeString(seedHex)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("KT_SIGNING_KEY must be %d hex-encoded bytes", ed25519.SeedSize)
+		}
+		signer = ed25519.NewKeyFromSeed(seed)
+	} else if path != "" {
+		return nil, fmt.Errorf("KT_LOG_FILE requires KT_SIGNING_KEY, or account IDs change on every restart")
+	} else {
+		log.Println("⚠️ KT_SIGNING_KEY not set, tree heads are signed with an ephemeral key")
+	}
+	kl := NewKeyLog(signer)
+
+	if path == "" {
+		return kl, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e transparency.Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("corrupt key log entry %d: %w", kl.tree.Size(), err)
+		}
+		kl.latest[e.AccountID] = kl.tree.Append(e)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	kl.file = f
+	return kl, nil
+}
+
+func (kl *KeyLog) PublicKey() ed25519.PublicKey {
+	return kl.signer.Public().(ed25519.PublicKey)
+}
+
+// AccountID is the identifier entries for email are logged under. AUTH_SUCCESS
+// tells each account its own, so owners can find and audit their entries.
+func (kl *KeyLog) AccountID(email string) string {
+	h := hmac.New(sha256.New, kl.idKey)
+	h.Write([]byte(normalizeEmail(email)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Record logs publicKey for the account unless it is already the latest key
+// logged for it, and returns the entry's index.
+func (kl *KeyLog) Record(email, publicKey string) int {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	id := kl.AccountID(email)
+	if idx, ok := kl.latest[id]; ok {
+		if e, _ := kl.tree.Entry(idx); e.PublicKey == publicKey {
+			return idx
+		}
+	}
+	e := transparency.Entry{AccountID: id, PublicKey: publicKey, Timestamp: kl.now().UnixMilli()}
+	if kl.file != nil {
+		line, _ := json.Marshal(e)
+		if _, err := kl.file.Write(append(line, '\n')); err != nil {
+			log.Printf("[KeyLog] Failed to persist entry: %v", err)
+		}
+	}
+	idx := kl.tree.Append(e)
+	kl.latest[id] = idx
+	return idx
+}
+
+func (kl *KeyLog) TreeHead() transparency.SignedTreeHead {
+	size := kl.tree.Size()
+	root, _ := kl.tree.Root(size)
+	return transparency.SignTreeHead(kl.signer, size, kl.now().UnixMilli(), root)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func queryInt(r *http.Request, name string) (int, error) {
+	v, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return v, nil
+}
+
+// GET /kt/sth
+func (kl *KeyLog) handleTreeHead(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"sth":       kl.TreeHead(),
+		"publicKey": hex.EncodeToString(kl.PublicKey()),
+	})
+}
+
+// GET /kt/entries?start=&end=
+func (kl *KeyLog) handleEntries(w http.ResponseWriter, r *http.Request) {
+	start, err := queryInt(r, "start")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	end, err := queryInt(r, "end")
+	if err != nil || end-start > maxKeyLogEntriesPerPage {
+		end = start + maxKeyLogEntriesPerPage
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"entries": kl.tree.Entries(start, end)})
+}
+
+// GET /kt/proof/inclusion?index=&size=
+func (kl *KeyLog) handleInclusionProof(w http.ResponseWriter, r *http.Request) {
+	index, err1 := queryInt(r, "index")
+	size, err2 := queryInt(r, "size")
+	if err1 != nil || err2 != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "index and size are required"})
+		return
+	}
+	proof, err := kl.tree.InclusionProof(index, size)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	entry, _ := kl.tree.Entry(index)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"index": index,
+		"size":  size,
+		"entry": entry,
+		"proof": transparency.EncodeProof(proof),
+	})
+}
+
+// GET /kt/proof/consistency?first=&second=
+func (kl *KeyLog) handleConsistencyProof(w http.ResponseWriter, r *http.Request) {
+	first, err1 := queryInt(r, "first")
+	second, err2 := queryInt(r, "second")
+	if err1 != nil || err2 != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "first and second are required"})
+		return
+	}
+	proof, err := kl.tree.ConsistencyProof(first, second)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"first":  first,
+		"second": second,
+		"proof":  transparency.EncodeProof(proof),
+	})
+}
+
+func (kl *KeyLog) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /kt/sth", kl.handleTreeHead)
+	mux.HandleFunc("GET /kt/entries", kl.handleEntries)
+	mux.HandleFunc("GET /kt/proof/inclusion", kl.handleInclusionProof)
+	mux.HandleFunc("GET /kt/proof/consistency", kl.handleConsistencyProof)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"relay/transparency"
+)
+
+func TestKeyLogRecordDedupesUnchangedKeys(t *testing.T) {
+	kl := NewKeyLog(nil)
+	a := kl.Record("alice@example.com", "keyA")
+	if again := kl.Record("Alice@Example.com", "keyA"); again != a {
+		t.Fatalf("unchanged key re-logged at %d (first %d)", again, a)
+	}
+	if rotated := kl.Record("alice@example.com", "keyA2"); rotated == a {
+		t.Fatal("rotated key was not logged")
+	}
+}
+
+func TestKeyLogServesVerifiableProofs(t *testing.T) {
+	kl := NewKeyLog(nil)
+	for i := 0; i < 6; i++ {
+		kl.Record(fmt.Sprintf("user%d@example.com", i), fmt.Sprintf("key%d", i))
+	}
+	mux := http.NewServeMux()
+	kl.register(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	var head struct {
+		STH       transparency.SignedTreeHead `json:"sth"`
+		PublicKey string                      `json:"publicKey"`
+	}
+	getJSON(t, ts.URL+"/kt/sth", &head)
+	pub, _ := hex.DecodeString(head.PublicKey)
+
+	var inc struct {
+		Entry transparency.Entry `json:"entry"`
+		Proof []string           `json:"proof"`
+	}
+	getJSON(t, fmt.Sprintf("%s/kt/proof/inclusion?index=4&size=%d", ts.URL, head.STH.TreeSize), &inc)
+	proof, err := transparency.DecodeProof(inc.Proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inc.Entry.AccountID != kl.AccountID("user4@example.com") || inc.Entry.AccountID == emailHash("user4@example.com") {
+		t.Fatalf("unexpected entry %+v", inc.Entry)
+	}
+	if err := transparency.VerifyEntry(pub, head.STH, inc.Entry, 4, proof); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getJSON(t *testing.T, url string, v any) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadKeyLogKeepsAccountIDsAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kt.log")
+	t.Setenv("KT_LOG_FILE", path)
+	t.Setenv("KT_SIGNING_KEY", "")
+	if _, err := loadKeyLog(); err == nil {
+		t.Fatal("KT_LOG_FILE accepted without KT_SIGNING_KEY")
+	}
+
+	t.Setenv("KT_SIGNING_KEY", strings.Repeat("ab", ed25519.SeedSize))
+	kl, err := loadKeyLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.UnixMilli(1_700_000_000_000)
+	kl.now = func() time.Time { return at }
+	idx := kl.Record("alice@example.com", "keyA")
+	kl.file.Close()
+
+	again, err := loadKeyLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.file.Close()
+	if again.AccountID("alice@example.com") != kl.AccountID("alice@example.com") {
+		t.Fatal("account ID changed across restarts")
+	}
+	if got := again.Record("alice@example.com", "keyA"); got != idx {
+		t.Fatalf("replayed key re-logged at %d (first %d)", got, idx)
+	}
+	if e, _ := again.tree.Entry(idx); e.Timestamp != at.UnixMilli() {
+		t.Fatalf("entry timestamp %d, want the log's clock %d", e.Timestamp, at.UnixMilli())
+	}
+}
+
+func TestAuthSuccessCarriesKeyLogAccountID(t *testing.T) {
+	s := newTestServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(Frame{T: "AUTH", Data: json.RawMessage(`{"token":"` + getTestSessionToken("alice@example.com") + `"}`)})
+	f := expectFrame(t, conn, "AUTH_SUCCESS")
+	var d struct {
+		AccountID string `json:"ktAccountId"`
+	}
+	json.Unmarshal(f.Data, &d)
+	if d.AccountID == "" || d.AccountID != s.keyLog.AccountID("alice@example.com") {
+		t.Fatalf("AUTH_SUCCESS account ID %q, want %q", d.AccountID, s.keyLog.AccountID("alice@example.com"))
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics is a minimal counter/gauge registry exposed in the Prometheus text
+// format on /metrics.
+type Metrics struct {
+	counters map[string]*atomic.Uint64
+	gauges   map[string]func() float64
+	mu       sync.Mutex
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters: make(map[string]*atomic.Uint64),
+		gauges:   make(map[string]func() float64),
+	}
+}
+
+// series renders name{k1="v1",k2="v2"} from alternating label keys/values.
+func series(name string, labels ...string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return name + "{" + strings.Join(parts, ",") + "}"
+}
+
+func (m *Metrics) Add(n uint64, name string, labels ...string) {
+	m.CounterRef(name, labels...).Add(n)
+}
+
+// CounterRef returns the counter for a series, creating it at zero. Hot
+// paths resolve it once and add to it directly, without the registry lock
+// or formatting the series name on every increment.
+func (m *Metrics) CounterRef(name string, labels ...string) *atomic.Uint64 {
+	k := series(name, labels...)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.counters[k]
+	if !ok {
+		c = new(atomic.Uint64)
+		m.counters[k] = c
+	}
+	return c
+}
+
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(1, name, labels...)
+}
+
+func (m *Metrics) Counter(name string, labels ...string) uint64 {
+	m.mu.Lock()
+	c := m.counters[series(name, labels...)]
+	m.mu.Unlock()
+	if c == nil {
+		return 0
+	}
+	return c.Load()
+}
+
+// Gauge registers fn to be sampled on every scrape.
+func (m *Metrics) Gauge(name string, fn func() float64, labels ...string) {
+	m.mu.Lock()
+	m.gauges[series(name, labels...)] = fn
+	m.mu.Unlock()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	lines := make([]string, 0, len(m.counters)+len(m.gauges))
+	for k, c := range m.counters {
+		lines = append(lines, fmt.Sprintf("%s %d", k, c.Load()))
+	}
+	gauges := make(map[string]func() float64, len(m.gauges))
+	for k, fn := range m.gauges {
+		gauges[k] = fn
+	}
+	m.mu.Unlock()
+
+	for k, fn := range gauges {
+		lines = append(lines, fmt.Sprintf("%s %g", k, fn()))
+	}
+	sort.Strings(lines)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+}
+
+// registerRuntimeGauges exports the relay process's own resource usage, so
+// load tests can report it next to their latencies.
+func registerRuntimeGauges(m *Metrics) {
+	m.Gauge("go_goroutines", func() float64 { return float64(runtime.NumGoroutine()) })
+	m.Gauge("go_heap_bytes", func() float64 {
+		return readRuntimeMetrics("/memory/classes/heap/objects:bytes")
+	})
+	m.Gauge("go_memory_bytes", func() float64 {
+		return readRuntimeMetrics("/memory/classes/total:bytes")
+	})
+	m.Gauge("process_cpu_seconds_total", processCPUSeconds)
+}
+
+// readRuntimeMetrics returns the sum of the named runtime/metrics samples.
+func readRuntimeMetrics(names ...string) float64 {
+	samples := make([]metrics.Sample, len(names))
+	for i, name := range names {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+	var sum float64
+	for _, s := range samples {
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			sum += float64(s.Value.Uint64())
+		case metrics.KindFloat64:
+			sum += s.Value.Float64()
+		}
+	}
+	return sum
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package server
+
+// processCPUSeconds falls back to the Go runtime's estimate, which is only
+// updated at each GC cycle.
+func processCPUSeconds() float64 {
+	return readRuntimeMetrics(
+		"/cpu/classes/user:cpu-seconds",
+		"/cpu/classes/gc/total:cpu-seconds",
+		"/cpu/classes/scavenge/total:cpu-seconds",
+	)
+}
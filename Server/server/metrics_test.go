@@ -0,0 +1,79 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testMetricsToken = "metrics-token-for-tests"
+
+func getMetrics(t *testing.T, url, token string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url+"/metrics", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestMetricsRequireToken(t *testing.T) {
+	open := setupTestServer()
+	defer open.Close()
+	resp := getMetrics(t, open.URL, "")
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("metrics served without any token configured")
+	}
+
+	server := httptest.NewServer(newTestServer(WithMetricsToken(testMetricsToken), WithAdminTokens(map[string]string{testAdminToken: "ops"})))
+	defer server.Close()
+	for token, want := range map[string]int{
+		"":               http.StatusUnauthorized,
+		"wrong-token":    http.StatusUnauthorized,
+		testMetricsToken: http.StatusOK,
+		testAdminToken:   http.StatusOK,
+	} {
+		resp := getMetrics(t, server.URL, token)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("token %q: got %s, want %d", token, resp.Status, want)
+		}
+	}
+}
+
+func TestMetricsReportLoadAndProcessUsage(t *testing.T) {
+	server := httptest.NewServer(newTestServer(WithMetricsToken(testMetricsToken)))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	alice, err := connectClient(url, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := connectClient(url, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	if _, err := establishSession(alice, bob, "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := getMetrics(t, server.URL, testMetricsToken)
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	body := string(raw)
+	for _, want := range []string{"relay_clients 2\n", "relay_sessions 1\n", "go_goroutines ", "go_heap_bytes ", "process_cpu_seconds_total "} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
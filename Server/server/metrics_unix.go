@@ -0,0 +1,14 @@
+//go:build unix
+
+package server
+
+import "syscall"
+
+// processCPUSeconds is the user and system CPU time used by the process.
+func processCPUSeconds() float64 {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return float64(ru.Utime.Nano()+ru.Stime.Nano()) / 1e9
+}
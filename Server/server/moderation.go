@@ -0,0 +1,352 @@
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	crand "crypto/rand"
+)
+
+const (
+	maxOpenReports      = 10000
+	maxReportReasonSize = 1000
+)
+
+// Moderation actions, as recorded in the audit log.
+const (
+	ActionSuspend = "suspend"
+	ActionBan     = "ban"
+	ActionLift    = "lift"
+	ActionResolve = "resolve"
+)
+
+// Report is a REPORT from one account about another member of a session.
+type Report struct {
+	ID         string `json:"id"`
+	At         int64  `json:"at"` // Unix milliseconds
+	Reporter   string `json:"reporter"`
+	Target     string `json:"target"`     // email of the reported account
+	TargetHash string `json:"targetHash"` // the peer ID the reporter sent
+	SID        string `json:"sid"`
+	Reason     string `json:"reason"`
+	Resolved   bool   `json:"resolved"`
+}
+
+// Restriction is a suspension or ban in force on an account.
+type Restriction struct {
+	Email  string `json:"email"`
+	Action string `json:"action"` // ActionSuspend or ActionBan
+	Until  int64  `json:"until"`  // Unix milliseconds; 0 for a permanent ban
+	Reason string `json:"reason"`
+	Actor  string `json:"actor"`
+	At     int64  `json:"at"`
+}
+
+func (r Restriction) activeAt(now time.Time) bool {
+	return r.Until == 0 || now.UnixMilli() < r.Until
+}
+
+// AuditEntry records one operator action: who did what to which account
+// or report, and why.
+type AuditEntry struct {
+	At     int64  `json:"at"` // Unix milliseconds
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	Email  string `json:"email,omitempty"`
+	Until  int64  `json:"until,omitempty"`
+	Report string `json:"report,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Moderation holds abuse reports awaiting review, the suspensions and bans
+// in force, and the audit log of operator actions. The audit log is the
+// record of truth: restrictions are rebuilt from it on load.
+type Moderation struct {
+	reports      []Report               // oldest first
+	restrictions map[string]Restriction // by normalized email
+	audit        []AuditEntry
+	file         *os.File
+	now          func() time.Time
+	mu           sync.Mutex
+}
+
+func NewModeration() *Moderation {
+	return &Moderation{restrictions: make(map[string]Restriction), now: time.Now}
+}
+
+// loadModeration replays and appends to MODERATION_LOG_FILE when set.
+func loadModeration() (*Moderation, error) {
+	m := NewModeration()
+	path := os.Getenv("MODERATION_LOG_FILE")
+	if path == "" {
+		return m, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("corrupt moderation log entry %d: %w", len(m.audit), err)
+		}
+		m.apply(e)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	m.file = f
+	return m, nil
+}
+
+// apply adds e to the audit log and updates the restrictions it changes.
+// The caller holds m.mu, or is the only one with m.
+func (m *Moderation) apply(e AuditEntry) {
+	m.audit = append(m.audit, e)
+	switch e.Action {
+	case ActionSuspend, ActionBan:
+		m.restrictions[e.Email] = Restriction{Email: e.Email, Action: e.Action, Until: e.Until, Reason: e.Reason, Actor: e.Actor, At: e.At}
+	case ActionLift:
+		delete(m.restrictions, e.Email)
+	}
+}
+
+// record persists e and applies it. The caller holds m.mu.
+func (m *Moderation) record(e AuditEntry) AuditEntry {
+	e.At = m.now().UnixMilli()
+	if m.file != nil {
+		line, _ := json.Marshal(e)
+		if _, err := m.file.Write(append(line, '\n')); err != nil {
+			log.Printf("[Moderation] Failed to persist audit entry: %v", err)
+		}
+	}
+	m.apply(e)
+	return e
+}
+
+// Restrict suspends or bans email until the given time, or for good when
+// until is zero, on behalf of actor. A suspension must end. report names
+// the report that prompted it, if any.
+func (m *Moderation) Restrict(actor, email, action string, until time.Time, reason, report string) (AuditEntry, error) {
+	if action != ActionSuspend && action != ActionBan {
+		return AuditEntry{}, fmt.Errorf("unknown action %q", action)
+	}
+	if action == ActionSuspend && until.IsZero() {
+		return AuditEntry{}, fmt.Errorf("a suspension needs an end")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !until.IsZero() && !until.After(m.now()) {
+		return AuditEntry{}, fmt.Errorf("the period has already ended")
+	}
+	e := AuditEntry{Actor: actor, Action: action, Email: normalizeEmail(email), Report: report, Reason: reason}
+	if !until.IsZero() {
+		e.Until = until.UnixMilli()
+	}
+	return m.record(e), nil
+}
+
+// Lift ends a restriction on email early. It reports false when none is
+// in force.
+func (m *Moderation) Lift(actor, email, reason string) (AuditEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	email = normalizeEmail(email)
+	if r, ok := m.restrictions[email]; !ok || !r.activeAt(m.now()) {
+		return AuditEntry{}, false
+	}
+	return m.record(AuditEntry{Actor: actor, Action: ActionLift, Email: email, Reason: reason}), true
+}
+
+// Restricted returns the restriction in force on email, if any.
+func (m *Moderation) Restricted(email string) (Restriction, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.restrictions[normalizeEmail(email)]
+	if !ok || !r.activeAt(m.now()) {
+		return Restriction{}, false
+	}
+	return r, true
+}
+
+// Restrictions lists the restrictions in force.
+func (m *Moderation) Restrictions() []Restriction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	out := make([]Restriction, 0, len(m.restrictions))
+	for _, r := range m.restrictions {
+		if r.activeAt(now) {
+			out = append(out, r)
+		}
+	}
+	slices.SortFunc(out, func(a, b Restriction) int { return cmp.Compare(a.At, b.At) })
+	return out
+}
+
+// Audit returns the audit log, oldest first.
+func (m *Moderation) Audit() []AuditEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.audit)
+}
+
+// addReport queues r for review. It reports false when the queue is full.
+func (m *Moderation) addReport(r Report) (Report, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.reports) >= maxOpenReports {
+		// Resolved reports make room first.
+		m.reports = slices.DeleteFunc(m.reports, func(r Report) bool { return r.Resolved })
+		if len(m.reports) >= maxOpenReports {
+			return Report{}, false
+		}
+	}
+	now := m.now()
+	r.ID = reportID(now)
+	r.At = now.UnixMilli()
+	m.reports = append(m.reports, r)
+	return r, true
+}
+
+// reportID mints a time-ordered, random report ID. Reports are not
+// persisted, so a counter would restart with the relay and the same ID
+// would name different reports in MODERATION_LOG_FILE.
+func reportID(now time.Time) string {
+	b := make([]byte, 8)
+	crand.Read(b)
+	return fmt.Sprintf("%d_%s", now.UnixMilli(), hex.EncodeToString(b))
+}
+
+// Reports lists the reports still open, or all kept reports when all is
+// set, oldest first.
+func (m *Moderation) Reports(all bool) []Report {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Report, 0, len(m.reports))
+	for _, r := range m.reports {
+		if all || !r.Resolved {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Resolve closes report id on behalf of actor. It reports false when
+// there is no open report with that ID.
+func (m *Moderation) Resolve(actor, id, reason string) (AuditEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.reports, func(r Report) bool { return r.ID == id })
+	if i < 0 || m.reports[i].Resolved {
+		return AuditEntry{}, false
+	}
+	m.reports[i].Resolved = true
+	return m.record(AuditEntry{Actor: actor, Action: ActionResolve, Email: m.reports[i].Target, Report: id, Reason: reason}), true
+}
+
+// restrictionError is the ERROR sent to a suspended or banned account.
+// The operator's reason stays in the audit log.
+func (s *Server) restrictionError(r Restriction) *ProtocolError {
+	if r.Action == ActionSuspend {
+		return NewError(ErrAccountSuspended, "Account suspended").
+			WithDetail("until", r.Until).
+			WithRetryAfter(time.UnixMilli(r.Until).Sub(s.now()))
+	}
+	pe := NewError(ErrAccountBanned, "Account banned")
+	if r.Until != 0 {
+		pe = pe.WithDetail("until", r.Until)
+	}
+	return pe
+}
+
+// enforce disconnects the account's connection, if any, after a
+// suspension or ban. A parked connection is torn down so it cannot resume.
+// The relay cannot tell which delivery tokens are the account's, so every
+// outstanding token stops working and members fetch new ones.
+func (s *Server) enforce(email string) {
+	r, ok := s.moderation.Restricted(email)
+	if !ok {
+		return
+	}
+	s.deliveryTokens.RevokeAll()
+	c := s.state.account(email)
+	if c == nil {
+		return
+	}
+	s.sendError(c, Frame{}, s.restrictionError(r))
+
+	c.mu.Lock()
+	parked := false
+	if c.stream != nil {
+		parked = c.stream.parked && !c.stream.ended
+		c.stream.ended = true
+	}
+	ws := c.conn
+	c.mu.Unlock()
+
+	s.metrics.Inc("relay_moderation_disconnects_total")
+	log.Printf("[Server] Disconnected %s: account %s", c.id, r.Action)
+	if parked {
+		s.teardown(c)
+		return
+	}
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "account "+r.Action), time.Now().Add(heartbeatWriteTimeout))
+	ws.Close()
+}
+
+// handleReport queues a report about the session member with peer ID
+// data.emailHash, as the reporter sees it, for review.
+func (s *Server) handleReport(client *Client, frame Frame) error {
+	var d struct {
+		EmailHash string `json:"emailHash"`
+		Reason    string `json:"reason"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || d.EmailHash == "" || d.Reason == "" {
+		return NewError(ErrInvalidFrame, "Invalid report")
+	}
+	if len(d.Reason) > maxReportReasonSize {
+		return NewError(ErrPayloadTooLarge, "Report reason too long").WithDetail("max", maxReportReasonSize)
+	}
+	sess := s.state.session(frame.SID)
+	if sess == nil {
+		return NewError(ErrNotMember, "Not a member of this session")
+	}
+	reporter := normalizeEmail(client.email)
+	pairwise := client.wantsPairwise()
+
+	target := ""
+	sess.mu.Lock()
+	for email := range sess.members {
+		if email != reporter && (d.EmailHash == s.peerID(email, reporter, pairwise) || d.EmailHash == s.pseudonyms.Pairwise(email, reporter)) {
+			target = email
+			break
+		}
+	}
+	sess.mu.Unlock()
+	if target == "" {
+		return NewError(ErrUnknownPseudonym, "No session member has that pseudonym")
+	}
+
+	r, ok := s.moderation.addReport(Report{Reporter: reporter, Target: target, TargetHash: d.EmailHash, SID: frame.SID, Reason: d.Reason})
+	if !ok {
+		return NewError(ErrQueueFull, "Report queue full")
+	}
+	s.metrics.Inc("relay_reports_total")
+	data, _ := json.Marshal(map[string]string{"reportId": r.ID})
+	s.send(client, Frame{T: "REPORTED", SID: frame.SID, ID: frame.ID, Data: json.RawMessage(data)})
+	return nil
+}
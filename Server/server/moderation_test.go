@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestModerationRestrictionsExpireAndSurviveReload(t *testing.T) {
+	t.Setenv("MODERATION_LOG_FILE", filepath.Join(t.TempDir(), "moderation.jsonl"))
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	m, err := loadModeration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.now = func() time.Time { return now }
+
+	if _, err := m.Restrict("ops", "a@example.com", ActionSuspend, time.Time{}, "spam", ""); err == nil {
+		t.Fatal("suspension without an end accepted")
+	}
+	m.Restrict("ops", "A@example.com", ActionSuspend, now.Add(time.Hour), "spam", "7")
+	m.Restrict("ops", "b@example.com", ActionBan, time.Time{}, "threats", "")
+	m.Restrict("ops", "c@example.com", ActionBan, time.Time{}, "mistake", "")
+	if _, ok := m.Lift("root", "c@example.com", "appeal upheld"); !ok {
+		t.Fatal("lift failed")
+	}
+	if r, ok := m.Restricted("a@example.com"); !ok || r.Action != ActionSuspend || r.Actor != "ops" {
+		t.Fatalf("suspension not in force: %+v", r)
+	}
+
+	now = now.Add(time.Hour)
+	if _, ok := m.Restricted("a@example.com"); ok {
+		t.Fatal("suspension outlived its period")
+	}
+
+	reloaded, err := loadModeration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded.now = m.now
+	if _, ok := reloaded.Restricted("b@example.com"); !ok {
+		t.Fatal("ban lost on reload")
+	}
+	if _, ok := reloaded.Restricted("c@example.com"); ok {
+		t.Fatal("lifted ban came back on reload")
+	}
+	audit := reloaded.Audit()
+	if len(audit) != 4 || audit[0].Report != "7" || audit[3].Actor != "root" || audit[3].Action != ActionLift || audit[3].Reason != "appeal upheld" {
+		t.Fatalf("unexpected audit log %+v", audit)
+	}
+
+	// Reports are not persisted, so IDs minted after a restart must not
+	// reuse those the audit log already names.
+	before, _ := m.addReport(Report{Target: "a@example.com"})
+	after, _ := reloaded.addReport(Report{Target: "a@example.com"})
+	if before.ID == after.ID {
+		t.Fatalf("report ID %s reused after a restart", after.ID)
+	}
+}
+
+func TestLoadAdminTokens(t *testing.T) {
+	t.Setenv("ADMIN_TOKENS", "alice:0123456789abcdef, bob:fedcba9876543210")
+	tokens, err := loadAdminTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens["0123456789abcdef"] != "alice" || tokens["fedcba9876543210"] != "bob" {
+		t.Fatalf("unexpected tokens %v", tokens)
+	}
+	t.Setenv("ADMIN_TOKENS", "alice:short")
+	if _, err := loadAdminTokens(); err == nil {
+		t.Fatal("short token accepted")
+	}
+}
+
+const testAdminToken = "test-admin-token-0123"
+
+// adminCall sends body (nil for GET) to path as the test operator and
+// decodes the answer into out.
+func adminCall(t *testing.T, base, method, path string, body, out any) int {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req, _ := http.NewRequest(method, base+path, &buf)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+func moderatedServer(t *testing.T, opts ...Option) (*Server, string) {
+	t.Helper()
+	s := newTestServer(append([]Option{WithAdminTokens(map[string]string{testAdminToken: "ops"})}, opts...)...)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts.URL
+}
+
+func TestReportReviewAndSuspension(t *testing.T) {
+	s, base := moderatedServer(t)
+	url := "ws" + strings.TrimPrefix(base, "http")
+	alice, bob, sid, err := connectPair(url, "mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	defer bob.Close()
+	bobEmail := "mod_b@example.com"
+
+	alice.WriteJSON(Frame{T: "REPORT", SID: sid, Data: json.RawMessage(`{"emailHash":"nobody","reason":"spam"}`)})
+	expectFrame(t, alice, "ERROR")
+	alice.WriteJSON(Frame{T: "REPORT", SID: sid, ID: "r1", Data: json.RawMessage(`{"emailHash":"` + emailHash(bobEmail) + `","reason":"spam links"}`)})
+	reported := expectFrame(t, alice, "REPORTED")
+	var ack struct{ ReportID string }
+	if json.Unmarshal(reported.Data, &ack); reported.ID != "r1" || ack.ReportID == "" {
+		t.Fatalf("unexpected REPORTED %+v", reported)
+	}
+
+	if code := adminCall(t, base, "GET", "/admin/reports", nil, nil); code != http.StatusOK {
+		t.Fatalf("GET /admin/reports = %d", code)
+	}
+	req, _ := http.NewRequest("GET", base+"/admin/reports", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("admin API without a token: %v %v", resp, err)
+	}
+	var reports struct{ Reports []Report }
+	adminCall(t, base, "GET", "/admin/reports", nil, &reports)
+	if len(reports.Reports) != 1 || reports.Reports[0].ID != ack.ReportID || reports.Reports[0].Target != bobEmail || reports.Reports[0].Reporter != "mod_a@example.com" {
+		t.Fatalf("unexpected reports %+v", reports)
+	}
+
+	var e AuditEntry
+	code := adminCall(t, base, "POST", "/admin/restrictions", map[string]string{
+		"email": bobEmail, "action": ActionSuspend, "for": "1h", "reason": "spam links", "report": ack.ReportID,
+	}, &e)
+	if code != http.StatusOK || e.Actor != "ops" || e.Until == 0 {
+		t.Fatalf("suspend = %d %+v", code, e)
+	}
+	if f := expectFrame(t, bob, "ERROR"); !strings.Contains(string(f.Data), string(ErrAccountSuspended)) {
+		t.Fatalf("suspended account told %s", f.Data)
+	}
+	bob.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := bob.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("suspended connection not closed: %v", err)
+	}
+	if err := expectNext(alice, "PEER_OFFLINE"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(Frame{T: "AUTH", Data: json.RawMessage(`{"token":"` + getTestSessionToken(bobEmail) + `"}`)})
+	if f := expectFrame(t, conn, "ERROR"); !strings.Contains(string(f.Data), string(ErrAccountSuspended)) || !strings.Contains(string(f.Data), `"until"`) {
+		t.Fatalf("suspended account answered with %s", f.Data)
+	}
+	adminCall(t, base, "POST", "/admin/reports/"+ack.ReportID+"/resolve", map[string]string{"reason": "suspended for a day"}, nil)
+	adminCall(t, base, "POST", "/admin/restrictions/"+bobEmail+"/lift", map[string]string{"reason": "appeal"}, nil)
+	again, err := connectClient(url, bobEmail)
+	if err != nil {
+		t.Fatalf("login after lift: %v", err)
+	}
+	again.Close()
+
+	var audit struct{ Entries []AuditEntry }
+	adminCall(t, base, "GET", "/admin/audit", nil, &audit)
+	var actions []string
+	for _, e := range audit.Entries {
+		actions = append(actions, e.Action)
+	}
+	if strings.Join(actions, ",") != "suspend,resolve,lift" {
+		t.Fatalf("audit actions %v", actions)
+	}
+	if n := s.metrics.Counter("relay_reports_total"); n != 1 {
+		t.Fatalf("relay_reports_total = %d", n)
+	}
+}
+
+func TestBanEndsParkedConnection(t *testing.T) {
+	s, url, alice, token, bob, _ := resumePair(t, WithAdminTokens(map[string]string{testAdminToken: "ops"}))
+	drop(t, s, alice, "alice@example.com")
+	if _, err := s.moderation.Restrict("ops", "alice@example.com", ActionBan, time.Time{}, "fraud", ""); err != nil {
+		t.Fatal(err)
+	}
+	s.enforce("alice@example.com")
+
+	if err := expectNext(bob, "PEER_OFFLINE"); err != nil {
+		t.Fatal(err)
+	}
+	conn := resume(t, url, token, 0)
+	if f := expectFrame(t, conn, "ERROR"); !strings.Contains(string(f.Data), string(ErrResumeFailed)) {
+		t.Fatalf("banned client resumed: %s", f.Data)
+	}
+}
+
+func TestBanRevokesDeliveryTokens(t *testing.T) {
+	s, base := moderatedServer(t)
+	url := "ws" + strings.TrimPrefix(base, "http")
+	alice, bob, sid, err := connectPair(url, "sealedban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	defer bob.Close()
+	tokens := issueTokens(t, s.deliveryTokens, sid, 1)
+	anon, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anon.Close()
+
+	// The relay cannot tell which tokens are the banned account's, so a
+	// ban revokes them all.
+	adminCall(t, base, "POST", "/admin/restrictions", map[string]string{"email": "sealedban_a@example.com", "action": ActionBan, "reason": "spam"}, nil)
+	anon.WriteJSON(Frame{T: "SEALED_MSG", SID: sid, Data: json.RawMessage(`{"payload":"x","token":"` + tokens[0] + `"}`)})
+	if f := expectFrame(t, anon, "ERROR"); !strings.Contains(string(f.Data), string(ErrInvalidToken)) {
+		t.Fatalf("revoked token answered with %s", f.Data)
+	}
+
+	// Other members fetch fresh tokens under a new key.
+	expectFrame(t, bob, "PEER_OFFLINE")
+	fresh := fetchTokens(t, bob, sid, 1)
+	anon.WriteJSON(Frame{T: "SEALED_MSG", SID: sid, C: true, Data: json.RawMessage(`{"payload":"x","token":"` + fresh[0] + `"}`)})
+	expectFrame(t, anon, "DELIVERED")
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	maxQueuedFramesPerUser = 50
+	queuedFrameTTL         = 7 * 24 * time.Hour
+	offlineSweepInterval   = time.Hour
+)
+
+type queuedFrame struct {
+	frame    Frame
+	queuedAt time.Time
+}
+
+// OfflineQueue holds frames for accounts that are not connected and hands
+// them over on the next successful AUTH.
+type OfflineQueue struct {
+	frames    map[string][]queuedFrame
+	now       func() time.Time
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+func NewOfflineQueue() *OfflineQueue {
+	return &OfflineQueue{frames: make(map[string][]queuedFrame), now: time.Now}
+}
+
+func (q *OfflineQueue) Push(email string, f Frame) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	q.sweep(now)
+	email = normalizeEmail(email)
+	pending := unexpired(q.frames[email], now)
+	if len(pending) >= maxQueuedFramesPerUser {
+		q.frames[email] = pending
+		return false
+	}
+	q.frames[email] = append(pending, queuedFrame{frame: f, queuedAt: now})
+	return true
+}
+
+func (q *OfflineQueue) Drain(email string) []Frame {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	email = normalizeEmail(email)
+	pending := q.frames[email]
+	delete(q.frames, email)
+
+	pending = unexpired(pending, q.now())
+	out := make([]Frame, len(pending))
+	for i, p := range pending {
+		out[i] = p.frame
+	}
+	return out
+}
+
+// sweep drops expired frames, and with them the queues of accounts that
+// never came back for them.
+func (q *OfflineQueue) sweep(now time.Time) {
+	if now.Sub(q.lastSweep) < offlineSweepInterval {
+		return
+	}
+	for email, pending := range q.frames {
+		if pending = unexpired(pending, now); len(pending) == 0 {
+			delete(q.frames, email)
+		} else {
+			q.frames[email] = pending
+		}
+	}
+	q.lastSweep = now
+}
+
+// unexpired returns the frames in pending that have not expired. Frames
+// are queued in order, so the expired ones are a prefix.
+func unexpired(pending []queuedFrame, now time.Time) []queuedFrame {
+	for i, p := range pending {
+		if now.Sub(p.queuedAt) < queuedFrameTTL {
+			return pending[i:]
+		}
+	}
+	return nil
+}
+
+func (q *OfflineQueue) Len(email string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(unexpired(q.frames[normalizeEmail(email)], q.now()))
+}
+
+// accounts is the number of accounts with a queue, expired or not.
+func (q *OfflineQueue) accounts() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.frames)
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOfflineQueueSweepsAccountsThatNeverReturn(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	q := NewOfflineQueue()
+	q.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		q.Push(fmt.Sprintf("gone%d@example.com", i), Frame{T: "JOIN_REQUEST"})
+	}
+	now = now.Add(queuedFrameTTL)
+	q.Push("fresh@example.com", Frame{T: "JOIN_REQUEST"})
+	if n := q.accounts(); n != 1 {
+		t.Fatalf("%d accounts queued after the sweep, want 1", n)
+	}
+	if n := q.Len("fresh@example.com"); n != 1 {
+		t.Fatalf("fresh queue has %d frames", n)
+	}
+}
+
+func TestOfflineQueueExpiredFramesFreeRoom(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	q := NewOfflineQueue()
+	q.now = func() time.Time { return now }
+
+	for i := 0; i < maxQueuedFramesPerUser; i++ {
+		q.Push("bob@example.com", Frame{T: "JOIN_REQUEST"})
+	}
+	if q.Push("bob@example.com", Frame{T: "JOIN_REQUEST"}) {
+		t.Fatal("pushed past a full queue")
+	}
+	now = now.Add(queuedFrameTTL)
+	if !q.Push("bob@example.com", Frame{T: "JOIN_REQUEST", SID: "new"}) {
+		t.Fatal("expired frames still count against the queue limit")
+	}
+	if frames := q.Drain("bob@example.com"); len(frames) != 1 || frames[0].SID != "new" {
+		t.Fatalf("drained %+v", frames)
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// Option configures a Server built by New.
+type Option func(*Server)
+
+// AuthVerifier resolves the OAuth token of an AUTH frame to an account
+// email. Session tokens issued by the server itself ("sess:") are checked
+// before the verifier is consulted.
+type AuthVerifier interface {
+	VerifyToken(token string) (email string, err error)
+}
+
+// AuthVerifierFunc adapts a plain function to AuthVerifier.
+type AuthVerifierFunc func(token string) (string, error)
+
+func (f AuthVerifierFunc) VerifyToken(token string) (string, error) { return f(token) }
+
+// OfflineStore holds frames for accounts that are not connected. Push
+// reports false when the account's queue is full.
+type OfflineStore interface {
+	Push(email string, f Frame) bool
+	Drain(email string) []Frame
+	Len(email string) int
+}
+
+// WithLogger sets the connection log, which records CONNECT_REQ attempts
+// by email hash. It is discarded by default.
+func WithLogger(l *log.Logger) Option {
+	return func(s *Server) { s.logger = l }
+}
+
+// WithSessionSecret sets the key that signs session tokens and, unless
+// they are configured separately, delivery tokens, pairwise pseudonyms and
+// TURN bindings. A random key is used by default, so tokens do not survive
+// a restart.
+func WithSessionSecret(secret []byte) Option {
+	return func(s *Server) { s.secret = secret }
+}
+
+// WithAuthVerifier replaces GoogleVerifier.
+func WithAuthVerifier(v AuthVerifier) Option {
+	return func(s *Server) { s.auth = v }
+}
+
+// WithOfflineStore replaces the in-memory offline queue.
+func WithOfflineStore(store OfflineStore) Option {
+	return func(s *Server) { s.offline = store }
+}
+
+// WithPreKeyStore replaces the in-memory prekey store.
+func WithPreKeyStore(ps *PreKeyStore) Option {
+	return func(s *Server) { s.preKeys = ps }
+}
+
+// WithKeyLog sets the key transparency log served under /kt/.
+func WithKeyLog(kl *KeyLog) Option {
+	return func(s *Server) { s.keyLog = kl }
+}
+
+// WithPseudonyms sets the pairwise pseudonym key and legacy cutoff.
+func WithPseudonyms(p *Pseudonyms) Option {
+	return func(s *Server) { s.pseudonyms = p }
+}
+
+// WithRateLimits replaces the per-frame rate rules. Frame types without
+// rules are not limited, so an empty map disables rate limiting.
+func WithRateLimits(rules map[string][]RateRule) Option {
+	return func(s *Server) { s.rules = rules }
+}
+
+// WithClock sets the time source for session, delivery token and offline
+// queue expiry. It defaults to time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(s *Server) { s.now = now }
+}
+
+// WithTurnPool sets the TURN servers handed out in TURN_CREDS.
+func WithTurnPool(p *TurnPool) Option {
+	return func(s *Server) { s.turnPool = p }
+}
+
+// WithEmbeddedTurn runs a TURN server in-process on Start. The pool must
+// contain an endpoint marked Embedded; its secrets are shared with cfg.
+func WithEmbeddedTurn(cfg TurnConfig) Option {
+	return func(s *Server) { s.turnConfig = &cfg }
+}
+
+// WithSFU enables the selective forwarding unit on Start.
+func WithSFU(cfg SFUConfig) Option {
+	return func(s *Server) { s.sfuConfig = &cfg }
+}
+
+// WithTrustedProxies sets the proxies whose forwarding headers are
+// believed when resolving client IPs.
+func WithTrustedProxies(tp *TrustedProxies) Option {
+	return func(s *Server) { s.proxies = tp }
+}
+
+// WithProxyProtocol makes Start expect a PROXY protocol header from
+// trusted proxies.
+func WithProxyProtocol(enabled bool) Option {
+	return func(s *Server) { s.proxyProtocol = enabled }
+}
+
+// WithCallRingTimeout sets how long CALL_START rings before the call is
+// reported missed.
+func WithCallRingTimeout(d time.Duration) Option {
+	return func(s *Server) { s.ringTimeout = d }
+}
+
+// WithRelayOnlyICE forces relay-only ICE for every client.
+func WithRelayOnlyICE(enabled bool) Option {
+	return func(s *Server) { s.relayOnly = enabled }
+}
+
+// WithFrameTrace logs every dispatched frame with its latency.
+func WithFrameTrace(enabled bool) Option {
+	return func(s *Server) { s.tracing = enabled }
+}
+
+// WithHeartbeat sets how often connections are pinged and how many pings
+// may go unanswered before the connection is dropped.
+func WithHeartbeat(interval time.Duration, missed int) Option {
+	return func(s *Server) { s.heartbeatInterval, s.heartbeatMissed = interval, missed }
+}
+
+// WithQuotas sets the per-account quotas and the tiers they come in.
+func WithQuotas(q *Quotas) Option {
+	return func(s *Server) { s.quotas = q }
+}
+
+// WithModeration sets the report queue, restrictions and audit log.
+func WithModeration(m *Moderation) Option {
+	return func(s *Server) { s.moderation = m }
+}
+
+// WithAdminTokens enables the moderation API under /admin/ for the given
+// bearer tokens, each mapped to the operator name the audit log records.
+func WithAdminTokens(tokens map[string]string) Option {
+	return func(s *Server) { s.adminTokens = tokens }
+}
+
+// WithMetricsToken serves /metrics to requests carrying this bearer token.
+// Admin tokens are accepted too. With neither, /metrics is not served.
+func WithMetricsToken(token string) Option {
+	return func(s *Server) { s.metricsToken = token }
+}
+
+// WithSyncRetention sets how many recent MSGs each session keeps for SYNC,
+// and for how long. Zero frames keeps none, so SYNC can only report gaps.
+func WithSyncRetention(frames int, age time.Duration) Option {
+	return func(s *Server) { s.syncFrames, s.syncAge = frames, age }
+}
+
+// WithResume sets how long a dropped resumable connection keeps its
+// account and sessions, and how many recent frames it buffers for RESUME.
+// A zero window turns resumption off.
+func WithResume(window time.Duration, frames int) Option {
+	return func(s *Server) { s.resumeWindow, s.resumeFrames = window, frames }
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Each connected client has an outbox: frames queued for it are written by
+// its own goroutine in the order they were queued. Handlers queue frames
+// while they hold a session's lock, so clients see them in the order they
+// were numbered, but wait for the writes only after unlocking. A peer that
+// stops reading then holds up its own writer and nobody else.
+
+// defaultOutboxFrames is how many frames may wait for a client on top of a
+// full SYNC replay before it is treated as too slow to keep up.
+const defaultOutboxFrames = 256
+
+var (
+	// errClientGone is the result of a frame queued after teardown.
+	errClientGone = errors.New("client is gone")
+	// errSlowClient means the outbox was full: the frame was dropped and
+	// the connection is closed, so the client catches up with SYNC.
+	errSlowClient = errors.New("client is not reading, outbox full")
+)
+
+type outbox struct {
+	mu     sync.Mutex
+	frames []outFrame
+	limit  int
+	closed bool
+	full   bool          // a frame was dropped; the writer closes the connection
+	wake   chan struct{} // signalled when frames are queued, closed at teardown
+}
+
+type outFrame struct {
+	data []byte
+	pm   *websocket.PreparedMessage // set when data is shared between recipients
+	done chan error
+}
+
+// openOutbox gives c an outbox and starts its writer.
+func (s *Server) openOutbox(c *Client) {
+	c.out = &outbox{limit: defaultOutboxFrames + s.syncFrames, wake: make(chan struct{}, 1)}
+	go s.drain(c, c.out)
+}
+
+// closeOutbox stops c's writer. Frames still queued, and any queued later,
+// fail with errClientGone.
+func (c *Client) closeOutbox() {
+	ob := c.out
+	if ob == nil {
+		return
+	}
+	ob.mu.Lock()
+	if ob.closed {
+		ob.mu.Unlock()
+		return
+	}
+	ob.closed = true
+	pending := ob.frames
+	ob.frames = nil
+	close(ob.wake)
+	ob.mu.Unlock()
+	for _, f := range pending {
+		f.done <- errClientGone
+	}
+}
+
+// queue adds an encoded frame for c and returns where its write result will
+// arrive. frame must not change afterwards. It never blocks on the network,
+// so it is safe under a session lock.
+func (s *Server) queue(c *Client, frame []byte, pm *websocket.PreparedMessage) <-chan error {
+	done := make(chan error, 1)
+	ob := c.out
+	if ob == nil {
+		done <- s.write(c, frame, pm)
+		return done
+	}
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	switch {
+	case ob.closed:
+		done <- errClientGone
+	case len(ob.frames) >= ob.limit:
+		ob.full = true
+		done <- errSlowClient
+		ob.signal()
+	default:
+		ob.frames = append(ob.frames, outFrame{data: frame, pm: pm, done: done})
+		ob.signal()
+	}
+	return done
+}
+
+// signal wakes the writer. The caller holds ob.mu and ob is open.
+func (ob *outbox) signal() {
+	select {
+	case ob.wake <- struct{}{}:
+	default:
+	}
+}
+
+// post encodes f and queues it for c.
+func (s *Server) post(c *Client, f Frame) <-chan error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		done := make(chan error, 1)
+		done <- err
+		return done
+	}
+	return s.queue(c, data, nil)
+}
+
+// drain is c's writer. It runs until closeOutbox.
+func (s *Server) drain(c *Client, ob *outbox) {
+	for range ob.wake {
+		for {
+			ob.mu.Lock()
+			if ob.full {
+				ob.full = false
+				ob.mu.Unlock()
+				s.dropSlow(c)
+				continue
+			}
+			if len(ob.frames) == 0 {
+				ob.mu.Unlock()
+				break
+			}
+			f := ob.frames[0]
+			ob.frames[0] = outFrame{}
+			ob.frames = ob.frames[1:]
+			ob.mu.Unlock()
+			f.done <- s.write(c, f.data, f.pm)
+		}
+	}
+}
+
+// dropSlow disconnects a client whose outbox overflowed. It may not
+// resume: the frames it would replay have a hole where the dropped ones were.
+func (s *Server) dropSlow(c *Client) {
+	c.mu.Lock()
+	parked := false
+	if c.stream != nil {
+		parked = c.stream.parked && !c.stream.ended
+		c.stream.ended = true
+	}
+	conn := c.conn
+	c.mu.Unlock()
+
+	s.metrics.Inc("relay_slow_client_disconnects_total")
+	log.Printf("[Server] Disconnected %s: outbox full", c.id)
+	if parked {
+		s.teardown(c)
+		return
+	}
+	conn.Close()
+}
+
+// write sends an encoded frame to c now. Resumable clients number their
+// frames, so they are written their own copy of a shared frame.
+func (s *Server) write(c *Client, frame []byte, pm *websocket.PreparedMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stream != nil {
+		return s.writeStream(c, frame)
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if pm != nil {
+		return c.conn.WritePreparedMessage(pm)
+	}
+	return c.conn.WriteMessage(websocket.TextMessage, frame)
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+const (
+	maxOneTimePreKeys     = 100
+	preKeyLowWatermark    = 10
+	maxPreKeyEncodedBytes = 256
+)
+
+type SignedPreKey struct {
+	KeyID     int    `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+}
+
+type OneTimePreKey struct {
+	KeyID     int    `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+}
+
+// PreKeyBundle is what a peer needs to start an X3DH-style handshake with an
+// account that may be offline. OneTimePreKey is nil once the pool is drained.
+// EmailHash is left for the caller to fill with the target's ID as the
+// fetching account sees it.
+type PreKeyBundle struct {
+	EmailHash     string         `json:"emailHash"`
+	IdentityKey   string         `json:"identityKey"`
+	SignedPreKey  SignedPreKey   `json:"signedPreKey"`
+	OneTimePreKey *OneTimePreKey `json:"oneTimePreKey,omitempty"`
+	Remaining     int            `json:"-"`
+}
+
+type preKeyAccount struct {
+	identityKey  string
+	signedPreKey SignedPreKey
+	oneTime      []OneTimePreKey
+}
+
+type PreKeyStore struct {
+	accounts map[string]*preKeyAccount
+	mu       sync.Mutex
+}
+
+func NewPreKeyStore() *PreKeyStore {
+	return &PreKeyStore{accounts: make(map[string]*preKeyAccount)}
+}
+
+func decodeP256Key(b64 string) (*ecdsa.PublicKey, error) {
+	if b64 == "" || len(b64) > maxPreKeyEncodedBytes {
+		return nil, fmt.Errorf("invalid key length")
+	}
+	raw, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key encoding")
+	}
+	return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), raw)
+}
+
+// verifySignedPreKey checks a WebCrypto ECDSA P-256/SHA-256 signature
+// (raw r||s) made by the identity key over the raw signed prekey bytes.
+func verifySignedPreKey(identityKey string, spk SignedPreKey) error {
+	idPub, err := decodeP256Key(identityKey)
+	if err != nil {
+		return fmt.Errorf("identity key: %w", err)
+	}
+	if _, err := decodeP256Key(spk.PublicKey); err != nil {
+		return fmt.Errorf("signed prekey: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(spk.Signature)
+	if err != nil || len(sig) != 64 {
+		return fmt.Errorf("invalid signature encoding")
+	}
+	raw, _ := base64.StdEncoding.DecodeString(spk.PublicKey)
+	digest := sha256.Sum256(raw)
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(idPub, digest[:], r, s) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// Upload replaces the identity key and signed prekey and appends the given
+// one-time prekeys. Changing the identity key discards any old one-time keys.
+func (ps *PreKeyStore) Upload(email, identityKey string, spk SignedPreKey, oneTime []OneTimePreKey) (int, error) {
+	if err := verifySignedPreKey(identityKey, spk); err != nil {
+		return 0, err
+	}
+	for _, k := range oneTime {
+		if _, err := decodeP256Key(k.PublicKey); err != nil {
+			return 0, fmt.Errorf("one-time prekey %d: %w", k.KeyID, err)
+		}
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	email = normalizeEmail(email)
+	acc, ok := ps.accounts[email]
+	if !ok || acc.identityKey != identityKey {
+		acc = &preKeyAccount{identityKey: identityKey}
+		ps.accounts[email] = acc
+	}
+	acc.signedPreKey = spk
+
+	seen := make(map[int]bool, len(acc.oneTime))
+	for _, k := range acc.oneTime {
+		seen[k.KeyID] = true
+	}
+	for _, k := range oneTime {
+		if len(acc.oneTime) >= maxOneTimePreKeys {
+			break
+		}
+		if seen[k.KeyID] {
+			continue
+		}
+		seen[k.KeyID] = true
+		acc.oneTime = append(acc.oneTime, k)
+	}
+	return len(acc.oneTime), nil
+}
+
+// Fetch returns the bundle for email and consumes one one-time prekey.
+func (ps *PreKeyStore) Fetch(email string) (*PreKeyBundle, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	email = normalizeEmail(email)
+	acc, ok := ps.accounts[email]
+	if !ok {
+		return nil, false
+	}
+	bundle := &PreKeyBundle{
+		IdentityKey:  acc.identityKey,
+		SignedPreKey: acc.signedPreKey,
+	}
+	if len(acc.oneTime) > 0 {
+		k := acc.oneTime[0]
+		acc.oneTime = acc.oneTime[1:]
+		bundle.OneTimePreKey = &k
+	}
+	bundle.Remaining = len(acc.oneTime)
+	return bundle, true
+}
+
+func (ps *PreKeyStore) Has(email string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	_, ok := ps.accounts[normalizeEmail(email)]
+	return ok
+}
+
+// Size is the number of key and signature bytes stored for email.
+func (ps *PreKeyStore) Size(email string) int64 {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	acc, ok := ps.accounts[normalizeEmail(email)]
+	if !ok {
+		return 0
+	}
+	n := len(acc.identityKey) + len(acc.signedPreKey.PublicKey) + len(acc.signedPreKey.Signature)
+	for _, k := range acc.oneTime {
+		n += len(k.PublicKey)
+	}
+	return int64(n)
+}
+
+// Remaining reports the one-time prekey count, or -1 if nothing was uploaded.
+func (ps *PreKeyStore) Remaining(email string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	acc, ok := ps.accounts[normalizeEmail(email)]
+	if !ok {
+		return -1
+	}
+	return len(acc.oneTime)
+}
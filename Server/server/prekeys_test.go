@@ -0,0 +1,225 @@
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testIdentity(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func encodeP256(t *testing.T, k *ecdsa.PublicKey) string {
+	t.Helper()
+	raw, err := k.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func testECDHKey(t *testing.T) string {
+	t.Helper()
+	k, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(k.PublicKey().Bytes())
+}
+
+func signPreKey(t *testing.T, id *ecdsa.PrivateKey, keyID int) SignedPreKey {
+	t.Helper()
+	pub := testECDHKey(t)
+	raw, _ := base64.StdEncoding.DecodeString(pub)
+	digest := sha256.Sum256(raw)
+	r, s, err := ecdsa.Sign(rand.Reader, id, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return SignedPreKey{KeyID: keyID, PublicKey: pub, Signature: base64.StdEncoding.EncodeToString(sig)}
+}
+
+func testOneTimeKeys(t *testing.T, n int) []OneTimePreKey {
+	keys := make([]OneTimePreKey, n)
+	for i := range keys {
+		keys[i] = OneTimePreKey{KeyID: i + 1, PublicKey: testECDHKey(t)}
+	}
+	return keys
+}
+
+func TestPreKeyStoreFetchConsumesOneTimeKeys(t *testing.T) {
+	ps := NewPreKeyStore()
+	id := testIdentity(t)
+	idKey := encodeP256(t, &id.PublicKey)
+
+	n, err := ps.Upload("Bob@Example.com", idKey, signPreKey(t, id, 1), testOneTimeKeys(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 one-time keys, got %d", n)
+	}
+
+	for i, want := range []int{1, 2} {
+		b, ok := ps.Fetch("bob@example.com")
+		if !ok || b.OneTimePreKey == nil {
+			t.Fatalf("fetch %d: expected a one-time key", i)
+		}
+		if b.OneTimePreKey.KeyID != want {
+			t.Fatalf("fetch %d: got key %d, want %d", i, b.OneTimePreKey.KeyID, want)
+		}
+	}
+
+	b, ok := ps.Fetch("bob@example.com")
+	if !ok {
+		t.Fatal("bundle should still be served once one-time keys run out")
+	}
+	if b.OneTimePreKey != nil || b.Remaining != 0 {
+		t.Fatalf("expected drained bundle, got %+v", b)
+	}
+}
+
+func TestPreKeyStoreRejectsBadSignature(t *testing.T) {
+	ps := NewPreKeyStore()
+	id := testIdentity(t)
+	other := testIdentity(t)
+
+	_, err := ps.Upload("bob@example.com", encodeP256(t, &id.PublicKey), signPreKey(t, other, 1), nil)
+	if err == nil {
+		t.Fatal("expected signature from a different key to be rejected")
+	}
+	if ps.Has("bob@example.com") {
+		t.Fatal("rejected upload must not be stored")
+	}
+}
+
+func TestPreKeyStoreIdentityChangeResetsPool(t *testing.T) {
+	ps := NewPreKeyStore()
+	id1, id2 := testIdentity(t), testIdentity(t)
+
+	if _, err := ps.Upload("bob@example.com", encodeP256(t, &id1.PublicKey), signPreKey(t, id1, 1), testOneTimeKeys(t, 5)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := ps.Upload("bob@example.com", encodeP256(t, &id2.PublicKey), signPreKey(t, id2, 1), testOneTimeKeys(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected old one-time keys to be discarded, have %d", n)
+	}
+}
+
+func TestConnectRequestQueuedForOfflineTarget(t *testing.T) {
+	s := newTestServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	bob, err := connectClient(wsUrl, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := testIdentity(t)
+	upload, _ := json.Marshal(map[string]any{
+		"identityKey":    encodeP256(t, &id.PublicKey),
+		"signedPreKey":   signPreKey(t, id, 7),
+		"oneTimePreKeys": testOneTimeKeys(t, 1),
+	})
+	bob.WriteJSON(Frame{T: "PREKEY_UPLOAD", Data: upload})
+	if f, err := readMSG(bob); err != nil || f.T != "PREKEY_UPLOADED" {
+		t.Fatalf("expected PREKEY_UPLOADED, got %+v (%v)", f, err)
+	}
+	if f, err := readMSG(bob); err != nil || f.T != "PREKEY_LOW" {
+		t.Fatalf("expected PREKEY_LOW after upload below watermark, got %+v (%v)", f, err)
+	}
+	bob.Close()
+	for {
+		online := s.state.account("bob@example.com") != nil
+		if !online {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	alice, err := connectClient(wsUrl, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	alice.WriteJSON(Frame{T: "PREKEY_FETCH", Data: json.RawMessage(`{"targetEmail":"bob@example.com"}`)})
+	f, err := readMSG(alice)
+	if err != nil || f.T != "PREKEY_BUNDLE" {
+		t.Fatalf("expected PREKEY_BUNDLE, got %+v (%v)", f, err)
+	}
+	var bundle PreKeyBundle
+	json.Unmarshal(f.Data, &bundle)
+	if bundle.SignedPreKey.KeyID != 7 || bundle.OneTimePreKey == nil {
+		t.Fatalf("unexpected bundle %+v", bundle)
+	}
+
+	req := fmt.Sprintf(`{"targetEmail":"bob@example.com","publicKey":"keyA","ephemeralKey":"ekA","signedPreKeyId":7,"oneTimePreKeyId":%d}`, bundle.OneTimePreKey.KeyID)
+	alice.WriteJSON(Frame{T: "CONNECT_REQ", Data: json.RawMessage(req)})
+	queued, err := readMSG(alice)
+	if err != nil || queued.T != "CONNECT_QUEUED" {
+		t.Fatalf("expected CONNECT_QUEUED, got %+v (%v)", queued, err)
+	}
+
+	bob, err = connectClient(wsUrl, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	joinReq, err := readMSG(bob)
+	if err != nil || joinReq.T != "JOIN_REQUEST" || joinReq.SID != queued.SID {
+		t.Fatalf("expected queued JOIN_REQUEST for %s, got %+v (%v)", queued.SID, joinReq, err)
+	}
+	var jr map[string]any
+	json.Unmarshal(joinReq.Data, &jr)
+	if jr["ephemeralKey"] != "ekA" {
+		t.Fatalf("handshake fields not forwarded: %v", jr)
+	}
+}
+
+func TestPreKeyFetchIsRateLimited(t *testing.T) {
+	ts := setupTestServer()
+	defer ts.Close()
+	alice, err := connectClient("ws"+strings.TrimPrefix(ts.URL, "http"), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	burst := int(defaultRateRules()["PREKEY_FETCH"][0].Burst)
+	for i := 0; i <= burst; i++ {
+		alice.WriteJSON(Frame{T: "PREKEY_FETCH", Data: json.RawMessage(fmt.Sprintf(`{"targetEmail":"probe%d@example.com"}`, i))})
+		f := expectFrame(t, alice, "ERROR")
+		var pe ProtocolError
+		json.Unmarshal(f.Data, &pe)
+		want := ErrNoPreKeys
+		if i == burst {
+			want = ErrRateLimited
+		}
+		if pe.Code != want {
+			t.Fatalf("fetch %d: expected %s, got %s", i, want, f.Data)
+		}
+	}
+}
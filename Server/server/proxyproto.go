@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener reads an HAProxy PROXY protocol (v1 or v2) header from
+// connections opened by trusted proxies and reports the original client as
+// the connection's RemoteAddr. Other peers are passed through untouched.
+type proxyListener struct {
+	net.Listener
+	trusted *TrustedProxies
+}
+
+func newProxyListener(l net.Listener, trusted *TrustedProxies) net.Listener {
+	return &proxyListener{Listener: l, trusted: trusted}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	peer, ok := parseHostAddr(c.RemoteAddr().String())
+	if !ok || !l.trusted.Trusted(peer) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn parses the header lazily, on the first Read or RemoteAddr call,
+// so a slow proxy cannot stall the accept loop.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader returns the source address announced by the proxy, or nil
+// for LOCAL / UNKNOWN headers where the connection's own address applies.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if prefix, err := r.Peek(6); err == nil && string(prefix) == "PROXY " {
+		return readProxyV1(r)
+	}
+	return nil, fmt.Errorf("proxy protocol: missing header")
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// A v1 header is at most 107 bytes including CRLF.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("proxy protocol: v1 header too long")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxy protocol: malformed v1 header")
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol: bad source address")
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol: bad source port")
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("proxy protocol: unsupported version")
+	}
+	command := hdr[12] & 0x0f
+	family := hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if command == 0x0 {
+		return nil, nil // LOCAL: health check from the proxy itself
+	}
+	if command != 0x1 {
+		return nil, fmt.Errorf("proxy protocol: unsupported command")
+	}
+
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("proxy protocol: short v2 address block")
+		}
+		addr := netip.AddrFrom4([4]byte(body[0:4]))
+		port := binary.BigEndian.Uint16(body[8:10])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("proxy protocol: short v2 address block")
+		}
+		addr := netip.AddrFrom16([16]byte(body[0:16])).Unmap()
+		port := binary.BigEndian.Uint16(body[32:34])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+	}
+	return nil, nil
+}
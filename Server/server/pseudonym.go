@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Pseudonyms derives pairwise identifiers: the name an account has in the
+// eyes of one particular contact. Unlike emailHash they are keyed with a
+// server secret, so a list of candidate emails cannot be used to reverse
+// them, and two contacts cannot correlate the same account by its ID.
+type Pseudonyms struct {
+	key []byte
+	// Until legacyUntil, clients that did not opt in with pairwiseIds in
+	// AUTH keep receiving the global emailHash. Zero means no cutoff yet.
+	legacyUntil time.Time
+}
+
+func NewPseudonyms(secret []byte, legacyUntil time.Time) *Pseudonyms {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("pairwise-pseudonym"))
+	return &Pseudonyms{key: h.Sum(nil), legacyUntil: legacyUntil}
+}
+
+// loadPseudonyms reads PSEUDONYM_SECRET and LEGACY_EMAIL_HASH_UNTIL
+// (RFC 3339 or YYYY-MM-DD). Without a secret, one is derived from the
+// session secret.
+func loadPseudonyms(secret []byte) (*Pseudonyms, error) {
+	if seed := strings.TrimSpace(os.Getenv("PSEUDONYM_SECRET")); seed != "" {
+		sum := sha256.Sum256([]byte(seed))
+		secret = sum[:]
+	}
+
+	var until time.Time
+	if v := strings.TrimSpace(os.Getenv("LEGACY_EMAIL_HASH_UNTIL")); v != "" {
+		var err error
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			if until, err = time.Parse(time.DateOnly, v); err != nil {
+				return nil, fmt.Errorf("invalid LEGACY_EMAIL_HASH_UNTIL: %q", v)
+			}
+		}
+	}
+	return NewPseudonyms(secret, until), nil
+}
+
+// Pairwise is the identifier of subject as presented to viewer.
+func (p *Pseudonyms) Pairwise(subject, viewer string) string {
+	h := hmac.New(sha256.New, p.key)
+	h.Write([]byte(normalizeEmail(viewer)))
+	h.Write([]byte{0})
+	h.Write([]byte(normalizeEmail(subject)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (p *Pseudonyms) legacyAllowed() bool {
+	return p.legacyUntil.IsZero() || time.Now().Before(p.legacyUntil)
+}
+
+// peerID is what viewer sees as subject's identifier in SH. Frames queued
+// for an offline viewer pass pairwise=false since its capabilities are
+// unknown until it authenticates.
+func (s *Server) peerID(subject, viewer string, pairwise bool) string {
+	if !pairwise && s.pseudonyms.legacyAllowed() {
+		return emailHash(subject)
+	}
+	return s.pseudonyms.Pairwise(subject, viewer)
+}
+
+// peerIDs returns peerID for subject as each viewer sees it. The legacy
+// email hash is the same for every viewer, so it is computed once.
+func (s *Server) peerIDs(subject string) func(viewer *Client) string {
+	var legacy string
+	return func(c *Client) string {
+		if c.wantsPairwise() || !s.pseudonyms.legacyAllowed() {
+			return s.pseudonyms.Pairwise(subject, c.email)
+		}
+		if legacy == "" {
+			legacy = emailHash(subject)
+		}
+		return legacy
+	}
+}
+
+// identityFields fills the sender identifiers of a JOIN_* payload for viewer.
+// The plaintext email and global hash only go to legacy clients during the
+// transition window; everyone else resolves the pseudonym with
+// RESOLVE_PSEUDONYM.
+func (s *Server) identityFields(m map[string]any, subject, viewer string, pairwise bool) {
+	m["pseudonym"] = s.pseudonyms.Pairwise(subject, viewer)
+	if !pairwise && s.pseudonyms.legacyAllowed() {
+		m["email"] = normalizeEmail(subject)
+		m["emailHash"] = emailHash(subject)
+	}
+}
+
+func (c *Client) wantsPairwise() bool {
+	return c.pairwise.Load()
+}
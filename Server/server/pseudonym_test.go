@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPairwisePseudonymsDifferPerViewer(t *testing.T) {
+	p := NewPseudonyms([]byte("secret"), time.Time{})
+	toBob := p.Pairwise("alice@example.com", "bob@example.com")
+	toCarol := p.Pairwise("Alice@Example.com", "carol@example.com")
+	if toBob == toCarol {
+		t.Fatal("pseudonym is not pairwise")
+	}
+	if toBob == emailHash("alice@example.com") {
+		t.Fatal("pseudonym equals the global email hash")
+	}
+	if toBob != p.Pairwise("alice@example.com", "BOB@example.com ") {
+		t.Fatal("pseudonym is not stable across email normalization")
+	}
+}
+
+func connectPairwiseClient(url, email string) (*websocket.Conn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	auth := fmt.Sprintf(`{"token":"%s","pairwiseIds":true}`, getTestSessionToken(email))
+	if err := conn.WriteJSON(Frame{T: "AUTH", Data: json.RawMessage(auth)}); err != nil {
+		return nil, err
+	}
+	if resp, err := readMSG(conn); err != nil || resp.T != "AUTH_SUCCESS" {
+		return nil, fmt.Errorf("auth failed: %v %v", resp, err)
+	}
+	return conn, nil
+}
+
+func TestMsgSenderIDTransition(t *testing.T) {
+	s := newTestServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	alice, err := connectClient(wsUrl, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := connectPairwiseClient(wsUrl, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	sid, err := establishSession(alice, bob, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"hi"}`)})
+	msg, err := readMSG(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := s.pseudonyms.Pairwise("alice@example.com", "bob@example.com")
+	if msg.SH != want {
+		t.Fatalf("opted-in client got SH %q, want pseudonym %q", msg.SH, want)
+	}
+
+	bob.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"hey"}`)})
+	if msg, err = readMSG(alice); err != nil {
+		t.Fatal(err)
+	}
+	if msg.SH != emailHash("bob@example.com") {
+		t.Fatalf("legacy client got SH %q during transition window", msg.SH)
+	}
+
+	bob.WriteJSON(Frame{T: "RESOLVE_PSEUDONYM", SID: sid, Data: json.RawMessage(fmt.Sprintf(`{"pseudonym":"%s"}`, want))})
+	resolved, err := readMSG(bob)
+	if err != nil || resolved.T != "PSEUDONYM_RESOLVED" {
+		t.Fatalf("expected PSEUDONYM_RESOLVED, got %+v (%v)", resolved, err)
+	}
+	if !strings.Contains(string(resolved.Data), "alice@example.com") {
+		t.Fatalf("unexpected resolution %s", resolved.Data)
+	}
+
+	s.pseudonyms.legacyUntil = time.Now().Add(-time.Hour)
+	bob.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"hey"}`)})
+	if msg, err = readMSG(alice); err != nil {
+		t.Fatal(err)
+	}
+	if msg.SH != s.pseudonyms.Pairwise("bob@example.com", "alice@example.com") {
+		t.Fatalf("legacy hash still sent after the transition window: %q", msg.SH)
+	}
+}
+
+func TestPairwiseClientsSeeNoGlobalIdentifiers(t *testing.T) {
+	s := newTestServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	alice, err := connectClient(wsUrl, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := connectPairwiseClient(wsUrl, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	alice.WriteJSON(Frame{T: "CONNECT_REQ", Data: json.RawMessage(`{"targetEmail":"bob@example.com","publicKey":"keyA"}`)})
+	joinReq, err := readMSG(bob)
+	if err != nil || joinReq.T != "JOIN_REQUEST" {
+		t.Fatalf("expected JOIN_REQUEST, got %+v (%v)", joinReq, err)
+	}
+	var req map[string]any
+	json.Unmarshal(joinReq.Data, &req)
+	if _, ok := req["email"]; ok {
+		t.Fatalf("opted-in client got the requester's email: %s", joinReq.Data)
+	}
+	if _, ok := req["emailHash"]; ok {
+		t.Fatalf("opted-in client got the global email hash: %s", joinReq.Data)
+	}
+
+	bob.WriteJSON(Frame{T: "JOIN_ACCEPT", SID: joinReq.SID, Data: json.RawMessage(`{"publicKey":"keyB"}`)})
+	accept, err := readMSG(alice)
+	if err != nil || accept.T != "JOIN_ACCEPT" {
+		t.Fatalf("expected JOIN_ACCEPT, got %+v (%v)", accept, err)
+	}
+	var acc map[string]any
+	json.Unmarshal(accept.Data, &acc)
+	if acc["email"] != "bob@example.com" || acc["emailHash"] != emailHash("bob@example.com") {
+		t.Fatalf("legacy client lost email fields during transition window: %s", accept.Data)
+	}
+
+	id := testIdentity(t)
+	upload, _ := json.Marshal(map[string]any{
+		"identityKey":    encodeP256(t, &id.PublicKey),
+		"signedPreKey":   signPreKey(t, id, 1),
+		"oneTimePreKeys": testOneTimeKeys(t, 12),
+	})
+	alice.WriteJSON(Frame{T: "PREKEY_UPLOAD", Data: upload})
+	if f, err := readMSG(alice); err != nil || f.T != "PREKEY_UPLOADED" {
+		t.Fatalf("expected PREKEY_UPLOADED, got %+v (%v)", f, err)
+	}
+	bob.WriteJSON(Frame{T: "PREKEY_FETCH", Data: json.RawMessage(`{"targetEmail":"alice@example.com"}`)})
+	f, err := readMSG(bob)
+	if err != nil || f.T != "PREKEY_BUNDLE" {
+		t.Fatalf("expected PREKEY_BUNDLE, got %+v (%v)", f, err)
+	}
+	var bundle PreKeyBundle
+	json.Unmarshal(f.Data, &bundle)
+	if want := s.pseudonyms.Pairwise("alice@example.com", "bob@example.com"); bundle.EmailHash != want {
+		t.Fatalf("bundle carries %q, want the fetcher's pseudonym %q", bundle.EmailHash, want)
+	}
+
+	bob.WriteJSON(Frame{T: "RESOLVE_PSEUDONYM", SID: joinReq.SID, Data: json.RawMessage(fmt.Sprintf(`{"pseudonym":"%s"}`, bundle.EmailHash))})
+	resolved, err := readMSG(bob)
+	if err != nil || resolved.T != "PSEUDONYM_RESOLVED" {
+		t.Fatalf("expected PSEUDONYM_RESOLVED, got %+v (%v)", resolved, err)
+	}
+	if strings.Contains(string(resolved.Data), emailHash("alice@example.com")) {
+		t.Fatalf("resolution leaks the global email hash: %s", resolved.Data)
+	}
+}
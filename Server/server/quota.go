@@ -0,0 +1,370 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTier is the tier of accounts that have no other.
+const DefaultTier = "default"
+
+// Quota names, as used in QUOTA_STATUS and QUOTA_EXCEEDED details.
+const (
+	QuotaDailyBytes      = "dailyBytes"
+	QuotaSessions        = "sessions"
+	QuotaPendingRequests = "pendingRequests"
+	QuotaStoredBytes     = "storedBytes"
+
+	quotaSweepInterval = time.Minute
+)
+
+// QuotaLimits caps what one account may use. Zero means no limit.
+type QuotaLimits struct {
+	DailyBytes      int64 `json:"dailyBytes"`      // MSG payload bytes relayed per UTC day, counted once per recipient
+	Sessions        int64 `json:"sessions"`        // sessions attached at once
+	PendingRequests int64 `json:"pendingRequests"` // CONNECT_REQs not yet accepted or denied
+	StoredBytes     int64 `json:"storedBytes"`     // prekeys plus connection requests queued for offline targets
+}
+
+func (l QuotaLimits) get(quota string) int64 {
+	switch quota {
+	case QuotaDailyBytes:
+		return l.DailyBytes
+	case QuotaSessions:
+		return l.Sessions
+	case QuotaPendingRequests:
+		return l.PendingRequests
+	case QuotaStoredBytes:
+		return l.StoredBytes
+	}
+	return 0
+}
+
+func defaultQuotaTiers() map[string]QuotaLimits {
+	return map[string]QuotaLimits{
+		DefaultTier: {DailyBytes: 1 << 30, Sessions: 256, PendingRequests: 20, StoredBytes: 1 << 20},
+	}
+}
+
+type pendingRequest struct {
+	queued  int64 // bytes held in the offline queue until the target logs in
+	expires time.Time
+}
+
+type quotaUsage struct {
+	day     int64 // UTC days since the epoch that relayed counts
+	relayed int64
+	pending map[string]pendingRequest // by session ID
+}
+
+// Quotas accounts for what each account uses of the limits of its tier:
+// bytes relayed per day, attached sessions, unanswered connection requests
+// and data stored for it. Sessions and prekeys are counted by the server
+// where they live; Quotas keeps the rest.
+type Quotas struct {
+	tiers     map[string]QuotaLimits
+	tierOf    func(email string) string
+	usage     map[string]*quotaUsage
+	now       func() time.Time
+	metrics   *Metrics
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+// NewQuotas applies tiers by the name tierOf returns for a normalized
+// email. Accounts it maps to "" or to an unknown tier, or every account
+// when tierOf is nil, get DefaultTier.
+func NewQuotas(tiers map[string]QuotaLimits, tierOf func(email string) string) *Quotas {
+	return &Quotas{
+		tiers:  tiers,
+		tierOf: tierOf,
+		usage:  make(map[string]*quotaUsage),
+		now:    time.Now,
+	}
+}
+
+// loadQuotas reads QUOTA_TIERS, a JSON object of tiers that replace or add
+// to the defaults, and QUOTA_ACCOUNTS, a JSON object mapping emails to
+// tier names.
+func loadQuotas() (*Quotas, error) {
+	tiers := defaultQuotaTiers()
+	if raw := strings.TrimSpace(os.Getenv("QUOTA_TIERS")); raw != "" {
+		var overrides map[string]QuotaLimits
+		if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+			return nil, fmt.Errorf("invalid QUOTA_TIERS: %w", err)
+		}
+		for name, l := range overrides {
+			if l.DailyBytes < 0 || l.Sessions < 0 || l.PendingRequests < 0 || l.StoredBytes < 0 {
+				return nil, fmt.Errorf("invalid QUOTA_TIERS limits for %s: %+v", name, l)
+			}
+			tiers[name] = l
+		}
+	}
+
+	accounts := make(map[string]string)
+	if raw := strings.TrimSpace(os.Getenv("QUOTA_ACCOUNTS")); raw != "" {
+		var m map[string]string
+		if err := json.Unmarshal([]byte(raw), &m); err != nil {
+			return nil, fmt.Errorf("invalid QUOTA_ACCOUNTS: %w", err)
+		}
+		for email, tier := range m {
+			if _, ok := tiers[tier]; !ok {
+				return nil, fmt.Errorf("invalid QUOTA_ACCOUNTS tier for %s: %q", email, tier)
+			}
+			accounts[normalizeEmail(email)] = tier
+		}
+	}
+	return NewQuotas(tiers, func(email string) string { return accounts[email] }), nil
+}
+
+// Limits returns the tier of email and its limits.
+func (q *Quotas) Limits(email string) (string, QuotaLimits) {
+	tier := DefaultTier
+	if q.tierOf != nil {
+		if t := q.tierOf(normalizeEmail(email)); t != "" {
+			tier = t
+		}
+	}
+	l, ok := q.tiers[tier]
+	if !ok {
+		tier, l = DefaultTier, q.tiers[DefaultTier]
+	}
+	return tier, l
+}
+
+// check returns QUOTA_EXCEEDED when adding n to used would take email past
+// its limit for quota.
+func (q *Quotas) check(email, quota string, used, n int64) *ProtocolError {
+	tier, limits := q.Limits(email)
+	limit := limits.get(quota)
+	if limit <= 0 || used+n <= limit {
+		return nil
+	}
+	if q.metrics != nil {
+		q.metrics.Inc("relay_quota_exceeded_total", "quota", quota, "tier", tier)
+	}
+	return NewError(ErrQuotaExceeded, "Quota exceeded: "+quota).
+		WithDetail("quota", quota).
+		WithDetail("tier", tier).
+		WithDetail("limit", limit).
+		WithDetail("used", used)
+}
+
+func unixDay(t time.Time) int64 {
+	return t.Unix() / int64(24*60*60)
+}
+
+// resetAt is when the daily relay count starts over.
+func (q *Quotas) resetAt() time.Time {
+	return time.Unix((unixDay(q.now())+1)*24*60*60, 0)
+}
+
+// usageLocked returns email's usage with expired entries dropped. The
+// caller holds q.mu.
+func (q *Quotas) usageLocked(email string) *quotaUsage {
+	now := q.now()
+	q.sweep(now)
+	email = normalizeEmail(email)
+	u, ok := q.usage[email]
+	if !ok {
+		u = &quotaUsage{day: unixDay(now), pending: make(map[string]pendingRequest)}
+		q.usage[email] = u
+	}
+	u.expire(now)
+	return u
+}
+
+func (u *quotaUsage) expire(now time.Time) {
+	if d := unixDay(now); d != u.day {
+		u.day, u.relayed = d, 0
+	}
+	for sid, p := range u.pending {
+		if !now.Before(p.expires) {
+			delete(u.pending, sid)
+		}
+	}
+}
+
+func (u *quotaUsage) queued() int64 {
+	var n int64
+	for _, p := range u.pending {
+		n += p.queued
+	}
+	return n
+}
+
+// sweep drops the usage of accounts that have nothing counted any more.
+func (q *Quotas) sweep(now time.Time) {
+	if now.Sub(q.lastSweep) < quotaSweepInterval {
+		return
+	}
+	for email, u := range q.usage {
+		u.expire(now)
+		if u.relayed == 0 && len(u.pending) == 0 {
+			delete(q.usage, email)
+		}
+	}
+	q.lastSweep = now
+}
+
+// chargeRelay adds n relayed bytes to email's count for today, unless that
+// would pass its daily limit.
+func (q *Quotas) chargeRelay(email string, n int64) *ProtocolError {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usageLocked(email)
+	if pe := q.check(email, QuotaDailyBytes, u.relayed, n); pe != nil {
+		return pe.WithRetryAfter(q.resetAt().Sub(q.now()))
+	}
+	u.relayed += n
+	return nil
+}
+
+// refundRelay returns n bytes charged by chargeRelay for a frame that was
+// never relayed.
+func (q *Quotas) refundRelay(email string, n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usageLocked(email)
+	u.relayed = max(0, u.relayed-n)
+}
+
+// addPending records a CONNECT_REQ from email that opened sid. queued is
+// the size of the request when it waits in the offline queue, and
+// preKeyBytes what email's prekeys take up.
+func (q *Quotas) addPending(email, sid string, queued, preKeyBytes int64) *ProtocolError {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usageLocked(email)
+	if pe := q.check(email, QuotaPendingRequests, int64(len(u.pending)), 1); pe != nil {
+		return pe
+	}
+	if pe := q.check(email, QuotaStoredBytes, preKeyBytes+u.queued(), queued); pe != nil {
+		return pe
+	}
+	u.pending[sid] = pendingRequest{queued: queued, expires: q.now().Add(queuedFrameTTL)}
+	return nil
+}
+
+// answered ends email's pending request for sid.
+func (q *Quotas) answered(email, sid string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.usageLocked(email).pending, sid)
+}
+
+// delivered stops counting email's request for sid as stored once it has
+// left the offline queue. It stays pending until answered.
+func (q *Quotas) delivered(email, sid string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usageLocked(email)
+	if p, ok := u.pending[sid]; ok {
+		p.queued = 0
+		u.pending[sid] = p
+	}
+}
+
+// checkStored checks that email may store n more bytes on top of its
+// prekeys and queued requests.
+func (q *Quotas) checkStored(email string, preKeyBytes, n int64) *ProtocolError {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.check(email, QuotaStoredBytes, preKeyBytes+q.usageLocked(email).queued(), n)
+}
+
+// QuotaUsage is one quota in QUOTA_STATUS. A zero Limit means no limit.
+type QuotaUsage struct {
+	Limit int64 `json:"limit"`
+	Used  int64 `json:"used"`
+}
+
+// QuotaStatus is the data of QUOTA_STATUS.
+type QuotaStatus struct {
+	Tier    string                `json:"tier"`
+	ResetAt int64                 `json:"resetAt"` // when dailyBytes starts over, in Unix milliseconds
+	Quotas  map[string]QuotaUsage `json:"quotas"`
+}
+
+func (q *Quotas) status(email string, sessions, preKeyBytes int64) QuotaStatus {
+	tier, l := q.Limits(email)
+	q.mu.Lock()
+	u := q.usageLocked(email)
+	relayed, pending, queued := u.relayed, int64(len(u.pending)), u.queued()
+	q.mu.Unlock()
+	return QuotaStatus{
+		Tier:    tier,
+		ResetAt: q.resetAt().UnixMilli(),
+		Quotas: map[string]QuotaUsage{
+			QuotaDailyBytes:      {Limit: l.DailyBytes, Used: relayed},
+			QuotaSessions:        {Limit: l.Sessions, Used: sessions},
+			QuotaPendingRequests: {Limit: l.PendingRequests, Used: pending},
+			QuotaStoredBytes:     {Limit: l.StoredBytes, Used: preKeyBytes + queued},
+		},
+	}
+}
+
+// attachedSessions reports how many sessions c is attached to, and whether
+// sid is one of them.
+func (c *Client) attachedSessions(sid string) (int64, bool) {
+	c.sessMu.Lock()
+	defer c.sessMu.Unlock()
+	_, ok := c.sessions[sid]
+	return int64(len(c.sessions)), ok
+}
+
+// admitSession checks the sessions quota before client joins sid.
+func (s *Server) admitSession(client *Client, sid string) error {
+	n, attached := client.attachedSessions(sid)
+	if attached {
+		return nil
+	}
+	if pe := s.quotas.check(client.email, QuotaSessions, n, 1); pe != nil {
+		return pe
+	}
+	return nil
+}
+
+// chargeRelay counts a payload relayed to n recipients against the
+// sender's daily quota.
+func (s *Server) chargeRelay(client *Client, payload []byte, n int) error {
+	if pe := s.quotas.chargeRelay(client.email, int64(len(payload))*int64(n)); pe != nil {
+		return pe
+	}
+	return nil
+}
+
+// sealedQuotaKey is the quota account SEALED_MSG bytes in sid are charged
+// to, since the relay cannot tell who sent them. It gets the default tier.
+func sealedQuotaKey(sid string) string {
+	return "sealed:" + sid
+}
+
+// releaseQueued stops charging the senders of connection requests that
+// were just handed over from the offline queue.
+func (s *Server) releaseQueued(frames []Frame) {
+	for _, f := range frames {
+		if f.T != "JOIN_REQUEST" {
+			continue
+		}
+		if sess := s.state.session(f.SID); sess != nil {
+			sess.mu.Lock()
+			owner := sess.owner
+			sess.mu.Unlock()
+			s.quotas.delivered(owner, f.SID)
+		}
+	}
+}
+
+// handleQuota reports the sender's tier, limits and usage.
+func (s *Server) handleQuota(client *Client, frame Frame) error {
+	sessions, _ := client.attachedSessions("")
+	status := s.quotas.status(client.email, sessions, s.preKeys.Size(client.email))
+	data, _ := json.Marshal(status)
+	s.send(client, Frame{T: "QUOTA_STATUS", ID: frame.ID, Data: json.RawMessage(data)})
+	return nil
+}
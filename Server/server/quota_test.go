@@ -0,0 +1,295 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestQuotasDailyBytesResetAtUTCMidnight(t *testing.T) {
+	now := time.Date(2026, 3, 1, 23, 59, 0, 0, time.UTC)
+	q := NewQuotas(map[string]QuotaLimits{DefaultTier: {DailyBytes: 100}}, nil)
+	q.now = func() time.Time { return now }
+
+	if pe := q.chargeRelay("a@example.com", 60); pe != nil {
+		t.Fatal(pe)
+	}
+	pe := q.chargeRelay("A@example.com", 50)
+	if pe == nil || pe.Code != ErrQuotaExceeded || pe.Details["quota"] != QuotaDailyBytes || pe.Details["used"] != int64(60) {
+		t.Fatalf("expected a dailyBytes error after 60 of 100 bytes, got %+v", pe)
+	}
+	if pe.RetryAfter != time.Minute.Milliseconds()+1 {
+		t.Fatalf("retryAfter = %dms, want the time to midnight", pe.RetryAfter)
+	}
+	if pe := q.chargeRelay("a@example.com", 40); pe != nil {
+		t.Fatalf("rejected charge was counted: %v", pe)
+	}
+
+	now = now.Add(time.Minute)
+	if pe := q.chargeRelay("a@example.com", 100); pe != nil {
+		t.Fatalf("count did not reset at midnight: %v", pe)
+	}
+}
+
+func TestQuotasTiers(t *testing.T) {
+	q := NewQuotas(map[string]QuotaLimits{
+		DefaultTier: {Sessions: 1},
+		"pro":       {Sessions: 10},
+	}, func(email string) string {
+		return map[string]string{"pro@example.com": "pro", "lost@example.com": "gone"}[email]
+	})
+	for email, want := range map[string]string{"Pro@example.com": "pro", "free@example.com": DefaultTier, "lost@example.com": DefaultTier} {
+		if tier, _ := q.Limits(email); tier != want {
+			t.Errorf("tier of %s = %q, want %q", email, tier, want)
+		}
+	}
+	if q.check("pro@example.com", QuotaSessions, 5, 1) != nil || q.check("free@example.com", QuotaSessions, 1, 1) == nil {
+		t.Fatal("session limits not applied by tier")
+	}
+	if q.check("free@example.com", QuotaDailyBytes, 1<<40, 1) != nil {
+		t.Fatal("a zero limit was enforced")
+	}
+}
+
+func TestQuotasPendingRequestsAndStoredBytes(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	q := NewQuotas(map[string]QuotaLimits{DefaultTier: {PendingRequests: 2, StoredBytes: 100}}, nil)
+	q.now = func() time.Time { return now }
+
+	q.addPending("a", "s1", 40, 0)
+	q.addPending("a", "s2", 0, 0)
+	if pe := q.addPending("a", "s3", 0, 0); pe == nil || pe.Details["quota"] != QuotaPendingRequests {
+		t.Fatalf("third pending request accepted: %v", pe)
+	}
+	q.answered("a", "s2")
+	if pe := q.addPending("a", "s3", 40, 30); pe == nil || pe.Details["quota"] != QuotaStoredBytes {
+		t.Fatalf("110 stored bytes accepted: %v", pe)
+	}
+	q.delivered("a", "s1")
+	if pe := q.addPending("a", "s3", 40, 30); pe != nil {
+		t.Fatalf("delivered request still counted as stored: %v", pe)
+	}
+
+	now = now.Add(queuedFrameTTL)
+	if st := q.status("a", 0, 0); st.Quotas[QuotaPendingRequests].Used != 0 {
+		t.Fatalf("expired requests still pending: %+v", st)
+	}
+}
+
+func TestLoadQuotas(t *testing.T) {
+	t.Setenv("QUOTA_TIERS", `{"pro":{"dailyBytes":5000000000,"sessions":1000}}`)
+	t.Setenv("QUOTA_ACCOUNTS", `{"Boss@Example.com":"pro"}`)
+	q, err := loadQuotas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tier, l := q.Limits("boss@example.com"); tier != "pro" || l.Sessions != 1000 {
+		t.Fatalf("boss is on %s with %+v", tier, l)
+	}
+	if _, l := q.Limits("intern@example.com"); l != defaultQuotaTiers()[DefaultTier] {
+		t.Fatalf("default tier was dropped: %+v", l)
+	}
+
+	t.Setenv("QUOTA_ACCOUNTS", `{"boss@example.com":"platinum"}`)
+	if _, err := loadQuotas(); err == nil {
+		t.Fatal("unknown tier accepted")
+	}
+	t.Setenv("QUOTA_TIERS", `{"pro":{"sessions":-1}}`)
+	if _, err := loadQuotas(); err == nil {
+		t.Fatal("negative limit accepted")
+	}
+}
+
+func quotaDetails(t *testing.T, f *Frame) map[string]any {
+	t.Helper()
+	var pe ProtocolError
+	json.Unmarshal(f.Data, &pe)
+	if pe.Code != ErrQuotaExceeded {
+		t.Fatalf("expected QUOTA_EXCEEDED, got %s", f.Data)
+	}
+	return pe.Details
+}
+
+func TestMsgOverDailyQuotaIsRejected(t *testing.T) {
+	s := newTestServer(WithQuotas(NewQuotas(map[string]QuotaLimits{DefaultTier: {DailyBytes: 12}}, nil)))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	alice, bob, sid, err := connectPair("ws"+strings.TrimPrefix(ts.URL, "http"), "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	defer bob.Close()
+
+	alice.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"12345678"}`)})
+	expectFrame(t, bob, "MSG")
+	alice.WriteJSON(Frame{T: "MSG", SID: sid, ID: "m2", Data: json.RawMessage(`{"payload":"12"}`)})
+	f := expectFrame(t, alice, "ERROR")
+	if d := quotaDetails(t, f); d["quota"] != QuotaDailyBytes || d["limit"] != float64(12) || d["used"] != float64(10) || d["tier"] != DefaultTier {
+		t.Fatalf("unexpected details %v", d)
+	}
+	if !strings.Contains(string(f.Data), `"retryAfter"`) {
+		t.Fatalf("no retryAfter on the daily quota: %s", f.Data)
+	}
+
+	alice.WriteJSON(Frame{T: "QUOTA", ID: "q1"})
+	status := expectFrame(t, alice, "QUOTA_STATUS")
+	var st QuotaStatus
+	json.Unmarshal(status.Data, &st)
+	if status.ID != "q1" || st.Tier != DefaultTier || st.Quotas[QuotaDailyBytes] != (QuotaUsage{Limit: 12, Used: 10}) || st.Quotas[QuotaSessions].Used != 1 || st.ResetAt == 0 {
+		t.Fatalf("unexpected QUOTA_STATUS %s", status.Data)
+	}
+	if n := s.metrics.Counter("relay_quota_exceeded_total", "quota", QuotaDailyBytes, "tier", DefaultTier); n != 1 {
+		t.Fatalf("relay_quota_exceeded_total = %d", n)
+	}
+}
+
+func TestSessionAndPendingRequestQuotas(t *testing.T) {
+	quotas := NewQuotas(map[string]QuotaLimits{DefaultTier: {Sessions: 2, PendingRequests: 1}}, nil)
+	ts := httptest.NewServer(newTestServer(WithQuotas(quotas), WithRateLimits(map[string][]RateRule{})))
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+	alice, err := connectClient(wsUrl, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := connectClient(wsUrl, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	connect := func(target string) {
+		alice.WriteJSON(Frame{T: "CONNECT_REQ", Data: json.RawMessage(`{"targetEmail":"` + target + `","publicKey":"keyA"}`)})
+	}
+	connect("bob@example.com")
+	req := expectFrame(t, bob, "JOIN_REQUEST")
+	connect("bob@example.com")
+	if d := quotaDetails(t, expectFrame(t, alice, "ERROR")); d["quota"] != QuotaPendingRequests {
+		t.Fatalf("second pending request: %v", d)
+	}
+
+	bob.WriteJSON(Frame{T: "JOIN_DENY", SID: req.SID})
+	expectFrame(t, alice, "JOIN_DENIED")
+	if _, err := establishSession(alice, bob, "bob@example.com"); err != nil {
+		t.Fatalf("request slot not freed by the answer: %v", err)
+	}
+
+	alice.WriteJSON(Frame{T: "REATTACH", SID: "third"})
+	if d := quotaDetails(t, expectFrame(t, alice, "ERROR")); d["quota"] != QuotaSessions || d["used"] != float64(2) {
+		t.Fatalf("third session: %v", d)
+	}
+}
+
+func TestQueuedRequestCountsAsStored(t *testing.T) {
+	s := newTestServer(
+		WithQuotas(NewQuotas(map[string]QuotaLimits{DefaultTier: {StoredBytes: 1000}}, nil)),
+		WithRateLimits(map[string][]RateRule{}),
+	)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+	s.preKeys.accounts["bob@example.com"] = &preKeyAccount{identityKey: "ik"}
+	alice, err := connectClient(wsUrl, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	big := `{"targetEmail":"bob@example.com","ephemeralKey":"ek","senderName":"` + strings.Repeat("x", 600) + `"}`
+	alice.WriteJSON(Frame{T: "CONNECT_REQ", Data: json.RawMessage(big)})
+	expectFrame(t, alice, "CONNECT_QUEUED")
+	alice.WriteJSON(Frame{T: "CONNECT_REQ", Data: json.RawMessage(big)})
+	if d := quotaDetails(t, expectFrame(t, alice, "ERROR")); d["quota"] != QuotaStoredBytes {
+		t.Fatalf("second queued request: %v", d)
+	}
+
+	bob, err := connectClient(wsUrl, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	expectFrame(t, bob, "JOIN_REQUEST")
+	alice.WriteJSON(Frame{T: "QUOTA"})
+	var st QuotaStatus
+	json.Unmarshal(expectFrame(t, alice, "QUOTA_STATUS").Data, &st)
+	if st.Quotas[QuotaStoredBytes].Used != 0 || st.Quotas[QuotaPendingRequests].Used != 1 {
+		t.Fatalf("after delivery: %+v", st.Quotas)
+	}
+}
+
+func TestSealedAndCallPayloadsCountTowardsDailyBytes(t *testing.T) {
+	s := newTestServer(WithQuotas(NewQuotas(map[string]QuotaLimits{DefaultTier: {DailyBytes: 20}}, nil)))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+	alice, bob, sid, err := connectPair(wsUrl, "sealedquota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	defer bob.Close()
+
+	alice.WriteJSON(Frame{T: "CALL_START", SID: sid, Data: json.RawMessage(`{"mode":"audio","payload":"0123456789"}`)})
+	expectFrame(t, alice, "CALL_RINGING")
+	expectFrame(t, bob, "CALL_START")
+
+	// Sealed messages have no known sender, so they count towards the
+	// session's own quota rather than alice's.
+	tokens := issueTokens(t, s.deliveryTokens, sid, 3)
+	bob.Close()
+	expectFrame(t, alice, "PEER_OFFLINE")
+	anon, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anon.Close()
+	sealed := func(token, payload string) {
+		anon.WriteJSON(Frame{T: "SEALED_MSG", SID: sid, C: true, Data: json.RawMessage(`{"payload":"` + payload + `","token":"` + token + `"}`)})
+	}
+	sealed(tokens[0], "12345678")
+	expectFrame(t, anon, "DELIVERED")
+	sealed(tokens[1], "12345678")
+	expectFrame(t, anon, "DELIVERED")
+	sealed(tokens[2], "12345678")
+	if d := quotaDetails(t, expectFrame(t, anon, "ERROR")); d["quota"] != QuotaDailyBytes || d["used"] != float64(20) {
+		t.Fatalf("sealed send over quota: %v", d)
+	}
+
+	expectFrame(t, alice, "MSG")
+	expectFrame(t, alice, "MSG")
+	var st QuotaStatus
+	alice.WriteJSON(Frame{T: "QUOTA"})
+	json.Unmarshal(expectFrame(t, alice, "QUOTA_STATUS").Data, &st)
+	if st.Quotas[QuotaDailyBytes].Used != 10 {
+		t.Fatalf("sealed bytes charged to alice: %+v", st.Quotas)
+	}
+}
+
+func TestRefusedCallFramesDoNotChargeQuota(t *testing.T) {
+	s := newTestServer(WithQuotas(NewQuotas(map[string]QuotaLimits{DefaultTier: {DailyBytes: 20}}, nil)))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+	alice, bob, sid, err := connectPair(wsUrl, "refusedcall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	defer bob.Close()
+
+	for range 3 {
+		alice.WriteJSON(Frame{T: "CALL_ACCEPT", SID: sid, Data: json.RawMessage(`{"payload":"0123456789"}`)})
+		if f := expectFrame(t, alice, "ERROR"); !strings.Contains(string(f.Data), "No call to accept") {
+			t.Fatalf("unexpected error: %s", f.Data)
+		}
+	}
+	alice.WriteJSON(Frame{T: "CALL_START", SID: sid, Data: json.RawMessage(`{"mode":"audio","payload":"0123456789"}`)})
+	expectFrame(t, alice, "CALL_RINGING")
+	expectFrame(t, bob, "CALL_START")
+}
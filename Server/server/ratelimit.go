@@ -0,0 +1,314 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ScopeIP      = "ip"
+	ScopeAccount = "account"
+	ScopeSession = "session"
+	ScopeToken   = "token"
+
+	rateLimitSweepInterval = time.Minute
+	rateLimitIdleTTL       = 10 * time.Minute
+)
+
+// RateRule is one token bucket applied to a frame type. Rate tokens are
+// added every Per, up to Burst.
+type RateRule struct {
+	Key   string   `json:"key"`
+	Rate  float64  `json:"rate"`
+	Per   Duration `json:"per"`
+	Burst float64  `json:"burst"`
+}
+
+func (r RateRule) perSecond() float64 {
+	return r.Rate / time.Duration(r.Per).Seconds()
+}
+
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// LimitKeys identifies the caller of a frame. Rules whose scope key is empty
+// are skipped.
+type LimitKeys struct {
+	IP      string
+	Account string
+	Session string
+	Token   string
+}
+
+func (k LimitKeys) get(scope string) string {
+	switch scope {
+	case ScopeIP:
+		return k.IP
+	case ScopeAccount:
+		return k.Account
+	case ScopeSession:
+		return k.Session
+	case ScopeToken:
+		return k.Token
+	}
+	return ""
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type bucketKey struct {
+	frameType, scope, id string
+}
+
+// Limiter applies per-frame-type token buckets keyed by IP, account,
+// session or delivery token. Buckets are split into shards like the relay's
+// state, so frames from unrelated callers do not queue on one lock.
+type Limiter struct {
+	rules    map[string][]RateRule
+	shards   [stateShards]limiterShard
+	metrics  *Metrics
+	rejected map[[2]string]*atomic.Uint64 // frame type, scope → relay_rate_limited_total
+	now      func() time.Time
+}
+
+type limiterShard struct {
+	mu        sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+}
+
+func defaultRateRules() map[string][]RateRule {
+	perSec := Duration(time.Second)
+	msgs := float64(maxMsgsPerSecond)
+	return map[string][]RateRule{
+		// AUTH is only charged for OAuth tokens; sess: tokens are free.
+		"AUTH":        {{Key: ScopeIP, Rate: 3, Per: Duration(time.Minute), Burst: 3}},
+		"RESUME":      {{Key: ScopeIP, Rate: 10, Per: Duration(time.Minute), Burst: 10}},
+		"CONNECT_REQ": {{Key: ScopeAccount, Rate: 1, Per: Duration(5 * time.Second), Burst: 1}},
+		"JOIN_ACCEPT": {{Key: ScopeAccount, Rate: 5, Per: perSec, Burst: 10}},
+		"JOIN_DENY":   {{Key: ScopeAccount, Rate: 5, Per: perSec, Burst: 10}},
+		"REATTACH":    {{Key: ScopeAccount, Rate: 20, Per: perSec, Burst: 100}},
+		"MSG": {
+			{Key: ScopeAccount, Rate: msgs, Per: perSec, Burst: msgs},
+			{Key: ScopeSession, Rate: 2 * msgs, Per: perSec, Burst: 2 * msgs},
+		},
+		"SEALED_MSG": {
+			{Key: ScopeToken, Rate: maxSealedMsgsPerToken, Per: perSec, Burst: maxSealedMsgsPerToken},
+			{Key: ScopeSession, Rate: 2 * msgs, Per: perSec, Burst: 2 * msgs},
+		},
+		"RTC_OFFER":           {{Key: ScopeAccount, Rate: 10, Per: perSec, Burst: 20}},
+		"RTC_ANSWER":          {{Key: ScopeAccount, Rate: 10, Per: perSec, Burst: 20}},
+		"RTC_ICE":             {{Key: ScopeAccount, Rate: 50, Per: perSec, Burst: 100}},
+		"GET_TURN_CREDS":      {{Key: ScopeAccount, Rate: 1, Per: perSec, Burst: 5}},
+		"PREKEY_UPLOAD":       {{Key: ScopeAccount, Rate: 1, Per: Duration(10 * time.Second), Burst: 3}},
+		"PREKEY_FETCH":        {{Key: ScopeAccount, Rate: 1, Per: perSec, Burst: 10}},
+		"SYNC":                {{Key: ScopeAccount, Rate: 2, Per: perSec, Burst: 10}},
+		"QUOTA":               {{Key: ScopeAccount, Rate: 1, Per: perSec, Burst: 5}},
+		"REPORT":              {{Key: ScopeAccount, Rate: 5, Per: Duration(time.Minute), Burst: 5}},
+		"GET_DELIVERY_TOKENS": {{Key: ScopeAccount, Rate: 1, Per: perSec, Burst: 10}},
+		"RESOLVE_PSEUDONYM":   {{Key: ScopeAccount, Rate: 5, Per: perSec, Burst: 20}},
+		"SFU_JOIN":            {{Key: ScopeAccount, Rate: 1, Per: perSec, Burst: 5}},
+		"SFU_OFFER":           {{Key: ScopeAccount, Rate: 10, Per: perSec, Burst: 20}},
+		"SFU_ANSWER":          {{Key: ScopeAccount, Rate: 10, Per: perSec, Burst: 20}},
+		"SFU_ICE":             {{Key: ScopeAccount, Rate: 50, Per: perSec, Burst: 100}},
+		"SFU_LAYER":           {{Key: ScopeAccount, Rate: 10, Per: perSec, Burst: 20}},
+		"CALL_START":          {{Key: ScopeAccount, Rate: 1, Per: perSec, Burst: 3}},
+		"CALL_ACCEPT":         {{Key: ScopeAccount, Rate: 5, Per: perSec, Burst: 10}},
+		"CALL_BUSY":           {{Key: ScopeAccount, Rate: 5, Per: perSec, Burst: 10}},
+		"CALL_END":            {{Key: ScopeAccount, Rate: 5, Per: perSec, Burst: 10}},
+	}
+}
+
+func NewLimiter(rules map[string][]RateRule, metrics *Metrics) *Limiter {
+	l := &Limiter{
+		rules:    rules,
+		metrics:  metrics,
+		rejected: make(map[[2]string]*atomic.Uint64),
+		now:      time.Now,
+	}
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[bucketKey]*bucket)
+	}
+	if metrics != nil {
+		for frameType, rs := range rules {
+			for _, r := range rs {
+				l.rejected[[2]string{frameType, r.Key}] = metrics.CounterRef("relay_rate_limited_total", "frame", frameType, "scope", r.Key)
+			}
+		}
+	}
+	return l
+}
+
+// loadRateRules overrides the defaults per frame type from RATE_LIMITS, a
+// JSON object such as {"MSG":[{"key":"account","rate":50,"per":"1s","burst":50}]}.
+func loadRateRules() (map[string][]RateRule, error) {
+	rules := defaultRateRules()
+	raw := strings.TrimSpace(os.Getenv("RATE_LIMITS"))
+	if raw == "" {
+		return rules, nil
+	}
+	var overrides map[string][]RateRule
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		return nil, fmt.Errorf("invalid RATE_LIMITS: %w", err)
+	}
+	for frameType, rs := range overrides {
+		for _, r := range rs {
+			if r.Rate <= 0 || r.Per <= 0 || r.Burst < 1 {
+				return nil, fmt.Errorf("invalid RATE_LIMITS rule for %s: %+v", frameType, r)
+			}
+			switch r.Key {
+			case ScopeIP, ScopeAccount, ScopeSession, ScopeToken:
+			default:
+				return nil, fmt.Errorf("invalid RATE_LIMITS key for %s: %q", frameType, r.Key)
+			}
+		}
+		rules[frameType] = rs
+	}
+	return rules, nil
+}
+
+// Limits reports whether frameType has a rule keyed by scope.
+func (l *Limiter) Limits(frameType, scope string) bool {
+	for _, r := range l.rules[frameType] {
+		if r.Key == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow charges one token from every applicable bucket for frameType. If any
+// bucket is empty nothing is charged and the longest wait is returned.
+func (l *Limiter) Allow(frameType string, keys LimitKeys) (bool, time.Duration) {
+	rules := l.rules[frameType]
+	if len(rules) == 0 {
+		return true, 0
+	}
+
+	// A frame's buckets may live in different shards. They are locked
+	// together, in index order, so a rejection charges none of them.
+	var (
+		keyBuf   [4]bucketKey
+		shardBuf [4]int
+		bkeys    = append(keyBuf[:0], make([]bucketKey, len(rules))...)
+		shards   = shardBuf[:0]
+	)
+	for i, rule := range rules {
+		id := keys.get(rule.Key)
+		if id == "" {
+			continue
+		}
+		bkeys[i] = bucketKey{frameType, rule.Key, id}
+		shards = append(shards, shardOf(id))
+	}
+	if len(shards) == 0 {
+		return true, 0
+	}
+	slices.Sort(shards)
+	shards = slices.Compact(shards)
+	for _, i := range shards {
+		l.shards[i].mu.Lock()
+	}
+	defer func() {
+		for _, i := range shards {
+			l.shards[i].mu.Unlock()
+		}
+	}()
+
+	now := l.now()
+	for _, i := range shards {
+		l.shards[i].sweep(now)
+	}
+
+	var (
+		charged    []*bucket
+		retryAfter time.Duration
+		rejectedBy string
+	)
+	for i, rule := range rules {
+		k := bkeys[i]
+		if k.id == "" {
+			continue
+		}
+		sh := &l.shards[shardOf(k.id)]
+		b, ok := sh.buckets[k]
+		if !ok {
+			b = &bucket{tokens: rule.Burst, last: now}
+			sh.buckets[k] = b
+		}
+		rate := rule.perSecond()
+		b.tokens = math.Min(rule.Burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+			if wait > retryAfter {
+				retryAfter = wait
+				rejectedBy = rule.Key
+			}
+			continue
+		}
+		charged = append(charged, b)
+	}
+
+	if rejectedBy != "" {
+		if c := l.rejected[[2]string{frameType, rejectedBy}]; c != nil {
+			c.Add(1)
+		}
+		return false, retryAfter
+	}
+	for _, b := range charged {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// sweep drops buckets that have been idle long enough to be full again. The
+// caller holds sh.mu.
+func (sh *limiterShard) sweep(now time.Time) {
+	if now.Sub(sh.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	for k, b := range sh.buckets {
+		if now.Sub(b.last) >= rateLimitIdleTTL {
+			delete(sh.buckets, k)
+		}
+	}
+	sh.lastSweep = now
+}
+
+func (l *Limiter) Len() int {
+	n := 0
+	for i := range l.shards {
+		sh := &l.shards[i]
+		sh.mu.Lock()
+		n += len(sh.buckets)
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+func rateLimitError(frameType string, retryAfter time.Duration) *ProtocolError {
+	return NewError(ErrRateLimited, "Rate limit exceeded: Too many "+frameType+" frames").WithRetryAfter(retryAfter)
+}
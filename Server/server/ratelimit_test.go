@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimiterBurstAndRetryAfter(t *testing.T) {
+	m := NewMetrics()
+	l := NewLimiter(map[string][]RateRule{
+		"RTC_ICE": {{Key: ScopeAccount, Rate: 1, Per: Duration(time.Second), Burst: 2}},
+	}, m)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	keys := LimitKeys{Account: "alice@example.com"}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("RTC_ICE", keys); !ok {
+			t.Fatalf("frame %d rejected within burst", i)
+		}
+	}
+	ok, retryAfter := l.Allow("RTC_ICE", keys)
+	if ok {
+		t.Fatal("burst exceeded but frame allowed")
+	}
+	if retryAfter <= 0 || retryAfter > time.Second {
+		t.Fatalf("unexpected retryAfter %v", retryAfter)
+	}
+	now = now.Add(retryAfter)
+	if ok, _ := l.Allow("RTC_ICE", keys); !ok {
+		t.Fatal("bucket did not refill on the limiter's clock")
+	}
+	if got := m.Counter("relay_rate_limited_total", "frame", "RTC_ICE", "scope", ScopeAccount); got != 1 {
+		t.Fatalf("expected 1 counted rejection, got %d", got)
+	}
+	if ok, _ := l.Allow("RTC_ICE", LimitKeys{Account: "bob@example.com"}); !ok {
+		t.Fatal("limit leaked across accounts")
+	}
+	if ok, _ := l.Allow("RTC_OFFER", keys); !ok {
+		t.Fatal("frame type without rules was limited")
+	}
+}
+
+func TestLimiterRejectionChargesNothing(t *testing.T) {
+	l := NewLimiter(map[string][]RateRule{
+		"MSG": {
+			{Key: ScopeAccount, Rate: 1, Per: Duration(time.Hour), Burst: 5},
+			{Key: ScopeSession, Rate: 1, Per: Duration(time.Hour), Burst: 1},
+		},
+	}, nil)
+
+	l.Allow("MSG", LimitKeys{Account: "a", Session: "s1"})
+	if ok, _ := l.Allow("MSG", LimitKeys{Account: "a", Session: "s1"}); ok {
+		t.Fatal("session bucket should be empty")
+	}
+	for i := 0; i < 4; i++ {
+		if ok, _ := l.Allow("MSG", LimitKeys{Account: "a", Session: fmt.Sprintf("other-%d", i)}); !ok {
+			t.Fatalf("account bucket was charged for a rejected frame (frame %d)", i)
+		}
+	}
+}
+
+func TestLimiterEvictsIdleBuckets(t *testing.T) {
+	l := NewLimiter(map[string][]RateRule{
+		"MSG": {{Key: ScopeIP, Rate: 1, Per: Duration(time.Second), Burst: 1}},
+	}, nil)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	l.Allow("MSG", LimitKeys{IP: "10.0.0.1"})
+	l.Allow("MSG", LimitKeys{IP: "10.0.0.2"})
+
+	// A shard sweeps when it is next touched: touch each once with a new key.
+	now = now.Add(2 * rateLimitIdleTTL)
+	touched := make(map[int]bool)
+	for i := 0; len(touched) < stateShards; i++ {
+		ip := fmt.Sprintf("10.1.%d.%d", i/256, i%256)
+		if sh := shardOf(ip); !touched[sh] {
+			touched[sh] = true
+			l.Allow("MSG", LimitKeys{IP: ip})
+		}
+	}
+	if n := l.Len(); n != stateShards {
+		t.Fatalf("expected idle buckets to be evicted, %d remain", n)
+	}
+}
+
+func TestLoadRateRulesOverrides(t *testing.T) {
+	t.Setenv("RATE_LIMITS", `{"RTC_ICE":[{"key":"session","rate":5,"per":"2s","burst":5}]}`)
+	rules, err := loadRateRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rules["RTC_ICE"]; len(r) != 1 || r[0].Key != ScopeSession || time.Duration(r[0].Per) != 2*time.Second {
+		t.Fatalf("override not applied: %+v", r)
+	}
+	if len(rules["MSG"]) == 0 {
+		t.Fatal("defaults for other frame types were dropped")
+	}
+
+	t.Setenv("RATE_LIMITS", `{"MSG":[{"key":"planet","rate":1,"per":"1s","burst":1}]}`)
+	if _, err := loadRateRules(); err == nil {
+		t.Fatal("unknown scope accepted")
+	}
+}
+
+func TestOutsiderCannotDrainSessionBuckets(t *testing.T) {
+	rules := defaultRateRules()
+	rules["MSG"] = []RateRule{{Key: ScopeSession, Rate: 1, Per: Duration(time.Hour), Burst: 1}}
+	ts := httptest.NewServer(newTestServer(WithRateLimits(rules)))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	alice, bob, sid, err := connectPair(url, "drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	defer bob.Close()
+	mallory, err := connectClient(url, "mallory@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mallory.Close()
+
+	for i := 0; i < 3; i++ {
+		mallory.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"spam"}`)})
+		f := expectFrame(t, mallory, "ERROR")
+		var pe ProtocolError
+		json.Unmarshal(f.Data, &pe)
+		if pe.Code != ErrNotMember {
+			t.Fatalf("outsider MSG %d: expected NOT_A_MEMBER, got %s", i, f.Data)
+		}
+	}
+
+	alice.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"hi"}`)})
+	if f := expectFrame(t, bob, "MSG"); !strings.Contains(string(f.Data), "hi") {
+		t.Fatalf("unexpected MSG %s", f.Data)
+	}
+	alice.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"again"}`)})
+	f := expectFrame(t, alice, "ERROR")
+	var pe ProtocolError
+	json.Unmarshal(f.Data, &pe)
+	if pe.Code != ErrRateLimited {
+		t.Fatalf("member over the session limit: expected RATE_LIMITED, got %s", f.Data)
+	}
+}
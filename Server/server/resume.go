@@ -0,0 +1,244 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	crand "crypto/rand"
+)
+
+const (
+	defaultResumeWindow = 30 * time.Second
+	defaultResumeFrames = 256
+	maxResumeBytes      = 1 << 20
+)
+
+// stream numbers the frames sent to a client that asked for resumable
+// delivery at AUTH, and keeps the most recent ones so RESUME can replay what
+// a dropped connection missed. It is guarded by Client.mu.
+type stream struct {
+	token  string
+	next   uint64 // n of the next frame
+	frames [][]byte
+	bytes  int
+	limit  int
+
+	parked bool   // the connection dropped and the client may still resume
+	ended  bool   // the client was torn down and can no longer resume
+	gen    uint64 // bumped on every park and resume to disarm stale expiry timers
+}
+
+func newStream(limit int) *stream {
+	return &stream{token: resumeToken(), next: 1, limit: limit}
+}
+
+func resumeToken() string {
+	b := make([]byte, 32)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// push stamps an encoded frame with the next sequence number as "n",
+// buffers it and returns the stamped copy.
+func (st *stream) push(frame []byte) []byte {
+	n := st.next
+	st.next++
+	stamped := make([]byte, 0, len(frame)+24)
+	stamped = append(stamped, frame[:len(frame)-1]...)
+	stamped = append(stamped, `,"n":`...)
+	stamped = strconv.AppendUint(stamped, n, 10)
+	stamped = append(stamped, '}')
+
+	st.frames = append(st.frames, stamped)
+	st.bytes += len(stamped)
+	for len(st.frames) > st.limit || (st.bytes > maxResumeBytes && len(st.frames) > 1) {
+		st.bytes -= len(st.frames[0])
+		st.frames[0] = nil
+		st.frames = st.frames[1:]
+	}
+	return stamped
+}
+
+// since returns the buffered frames after last, or false when some of them
+// were already dropped or last was never sent.
+func (st *stream) since(last uint64) ([][]byte, bool) {
+	first := st.next - uint64(len(st.frames))
+	if last >= st.next || last+1 < first {
+		return nil, false
+	}
+	return st.frames[last+1-first:], true
+}
+
+// errBuffered reports a frame that was buffered for a parked client rather
+// than written: it only arrives if the client resumes in time.
+var errBuffered = errors.New("client is parked, frame buffered for RESUME")
+
+// writeStream numbers and buffers frame for c, then writes it unless c is
+// parked, in which case it returns errBuffered. The caller holds c.mu.
+func (s *Server) writeStream(c *Client, frame []byte) error {
+	stamped := c.stream.push(frame)
+	if c.stream.parked {
+		return errBuffered
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	return c.conn.WriteMessage(websocket.TextMessage, stamped)
+}
+
+// release runs when the read loop on ws ends. A resumable client that
+// dropped without closing cleanly, and was not disconnected on purpose, is
+// parked for s.resumeWindow: it keeps its
+// account and sessions, and frames for it are buffered. Anything else is
+// torn down now.
+func (s *Server) release(c *Client, ws *websocket.Conn, readErr error) {
+	c.mu.Lock()
+	if c.conn != ws {
+		// RESUME moved c to another connection.
+		c.mu.Unlock()
+		return
+	}
+	st := c.stream
+	if st != nil && !st.ended && readErr != nil && !s.closing.Load() && !websocket.IsCloseError(readErr, websocket.CloseNormalClosure) {
+		st.parked = true
+		st.gen++
+		gen := st.gen
+		c.mu.Unlock()
+		log.Printf("[Server] Parked %s for %s", c.id, s.resumeWindow)
+		time.AfterFunc(s.resumeWindow, func() { s.expire(c, gen) })
+		return
+	}
+	if st != nil {
+		st.ended = true
+	}
+	c.mu.Unlock()
+	s.teardown(c)
+}
+
+// expire tears down c if it is still parked from park number gen, or from
+// any park when gen is 0. It reports whether it did.
+func (s *Server) expire(c *Client, gen uint64) bool {
+	c.mu.Lock()
+	st := c.stream
+	if st == nil || !st.parked || st.ended || (gen != 0 && st.gen != gen) {
+		c.mu.Unlock()
+		return false
+	}
+	st.ended = true
+	c.mu.Unlock()
+	s.metrics.Inc("relay_resume_expired_total")
+	s.teardown(c)
+	return true
+}
+
+// handleResume moves the client a resume token belongs to onto this
+// connection and replays the frames it missed after data.last. The read
+// loop carries on as that client.
+func (s *Server) handleResume(client *Client, frame Frame) error {
+	var d struct {
+		Token string `json:"token"`
+		Last  uint64 `json:"last"`
+	}
+	if err := json.Unmarshal(frame.Data, &d); err != nil || d.Token == "" {
+		return NewError(ErrInvalidFrame, "Invalid resume request")
+	}
+	if client.email != "" {
+		return NewError(ErrInvalidFrame, "Connection is already authenticated")
+	}
+	old := s.state.resumable(d.Token)
+	if old == nil {
+		s.metrics.Inc("relay_resume_failures_total")
+		return NewError(ErrResumeFailed, "Resume token is unknown or expired").WithDetail("reason", "expired")
+	}
+
+	old.mu.Lock()
+	st := old.stream
+	if st == nil || st.ended || st.token != d.Token {
+		old.mu.Unlock()
+		s.metrics.Inc("relay_resume_failures_total")
+		return NewError(ErrResumeFailed, "Resume token is unknown or expired").WithDetail("reason", "expired")
+	}
+	missed, ok := st.since(d.Last)
+	if !ok {
+		// The client cannot catch up, so free its account for a new AUTH.
+		st.ended = true
+		wasParked, oldConn := st.parked, old.conn
+		old.mu.Unlock()
+		if !wasParked {
+			oldConn.Close()
+		}
+		s.teardown(old)
+		s.metrics.Inc("relay_resume_failures_total")
+		return NewError(ErrResumeFailed, "Missed frames are no longer buffered").WithDetail("reason", "gap")
+	}
+
+	wasParked, oldConn := st.parked, old.conn
+	old.conn = client.conn
+	old.ip, old.region = client.ip, client.region
+	st.parked = false
+	st.gen++
+	st.token = resumeToken()
+	s.state.dropResume(d.Token)
+	s.state.addResume(st.token, old)
+	resumed, _ := json.Marshal(map[string]any{
+		"resumeToken": st.token,
+		"n":           st.next - 1,
+		"replayed":    len(missed),
+	})
+	_ = old.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	err := old.conn.WriteJSON(Frame{T: "RESUMED", Data: json.RawMessage(resumed)})
+	for _, f := range missed {
+		if err != nil {
+			break
+		}
+		err = old.conn.WriteMessage(websocket.TextMessage, f)
+	}
+	old.mu.Unlock()
+	if err != nil {
+		// The read loop notices the broken connection and parks old again.
+		log.Printf("[Server] Replay to %s failed: %v", old.id, err)
+	}
+
+	s.state.removeClient(client)
+	if !wasParked {
+		oldConn.Close()
+	}
+	client.resumed = old
+	s.metrics.Inc("relay_resumes_total")
+	log.Printf("[Server] Resumed %s after n=%d, replayed %d frames", old.id, d.Last, len(missed))
+	return nil
+}
+
+// addr returns where the client connects from. RESUME moves a client to a
+// new connection, so both may change while it is live.
+func (c *Client) addr() (ip, region string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ip, c.region
+}
+
+// loadResume reads RESUME_WINDOW and RESUME_BUFFER_FRAMES.
+func loadResume() (time.Duration, int, error) {
+	window, frames := defaultResumeWindow, defaultResumeFrames
+	if v := os.Getenv("RESUME_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return 0, 0, fmt.Errorf("invalid RESUME_WINDOW: %q", v)
+		}
+		window = d
+	}
+	if v := os.Getenv("RESUME_BUFFER_FRAMES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("invalid RESUME_BUFFER_FRAMES: %q", v)
+		}
+		frames = n
+	}
+	return window, frames, nil
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestStreamReplaysOnlyWhatItStillHolds(t *testing.T) {
+	st := newStream(3)
+	for i := 0; i < 5; i++ {
+		st.push([]byte(fmt.Sprintf(`{"t":"MSG","id":"%d"}`, i)))
+	}
+	if _, ok := st.since(1); ok {
+		t.Fatal("replayed from before the oldest buffered frame")
+	}
+	if _, ok := st.since(6); ok {
+		t.Fatal("replayed from a frame never sent")
+	}
+	if missed, ok := st.since(5); !ok || len(missed) != 0 {
+		t.Fatalf("up-to-date client got %d frames, ok=%v", len(missed), ok)
+	}
+	missed, ok := st.since(2)
+	if !ok || len(missed) != 3 {
+		t.Fatalf("since(2) = %d frames, ok=%v", len(missed), ok)
+	}
+	var f struct {
+		ID string `json:"id"`
+		N  uint64 `json:"n"`
+	}
+	if err := json.Unmarshal(missed[0], &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.N != 3 || f.ID != "2" {
+		t.Fatalf("first replayed frame is %s", missed[0])
+	}
+}
+
+// streamFrame is a frame from a resumable connection, with its number.
+type streamFrame struct {
+	Frame
+	N uint64 `json:"n"`
+}
+
+func readStream(conn *websocket.Conn) (streamFrame, error) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var f streamFrame
+	err := conn.ReadJSON(&f)
+	return f, err
+}
+
+// expectStream reads frames until one of type t arrives.
+func expectStream(t *testing.T, conn *websocket.Conn, typ string) streamFrame {
+	t.Helper()
+	for {
+		f, err := readStream(conn)
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if f.T == typ {
+			return f
+		}
+	}
+}
+
+// connectResumable logs in with resumption on and returns the resume token.
+func connectResumable(t *testing.T, url, email string) (*websocket.Conn, string) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := fmt.Sprintf(`{"token":"%s","resumable":true}`, getTestSessionToken(email))
+	conn.WriteJSON(Frame{T: "AUTH", Data: json.RawMessage(auth)})
+	f := expectStream(t, conn, "AUTH_SUCCESS")
+	var d struct{ ResumeToken string }
+	json.Unmarshal(f.Data, &d)
+	if d.ResumeToken == "" || f.N != 1 {
+		t.Fatalf("AUTH_SUCCESS without resume token or numbering: %+v", f)
+	}
+	return conn, d.ResumeToken
+}
+
+// resumePair logs in a resumable alice and a plain bob and opens a session
+// between them.
+func resumePair(t *testing.T, opts ...Option) (s *Server, url string, alice *websocket.Conn, token string, bob *websocket.Conn, sid string) {
+	t.Helper()
+	s = newTestServer(opts...)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	url = "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	alice, token = connectResumable(t, url, "alice@example.com")
+	t.Cleanup(func() { alice.Close() })
+	bob, err := connectClient(url, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bob.Close() })
+	if sid, err = establishSession(alice, bob, "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	return s, url, alice, token, bob, sid
+}
+
+// drop cuts conn without a close frame and waits until the server has
+// parked the account's client.
+func drop(t *testing.T, s *Server, conn *websocket.Conn, email string) {
+	t.Helper()
+	conn.UnderlyingConn().Close()
+	c := s.state.account(email)
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		c.mu.Lock()
+		parked := c.stream.parked
+		c.mu.Unlock()
+		if parked {
+			return
+		}
+	}
+	t.Fatal("client was not parked")
+}
+
+func resume(t *testing.T, url, token string, last uint64) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.WriteJSON(Frame{T: "RESUME", Data: json.RawMessage(fmt.Sprintf(`{"token":"%s","last":%d}`, token, last))})
+	return conn
+}
+
+func TestResumeReplaysFramesMissedWhileParked(t *testing.T) {
+	s, url, alice, token, bob, sid := resumePair(t, WithResume(5*time.Second, 16))
+	bob.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"one"}`)})
+	last := expectStream(t, alice, "MSG").N
+
+	drop(t, s, alice, "alice@example.com")
+	for _, p := range []string{"two", "three"} {
+		bob.WriteJSON(Frame{T: "MSG", SID: sid, C: true, ID: p, Data: json.RawMessage(`{"payload":"` + p + `"}`)})
+		ack := expectFrame(t, bob, "DELIVERED_FAILED")
+		if ack.ID != p || string(ack.Data) != `{"buffered":true}` {
+			t.Fatalf("ack for %q (%s), want a buffered ack for %q", ack.ID, ack.Data, p)
+		}
+	}
+
+	conn := resume(t, url, token, last)
+	resumed := expectStream(t, conn, "RESUMED")
+	var d struct {
+		ResumeToken string
+		N           uint64
+		Replayed    int
+	}
+	json.Unmarshal(resumed.Data, &d)
+	if d.Replayed != 2 || d.N != last+2 || d.ResumeToken == "" || d.ResumeToken == token {
+		t.Fatalf("unexpected RESUMED %s", resumed.Data)
+	}
+	for i, want := range []string{"two", "three"} {
+		f := expectStream(t, conn, "MSG")
+		if f.N != last+1+uint64(i) || string(f.Data) != `{"payload":"`+want+`"}` {
+			t.Fatalf("replayed frame %d: n=%d data=%s", i, f.N, f.Data)
+		}
+	}
+
+	bob.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"four"}`)})
+	if f := expectStream(t, conn, "MSG"); f.N != last+3 {
+		t.Fatalf("live frame after resume has n=%d", f.N)
+	}
+	conn.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"back"}`)})
+	if f, err := readMSG(bob); err != nil || f.T != "MSG" {
+		t.Fatalf("bob expected alice's MSG after resume, got %+v (%v)", f, err)
+	}
+
+	again := resume(t, url, token, last)
+	if f := expectFrame(t, again, "ERROR"); !strings.Contains(string(f.Data), string(ErrResumeFailed)) {
+		t.Fatalf("spent resume token accepted: %s", f.Data)
+	}
+}
+
+func TestResumeMovesTheClientAddress(t *testing.T) {
+	proxies, err := ParseTrustedProxies("127.0.0.1, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, url, alice, token, _, _ := resumePair(t, WithTrustedProxies(proxies))
+	drop(t, s, alice, "alice@example.com")
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Forwarded-For": {"198.51.100.4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(Frame{T: "RESUME", Data: json.RawMessage(fmt.Sprintf(`{"token":"%s","last":0}`, token))})
+	expectStream(t, conn, "RESUMED")
+	if ip, _ := s.state.account("alice@example.com").addr(); ip != "198.51.100.4" {
+		t.Fatalf("resumed client still has IP %q", ip)
+	}
+}
+
+func TestResumeTakesOverALiveConnection(t *testing.T) {
+	_, url, alice, token, bob, sid := resumePair(t)
+
+	conn := resume(t, url, token, 0)
+	expectStream(t, conn, "RESUMED")
+	alice.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := alice.ReadMessage(); err != nil {
+			break
+		}
+	}
+	bob.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"hi"}`)})
+	expectStream(t, conn, "MSG")
+}
+
+func TestParkedClientExpires(t *testing.T) {
+	s, url, alice, token, bob, _ := resumePair(t, WithResume(50*time.Millisecond, 16))
+	drop(t, s, alice, "alice@example.com")
+
+	if err := expectNext(bob, "PEER_OFFLINE"); err != nil {
+		t.Fatal(err)
+	}
+	conn := resume(t, url, token, 0)
+	if f := expectFrame(t, conn, "ERROR"); !strings.Contains(string(f.Data), string(ErrResumeFailed)) {
+		t.Fatalf("expired client resumed: %s", f.Data)
+	}
+	if n := s.metrics.Counter("relay_resume_expired_total"); n != 1 {
+		t.Fatalf("relay_resume_expired_total = %d", n)
+	}
+}
+
+func TestResumeAfterBufferOverflowFreesTheAccount(t *testing.T) {
+	s, url, alice, token, bob, sid := resumePair(t, WithResume(5*time.Second, 2))
+	drop(t, s, alice, "alice@example.com")
+	for i := 0; i < 4; i++ {
+		bob.WriteJSON(Frame{T: "MSG", SID: sid, C: true, Data: json.RawMessage(`{"payload":"x"}`)})
+		expectFrame(t, bob, "DELIVERED_FAILED")
+	}
+
+	conn := resume(t, url, token, 1)
+	f := expectFrame(t, conn, "ERROR")
+	if !strings.Contains(string(f.Data), `"reason":"gap"`) {
+		t.Fatalf("expected a gap error, got %s", f.Data)
+	}
+	if err := expectNext(bob, "PEER_OFFLINE"); err != nil {
+		t.Fatal(err)
+	}
+	again, err := connectClient(url, "alice@example.com")
+	if err != nil {
+		t.Fatalf("AUTH after a failed resume: %v", err)
+	}
+	again.Close()
+}
+
+func TestAuthReplacesParkedLogin(t *testing.T) {
+	s, url, alice, _, bob, _ := resumePair(t)
+	drop(t, s, alice, "alice@example.com")
+
+	again, err := connectClient(url, "alice@example.com")
+	if err != nil {
+		t.Fatalf("AUTH while parked: %v", err)
+	}
+	defer again.Close()
+	if err := expectNext(bob, "PEER_OFFLINE"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCleanCloseIsNotParked(t *testing.T) {
+	_, url, alice, token, bob, _ := resumePair(t)
+	alice.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err := expectNext(bob, "PEER_OFFLINE"); err != nil {
+		t.Fatal(err)
+	}
+	conn := resume(t, url, token, 0)
+	if f := expectFrame(t, conn, "ERROR"); !strings.Contains(string(f.Data), string(ErrResumeFailed)) {
+		t.Fatalf("closed client resumed: %s", f.Data)
+	}
+}
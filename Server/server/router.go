@@ -0,0 +1,257 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FrameHandler handles frames of one type. A returned error is sent back to
+// the client as an ERROR frame.
+type FrameHandler interface {
+	ServeFrame(client *Client, frame Frame) error
+}
+
+type FrameHandlerFunc func(client *Client, frame Frame) error
+
+func (f FrameHandlerFunc) ServeFrame(client *Client, frame Frame) error {
+	return f(client, frame)
+}
+
+// Middleware wraps a handler, usually to check the frame before passing it
+// on or to observe the result.
+type Middleware func(FrameHandler) FrameHandler
+
+// Router maps frame types to handlers. Middleware added with Use wraps
+// every handler registered after it, outside any per-route middleware.
+// Frames of unregistered types are ignored.
+type Router struct {
+	routes     map[string]FrameHandler
+	middleware []Middleware
+	mu         sync.RWMutex
+}
+
+func NewRouter() *Router {
+	return &Router{routes: make(map[string]FrameHandler)}
+}
+
+func (r *Router) Use(mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.routes) > 0 {
+		panic("router: Use must be called before Handle")
+	}
+	r.middleware = append(r.middleware, mw...)
+}
+
+// Handle registers h for frameType, replacing any earlier handler. mw runs
+// in order, the first one outermost.
+func (r *Router) Handle(frameType string, h FrameHandler, mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		h = r.middleware[i](h)
+	}
+	r.routes[frameType] = h
+}
+
+func (r *Router) HandleFunc(frameType string, fn func(*Client, Frame) error, mw ...Middleware) {
+	r.Handle(frameType, FrameHandlerFunc(fn), mw...)
+}
+
+func (r *Router) Dispatch(client *Client, frame Frame) error {
+	r.mu.RLock()
+	h := r.routes[frame.T]
+	r.mu.RUnlock()
+	if h == nil {
+		return nil
+	}
+	return h.ServeFrame(client, frame)
+}
+
+// closeError marks a handler error after which the connection is closed.
+type closeError struct {
+	error
+}
+
+func closeAfter(err error) error {
+	return &closeError{err}
+}
+
+func (e *closeError) Unwrap() error {
+	return e.error
+}
+
+// routes registers the built-in frame types.
+func (s *Server) routes() *Router {
+	r := NewRouter()
+	r.Use(s.instrument, s.trace)
+
+	authed := []Middleware{s.requireAuth, s.rateLimited}
+	member := []Middleware{s.requireAuth, s.rateLimited, s.requireMember, s.sessionLimited}
+
+	// AUTH is charged in its handler, and only for OAuth tokens.
+	r.HandleFunc("AUTH", s.handleAuth)
+	r.HandleFunc("RESUME", s.handleResume, s.rateLimited)
+	r.HandleFunc("CONNECT_REQ", s.handleConnectReq, authed...)
+	r.HandleFunc("JOIN_ACCEPT", s.handleJoinAccept, authed...)
+	r.HandleFunc("JOIN_DENY", s.handleJoinDeny, authed...)
+	r.HandleFunc("REATTACH", s.handleReattach, authed...)
+	r.HandleFunc("MSG", s.handleMsg, append(authed, validSID, s.sessionLimited)...)
+	// Sealed sender: no AUTH needed, the token alone authorizes delivery
+	// into frame.SID and nothing identifies the sender. The handler charges
+	// the token and session buckets once the token checks out.
+	r.HandleFunc("SEALED_MSG", s.handleSealedMsg, s.rateLimited, validSID)
+	r.HandleFunc("SYNC", s.handleSync, member...)
+	r.HandleFunc("GET_DELIVERY_TOKENS", s.handleGetDeliveryTokens, member...)
+	r.HandleFunc("RESOLVE_PSEUDONYM", s.handleResolvePseudonym, member...)
+	for _, t := range []string{"RTC_OFFER", "RTC_ANSWER", "RTC_ICE"} {
+		r.HandleFunc(t, s.handleRTC, append(authed, s.sessionLimited, maxData(maxSignalingDataBytes))...)
+	}
+	for _, t := range []string{"SFU_JOIN", "SFU_LEAVE", "SFU_OFFER", "SFU_ANSWER", "SFU_ICE", "SFU_LAYER"} {
+		r.HandleFunc(t, s.handleSFU, append(member, maxData(maxSignalingDataBytes))...)
+	}
+	for _, t := range []string{"CALL_START", "CALL_ACCEPT", "CALL_BUSY", "CALL_END"} {
+		r.HandleFunc(t, s.handleCall, member...)
+	}
+	r.HandleFunc("PREKEY_UPLOAD", s.handlePreKeyUpload, authed...)
+	r.HandleFunc("PREKEY_FETCH", s.handlePreKeyFetch, authed...)
+	r.HandleFunc("GET_TURN_CREDS", s.handleGetTurnCreds, authed...)
+	r.HandleFunc("QUOTA", s.handleQuota, authed...)
+	r.HandleFunc("REPORT", s.handleReport, append(member, maxData(maxSignalingDataBytes))...)
+	return r
+}
+
+// Handle registers an extra frame type behind the auth check and rate
+// limiter, or replaces a built-in one.
+func (s *Server) Handle(frameType string, h FrameHandler, mw ...Middleware) {
+	s.router.Handle(frameType, h, append([]Middleware{s.requireAuth, s.rateLimited, s.sessionLimited}, mw...)...)
+}
+
+const maxSignalingDataBytes = 64 * 1024
+
+func (s *Server) requireAuth(next FrameHandler) FrameHandler {
+	return FrameHandlerFunc(func(client *Client, frame Frame) error {
+		if client.email == "" {
+			return NewError(ErrAuthRequired, "Auth required")
+		}
+		return next.ServeFrame(client, frame)
+	})
+}
+
+// rateLimited charges the IP and account buckets. Session buckets are left
+// to sessionLimited.
+func (s *Server) rateLimited(next FrameHandler) FrameHandler {
+	return FrameHandlerFunc(func(client *Client, frame Frame) error {
+		ip, _ := client.addr()
+		keys := LimitKeys{IP: ip, Account: client.email}
+		if ok, retryAfter := s.limiter.Allow(frame.T, keys); !ok {
+			return rateLimitError(frame.T, retryAfter)
+		}
+		return next.ServeFrame(client, frame)
+	})
+}
+
+// sessionLimited charges the session buckets for frame.SID, but only to
+// clients attached to it. The buckets are shared by every member, so
+// anyone who merely knows the SID must not be able to drain them.
+func (s *Server) sessionLimited(next FrameHandler) FrameHandler {
+	return FrameHandlerFunc(func(client *Client, frame Frame) error {
+		if s.limiter.Limits(frame.T, ScopeSession) && s.attached(client, frame.SID) {
+			if ok, retryAfter := s.limiter.Allow(frame.T, LimitKeys{Session: frame.SID}); !ok {
+				return rateLimitError(frame.T, retryAfter)
+			}
+		}
+		return next.ServeFrame(client, frame)
+	})
+}
+
+// requireMember admits only clients attached to the session in frame.SID.
+func (s *Server) requireMember(next FrameHandler) FrameHandler {
+	return FrameHandlerFunc(func(client *Client, frame Frame) error {
+		if !s.attached(client, frame.SID) {
+			return NewError(ErrNotMember, "Not a member of this session")
+		}
+		return next.ServeFrame(client, frame)
+	})
+}
+
+func (s *Server) attached(client *Client, sid string) bool {
+	sess := s.state.session(sid)
+	if sess == nil {
+		return false
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	_, ok := sess.clients[client.id]
+	return ok
+}
+
+func validSID(next FrameHandler) FrameHandler {
+	return FrameHandlerFunc(func(client *Client, frame Frame) error {
+		if len(frame.SID) == 0 || len(frame.SID) > maxSIDLength {
+			return NewError(ErrInvalidSessionID, "Invalid session id")
+		}
+		return next.ServeFrame(client, frame)
+	})
+}
+
+// maxData rejects frames whose data is over n bytes.
+func maxData(n int) Middleware {
+	return func(next FrameHandler) FrameHandler {
+		return FrameHandlerFunc(func(client *Client, frame Frame) error {
+			if len(frame.Data) > n {
+				return NewError(ErrPayloadTooLarge, "Frame data too large").WithDetail("max", n)
+			}
+			return next.ServeFrame(client, frame)
+		})
+	}
+}
+
+// instrument counts frames by type, and failures by type and code. Each
+// route is wrapped separately and so sees one frame type: its counters are
+// resolved on the first frame and bumped directly after that.
+func (s *Server) instrument(next FrameHandler) FrameHandler {
+	var (
+		once   sync.Once
+		frames *atomic.Uint64
+		errs   sync.Map // ErrCode → *atomic.Uint64
+	)
+	return FrameHandlerFunc(func(client *Client, frame Frame) error {
+		once.Do(func() { frames = s.metrics.CounterRef("relay_frames_total", "frame", frame.T) })
+		frames.Add(1)
+		err := next.ServeFrame(client, frame)
+		if err != nil {
+			code := ErrInternal
+			var pe *ProtocolError
+			if errors.As(err, &pe) {
+				code = pe.Code
+			}
+			c, ok := errs.Load(code)
+			if !ok {
+				c, _ = errs.LoadOrStore(code, s.metrics.CounterRef("relay_frame_errors_total", "frame", frame.T, "code", string(code)))
+			}
+			c.(*atomic.Uint64).Add(1)
+		}
+		return err
+	})
+}
+
+// trace logs each frame's type, session, request ID, handling time and
+// outcome when FRAME_TRACE is set. Payloads are never logged.
+func (s *Server) trace(next FrameHandler) FrameHandler {
+	return FrameHandlerFunc(func(client *Client, frame Frame) error {
+		if !s.tracing {
+			return next.ServeFrame(client, frame)
+		}
+		start := time.Now()
+		err := next.ServeFrame(client, frame)
+		log.Printf("[Trace] client=%s frame=%s sid=%s id=%s took=%s err=%v", client.id, frame.T, frame.SID, frame.ID, time.Since(start), err)
+		return err
+	})
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRouterMiddlewareOrder(t *testing.T) {
+	var calls []string
+	tag := func(name string) Middleware {
+		return func(next FrameHandler) FrameHandler {
+			return FrameHandlerFunc(func(c *Client, f Frame) error {
+				calls = append(calls, name)
+				return next.ServeFrame(c, f)
+			})
+		}
+	}
+	r := NewRouter()
+	r.Use(tag("global"))
+	r.HandleFunc("PING", func(*Client, Frame) error {
+		calls = append(calls, "handler")
+		return nil
+	}, tag("first"), tag("second"))
+
+	if err := r.Dispatch(&Client{}, Frame{T: "PING"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(calls, ","); got != "global,first,second,handler" {
+		t.Fatalf("unexpected order: %s", got)
+	}
+	if err := r.Dispatch(&Client{}, Frame{T: "UNKNOWN"}); err != nil {
+		t.Fatalf("unregistered frame type: %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Use after Handle did not panic")
+		}
+	}()
+	r.Use(tag("late"))
+}
+
+func TestServerHandleRegistersExtension(t *testing.T) {
+	s := newTestServer()
+	s.Handle("ECHO", FrameHandlerFunc(func(c *Client, f Frame) error {
+		return s.send(c, Frame{T: "ECHO", ID: f.ID, Data: f.Data})
+	}), maxData(8))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	alice, err := connectClient(url, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	alice.WriteJSON(Frame{T: "ECHO", ID: "1", Data: json.RawMessage(`"hi"`)})
+	if f := expectFrame(t, alice, "ECHO"); f.ID != "1" || string(f.Data) != `"hi"` {
+		t.Fatalf("unexpected echo: %+v", f)
+	}
+	alice.WriteJSON(Frame{T: "ECHO", ID: "2", Data: json.RawMessage(`"too long for it"`)})
+	f := expectFrame(t, alice, "ERROR")
+	var pe ProtocolError
+	json.Unmarshal(f.Data, &pe)
+	if pe.Code != ErrPayloadTooLarge || pe.RequestID != "2" {
+		t.Fatalf("unexpected error: %s", f.Data)
+	}
+
+	if got := s.metrics.Counter("relay_frames_total", "frame", "ECHO"); got != 2 {
+		t.Fatalf("expected 2 ECHO frames counted, got %d", got)
+	}
+	if got := s.metrics.Counter("relay_frame_errors_total", "frame", "ECHO", "code", string(ErrPayloadTooLarge)); got != 1 {
+		t.Fatalf("expected 1 ECHO error counted, got %d", got)
+	}
+}
+
+func TestAuthRequiredBeforeHandler(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, ft := range []string{"CONNECT_REQ", "MSG", "RTC_OFFER", "SFU_JOIN", "CALL_START", "GET_TURN_CREDS"} {
+		conn.WriteJSON(Frame{T: ft, SID: "s"})
+		f := expectFrame(t, conn, "ERROR")
+		var pe ProtocolError
+		json.Unmarshal(f.Data, &pe)
+		if pe.Code != ErrAuthRequired || pe.Frame != ft {
+			t.Fatalf("%s: unexpected error %s", ft, f.Data)
+		}
+	}
+}
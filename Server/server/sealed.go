@@ -0,0 +1,222 @@
+package server
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	crand "crypto/rand"
+)
+
+const (
+	deliveryTokenTTL       = 15 * time.Minute
+	deliveryTokensPerIssue = 20
+	maxSealedMsgsPerToken  = 30
+	deliveryKeyBits        = 2048
+)
+
+// DeliveryTokens issues and checks sealed-sender delivery tokens. They are
+// RSA blind signatures: a member sends blinded nonces, the relay signs them
+// without seeing them, and the member unblinds the signatures. A spent
+// token is "bt.<keyId>.<nonce>.<signature>" over the session ID and nonce,
+// which the relay has never seen, so it cannot tell which account a
+// SEALED_MSG came from. Abuse is bounded per token and per session instead:
+// the "token" rate-limit scope, and the session's own dailyBytes quota.
+//
+// The signing key rotates every deliveryTokenTTL and keeps verifying for
+// one more period, so a token lives at most twice that. RevokeAll drops
+// every key, which is the only way to take back tokens the relay cannot
+// attribute.
+type DeliveryTokens struct {
+	bits int
+	keys []*deliveryKey // newest first
+	now  func() time.Time
+	mu   sync.Mutex
+}
+
+type deliveryKey struct {
+	id        string
+	priv      *rsa.PrivateKey
+	signUntil time.Time
+	expires   time.Time
+}
+
+// DeliveryKey is the public half of the signing key, which members need to
+// blind nonces and check the signatures they get back.
+type DeliveryKey struct {
+	ID        string `json:"keyId"`
+	N         string `json:"n"` // base64url modulus, big-endian
+	E         int    `json:"e"`
+	ExpiresAt int64  `json:"expiresAt"` // ms; tokens it signs verify until then
+}
+
+// errUnknownDeliveryKey means the key a token or blinded nonce names has
+// expired or been revoked.
+var errUnknownDeliveryKey = errors.New("delivery key expired or revoked")
+
+func NewDeliveryTokens() *DeliveryTokens {
+	return &DeliveryTokens{bits: deliveryKeyBits, now: time.Now}
+}
+
+// signingKey returns the current key, generating a new one once it has
+// signed for deliveryTokenTTL.
+func (dt *DeliveryTokens) signingKey() (*deliveryKey, error) {
+	now := dt.now()
+	dt.mu.Lock()
+	if len(dt.keys) > 0 && now.Before(dt.keys[0].signUntil) {
+		k := dt.keys[0]
+		dt.mu.Unlock()
+		return k, nil
+	}
+	dt.mu.Unlock()
+
+	priv, err := rsa.GenerateKey(crand.Reader, dt.bits)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(priv.N.Bytes())
+	k := &deliveryKey{
+		id:        hex.EncodeToString(sum[:8]),
+		priv:      priv,
+		signUntil: now.Add(deliveryTokenTTL),
+		expires:   now.Add(2 * deliveryTokenTTL),
+	}
+
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if len(dt.keys) > 0 && now.Before(dt.keys[0].signUntil) {
+		return dt.keys[0], nil // another request rotated first
+	}
+	keys := []*deliveryKey{k}
+	for _, old := range dt.keys {
+		if now.Before(old.expires) {
+			keys = append(keys, old)
+		}
+	}
+	dt.keys = keys
+	return k, nil
+}
+
+// Key returns the public half of the current signing key.
+func (dt *DeliveryTokens) Key() (DeliveryKey, error) {
+	k, err := dt.signingKey()
+	if err != nil {
+		return DeliveryKey{}, err
+	}
+	return k.public(), nil
+}
+
+func (k *deliveryKey) public() DeliveryKey {
+	return DeliveryKey{
+		ID:        k.id,
+		N:         base64.RawURLEncoding.EncodeToString(k.priv.N.Bytes()),
+		E:         k.priv.E,
+		ExpiresAt: k.expires.UnixMilli(),
+	}
+}
+
+// Sign signs blinded nonces, each base64url and smaller than the modulus,
+// with the unexpired key keyID they were blinded for.
+func (dt *DeliveryTokens) Sign(keyID string, blinded []string) ([]string, error) {
+	k := dt.key(keyID)
+	if k == nil {
+		return nil, errUnknownDeliveryKey
+	}
+
+	sigs := make([]string, len(blinded))
+	for i, b := range blinded {
+		raw, err := base64.RawURLEncoding.DecodeString(b)
+		if err != nil {
+			return nil, fmt.Errorf("blinded token %d: %w", i, err)
+		}
+		m := new(big.Int).SetBytes(raw)
+		if m.Sign() == 0 || m.Cmp(k.priv.N) >= 0 {
+			return nil, fmt.Errorf("blinded token %d out of range", i)
+		}
+		sigs[i] = base64.RawURLEncoding.EncodeToString(new(big.Int).Exp(m, k.priv.D, k.priv.N).Bytes())
+	}
+	return sigs, nil
+}
+
+// Verify checks that token names sid and carries a valid signature from a
+// key that has not expired. It returns an ID for the token, for rate
+// limiting.
+func (dt *DeliveryTokens) Verify(sid, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 || parts[0] != "bt" {
+		return "", errors.New("invalid token format")
+	}
+	nonce, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(nonce) < 16 {
+		return "", errors.New("invalid token nonce")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", errors.New("invalid token signature")
+	}
+
+	k := dt.key(parts[1])
+	if k == nil {
+		return "", errUnknownDeliveryKey
+	}
+
+	s := new(big.Int).SetBytes(sig)
+	if s.Cmp(k.priv.N) >= 0 {
+		return "", errors.New("invalid token signature")
+	}
+	e := big.NewInt(int64(k.priv.E))
+	if new(big.Int).Exp(s, e, k.priv.N).Cmp(deliveryDigest(k.priv.N, sid, nonce)) != 0 {
+		return "", errors.New("invalid token signature")
+	}
+	return parts[1] + "." + parts[2], nil
+}
+
+// key returns the unexpired key with the given ID, or nil.
+func (dt *DeliveryTokens) key(id string) *deliveryKey {
+	now := dt.now()
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	for _, k := range dt.keys {
+		if k.id == id && now.Before(k.expires) {
+			return k
+		}
+	}
+	return nil
+}
+
+// RevokeAll drops every signing key, so no outstanding token verifies.
+// Members fetch new tokens when theirs are refused.
+func (dt *DeliveryTokens) RevokeAll() {
+	dt.mu.Lock()
+	dt.keys = nil
+	dt.mu.Unlock()
+}
+
+// deliveryDigest is the full-domain hash a token's signature covers: MGF1
+// with SHA-256 over the session ID and nonce, reduced mod n.
+func deliveryDigest(n *big.Int, sid string, nonce []byte) *big.Int {
+	seed := sha256.New()
+	seed.Write([]byte("delivery-token\x00" + sid + "\x00"))
+	seed.Write(nonce)
+	prefix := seed.Sum(nil)
+
+	size := (n.BitLen() + 7) / 8
+	out := make([]byte, 0, size+sha256.Size)
+	var counter [4]byte
+	for i := uint32(0); len(out) < size; i++ {
+		binary.BigEndian.PutUint32(counter[:], i)
+		h := sha256.New()
+		h.Write(prefix)
+		h.Write(counter[:])
+		out = h.Sum(out)
+	}
+	return new(big.Int).Mod(new(big.Int).SetBytes(out[:size]), n)
+}
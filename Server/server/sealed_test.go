@@ -0,0 +1,251 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	crand "crypto/rand"
+
+	"github.com/gorilla/websocket"
+)
+
+// blindTokens is a member's side of token issuance: it blinds n random
+// nonces for sid under key, and returns them with a function that turns the
+// relay's signatures into spendable tokens.
+func blindTokens(t *testing.T, key DeliveryKey, sid string, n int) ([]string, func([]string) []string) {
+	t.Helper()
+	raw, err := base64.RawURLEncoding.DecodeString(key.N)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod := new(big.Int).SetBytes(raw)
+	e := big.NewInt(int64(key.E))
+	nonces := make([][]byte, n)
+	inverses := make([]*big.Int, n)
+	blinded := make([]string, n)
+	for i := range blinded {
+		nonces[i] = make([]byte, 32)
+		crand.Read(nonces[i])
+		var r, rInv *big.Int
+		for rInv == nil {
+			if r, err = crand.Int(crand.Reader, mod); err != nil {
+				t.Fatal(err)
+			}
+			rInv = new(big.Int).ModInverse(r, mod)
+		}
+		inverses[i] = rInv
+		m := deliveryDigest(mod, sid, nonces[i])
+		m.Mul(m, new(big.Int).Exp(r, e, mod)).Mod(m, mod)
+		blinded[i] = base64.RawURLEncoding.EncodeToString(m.Bytes())
+	}
+	return blinded, func(sigs []string) []string {
+		t.Helper()
+		if len(sigs) != n {
+			t.Fatalf("got %d signatures for %d blinded tokens", len(sigs), n)
+		}
+		tokens := make([]string, n)
+		for i, sig := range sigs {
+			raw, err := base64.RawURLEncoding.DecodeString(sig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := new(big.Int).SetBytes(raw)
+			s.Mul(s, inverses[i]).Mod(s, mod)
+			tokens[i] = "bt." + key.ID + "." + base64.RawURLEncoding.EncodeToString(nonces[i]) + "." + base64.RawURLEncoding.EncodeToString(s.Bytes())
+		}
+		return tokens
+	}
+}
+
+// issueTokens gets n tokens for sid straight from dt.
+func issueTokens(t *testing.T, dt *DeliveryTokens, sid string, n int) []string {
+	t.Helper()
+	key, err := dt.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blinded, finish := blindTokens(t, key, sid, n)
+	sigs, err := dt.Sign(key.ID, blinded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return finish(sigs)
+}
+
+// fetchTokens gets n tokens for sid over GET_DELIVERY_TOKENS on conn.
+func fetchTokens(t *testing.T, conn *websocket.Conn, sid string, n int) []string {
+	t.Helper()
+	conn.WriteJSON(Frame{T: "GET_DELIVERY_TOKENS", SID: sid})
+	var resp struct {
+		Key        DeliveryKey `json:"key"`
+		Signatures []string    `json:"signatures"`
+	}
+	json.Unmarshal(expectFrame(t, conn, "DELIVERY_TOKENS").Data, &resp)
+	blinded, finish := blindTokens(t, resp.Key, sid, n)
+	req, _ := json.Marshal(map[string]any{"keyId": resp.Key.ID, "blinded": blinded})
+	conn.WriteJSON(Frame{T: "GET_DELIVERY_TOKENS", SID: sid, Data: req})
+	json.Unmarshal(expectFrame(t, conn, "DELIVERY_TOKENS").Data, &resp)
+	return finish(resp.Signatures)
+}
+
+func TestDeliveryTokenScopedToSession(t *testing.T) {
+	dt := NewDeliveryTokens()
+	tokens := issueTokens(t, dt, "sid-1", 2)
+	if len(tokens) != 2 || tokens[0] == tokens[1] {
+		t.Fatalf("expected two distinct tokens, got %v", tokens)
+	}
+	id, err := dt.Verify("sid-1", tokens[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := dt.Verify("sid-1", tokens[1]); other == id {
+		t.Fatal("two tokens share a rate-limit ID")
+	}
+	if _, err := dt.Verify("sid-2", tokens[0]); err == nil {
+		t.Fatal("token accepted for a different session")
+	}
+	parts := strings.Split(tokens[0], ".")
+	parts[2] = base64.RawURLEncoding.EncodeToString(make([]byte, 32))
+	if _, err := dt.Verify("sid-1", strings.Join(parts, ".")); err == nil {
+		t.Fatal("tampered token accepted")
+	}
+	if _, err := dt.Sign("unknown", []string{"AQ"}); err != errUnknownDeliveryKey {
+		t.Fatalf("signing under an unknown key: %v", err)
+	}
+}
+
+func TestDeliveryKeysRotate(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	dt := NewDeliveryTokens()
+	dt.now = func() time.Time { return now }
+	first := issueTokens(t, dt, "sid", 1)
+
+	now = now.Add(deliveryTokenTTL + time.Second)
+	second := issueTokens(t, dt, "sid", 1)
+	if strings.Split(first[0], ".")[1] == strings.Split(second[0], ".")[1] {
+		t.Fatal("signing key did not rotate")
+	}
+	if _, err := dt.Verify("sid", first[0]); err != nil {
+		t.Fatalf("token from the previous key refused: %v", err)
+	}
+
+	now = now.Add(deliveryTokenTTL)
+	if _, err := dt.Verify("sid", first[0]); err == nil {
+		t.Fatal("token verified after its key expired")
+	}
+	if _, err := dt.Verify("sid", second[0]); err != nil {
+		t.Fatalf("token from the current key refused: %v", err)
+	}
+	issueTokens(t, dt, "sid", 1)
+	if len(dt.keys) != 2 {
+		t.Fatalf("%d keys held after rotation, want 2", len(dt.keys))
+	}
+
+	dt.RevokeAll()
+	if _, err := dt.Verify("sid", second[0]); err == nil {
+		t.Fatal("token verified after RevokeAll")
+	}
+}
+
+func TestDeliveryTokenRateLimit(t *testing.T) {
+	dt := NewDeliveryTokens()
+	l := NewLimiter(defaultRateRules(), nil)
+	tokens := issueTokens(t, dt, "sid", 2)
+	id, _ := dt.Verify("sid", tokens[0])
+	for i := 0; i < maxSealedMsgsPerToken; i++ {
+		if ok, _ := l.Allow("SEALED_MSG", LimitKeys{Token: id}); !ok {
+			t.Fatalf("message %d rejected under the limit", i)
+		}
+	}
+	if ok, _ := l.Allow("SEALED_MSG", LimitKeys{Token: id}); ok {
+		t.Fatal("per-token limit not enforced")
+	}
+	other, _ := dt.Verify("sid", tokens[1])
+	if ok, _ := l.Allow("SEALED_MSG", LimitKeys{Token: other}); !ok {
+		t.Fatal("limit leaked across tokens")
+	}
+}
+
+func TestSealedMsgOmitsSender(t *testing.T) {
+	ts := setupTestServer()
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	alice, err := connectClient(wsUrl, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := connectClient(wsUrl, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	sid, err := establishSession(alice, bob, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := fetchTokens(t, alice, sid, 2)
+
+	anon, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anon.Close()
+	data := fmt.Sprintf(`{"payload":"sealed","token":"%s"}`, tokens[0])
+	anon.WriteJSON(Frame{T: "SEALED_MSG", SID: sid, C: true, Data: json.RawMessage(data)})
+
+	bob.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err := readMSG(bob)
+	if err != nil || msg.T != "MSG" {
+		t.Fatalf("expected MSG, got %+v (%v)", msg, err)
+	}
+	if msg.SH != "" {
+		t.Fatalf("sealed message leaked sender hash %q", msg.SH)
+	}
+	if ack, err := readMSG(anon); err != nil || ack.T != "DELIVERED" {
+		t.Fatalf("expected DELIVERED, got %+v (%v)", ack, err)
+	}
+
+	// The relay cannot tell that alice sent it, so her own attached
+	// connection gets it back like any other member's.
+	if echo := expectFrame(t, alice, "MSG"); echo.SH != "" || echo.Seq != msg.Seq {
+		t.Fatalf("unexpected echo %+v", echo)
+	}
+
+	// With nobody else attached, nothing is delivered.
+	bob.Close()
+	expectFrame(t, alice, "PEER_OFFLINE")
+	alice.Close()
+	time.Sleep(50 * time.Millisecond)
+	data = fmt.Sprintf(`{"payload":"alone","token":"%s"}`, tokens[1])
+	anon.WriteJSON(Frame{T: "SEALED_MSG", SID: sid, C: true, Data: json.RawMessage(data)})
+	expectFrame(t, anon, "DELIVERED_FAILED")
+}
+
+func TestGetDeliveryTokensValidatesRequests(t *testing.T) {
+	ts := setupTestServer()
+	defer ts.Close()
+	wsUrl := "ws" + strings.TrimPrefix(ts.URL, "http")
+	alice, bob, sid, err := connectPair(wsUrl, "blind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	defer bob.Close()
+
+	tooMany, _ := json.Marshal(map[string]any{"keyId": "k", "blinded": make([]string, deliveryTokensPerIssue+1)})
+	alice.WriteJSON(Frame{T: "GET_DELIVERY_TOKENS", SID: sid, Data: tooMany})
+	if f := expectFrame(t, alice, "ERROR"); !strings.Contains(string(f.Data), string(ErrInvalidFrame)) {
+		t.Fatalf("oversized request answered with %s", f.Data)
+	}
+	alice.WriteJSON(Frame{T: "GET_DELIVERY_TOKENS", SID: sid, Data: json.RawMessage(`{"keyId":"gone","blinded":["AQ"]}`)})
+	if f := expectFrame(t, alice, "ERROR"); !strings.Contains(string(f.Data), string(ErrInvalidToken)) {
+		t.Fatalf("unknown key answered with %s", f.Data)
+	}
+}
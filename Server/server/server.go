@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	crand "crypto/rand"
+)
+
+const sessionTokenTTL = 30 * 24 * time.Hour
+
+// New builds a relay. Without options it has no TURN servers, keeps all
+// state in memory, signs tokens with a random secret and authenticates
+// OAuth tokens with GoogleVerifier. Serve it with Start, or mount it as an
+// http.Handler.
+func New(opts ...Option) *Server {
+	s := &Server{
+		state:       newState(),
+		metrics:     NewMetrics(),
+		ringTimeout: defaultCallRingTimeout,
+
+		heartbeatInterval: defaultHeartbeatInterval,
+		heartbeatMissed:   defaultHeartbeatMissed,
+		resumeWindow:      defaultResumeWindow,
+		resumeFrames:      defaultResumeFrames,
+		syncFrames:        defaultSyncFrames,
+		syncAge:           defaultSyncAge,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.secret == nil {
+		s.secret = make([]byte, 32)
+		crand.Read(s.secret)
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+	if s.logger == nil {
+		s.logger = log.New(io.Discard, "", 0)
+	}
+	if s.auth == nil {
+		s.auth = GoogleVerifier
+	}
+	if s.rules == nil {
+		s.rules = defaultRateRules()
+	}
+	if s.preKeys == nil {
+		s.preKeys = NewPreKeyStore()
+	}
+	if s.offline == nil {
+		q := NewOfflineQueue()
+		q.now = s.now
+		s.offline = q
+	}
+	if s.keyLog == nil {
+		s.keyLog = NewKeyLog(nil)
+	}
+	s.keyLog.now = s.now
+	if s.pseudonyms == nil {
+		s.pseudonyms = NewPseudonyms(s.secret, time.Time{})
+	}
+	if s.proxies == nil {
+		s.proxies = &TrustedProxies{}
+	}
+	if s.turnPool == nil {
+		s.turnPool = NewTurnPool(nil, defaultTurnCredTTL, defaultTurnCredTTL, s.secret)
+	}
+	if s.quotas == nil {
+		s.quotas = NewQuotas(defaultQuotaTiers(), nil)
+	}
+	s.quotas.now = s.now
+	s.quotas.metrics = s.metrics
+	if s.moderation == nil {
+		s.moderation = NewModeration()
+	}
+	s.moderation.now = s.now
+	s.deliveryTokens = NewDeliveryTokens()
+	s.deliveryTokens.now = s.now
+	s.limiter = NewLimiter(s.rules, s.metrics)
+	s.limiter.now = s.now
+	s.calls = NewCalls(s.ringTimeout, s.dispatchCall, s.metrics)
+	s.router = s.routes()
+
+	s.metrics.Gauge("relay_clients", func() float64 {
+		clients, _ := s.state.counts()
+		return float64(clients)
+	})
+	s.metrics.Gauge("relay_sessions", func() float64 {
+		_, sessions := s.state.counts()
+		return float64(sessions)
+	})
+	registerRuntimeGauges(s.metrics)
+
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("GET /errors", serveErrorCodes)
+	s.keyLog.register(s.mux)
+	s.registerAdmin(s.mux)
+	s.registerMetrics(s.mux)
+	s.mux.HandleFunc("/", s.handle)
+	return s
+}
+
+// ServeHTTP upgrades / to the relay websocket and serves /errors, the key
+// transparency endpoints and, when tokens are configured, /metrics and
+// /admin/.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Start listens on addr and serves in the background, together with the
+// embedded TURN server, TURN health checks and the SFU when configured.
+func (s *Server) Start(addr string) error {
+	if s.turnConfig != nil {
+		ep, ok := s.turnPool.Embedded()
+		if !ok {
+			return errors.New("embedded TURN is configured but no TURN server is marked embedded")
+		}
+		cfg := *s.turnConfig
+		cfg.Secrets = ep.Secrets
+		cfg.SecretOverlap = s.turnPool.Overlap()
+		cfg.Authorize = s.turnBindingActive
+		turn, err := StartTurnServer(cfg, s.metrics)
+		if err != nil {
+			return fmt.Errorf("starting TURN server: %w", err)
+		}
+		s.turn = turn
+	}
+	if s.sfuConfig != nil {
+		sfu, err := NewSFU(*s.sfuConfig, s.send, s.sfuLabel, s.metrics)
+		if err != nil {
+			s.closeMedia()
+			return fmt.Errorf("starting SFU: %w", err)
+		}
+		s.sfu = sfu
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		s.closeMedia()
+		return err
+	}
+	if s.proxyProtocol {
+		ln = newProxyListener(ln, s.proxies)
+	}
+	s.listener = ln
+	s.stop = make(chan struct{})
+	go s.turnPool.RunHealthChecks(turnHealthInterval, s.metrics, s.stop)
+
+	s.httpServer = &http.Server{Handler: s}
+	go s.httpServer.Serve(ln)
+	return nil
+}
+
+// Addr is the address Start is listening on.
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Shutdown stops accepting connections, closes every client websocket and
+// stops the media servers. Clients see PEER_OFFLINE and call teardown as
+// their peers disconnect.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	if s.httpServer != nil {
+		err = s.httpServer.Shutdown(ctx)
+		close(s.stop)
+	}
+
+	s.closing.Store(true)
+	for _, c := range s.state.allClients() {
+		c.mu.Lock()
+		c.conn.Close()
+		c.mu.Unlock()
+	}
+
+	s.closeMedia()
+	return err
+}
+
+func (s *Server) closeMedia() {
+	if s.turn != nil {
+		s.turn.Close()
+	}
+	if s.sfu != nil {
+		s.sfu.Close()
+	}
+}
+
+// IssueSessionToken returns a session token for email, as sent in
+// AUTH_SUCCESS, that AUTH accepts without consulting the AuthVerifier.
+func (s *Server) IssueSessionToken(email string) string {
+	exp := s.now().Add(sessionTokenTTL).Unix()
+	data := fmt.Sprintf("sess:%d:%s", exp, email)
+
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte(data))
+	sig := hex.EncodeToString(h.Sum(nil))
+
+	return fmt.Sprintf("%s:%s", data, sig)
+}
+
+func (s *Server) verifyAuthToken(token string) (string, string, error) {
+	if strings.HasPrefix(token, "sess:") {
+		parts := strings.Split(token, ":")
+		if len(parts) != 4 {
+			return "", "", fmt.Errorf("invalid session format")
+		}
+		expStr := parts[1]
+		email := parts[2]
+		sig := parts[3]
+
+		data := fmt.Sprintf("sess:%s:%s", expStr, email)
+		h := hmac.New(sha256.New, s.secret)
+		h.Write([]byte(data))
+		expectedSig := hex.EncodeToString(h.Sum(nil))
+
+		if !hmac.Equal([]byte(sig), []byte(expectedSig)) {
+			return "", "", fmt.Errorf("invalid signature")
+		}
+
+		exp, _ := strconv.ParseInt(expStr, 10, 64)
+		if s.now().Unix() > exp {
+			return "", "", fmt.Errorf("token expired")
+		}
+
+		return email, token, nil
+	}
+
+	email, err := s.auth.VerifyToken(token)
+	if err != nil {
+		return "", "", err
+	}
+	return email, s.IssueSessionToken(email), nil
+}
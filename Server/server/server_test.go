@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestStartShutdownWithCustomVerifierAndClock(t *testing.T) {
+	var now atomic.Int64
+	now.Store(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	s := New(
+		WithAuthVerifier(AuthVerifierFunc(func(token string) (string, error) {
+			if token != "let-me-in" {
+				return "", errors.New("unknown token")
+			}
+			return "alice@example.com", nil
+		})),
+		WithClock(func() time.Time { return time.Unix(0, now.Load()) }),
+		WithRateLimits(map[string][]RateRule{}),
+	)
+	if err := s.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	url := "ws://" + s.Addr().String()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(Frame{T: "AUTH", Data: json.RawMessage(`{"token":"let-me-in"}`)})
+	f := expectFrame(t, conn, "AUTH_SUCCESS")
+	var d struct{ Email, Token string }
+	json.Unmarshal(f.Data, &d)
+	if d.Email != "alice@example.com" {
+		t.Fatalf("unexpected email %q", d.Email)
+	}
+
+	if _, _, err := s.verifyAuthToken(d.Token); err != nil {
+		t.Fatalf("issued session token rejected: %v", err)
+	}
+	now.Add(int64(sessionTokenTTL + time.Second))
+	if _, _, err := s.verifyAuthToken(d.Token); err == nil {
+		t.Fatal("session token accepted after expiry on the injected clock")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+				t.Fatal("client connection left open after Shutdown")
+			}
+			break
+		}
+	}
+}
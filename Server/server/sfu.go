@@ -0,0 +1,929 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	crand "crypto/rand"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const sfuKeyframeInterval = 500 * time.Millisecond
+
+// sfuLayerPreference ranks simulcast RIDs from best to worst, covering both
+// the "f/h/q" and "h/m/l" naming schemes browsers commonly use.
+var sfuLayerPreference = []string{"f", "h", "m", "l", "q"}
+
+// SFUConfig configures the optional selective forwarding unit.
+type SFUConfig struct {
+	PublicIP string // advertised in host candidates when behind 1:1 NAT
+	UDPPort  int    // single UDP port for all media, 0 = ephemeral per peer
+}
+
+func loadSFUConfig() (*SFUConfig, error) {
+	if os.Getenv("SFU_ENABLED") != "true" {
+		return nil, nil
+	}
+	cfg := &SFUConfig{PublicIP: envOr("SFU_PUBLIC_IP", os.Getenv("TURN_HOST"))}
+	if cfg.PublicIP != "" && net.ParseIP(cfg.PublicIP) == nil {
+		return nil, fmt.Errorf("SFU_PUBLIC_IP must be an IP address, got %q", cfg.PublicIP)
+	}
+	if v := os.Getenv("SFU_UDP_PORT"); v != "" {
+		p, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SFU_UDP_PORT: %q", v)
+		}
+		cfg.UDPPort = int(p)
+	}
+	return cfg, nil
+}
+
+// SFU forwards media between the members of sessions that opt into it.
+// Each participant holds one PeerConnection to the SFU, publishes its
+// tracks upstream once and receives everyone else's tracks downstream.
+// RTP payloads are forwarded untouched, so frames encrypted end to end with
+// insertable streams stay opaque; only RTP headers are rewritten.
+type SFU struct {
+	api     *webrtc.API
+	send    func(*Client, Frame) error
+	label   func(publisher, viewer *Client) string
+	metrics *Metrics
+	udp     net.PacketConn
+
+	rooms   map[string]*sfuRoom
+	retired map[webrtc.RTPCodecType]*atomic.Uint64 // bytes forwarded by ended publications
+	mu      sync.Mutex
+}
+
+type sfuRoom struct {
+	sid   string
+	peers map[string]*sfuPeer // by client id
+	mu    sync.Mutex
+}
+
+type sfuPeer struct {
+	sfu    *SFU
+	room   *sfuRoom
+	client *Client
+	pc     *webrtc.PeerConnection
+
+	publications map[string]*sfuPublication  // by upstream track id
+	subs         map[string]*sfuSubscription // by forwarded track id
+
+	// Negotiation is serialized per peer. The SFU offers when its set of
+	// forwarded tracks changes and answers the client's publish offers; on
+	// glare it rolls back its own offer and retries after answering.
+	negMu         sync.Mutex
+	pendingOffer  bool
+	pendingRemote []webrtc.ICECandidateInit
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// sfuPublication is one upstream track, with one TrackRemote per simulcast
+// layer (a single "" layer without simulcast).
+type sfuPublication struct {
+	id     string
+	owner  *sfuPeer
+	kind   webrtc.RTPCodecType
+	codec  webrtc.RTPCodecCapability
+	layers map[string]*webrtc.TrackRemote
+	subs   map[*sfuSubscription]struct{}
+
+	lastKeyframeReq map[string]time.Time
+	forwarded       atomic.Uint64 // payload bytes read from the publisher
+	mu              sync.Mutex
+}
+
+// sfuSubscription forwards one publication to one viewer, rewriting
+// sequence numbers and timestamps so layer switches look like one stream.
+type sfuSubscription struct {
+	pub    *sfuPublication
+	peer   *sfuPeer
+	track  *webrtc.TrackLocalStaticRTP
+	sender *webrtc.RTPSender
+
+	want  string // requested layer, "" = best available
+	layer string // layer currently forwarded, "" before the first keyframe
+
+	started   bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+	mu        sync.Mutex
+}
+
+func NewSFU(cfg SFUConfig, send func(*Client, Frame) error, label func(publisher, viewer *Client) string, metrics *Metrics) (*SFU, error) {
+	se := webrtc.SettingEngine{}
+	if cfg.PublicIP != "" {
+		se.SetNAT1To1IPs([]string{cfg.PublicIP}, webrtc.ICECandidateTypeHost)
+	}
+	sfu := &SFU{
+		send:    send,
+		label:   label,
+		metrics: metrics,
+		rooms:   make(map[string]*sfuRoom),
+		retired: map[webrtc.RTPCodecType]*atomic.Uint64{
+			webrtc.RTPCodecTypeAudio: new(atomic.Uint64),
+			webrtc.RTPCodecTypeVideo: new(atomic.Uint64),
+		},
+	}
+	if cfg.UDPPort != 0 {
+		udp, err := net.ListenUDP("udp", &net.UDPAddr{Port: cfg.UDPPort})
+		if err != nil {
+			return nil, fmt.Errorf("sfu udp listen: %w", err)
+		}
+		sfu.udp = udp
+		se.SetICEUDPMux(webrtc.NewICEUDPMux(nil, udp))
+	}
+	sfu.api = webrtc.NewAPI(webrtc.WithSettingEngine(se))
+
+	metrics.Gauge("relay_sfu_rooms", func() float64 {
+		sfu.mu.Lock()
+		defer sfu.mu.Unlock()
+		return float64(len(sfu.rooms))
+	})
+	metrics.Gauge("relay_sfu_peers", func() float64 {
+		sfu.mu.Lock()
+		rooms := make([]*sfuRoom, 0, len(sfu.rooms))
+		for _, r := range sfu.rooms {
+			rooms = append(rooms, r)
+		}
+		sfu.mu.Unlock()
+		n := 0
+		for _, r := range rooms {
+			r.mu.Lock()
+			n += len(r.peers)
+			r.mu.Unlock()
+		}
+		return float64(n)
+	})
+	for kind := range sfu.retired {
+		metrics.Gauge("relay_sfu_forwarded_bytes_total", func() float64 {
+			sfu.mu.Lock()
+			defer sfu.mu.Unlock()
+			return float64(sfu.forwardedBytes(kind))
+		}, "kind", kind.String())
+	}
+	return sfu, nil
+}
+
+// forwardedBytes sums the payload bytes publications of kind have forwarded,
+// ended ones included. Each publication counts its own packets, so the
+// forwarding loops share no lock or counter. The caller holds sfu.mu.
+func (sfu *SFU) forwardedBytes(kind webrtc.RTPCodecType) uint64 {
+	n := sfu.retired[kind].Load()
+	for _, r := range sfu.rooms {
+		r.mu.Lock()
+		for _, p := range r.peers {
+			p.mu.Lock()
+			for _, pub := range p.publications {
+				if pub.kind == kind {
+					n += pub.forwarded.Load()
+				}
+			}
+			p.mu.Unlock()
+		}
+		r.mu.Unlock()
+	}
+	return n
+}
+
+func (sfu *SFU) Close() {
+	sfu.mu.Lock()
+	rooms := make([]*sfuRoom, 0, len(sfu.rooms))
+	for _, r := range sfu.rooms {
+		rooms = append(rooms, r)
+	}
+	sfu.mu.Unlock()
+	for _, r := range rooms {
+		for _, p := range r.snapshot() {
+			p.leave()
+		}
+	}
+	if sfu.udp != nil {
+		sfu.udp.Close()
+	}
+}
+
+func newTrackID() string {
+	b := make([]byte, 8)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (r *sfuRoom) snapshot() []*sfuPeer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	peers := make([]*sfuPeer, 0, len(r.peers))
+	for _, p := range r.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Join adds client to the SFU room for sid, creating it if needed, and
+// subscribes it to every track already published there. It reports whether
+// the room is new so the caller can announce SFU mode to the session.
+func (sfu *SFU) Join(sid string, client *Client) (bool, error) {
+	sfu.mu.Lock()
+	room, ok := sfu.rooms[sid]
+	created := !ok
+	if created {
+		room = &sfuRoom{sid: sid, peers: make(map[string]*sfuPeer)}
+		sfu.rooms[sid] = room
+	}
+	sfu.mu.Unlock()
+
+	room.mu.Lock()
+	old := room.peers[client.id]
+	room.mu.Unlock()
+	if old != nil {
+		old.leave()
+	}
+
+	pc, err := sfu.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return false, err
+	}
+	p := &sfuPeer{
+		sfu:          sfu,
+		room:         room,
+		client:       client,
+		pc:           pc,
+		publications: make(map[string]*sfuPublication),
+		subs:         make(map[string]*sfuSubscription),
+	}
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		// Wait out any in-flight negotiation so the description that
+		// produced this candidate reaches the client first.
+		p.negMu.Lock()
+		p.negMu.Unlock()
+		data, _ := json.Marshal(c.ToJSON())
+		sfu.send(client, Frame{T: "SFU_ICE", SID: sid, Data: data})
+	})
+	pc.OnTrack(p.onTrack)
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed {
+			p.leave()
+		}
+	})
+
+	sfu.mu.Lock()
+	room.mu.Lock()
+	if sfu.rooms[sid] != room {
+		// Emptied and removed while we were setting up; start over.
+		room.mu.Unlock()
+		sfu.mu.Unlock()
+		pc.Close()
+		return sfu.Join(sid, client)
+	}
+	room.peers[client.id] = p
+	var pubs []*sfuPublication
+	for _, other := range room.peers {
+		if other == p {
+			continue
+		}
+		other.mu.Lock()
+		for _, pub := range other.publications {
+			pubs = append(pubs, pub)
+		}
+		other.mu.Unlock()
+	}
+	room.mu.Unlock()
+	sfu.mu.Unlock()
+
+	for _, pub := range pubs {
+		if err := p.subscribe(pub); err != nil {
+			log.Printf("sfu: subscribe %s: %v", pub.id, err)
+		}
+	}
+	p.negotiate()
+	return created, nil
+}
+
+func (sfu *SFU) peer(sid, clientID string) *sfuPeer {
+	sfu.mu.Lock()
+	room := sfu.rooms[sid]
+	sfu.mu.Unlock()
+	if room == nil {
+		return nil
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	return room.peers[clientID]
+}
+
+// Leave removes client from the room for sid.
+func (sfu *SFU) Leave(sid string, client *Client) {
+	if p := sfu.peer(sid, client.id); p != nil {
+		p.leave()
+	}
+}
+
+// LeaveAll removes client from every room, e.g. when it disconnects.
+func (sfu *SFU) LeaveAll(client *Client) {
+	sfu.mu.Lock()
+	var peers []*sfuPeer
+	for _, room := range sfu.rooms {
+		room.mu.Lock()
+		if p := room.peers[client.id]; p != nil {
+			peers = append(peers, p)
+		}
+		room.mu.Unlock()
+	}
+	sfu.mu.Unlock()
+	for _, p := range peers {
+		p.leave()
+	}
+}
+
+// Signal handles SFU_OFFER, SFU_ANSWER, SFU_ICE and SFU_LAYER from client.
+func (sfu *SFU) Signal(client *Client, frame Frame) error {
+	p := sfu.peer(frame.SID, client.id)
+	if p == nil {
+		return NewError(ErrSFUNotJoined, "Not joined to the SFU for this session")
+	}
+	switch frame.T {
+	case "SFU_OFFER", "SFU_ANSWER":
+		var desc webrtc.SessionDescription
+		if err := json.Unmarshal(frame.Data, &desc); err != nil {
+			return NewError(ErrInvalidFrame, "Invalid session description")
+		}
+		if frame.T == "SFU_OFFER" {
+			return p.handleOffer(desc)
+		}
+		return p.handleAnswer(desc)
+	case "SFU_ICE":
+		var cand webrtc.ICECandidateInit
+		if err := json.Unmarshal(frame.Data, &cand); err != nil {
+			return NewError(ErrInvalidFrame, "Invalid ICE candidate")
+		}
+		return p.addCandidate(cand)
+	case "SFU_LAYER":
+		var req struct {
+			TrackID string `json:"trackId"`
+			RID     string `json:"rid"`
+		}
+		if err := json.Unmarshal(frame.Data, &req); err != nil {
+			return NewError(ErrInvalidFrame, "Invalid layer request")
+		}
+		return p.selectLayer(req.TrackID, req.RID)
+	}
+	return NewError(ErrInvalidFrame, "Unknown SFU frame "+frame.T)
+}
+
+// negotiate sends an offer if the peer's forwarded tracks changed, or
+// defers it until the in-flight exchange completes.
+func (p *sfuPeer) negotiate() {
+	p.negMu.Lock()
+	defer p.negMu.Unlock()
+	p.offerLocked()
+}
+
+func (p *sfuPeer) offerLocked() {
+	if p.pc.ConnectionState() == webrtc.PeerConnectionStateClosed || len(p.pc.GetTransceivers()) == 0 {
+		return
+	}
+	if p.pc.SignalingState() != webrtc.SignalingStateStable {
+		p.pendingOffer = true
+		return
+	}
+	p.pendingOffer = false
+	offer, err := p.pc.CreateOffer(nil)
+	if err == nil {
+		err = p.pc.SetLocalDescription(offer)
+	}
+	if err != nil {
+		log.Printf("sfu: offer: %v", err)
+		return
+	}
+	data, _ := json.Marshal(p.pc.LocalDescription())
+	p.sfu.send(p.client, Frame{T: "SFU_OFFER", SID: p.room.sid, Data: data})
+}
+
+func (p *sfuPeer) handleOffer(offer webrtc.SessionDescription) error {
+	p.negMu.Lock()
+	defer p.negMu.Unlock()
+	if p.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		if err := p.pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			return err
+		}
+		p.pendingOffer = true
+	}
+	if err := p.pc.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	p.flushCandidatesLocked()
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := p.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(p.pc.LocalDescription())
+	p.sfu.send(p.client, Frame{T: "SFU_ANSWER", SID: p.room.sid, Data: data})
+	if p.pendingOffer {
+		p.offerLocked()
+	}
+	return nil
+}
+
+func (p *sfuPeer) handleAnswer(answer webrtc.SessionDescription) error {
+	p.negMu.Lock()
+	defer p.negMu.Unlock()
+	if err := p.pc.SetRemoteDescription(answer); err != nil {
+		return err
+	}
+	p.flushCandidatesLocked()
+	if p.pendingOffer {
+		p.offerLocked()
+	}
+	return nil
+}
+
+// addCandidate buffers candidates that arrive before the first remote
+// description, which pion would otherwise reject.
+func (p *sfuPeer) addCandidate(c webrtc.ICECandidateInit) error {
+	p.negMu.Lock()
+	defer p.negMu.Unlock()
+	if p.pc.RemoteDescription() == nil {
+		p.pendingRemote = append(p.pendingRemote, c)
+		return nil
+	}
+	return p.pc.AddICECandidate(c)
+}
+
+func (p *sfuPeer) flushCandidatesLocked() {
+	for _, c := range p.pendingRemote {
+		p.pc.AddICECandidate(c)
+	}
+	p.pendingRemote = nil
+}
+
+func (p *sfuPeer) leave() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	pubs := make([]*sfuPublication, 0, len(p.publications))
+	for _, pub := range p.publications {
+		pubs = append(pubs, pub)
+	}
+	p.mu.Unlock()
+
+	sfu := p.sfu
+	sfu.mu.Lock()
+	p.room.mu.Lock()
+	if p.room.peers[p.client.id] == p {
+		delete(p.room.peers, p.client.id)
+	}
+	// The peer's publications no longer show up in forwardedBytes.
+	for _, pub := range pubs {
+		if c := sfu.retired[pub.kind]; c != nil {
+			c.Add(pub.forwarded.Swap(0))
+		}
+	}
+	if len(p.room.peers) == 0 && sfu.rooms[p.room.sid] == p.room {
+		delete(sfu.rooms, p.room.sid)
+	}
+	p.room.mu.Unlock()
+	sfu.mu.Unlock()
+
+	for _, pub := range pubs {
+		pub.unpublish()
+	}
+	p.pc.Close()
+}
+
+// onTrack runs once per upstream track, or once per layer with simulcast.
+func (p *sfuPeer) onTrack(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+	key := track.StreamID() + "/" + track.ID()
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	pub, ok := p.publications[key]
+	if !ok {
+		pub = &sfuPublication{
+			id:              newTrackID(),
+			owner:           p,
+			kind:            track.Kind(),
+			codec:           track.Codec().RTPCodecCapability,
+			layers:          make(map[string]*webrtc.TrackRemote),
+			subs:            make(map[*sfuSubscription]struct{}),
+			lastKeyframeReq: make(map[string]time.Time),
+		}
+		p.publications[key] = pub
+	}
+	p.mu.Unlock()
+
+	pub.mu.Lock()
+	pub.layers[track.RID()] = track
+	pub.mu.Unlock()
+
+	if !ok {
+		for _, other := range p.room.snapshot() {
+			if other == p {
+				continue
+			}
+			if err := other.subscribe(pub); err != nil {
+				log.Printf("sfu: subscribe %s: %v", pub.id, err)
+				continue
+			}
+			go other.negotiate()
+		}
+	}
+	pub.requestKeyframe(track.RID())
+	pub.forward(track)
+}
+
+func (p *sfuPeer) subscribe(pub *sfuPublication) error {
+	track, err := webrtc.NewTrackLocalStaticRTP(pub.codec, pub.id, p.sfu.label(pub.owner.client, p.client))
+	if err != nil {
+		return err
+	}
+	sender, err := p.pc.AddTrack(track)
+	if err != nil {
+		return err
+	}
+	sub := &sfuSubscription{pub: pub, peer: p, track: track, sender: sender}
+
+	p.mu.Lock()
+	p.subs[pub.id] = sub
+	p.mu.Unlock()
+	pub.mu.Lock()
+	pub.subs[sub] = struct{}{}
+	pub.mu.Unlock()
+
+	go sub.readRTCP()
+	return nil
+}
+
+func (p *sfuPeer) selectLayer(trackID, rid string) error {
+	p.mu.Lock()
+	sub := p.subs[trackID]
+	p.mu.Unlock()
+	if sub == nil {
+		return NewError(ErrInvalidFrame, "Unknown track")
+	}
+	sub.pub.mu.Lock()
+	_, ok := sub.pub.layers[rid]
+	sub.pub.mu.Unlock()
+	if !ok && rid != "" {
+		return NewError(ErrInvalidFrame, "Unknown layer")
+	}
+	sub.mu.Lock()
+	sub.want = rid
+	sub.mu.Unlock()
+	sub.pub.requestKeyframe(sub.target())
+	return nil
+}
+
+// unpublish removes the publication from every viewer once its publisher
+// leaves.
+func (pub *sfuPublication) unpublish() {
+	pub.mu.Lock()
+	subs := make([]*sfuSubscription, 0, len(pub.subs))
+	for sub := range pub.subs {
+		subs = append(subs, sub)
+	}
+	pub.subs = make(map[*sfuSubscription]struct{})
+	pub.mu.Unlock()
+
+	for _, sub := range subs {
+		p := sub.peer
+		p.mu.Lock()
+		delete(p.subs, pub.id)
+		closed := p.closed
+		p.mu.Unlock()
+		if closed {
+			continue
+		}
+		p.pc.RemoveTrack(sub.sender)
+		go p.negotiate()
+	}
+}
+
+func (pub *sfuPublication) bestLayer() string {
+	for _, rid := range sfuLayerPreference {
+		if _, ok := pub.layers[rid]; ok {
+			return rid
+		}
+	}
+	for rid := range pub.layers {
+		return rid
+	}
+	return ""
+}
+
+// requestKeyframe asks the publisher for a keyframe on one layer, at most
+// once per sfuKeyframeInterval.
+func (pub *sfuPublication) requestKeyframe(rid string) {
+	if pub.kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	pub.mu.Lock()
+	track := pub.layers[rid]
+	if track == nil || time.Since(pub.lastKeyframeReq[rid]) < sfuKeyframeInterval {
+		pub.mu.Unlock()
+		return
+	}
+	pub.lastKeyframeReq[rid] = time.Now()
+	pub.mu.Unlock()
+	pub.owner.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
+}
+
+func (pub *sfuPublication) forward(track *webrtc.TrackRemote) {
+	rid := track.RID()
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		pub.mu.Lock()
+		subs := make([]*sfuSubscription, 0, len(pub.subs))
+		for sub := range pub.subs {
+			subs = append(subs, sub)
+		}
+		pub.mu.Unlock()
+
+		for _, sub := range subs {
+			if err := sub.write(rid, pkt); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				log.Printf("sfu: forward %s: %v", pub.id, err)
+			}
+		}
+		pub.forwarded.Add(uint64(len(pkt.Payload)))
+	}
+}
+
+func (sub *sfuSubscription) target() string {
+	sub.pub.mu.Lock()
+	defer sub.pub.mu.Unlock()
+	sub.mu.Lock()
+	want := sub.want
+	sub.mu.Unlock()
+	if _, ok := sub.pub.layers[want]; ok {
+		return want
+	}
+	return sub.pub.bestLayer()
+}
+
+// write forwards pkt from layer rid if that is the layer this viewer is on,
+// switching layers only at a keyframe so the decoder never sees a gap. Video
+// in a codec without keyframe detection never switches once started.
+func (sub *sfuSubscription) write(rid string, pkt *rtp.Packet) error {
+	target := sub.target()
+
+	sub.mu.Lock()
+	video := sub.pub.kind == webrtc.RTPCodecTypeVideo
+	switchable := !video || keyframeCodecs[sub.pub.codec.MimeType]
+	if sub.layer != target && rid == target && (switchable || !sub.started) {
+		if video && switchable && !isKeyframe(sub.pub.codec.MimeType, pkt.Payload) {
+			sub.mu.Unlock()
+			sub.pub.requestKeyframe(rid)
+			return nil
+		}
+		sub.switchTo(rid, pkt)
+	}
+	if sub.layer != rid {
+		sub.mu.Unlock()
+		return nil
+	}
+
+	out := *pkt
+	out.Header.Extension = false
+	out.Header.Extensions = nil
+	out.SequenceNumber = pkt.SequenceNumber + sub.seqOffset
+	out.Timestamp = pkt.Timestamp + sub.tsOffset
+	if int16(out.SequenceNumber-sub.lastSeq) > 0 || !sub.started {
+		sub.lastSeq = out.SequenceNumber
+		sub.lastTS = out.Timestamp
+		sub.lastWrite = time.Now()
+	}
+	sub.started = true
+	sub.mu.Unlock()
+
+	return sub.track.WriteRTP(&out)
+}
+
+// switchTo rebases sequence numbers and timestamps so the new layer
+// continues where the previous one left off.
+func (sub *sfuSubscription) switchTo(rid string, pkt *rtp.Packet) {
+	sub.layer = rid
+	if !sub.started {
+		return
+	}
+	elapsed := uint32(time.Since(sub.lastWrite).Seconds() * float64(sub.pub.codec.ClockRate))
+	sub.seqOffset = sub.lastSeq + 1 - pkt.SequenceNumber
+	sub.tsOffset = sub.lastTS + max(elapsed, 1) - pkt.Timestamp
+}
+
+// readRTCP relays the viewer's keyframe requests to the publisher.
+func (sub *sfuSubscription) readRTCP() {
+	for {
+		pkts, _, err := sub.sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				sub.mu.Lock()
+				layer := sub.layer
+				sub.mu.Unlock()
+				sub.pub.requestKeyframe(layer)
+			}
+		}
+	}
+}
+
+// keyframeCodecs are the video codecs isKeyframe can parse. Viewers only
+// switch between simulcast layers of these; with any other codec a viewer
+// stays on the first layer it receives.
+var keyframeCodecs = map[string]bool{
+	webrtc.MimeTypeVP8:  true,
+	webrtc.MimeTypeVP9:  true,
+	webrtc.MimeTypeH264: true,
+	webrtc.MimeTypeAV1:  true,
+}
+
+// isKeyframe reports whether payload starts a keyframe. It inspects only the
+// RTP payload descriptor and the first codec header bytes, which
+// insertable-streams encryption schemes leave in the clear precisely so SFUs
+// can find keyframes.
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch mimeType {
+	case webrtc.MimeTypeVP8:
+		return isVP8Keyframe(payload)
+	case webrtc.MimeTypeVP9:
+		return isVP9Keyframe(payload)
+	case webrtc.MimeTypeH264:
+		return isH264Keyframe(payload)
+	case webrtc.MimeTypeAV1:
+		return isAV1Keyframe(payload)
+	}
+	return false
+}
+
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	desc := payload[0]
+	start := desc&0x10 != 0
+	pid := desc & 0x07
+	i := 1
+	if desc&0x80 != 0 { // X: extension byte present
+		if len(payload) <= i {
+			return false
+		}
+		ext := payload[i]
+		i++
+		if ext&0x80 != 0 { // I: picture ID
+			if len(payload) <= i {
+				return false
+			}
+			if payload[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		if ext&0x40 != 0 { // L: TL0PICIDX
+			i++
+		}
+		if ext&0x30 != 0 { // T or K
+			i++
+		}
+	}
+	if !start || pid != 0 || len(payload) <= i {
+		return false
+	}
+	return payload[i]&0x01 == 0
+}
+
+// isVP9Keyframe looks for the start of a frame that is not inter-picture
+// predicted, on the base spatial layer when layer indices are present.
+func isVP9Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	desc := payload[0]
+	if desc&0x40 != 0 || desc&0x08 == 0 { // P: inter-predicted, B: start of frame
+		return false
+	}
+	i := 1
+	if desc&0x80 != 0 { // I: picture ID
+		if len(payload) <= i {
+			return false
+		}
+		if payload[i]&0x80 != 0 {
+			i++
+		}
+		i++
+	}
+	if desc&0x20 != 0 { // L: layer indices
+		if len(payload) <= i {
+			return false
+		}
+		return payload[i]&0x0e == 0 // SID 0
+	}
+	return true
+}
+
+// isH264Keyframe looks for an SPS or IDR slice, alone, inside a STAP-A or at
+// the start of an FU-A.
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	keyNAL := func(t byte) bool { return t == 5 || t == 7 } // IDR slice, SPS
+	switch t := payload[0] & 0x1f; t {
+	case 24: // STAP-A
+		for i := 1; i+2 < len(payload); i += 2 + int(binary.BigEndian.Uint16(payload[i:])) {
+			if keyNAL(payload[i+2] & 0x1f) {
+				return true
+			}
+		}
+		return false
+	case 28: // FU-A
+		return len(payload) > 1 && payload[1]&0x80 != 0 && keyNAL(payload[1]&0x1f)
+	default:
+		return keyNAL(t)
+	}
+}
+
+// isAV1Keyframe checks the aggregation header's N bit, which marks the first
+// packet of a coded video sequence.
+func isAV1Keyframe(payload []byte) bool {
+	return len(payload) > 0 && payload[0]&0x80 == 0 && payload[0]&0x08 != 0 // Z clear, N set
+}
+
+// sfuLabel is the stream ID viewers see for a publisher: the same peer ID
+// MSG frames carry, so clients can pick the right decryption key.
+func (s *Server) sfuLabel(publisher, viewer *Client) string {
+	return s.peerID(publisher.email, viewer.email, viewer.wantsPairwise())
+}
+
+func (s *Server) handleSFU(client *Client, frame Frame) error {
+	if s.sfu == nil {
+		return NewError(ErrSFUDisabled, "SFU not enabled")
+	}
+
+	switch frame.T {
+	case "SFU_JOIN":
+		created, err := s.sfu.Join(frame.SID, client)
+		if err != nil {
+			log.Printf("sfu: join: %v", err)
+			return NewError(ErrSFUUnavailable, "Could not join SFU")
+		}
+		s.send(client, Frame{T: "SFU_JOINED", SID: frame.SID})
+		if created {
+			sess := s.state.session(frame.SID)
+			if sess == nil {
+				return nil
+			}
+			sess.mu.Lock()
+			peers := sess.others(client.id)
+			sess.mu.Unlock()
+			for _, c := range peers {
+				s.send(c, Frame{T: "SFU_ACTIVE", SID: frame.SID})
+			}
+		}
+	case "SFU_LEAVE":
+		s.sfu.Leave(frame.SID, client)
+	default:
+		if err := s.sfu.Signal(client, frame); err != nil {
+			var pe *ProtocolError
+			if !errors.As(err, &pe) {
+				pe = NewError(ErrNegotiationFailed, err.Error())
+			}
+			return pe
+		}
+	}
+	return nil
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestIsKeyframeVP8(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload []byte
+		want    bool
+	}{
+		{"keyframe", []byte{0x10, 0x00, 0xaa}, true},
+		{"delta", []byte{0x10, 0x01, 0xaa}, false},
+		{"continuation", []byte{0x00, 0x00, 0xaa}, false},
+		{"keyframe with 15-bit picture id", []byte{0x90, 0x80, 0x81, 0x02, 0x00, 0xaa}, true},
+		{"delta with 7-bit picture id", []byte{0x90, 0x80, 0x05, 0x01, 0xaa}, false},
+		{"truncated", []byte{0x90}, false},
+	}
+	for _, c := range cases {
+		if got := isKeyframe(webrtc.MimeTypeVP8, c.payload); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestIsKeyframeOtherCodecs(t *testing.T) {
+	cases := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     bool
+	}{
+		{"vp9 keyframe", webrtc.MimeTypeVP9, []byte{0x88, 0x12, 0xaa}, true},
+		{"vp9 inter frame", webrtc.MimeTypeVP9, []byte{0xc8, 0x12, 0xaa}, false},
+		{"vp9 mid-frame", webrtc.MimeTypeVP9, []byte{0x80, 0x12, 0xaa}, false},
+		{"vp9 keyframe with 15-bit picture id and base layer", webrtc.MimeTypeVP9, []byte{0xaa, 0x81, 0x02, 0x00, 0x00}, true},
+		{"vp9 keyframe on upper spatial layer", webrtc.MimeTypeVP9, []byte{0xaa, 0x05, 0x02, 0x00}, false},
+		{"h264 idr", webrtc.MimeTypeH264, []byte{0x65, 0x88}, true},
+		{"h264 sps", webrtc.MimeTypeH264, []byte{0x67, 0x42}, true},
+		{"h264 non-idr slice", webrtc.MimeTypeH264, []byte{0x41, 0x9a}, false},
+		{"h264 stap-a with sps", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x01, 0x09, 0x00, 0x02, 0x67, 0x42}, true},
+		{"h264 stap-a without keyframe", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x01, 0x09, 0x00, 0x02, 0x41, 0x9a}, false},
+		{"h264 fu-a idr start", webrtc.MimeTypeH264, []byte{0x7c, 0x85, 0x88}, true},
+		{"h264 fu-a idr continuation", webrtc.MimeTypeH264, []byte{0x7c, 0x05, 0x88}, false},
+		{"av1 new sequence", webrtc.MimeTypeAV1, []byte{0x18, 0x0a}, true},
+		{"av1 continuation", webrtc.MimeTypeAV1, []byte{0x98, 0x0a}, false},
+		{"av1 delta", webrtc.MimeTypeAV1, []byte{0x10, 0x32}, false},
+		{"h265 is not parsed", webrtc.MimeTypeH265, []byte{0x26, 0x01}, false},
+		{"empty", webrtc.MimeTypeH264, nil, false},
+	}
+	for _, c := range cases {
+		if got := isKeyframe(c.mimeType, c.payload); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSFULayerSwitchNeedsKeyframeDetection(t *testing.T) {
+	vp8Key, vp8Delta := []byte{0x10, 0x00, 0xaa}, []byte{0x10, 0x01, 0xaa}
+	cases := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     string
+	}{
+		{"vp8 delta waits", webrtc.MimeTypeVP8, vp8Delta, "q"},
+		{"vp8 keyframe switches", webrtc.MimeTypeVP8, vp8Key, "h"},
+		{"h265 never switches", webrtc.MimeTypeH265, []byte{0x26, 0x01}, "q"},
+	}
+	for _, c := range cases {
+		codec := webrtc.RTPCodecCapability{MimeType: c.mimeType, ClockRate: 90000}
+		track, err := webrtc.NewTrackLocalStaticRTP(codec, "video", "stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := &sfuPublication{
+			kind:            webrtc.RTPCodecTypeVideo,
+			codec:           codec,
+			layers:          map[string]*webrtc.TrackRemote{"h": nil, "q": nil},
+			lastKeyframeReq: make(map[string]time.Time),
+		}
+		sub := &sfuSubscription{pub: pub, track: track, want: "q"}
+		if err := sub.write("q", &rtp.Packet{Header: rtp.Header{SequenceNumber: 1}, Payload: vp8Key}); err != nil {
+			t.Fatal(err)
+		}
+		sub.want = "h"
+		if err := sub.write("h", &rtp.Packet{Header: rtp.Header{SequenceNumber: 100}, Payload: c.payload}); err != nil {
+			t.Fatal(err)
+		}
+		if sub.layer != c.want {
+			t.Errorf("%s: forwarding layer %q, want %q", c.name, sub.layer, c.want)
+		}
+	}
+}
+
+// sfuTestPeer is a pion client that answers the SFU's signaling in-process.
+type sfuTestPeer struct {
+	t      *testing.T
+	sfu    *SFU
+	client *Client
+	pc     *webrtc.PeerConnection
+	frames chan Frame
+	errs   chan error
+	queued []webrtc.ICECandidateInit
+}
+
+func newSFUTestPeer(t *testing.T, sfu *SFU, client *Client, frames chan Frame) *sfuTestPeer {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	p := &sfuTestPeer{t: t, sfu: sfu, client: client, pc: pc, frames: frames, errs: make(chan error, 16)}
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil {
+			p.signal("SFU_ICE", c.ToJSON())
+		}
+	})
+	go p.run()
+	return p
+}
+
+// signal reports failures on errs rather than through t, since the SFU may
+// still be renegotiating with this peer after the test has returned.
+func (p *sfuTestPeer) signal(t string, v any) {
+	data, _ := json.Marshal(v)
+	if err := p.sfu.Signal(p.client, Frame{T: t, SID: "room", Data: data}); err != nil {
+		p.fail(fmt.Errorf("%s: %w", t, err))
+	}
+}
+
+func (p *sfuTestPeer) fail(err error) {
+	select {
+	case p.errs <- err:
+	default:
+	}
+}
+
+func (p *sfuTestPeer) checkErrors() {
+	p.t.Helper()
+	select {
+	case err := <-p.errs:
+		p.t.Fatal(err)
+	default:
+	}
+}
+
+func (p *sfuTestPeer) run() {
+	for f := range p.frames {
+		switch f.T {
+		case "SFU_OFFER":
+			var offer webrtc.SessionDescription
+			json.Unmarshal(f.Data, &offer)
+			if err := p.pc.SetRemoteDescription(offer); err != nil {
+				p.fail(fmt.Errorf("set offer: %w", err))
+				continue
+			}
+			p.flush()
+			answer, _ := p.pc.CreateAnswer(nil)
+			p.pc.SetLocalDescription(answer)
+			p.signal("SFU_ANSWER", p.pc.LocalDescription())
+		case "SFU_ANSWER":
+			var answer webrtc.SessionDescription
+			json.Unmarshal(f.Data, &answer)
+			if err := p.pc.SetRemoteDescription(answer); err != nil {
+				p.fail(fmt.Errorf("set answer: %w", err))
+			}
+			p.flush()
+		case "SFU_ICE":
+			var c webrtc.ICECandidateInit
+			json.Unmarshal(f.Data, &c)
+			if p.pc.RemoteDescription() == nil {
+				p.queued = append(p.queued, c)
+			} else {
+				p.pc.AddICECandidate(c)
+			}
+		}
+	}
+}
+
+func (p *sfuTestPeer) flush() {
+	for _, c := range p.queued {
+		p.pc.AddICECandidate(c)
+	}
+	p.queued = nil
+}
+
+func (p *sfuTestPeer) publish() {
+	offer, err := p.pc.CreateOffer(nil)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if err := p.pc.SetLocalDescription(offer); err != nil {
+		p.t.Fatal(err)
+	}
+	p.signal("SFU_OFFER", p.pc.LocalDescription())
+}
+
+// vp8Keyframe builds a payload with a cleartext VP8 keyframe header followed
+// by bytes standing in for an insertable-streams ciphertext.
+func vp8Keyframe(tag byte) []byte {
+	return []byte{0x10, 0x00, tag, 0xde, 0xad, 0xbe, 0xef}
+}
+
+func TestSFUForwardsSimulcastLayersUntouched(t *testing.T) {
+	alice := &Client{id: "a", email: "alice@example.com"}
+	bob := &Client{id: "b", email: "bob@example.com"}
+	inbox := map[string]chan Frame{"a": make(chan Frame, 64), "b": make(chan Frame, 64)}
+	send := func(c *Client, f Frame) error {
+		inbox[c.id] <- f
+		return nil
+	}
+	label := func(pub, viewer *Client) string { return "peer-" + pub.id }
+	sfu, err := NewSFU(SFUConfig{}, send, label, NewMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sfu.Close()
+
+	if created, err := sfu.Join("room", alice); err != nil || !created {
+		t.Fatalf("alice join: created=%v err=%v", created, err)
+	}
+	if created, err := sfu.Join("room", bob); err != nil || created {
+		t.Fatalf("bob join: created=%v err=%v", created, err)
+	}
+	a := newSFUTestPeer(t, sfu, alice, inbox["a"])
+	b := newSFUTestPeer(t, sfu, bob, inbox["b"])
+
+	layers := map[string]*webrtc.TrackLocalStaticRTP{}
+	for _, rid := range []string{"f", "q"} {
+		tr, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "alice", webrtc.WithRTPStreamID(rid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers[rid] = tr
+	}
+	tx, err := a.pc.AddTransceiverFromTrack(layers["f"], webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Sender().AddEncoding(layers["q"]); err != nil {
+		t.Fatal(err)
+	}
+
+	type received struct {
+		track *webrtc.TrackRemote
+		pkt   *rtp.Packet
+	}
+	got := make(chan received, 256)
+	b.pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			got <- received{track, pkt}
+		}
+	})
+
+	a.publish()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		seq := uint16(0)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			seq++
+			// Browsers tag simulcast packets with MID and RID header
+			// extensions; pion leaves that to the application.
+			var midID, ridID uint8
+			for _, ext := range tx.Sender().GetParameters().HeaderExtensions {
+				switch ext.URI {
+				case sdp.SDESMidURI:
+					midID = uint8(ext.ID)
+				case sdp.SDESRTPStreamIDURI:
+					ridID = uint8(ext.ID)
+				}
+			}
+			if midID == 0 || ridID == 0 {
+				continue
+			}
+			for rid, tr := range layers {
+				pkt := &rtp.Packet{
+					Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, Marker: true},
+					Payload: vp8Keyframe(rid[0]),
+				}
+				pkt.Header.SetExtension(midID, []byte(tx.Mid()))
+				pkt.Header.SetExtension(ridID, []byte(rid))
+				tr.WriteRTP(pkt)
+			}
+		}
+	}()
+
+	waitFor := func(tag byte) received {
+		t.Helper()
+		deadline := time.After(15 * time.Second)
+		for {
+			select {
+			case r := <-got:
+				if r.pkt.Payload[2] == tag {
+					return r
+				}
+			case <-deadline:
+				t.Fatalf("never received layer %q", tag)
+			}
+		}
+	}
+
+	var r received
+	select {
+	case r = <-got:
+	case <-time.After(15 * time.Second):
+		t.Fatal("no media forwarded")
+	}
+	if !bytes.Equal(r.pkt.Payload, vp8Keyframe('f')) {
+		t.Fatalf("payload modified in transit: %x", r.pkt.Payload)
+	}
+	if r.track.StreamID() != "peer-a" {
+		t.Fatalf("expected stream labelled with the publisher, got %q", r.track.StreamID())
+	}
+
+	b.signal("SFU_LAYER", map[string]string{"trackId": r.track.ID(), "rid": "q"})
+	r = waitFor('q')
+	if !bytes.Equal(r.pkt.Payload, vp8Keyframe('q')) {
+		t.Fatalf("payload modified in transit: %x", r.pkt.Payload)
+	}
+
+	a.checkErrors()
+	b.checkErrors()
+
+	forwarded := func() uint64 {
+		sfu.mu.Lock()
+		defer sfu.mu.Unlock()
+		return sfu.forwardedBytes(webrtc.RTPCodecTypeVideo)
+	}
+	live := forwarded()
+	if live == 0 {
+		t.Fatal("forwarded bytes not counted")
+	}
+
+	sfu.LeaveAll(alice)
+	sfu.LeaveAll(bob)
+	sfu.mu.Lock()
+	rooms := len(sfu.rooms)
+	sfu.mu.Unlock()
+	if rooms != 0 {
+		t.Fatalf("expected empty rooms to be removed, %d left", rooms)
+	}
+	if after := forwarded(); after < live {
+		t.Fatalf("forwarded bytes went from %d to %d when the publisher left", live, after)
+	}
+}
@@ -0,0 +1,352 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	crand "crypto/rand"
+)
+
+type Frame struct {
+	T    string          `json:"t"`
+	SID  string          `json:"sid,omitempty"`
+	C    bool            `json:"c,omitempty"`
+	P    int             `json:"p,omitempty"`
+	SH   string          `json:"sh,omitempty"`
+	To   string          `json:"to,omitempty"`
+	ID   string          `json:"id,omitempty"`
+	Seq  uint64          `json:"seq,omitempty"` // number of a relayed frame within the session
+	TS   int64           `json:"ts,omitempty"`  // server time of a numbered frame, Unix ms
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type Client struct {
+	id         string
+	email      string
+	ip         string
+	conn       *websocket.Conn
+	mu         sync.Mutex
+	pairwise   atomic.Bool // set at AUTH; atomic so labelling recipients never waits on a write
+	relayOnly  atomic.Bool
+	legacyPing atomic.Bool
+	region     string
+	stream     *stream // numbers and buffers outbound frames once AUTH asks for resumption
+	resumed    *Client // set by RESUME: the client this connection now serves
+	out        *outbox // frames waiting for this client's writer
+
+	sessions map[string]*Session // sessions this connection is attached to
+	sessMu   sync.Mutex
+}
+
+type Session struct {
+	id        string
+	clients   map[string]*Client
+	members   map[string]uint64 // account → the session's last seq when it joined
+	owner     string
+	invited   string // account the CONNECT_REQ that opened the session named
+	connectID string // id of the CONNECT_REQ that opened the session
+	hist      history
+	mu        sync.Mutex
+}
+
+func newSession(id string, c *Client) *Session {
+	sess := &Session{
+		id:      id,
+		clients: make(map[string]*Client),
+		members: make(map[string]uint64),
+	}
+	sess.add(c)
+	return sess
+}
+
+// add attaches c to the session. Accounts stay in members after they
+// disconnect so calls can still reach them, and SYNC only ever replays
+// what was relayed after they first joined. The caller holds sess.mu, or
+// is the only one with sess.
+func (sess *Session) add(c *Client) {
+	sess.clients[c.id] = c
+	email := normalizeEmail(c.email)
+	if _, ok := sess.members[email]; !ok {
+		sess.members[email] = sess.hist.seq
+	}
+	c.attach(sess)
+}
+
+// admits reports whether the account email may attach to the session. A
+// session opened by CONNECT_REQ admits its members and the account it
+// invited. A session the relay has no CONNECT_REQ for, as after a restart
+// or for a group keyed by a shared ID, admits any account that knows its ID.
+// The caller holds sess.mu.
+func (sess *Session) admits(email string) bool {
+	email = normalizeEmail(email)
+	_, member := sess.members[email]
+	return sess.owner == "" || member || email == sess.invited
+}
+
+// others returns the attached clients except the one with ID id. The
+// caller holds sess.mu.
+func (sess *Session) others(id string) []*Client {
+	out := make([]*Client, 0, len(sess.clients))
+	for _, c := range sess.clients {
+		if c.id != id {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// answerID is the id to put on a JOIN_ACCEPT or JOIN_DENIED sent to
+// email: the owner gets the id of its CONNECT_REQ back.
+func (sess *Session) answerID(email string) string {
+	if email == sess.owner {
+		return sess.connectID
+	}
+	return ""
+}
+
+type Server struct {
+	state          *state
+	logger         *log.Logger
+	limiter        *Limiter
+	metrics        *Metrics
+	preKeys        *PreKeyStore
+	offline        OfflineStore
+	keyLog         *KeyLog
+	deliveryTokens *DeliveryTokens
+	quotas         *Quotas
+	moderation     *Moderation
+	adminTokens    map[string]string // bearer token to operator name
+	metricsToken   string
+	pseudonyms     *Pseudonyms
+	proxies        *TrustedProxies
+	turn           *TurnServer
+	turnPool       *TurnPool
+	sfu            *SFU
+	calls          *Calls
+	relayOnly      bool
+	router         *Router
+	tracing        bool
+
+	secret        []byte
+	auth          AuthVerifier
+	now           func() time.Time
+	rules         map[string][]RateRule
+	ringTimeout   time.Duration
+	turnConfig    *TurnConfig
+	sfuConfig     *SFUConfig
+	proxyProtocol bool
+	mux           *http.ServeMux
+	httpServer    *http.Server
+	listener      net.Listener
+	stop          chan struct{}
+
+	heartbeatInterval time.Duration
+	heartbeatMissed   int
+	resumeWindow      time.Duration
+	resumeFrames      int
+	syncFrames        int
+	syncAge           time.Duration
+	closing           atomic.Bool
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+const (
+	maxWSFrameBytes       = 1024 * 1024
+	maxEncryptedDataBytes = 400 * 1024
+	maxSIDLength          = 128
+)
+
+const maxMsgsPerSecond = 100
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func emailHash(email string) string {
+	sum := sha256.Sum256([]byte(normalizeEmail(email)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Server) newID() string {
+	b := make([]byte, 8)
+	crand.Read(b)
+	return fmt.Sprintf("%d_%s", s.now().UnixMilli(), hex.EncodeToString(b))
+}
+
+// send writes f to c and waits for the write. Under a session lock, use
+// post and wait after unlocking.
+func (s *Server) send(c *Client, f Frame) error {
+	if c == nil {
+		return nil
+	}
+	return <-s.post(c, f)
+}
+
+func (s *Server) logConnection(initiator, target string) {
+	h1 := sha256.Sum256([]byte(initiator))
+	iHash := hex.EncodeToString(h1[:])
+
+	h2 := sha256.Sum256([]byte(target))
+	tHash := hex.EncodeToString(h2[:])
+
+	s.logger.Printf("CONNECTION: %s requested connection to %s on %s", iHash, tHash, time.Now().Format(time.RFC3339))
+}
+
+func GenerateTurnCreds(userId, secret string) (string, string) {
+	expiry := time.Now().Add(10 * time.Minute).Unix()
+	username := fmt.Sprintf("%d:%s", expiry, userId)
+	return username, turnPassword(username, secret)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	ws.SetReadLimit(maxWSFrameBytes)
+	s.extendReadDeadline(ws)
+	ws.SetPongHandler(func(string) error {
+		s.extendReadDeadline(ws)
+		return nil
+	})
+
+	client := &Client{id: s.newID(), ip: s.proxies.ClientIP(r), region: s.turnPool.Region(r, s.proxies), conn: ws}
+	s.openOutbox(client)
+	s.state.addClient(client)
+
+	done := make(chan struct{})
+	go s.heartbeat(client, ws, done)
+
+	var readErr error
+	defer func() {
+		close(done)
+		ws.Close()
+		s.release(client, ws, readErr)
+	}()
+
+	for {
+		var frame Frame
+		if readErr = ws.ReadJSON(&frame); readErr != nil {
+			var ne net.Error
+			if errors.As(readErr, &ne) && ne.Timeout() {
+				s.metrics.Inc("relay_heartbeat_evictions_total")
+				log.Printf("[Server] Evicted %s after %d missed pongs", client.id, s.heartbeatMissed)
+			}
+			break
+		}
+		s.extendReadDeadline(ws)
+
+		if err := s.router.Dispatch(client, frame); err != nil {
+			s.sendError(client, frame, err)
+			var ce *closeError
+			if errors.As(err, &ce) {
+				return
+			}
+		}
+		if client.resumed != nil {
+			client.closeOutbox()
+			client = client.resumed
+			close(done)
+			done = make(chan struct{})
+			go s.heartbeat(client, ws, done)
+		}
+	}
+}
+
+// teardown removes a client that has gone for good: it leaves its sessions,
+// frees its account and tells its peers.
+func (s *Server) teardown(client *Client) {
+	s.state.removeClient(client)
+	defer client.closeOutbox()
+	if client.email != "" {
+		s.state.releaseAccount(client.email, client)
+	}
+	client.mu.Lock()
+	if client.stream != nil {
+		s.state.dropResume(client.stream.token)
+	}
+	client.mu.Unlock()
+
+	for _, sess := range client.detachAll() {
+		sess.mu.Lock()
+		delete(sess.clients, client.id)
+		peers := sess.others(client.id)
+		offline := Frame{T: "PEER_OFFLINE", SID: sess.id}
+		s.number(sess, &offline)
+		for _, c := range peers {
+			offline.SH = s.peerID(client.email, c.email, c.wantsPairwise())
+			s.post(c, offline)
+		}
+		sess.mu.Unlock()
+	}
+
+	if s.sfu != nil {
+		s.sfu.LeaveAll(client)
+	}
+	if client.email != "" {
+		s.dispatchCall(s.calls.Disconnect(normalizeEmail(client.email)))
+	}
+}
+
+func (s *Server) notifyPreKeysLow(c *Client) {
+	if c == nil || c.email == "" {
+		return
+	}
+	remaining := s.preKeys.Remaining(c.email)
+	if remaining < 0 || remaining >= preKeyLowWatermark {
+		return
+	}
+	data, _ := json.Marshal(map[string]int{
+		"remaining": remaining,
+		"max":       maxOneTimePreKeys,
+	})
+	s.send(c, Frame{T: "PREKEY_LOW", Data: json.RawMessage(data)})
+}
+
+// recipients returns the members of sess a frame from sender is relayed to:
+// every other member, or only the one named by to. Members are named by the
+// peer ID the sender sees for them (sh on MSG, PEER_ONLINE and the RTC_*
+// frames). The caller holds sess.mu.
+func (s *Server) recipients(sess *Session, sender *Client, to string) ([]*Client, error) {
+	if _, ok := sess.clients[sender.id]; !ok {
+		return nil, NewError(ErrNotMember, "Not a member of this session")
+	}
+	pairwise := sender.wantsPairwise()
+	var targets []*Client
+	for _, c := range sess.clients {
+		if c.id == sender.id {
+			continue
+		}
+		if to == "" || to == s.peerID(c.email, sender.email, pairwise) || to == s.pseudonyms.Pairwise(c.email, sender.email) {
+			targets = append(targets, c)
+		}
+	}
+	if to != "" && len(targets) == 0 {
+		return nil, NewError(ErrUnknownRecipient, "Recipient is not a member of this session").WithDetail("to", to)
+	}
+	return targets, nil
+}
+
+func htmlUnescape(s string) string {
+	s = strings.ReplaceAll(s, "&quot;", "\"")
+	s = strings.ReplaceAll(s, "&amp;", "&")
+	s = strings.ReplaceAll(s, "&lt;", "<")
+	s = strings.ReplaceAll(s, "&gt;", ">")
+	s = strings.ReplaceAll(s, "&#39;", "'")
+	return s
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// stateShards is the number of independently locked slices of each map in
+// state. Frames for different sessions and accounts rarely share a shard,
+// so they no longer queue on one server-wide lock.
+const stateShards = 64
+
+var shardSeed = maphash.MakeSeed()
+
+func shardOf(key string) int {
+	return int(maphash.String(shardSeed, key) % stateShards)
+}
+
+// state holds the relay's connections, sessions and logged-in accounts.
+// Each map is split into shards with their own lock. No shard lock is held
+// while taking another, or while writing to a connection.
+//
+// Lock order: shard lock, then Session.mu, then Client.sessMu. The resumes
+// shards are only ever taken last, under Client.mu.
+type state struct {
+	clients  [stateShards]shard[*Client]  // by connection ID
+	sessions [stateShards]shard[*Session] // by session ID
+	accounts [stateShards]shard[*Client]  // logged-in connection by email
+	resumes  [stateShards]shard[*Client]  // resumable client by resume token
+}
+
+type shard[V any] struct {
+	mu sync.RWMutex
+	m  map[string]V
+}
+
+func newState() *state {
+	st := &state{}
+	for i := range stateShards {
+		st.clients[i].m = make(map[string]*Client)
+		st.sessions[i].m = make(map[string]*Session)
+		st.accounts[i].m = make(map[string]*Client)
+		st.resumes[i].m = make(map[string]*Client)
+	}
+	return st
+}
+
+func (sh *shard[V]) get(key string) (V, bool) {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	v, ok := sh.m[key]
+	return v, ok
+}
+
+func (sh *shard[V]) put(key string, v V) {
+	sh.mu.Lock()
+	sh.m[key] = v
+	sh.mu.Unlock()
+}
+
+func (sh *shard[V]) del(key string) {
+	sh.mu.Lock()
+	delete(sh.m, key)
+	sh.mu.Unlock()
+}
+
+func (sh *shard[V]) len() int {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return len(sh.m)
+}
+
+func (st *state) addClient(c *Client) {
+	st.clients[shardOf(c.id)].put(c.id, c)
+}
+
+func (st *state) removeClient(c *Client) {
+	st.clients[shardOf(c.id)].del(c.id)
+}
+
+// allClients returns every open connection.
+func (st *state) allClients() []*Client {
+	var all []*Client
+	for i := range st.clients {
+		sh := &st.clients[i]
+		sh.mu.RLock()
+		for _, c := range sh.m {
+			all = append(all, c)
+		}
+		sh.mu.RUnlock()
+	}
+	return all
+}
+
+// session returns the session sid, or nil.
+func (st *state) session(sid string) *Session {
+	sess, _ := st.sessions[shardOf(sid)].get(sid)
+	return sess
+}
+
+// addSession stores a new session under its ID.
+func (st *state) addSession(sess *Session) {
+	st.sessions[shardOf(sess.id)].put(sess.id, sess)
+}
+
+// sessionOrCreate returns the session sid, creating it with c as its first
+// member when it does not exist yet.
+func (st *state) sessionOrCreate(sid string, c *Client) (*Session, bool) {
+	sh := &st.sessions[shardOf(sid)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sess, ok := sh.m[sid]; ok {
+		return sess, false
+	}
+	sess := newSession(sid, c)
+	sh.m[sid] = sess
+	return sess, true
+}
+
+// account returns the connection logged in as email, or nil.
+func (st *state) account(email string) *Client {
+	c, _ := st.accounts[shardOf(email)].get(email)
+	return c
+}
+
+// claimAccount records c as the connection for email, unless another
+// connection already holds it.
+func (st *state) claimAccount(email string, c *Client) bool {
+	sh := &st.accounts[shardOf(email)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, taken := sh.m[email]; taken {
+		return false
+	}
+	sh.m[email] = c
+	return true
+}
+
+// releaseAccount frees email if c still holds it.
+func (st *state) releaseAccount(email string, c *Client) {
+	sh := &st.accounts[shardOf(email)]
+	sh.mu.Lock()
+	if sh.m[email] == c {
+		delete(sh.m, email)
+	}
+	sh.mu.Unlock()
+}
+
+// resumable returns the client a resume token was issued to, or nil.
+func (st *state) resumable(token string) *Client {
+	c, _ := st.resumes[shardOf(token)].get(token)
+	return c
+}
+
+func (st *state) addResume(token string, c *Client) {
+	st.resumes[shardOf(token)].put(token, c)
+}
+
+func (st *state) dropResume(token string) {
+	st.resumes[shardOf(token)].del(token)
+}
+
+func (st *state) counts() (clients, sessions int) {
+	for i := range stateShards {
+		clients += st.clients[i].len()
+		sessions += st.sessions[i].len()
+	}
+	return clients, sessions
+}
+
+// attach records sess in c's session index. The caller holds sess.mu.
+func (c *Client) attach(sess *Session) {
+	c.sessMu.Lock()
+	if c.sessions == nil {
+		c.sessions = make(map[string]*Session)
+	}
+	c.sessions[sess.id] = sess
+	c.sessMu.Unlock()
+}
+
+// detachAll empties c's session index and returns what it held, so a
+// disconnect only visits the sessions c was in.
+func (c *Client) detachAll() []*Session {
+	c.sessMu.Lock()
+	defer c.sessMu.Unlock()
+	out := make([]*Session, 0, len(c.sessions))
+	for _, sess := range c.sessions {
+		out = append(out, sess)
+	}
+	c.sessions = nil
+	return out
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReleaseAccountOnlyFreesItsOwnLogin(t *testing.T) {
+	st := newState()
+	old, current := &Client{id: "old"}, &Client{id: "current"}
+	if !st.claimAccount("alice@example.com", old) {
+		t.Fatal("first login rejected")
+	}
+	if st.claimAccount("alice@example.com", current) {
+		t.Fatal("second login accepted while the first is live")
+	}
+	st.releaseAccount("alice@example.com", old)
+	if !st.claimAccount("alice@example.com", current) {
+		t.Fatal("login rejected after the first connection left")
+	}
+	// A late cleanup of the old connection must not log out the new one.
+	st.releaseAccount("alice@example.com", old)
+	if st.account("alice@example.com") != current {
+		t.Fatal("stale release logged out the current connection")
+	}
+}
+
+func TestDisconnectNotifiesOnlyItsSessions(t *testing.T) {
+	s := newTestServer()
+	server := httptest.NewServer(s)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	alice, bob, sid, err := connectPair(url, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	carol, dave, _, err := connectPair(url, "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer carol.Close()
+	defer dave.Close()
+
+	alice.Close()
+	f := expectFrame(t, bob, "PEER_OFFLINE")
+	if f.SID != sid {
+		t.Fatalf("PEER_OFFLINE for %s, want %s", f.SID, sid)
+	}
+	dave.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := readMSG(dave); err == nil {
+		t.Fatal("a client outside the session heard about the disconnect")
+	}
+	sess := s.state.session(sid)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if len(sess.clients) != 1 {
+		t.Fatalf("session still has %d clients attached", len(sess.clients))
+	}
+}
+
+func TestConcurrentChurnLeavesNoConnections(t *testing.T) {
+	s := newTestServer()
+	server := httptest.NewServer(s)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	var wg sync.WaitGroup
+	for i := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 5 {
+				c, err := connectClient(url, fmt.Sprintf("churn_%d_%d@example.com", i, j))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				c.WriteJSON(Frame{T: "REATTACH", SID: "shared"})
+				c.WriteJSON(Frame{T: "REATTACH", SID: fmt.Sprintf("own_%d", i)})
+				c.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if clients, _ := s.state.counts(); clients == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connections left after every client disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sess := s.state.session("shared"); sess != nil {
+		sess.mu.Lock()
+		n := len(sess.clients)
+		sess.mu.Unlock()
+		if n != 0 {
+			t.Fatalf("%d clients still attached to the shared session", n)
+		}
+	}
+}
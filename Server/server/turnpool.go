@@ -0,0 +1,495 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/stun/v3"
+)
+
+const (
+	defaultTurnCredTTL     = 10 * time.Minute
+	turnHealthInterval     = 30 * time.Second
+	turnHealthTimeout      = 3 * time.Second
+	turnUnhealthyAfter     = 2 // consecutive failed probes
+	maxTurnServersPerCreds = 3
+)
+
+// TurnSecret is one generation of a TURN server's shared REST secret.
+type TurnSecret struct {
+	ID         string    `json:"id"`
+	Secret     string    `json:"secret"`
+	ActiveFrom time.Time `json:"activeFrom"`
+}
+
+// TurnSecrets lists a server's secret generations. New credentials are
+// signed with the newest generation whose ActiveFrom has passed; a
+// superseded one keeps verifying for an overlap window so credentials minted
+// just before a rotation stay usable until they expire.
+type TurnSecrets []TurnSecret
+
+func (ss TurnSecrets) Current(now time.Time) (TurnSecret, bool) {
+	var cur TurnSecret
+	found := false
+	for _, s := range ss {
+		if !s.ActiveFrom.After(now) && (!found || s.ActiveFrom.After(cur.ActiveFrom)) {
+			cur, found = s, true
+		}
+	}
+	return cur, found
+}
+
+// Lookup returns the secret with the given ID if it may still verify
+// credentials. An empty id means an unversioned "<expiry>:<user>" username,
+// which is checked against the current secret.
+func (ss TurnSecrets) Lookup(id string, now time.Time, overlap time.Duration) (TurnSecret, bool) {
+	if id == "" {
+		return ss.Current(now)
+	}
+	i := slices.IndexFunc(ss, func(s TurnSecret) bool { return s.ID == id })
+	if i < 0 || ss[i].ActiveFrom.After(now) {
+		return TurnSecret{}, false
+	}
+	for _, s := range ss {
+		// Retired once a successor has been active for longer than overlap.
+		if s.ActiveFrom.After(ss[i].ActiveFrom) && !s.ActiveFrom.After(now) && now.Sub(s.ActiveFrom) > overlap {
+			return TurnSecret{}, false
+		}
+	}
+	return ss[i], true
+}
+
+// TurnEndpoint is one TURN server in the pool. TLSPort adds turns: URLs;
+// Embedded marks the entry served by this process's own TURN server.
+type TurnEndpoint struct {
+	ID       string      `json:"id"`
+	Region   string      `json:"region"`
+	Host     string      `json:"host"`
+	Port     int         `json:"port"`
+	TLSHost  string      `json:"tlsHost"`
+	TLSPort  int         `json:"tlsPort"`
+	Secrets  TurnSecrets `json:"secrets"`
+	Embedded bool        `json:"embedded"`
+}
+
+func (e TurnEndpoint) urls(transports []string) []string {
+	want := func(t string) bool { return len(transports) == 0 || slices.Contains(transports, t) }
+	addr := net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+	var urls []string
+	if want("udp") {
+		urls = append(urls, "turn:"+addr+"?transport=udp")
+	}
+	if want("tcp") {
+		urls = append(urls, "turn:"+addr+"?transport=tcp")
+	}
+	if want("tls") && e.TLSPort != 0 {
+		host := e.TLSHost
+		if host == "" {
+			host = e.Host
+		}
+		urls = append(urls, "turns:"+net.JoinHostPort(host, strconv.Itoa(e.TLSPort))+"?transport=tcp")
+	}
+	return urls
+}
+
+// TurnCreds is one RTCIceServer entry handed to a client.
+type TurnCreds struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username"`
+	Credential string   `json:"credential"`
+	Region     string   `json:"region,omitempty"`
+}
+
+type turnPoolServer struct {
+	TurnEndpoint
+	healthy  bool
+	failures int
+}
+
+// turnBinding ties issued credentials to the account and session that
+// requested them. An empty sid binds to the account's live connection.
+type turnBinding struct {
+	account string
+	sid     string
+	expires time.Time
+}
+
+// TurnPool hands out per-server credentials for a set of TURN servers,
+// preferring healthy servers in the client's region.
+type TurnPool struct {
+	servers      []*turnPoolServer
+	ttl          time.Duration
+	overlap      time.Duration
+	regionHeader string // set by a trusted proxy, e.g. a geo-IP region
+	bindingKey   []byte
+	bindings     map[string]turnBinding
+	next         int
+	mu           sync.Mutex
+}
+
+func NewTurnPool(endpoints []TurnEndpoint, ttl, overlap time.Duration, secret []byte) *TurnPool {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("turn-binding"))
+	p := &TurnPool{
+		ttl:        ttl,
+		overlap:    overlap,
+		bindingKey: h.Sum(nil),
+		bindings:   make(map[string]turnBinding),
+	}
+	for _, e := range endpoints {
+		p.servers = append(p.servers, &turnPoolServer{TurnEndpoint: e, healthy: true})
+	}
+	return p
+}
+
+// envTurnEndpoints describes the single TURN_HOST server used when
+// TURN_SERVERS is not set.
+func envTurnEndpoints() []TurnEndpoint {
+	host := os.Getenv("TURN_HOST")
+	if host == "" {
+		return nil
+	}
+	ep := TurnEndpoint{
+		ID:       "default",
+		Host:     host,
+		Port:     3478,
+		Secrets:  TurnSecrets{{ID: "0", Secret: os.Getenv("TURN_SECRET")}},
+		Embedded: os.Getenv("TURN_EMBEDDED") == "true",
+	}
+	if ep.Embedded {
+		_, port, _ := net.SplitHostPort(envOr("TURN_LISTEN", "0.0.0.0:3478"))
+		ep.Port, _ = strconv.Atoi(port)
+	}
+	if v := os.Getenv("TURN_TLS_PORT"); v != "" {
+		ep.TLSPort, _ = strconv.Atoi(v)
+	}
+	return []TurnEndpoint{ep}
+}
+
+// loadTurnPool reads TURN_SERVERS, a JSON array of TurnEndpoint, plus
+// TURN_CRED_TTL, TURN_SECRET_OVERLAP and TURN_REGION_HEADER.
+func loadTurnPool(secret []byte) (*TurnPool, error) {
+	ttl, overlap := defaultTurnCredTTL, time.Duration(0)
+	for name, dst := range map[string]*time.Duration{"TURN_CRED_TTL": &ttl, "TURN_SECRET_OVERLAP": &overlap} {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid %s: %q", name, v)
+			}
+			*dst = d
+		}
+	}
+	if overlap == 0 {
+		overlap = ttl
+	}
+	if overlap < ttl {
+		return nil, fmt.Errorf("TURN_SECRET_OVERLAP (%s) must be at least TURN_CRED_TTL (%s)", overlap, ttl)
+	}
+
+	endpoints := envTurnEndpoints()
+	if raw := os.Getenv("TURN_SERVERS"); raw != "" {
+		endpoints = nil
+		if err := json.Unmarshal([]byte(raw), &endpoints); err != nil {
+			return nil, fmt.Errorf("TURN_SERVERS: %w", err)
+		}
+	}
+	seen := make(map[string]bool)
+	embedded := 0
+	for i, e := range endpoints {
+		if e.ID == "" || seen[e.ID] {
+			return nil, fmt.Errorf("TURN_SERVERS[%d]: missing or duplicate id", i)
+		}
+		seen[e.ID] = true
+		if e.Host == "" || e.Port <= 0 {
+			return nil, fmt.Errorf("TURN server %s: host and port are required", e.ID)
+		}
+		if _, ok := e.Secrets.Current(time.Now()); !ok {
+			return nil, fmt.Errorf("TURN server %s: no active secret", e.ID)
+		}
+		for _, s := range e.Secrets {
+			if s.ID == "" || s.Secret == "" {
+				return nil, fmt.Errorf("TURN server %s: secrets need an id and a value", e.ID)
+			}
+		}
+		if e.Embedded {
+			embedded++
+		}
+	}
+	if embedded > 1 {
+		return nil, fmt.Errorf("at most one TURN server may be embedded")
+	}
+	p := NewTurnPool(endpoints, ttl, overlap, secret)
+	p.regionHeader = os.Getenv("TURN_REGION_HEADER")
+	return p, nil
+}
+
+// Embedded returns the pool entry served by this process, if any.
+func (p *TurnPool) Embedded() (TurnEndpoint, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, srv := range p.servers {
+		if srv.Embedded {
+			return srv.TurnEndpoint, true
+		}
+	}
+	return TurnEndpoint{}, false
+}
+
+func (p *TurnPool) Overlap() time.Duration {
+	return p.overlap
+}
+
+// Region returns the region a trusted proxy reported for r, if configured.
+func (p *TurnPool) Region(r *http.Request, proxies *TrustedProxies) string {
+	if p.regionHeader == "" || !proxies.FromProxy(r) {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(p.regionHeader))
+}
+
+func (p *TurnPool) bindingTag(account, sid string) string {
+	h := hmac.New(sha256.New, p.bindingKey)
+	h.Write([]byte(account + "\x00" + sid))
+	return hex.EncodeToString(h.Sum(nil)[:12])
+}
+
+// Binding resolves a tag from a credential username back to the account
+// and session it was issued for.
+func (p *TurnPool) Binding(tag string) (account, sid string, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, ok := p.bindings[tag]
+	if !ok || time.Now().After(b.expires) {
+		return "", "", false
+	}
+	return b.account, b.sid, true
+}
+
+// pick orders candidate servers: healthy ones in region first, then other
+// healthy ones, rotating within each group to spread load. If every server
+// is failing its probes they are all offered rather than none.
+func (p *TurnPool) pick(region string) []*turnPoolServer {
+	candidates := make([]*turnPoolServer, 0, len(p.servers))
+	for _, srv := range p.servers {
+		if srv.healthy {
+			candidates = append(candidates, srv)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = append(candidates, p.servers...)
+	}
+
+	var local, remote []*turnPoolServer
+	for _, srv := range candidates {
+		if region != "" && strings.EqualFold(srv.Region, region) {
+			local = append(local, srv)
+		} else {
+			remote = append(remote, srv)
+		}
+	}
+	p.next++
+	rotate := func(s []*turnPoolServer) []*turnPoolServer {
+		if len(s) == 0 {
+			return s
+		}
+		k := p.next % len(s)
+		return append(s[k:], s[:k]...)
+	}
+	out := append(rotate(local), rotate(remote)...)
+	if len(out) > maxTurnServersPerCreds {
+		out = out[:maxTurnServersPerCreds]
+	}
+	return out
+}
+
+// Issue mints credentials for account on the best servers for region,
+// restricted to the given transports ("udp", "tcp", "tls") when non-empty.
+// Usernames take the form "<expiry>:<secretID>:<binding>:<account>"; the
+// leading expiry keeps them compatible with coturn's use-auth-secret.
+func (p *TurnPool) Issue(account, sid, region string, transports []string) ([]TurnCreds, time.Duration) {
+	now := time.Now()
+	expires := now.Add(p.ttl)
+	tag := p.bindingTag(account, sid)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for t, b := range p.bindings {
+		if now.After(b.expires) {
+			delete(p.bindings, t)
+		}
+	}
+	p.bindings[tag] = turnBinding{account: account, sid: sid, expires: expires}
+
+	var creds []TurnCreds
+	for _, srv := range p.pick(region) {
+		secret, ok := srv.Secrets.Current(now)
+		urls := srv.urls(transports)
+		if !ok || len(urls) == 0 {
+			continue
+		}
+		username := fmt.Sprintf("%d:%s:%s:%s", expires.Unix(), secret.ID, tag, account)
+		creds = append(creds, TurnCreds{
+			URLs:       urls,
+			Username:   username,
+			Credential: turnPassword(username, secret.Secret),
+			Region:     srv.Region,
+		})
+	}
+	return creds, p.ttl
+}
+
+// turnBindingActive reports whether the account a TURN credential was issued
+// to is still connected and, for session-bound credentials, still a member
+// of that session. The embedded TURN server consults it on every request.
+func (s *Server) turnBindingActive(tag string) bool {
+	account, sid, ok := s.turnPool.Binding(tag)
+	if !ok {
+		return false
+	}
+	client := s.state.account(account)
+	sess := s.state.session(sid)
+	if client == nil {
+		return false
+	}
+	if sid == "" {
+		return true
+	}
+	if sess == nil {
+		return false
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	_, member := sess.clients[client.id]
+	return member
+}
+
+func turnPassword(username, secret string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// RunHealthChecks probes every external server each interval with a STUN
+// Binding request over UDP and, where configured, over TLS, and exports the
+// result as relay_turn_server_up, until stop is closed.
+func (p *TurnPool) RunHealthChecks(interval time.Duration, metrics *Metrics, stop <-chan struct{}) {
+	for _, srv := range p.servers {
+		metrics.Gauge("relay_turn_server_up", func() float64 {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if srv.healthy {
+				return 1
+			}
+			return 0
+		}, "server", srv.ID, "region", srv.Region)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.checkHealth(metrics)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *TurnPool) checkHealth(metrics *Metrics) {
+	p.mu.Lock()
+	endpoints := make([]TurnEndpoint, len(p.servers))
+	for i, srv := range p.servers {
+		endpoints[i] = srv.TurnEndpoint
+	}
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(endpoints))
+	for i, e := range endpoints {
+		if e.Embedded {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = probeTurn(e)
+		}()
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, srv := range p.servers {
+		if errs[i] == nil {
+			srv.failures = 0
+			srv.healthy = true
+			continue
+		}
+		metrics.Inc("relay_turn_health_check_failures_total", "server", srv.ID)
+		srv.failures++
+		if srv.failures >= turnUnhealthyAfter && srv.healthy {
+			srv.healthy = false
+			log.Printf("⚠️ TURN server %s marked unhealthy: %v", srv.ID, errs[i])
+		}
+	}
+}
+
+func probeTurn(e TurnEndpoint) error {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(e.Host, strconv.Itoa(e.Port)), turnHealthTimeout)
+	if err != nil {
+		return err
+	}
+	err = stunBinding(conn)
+	conn.Close()
+	if err != nil || e.TLSPort == 0 {
+		return err
+	}
+
+	host := e.TLSHost
+	if host == "" {
+		host = e.Host
+	}
+	dialer := &net.Dialer{Timeout: turnHealthTimeout}
+	tconn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, strconv.Itoa(e.TLSPort)), &tls.Config{ServerName: host})
+	if err != nil {
+		return err
+	}
+	defer tconn.Close()
+	return stunBinding(tconn)
+}
+
+func stunBinding(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(turnHealthTimeout))
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	if _, err := conn.Write(req.Raw); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	var resp stun.Message
+	if err := stun.Decode(buf[:n], &resp); err != nil {
+		return err
+	}
+	if resp.TransactionID != req.TransactionID || resp.Type != stun.BindingSuccess {
+		return fmt.Errorf("unexpected STUN response %s", resp.Type)
+	}
+	return nil
+}
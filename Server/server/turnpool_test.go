@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTurnSecretRotationOverlap(t *testing.T) {
+	now := time.Now()
+	secrets := TurnSecrets{
+		{ID: "old", Secret: "a", ActiveFrom: now.Add(-24 * time.Hour)},
+		{ID: "new", Secret: "b", ActiveFrom: now.Add(-5 * time.Minute)},
+		{ID: "next", Secret: "c", ActiveFrom: now.Add(time.Hour)},
+	}
+
+	if cur, _ := secrets.Current(now); cur.ID != "new" {
+		t.Fatalf("expected new to sign, got %s", cur.ID)
+	}
+	if _, ok := secrets.Lookup("old", now, 10*time.Minute); !ok {
+		t.Fatal("superseded secret rejected inside the overlap window")
+	}
+	if _, ok := secrets.Lookup("old", now, time.Minute); ok {
+		t.Fatal("superseded secret accepted after the overlap window")
+	}
+	if _, ok := secrets.Lookup("next", now, time.Minute); ok {
+		t.Fatal("secret accepted before it became active")
+	}
+	if cur, _ := secrets.Current(now.Add(2 * time.Hour)); cur.ID != "next" {
+		t.Fatalf("expected next to sign after rotation, got %s", cur.ID)
+	}
+}
+
+func TestTurnPoolPrefersHealthyServersInRegion(t *testing.T) {
+	secrets := TurnSecrets{{ID: "1", Secret: "s"}}
+	pool := NewTurnPool([]TurnEndpoint{
+		{ID: "eu1", Region: "eu", Host: "eu1.example", Port: 3478, Secrets: secrets},
+		{ID: "us1", Region: "us", Host: "us1.example", Port: 3478, TLSPort: 5349, Secrets: secrets},
+		{ID: "us2", Region: "us", Host: "us2.example", Port: 3478, Secrets: secrets},
+	}, time.Minute, time.Minute, []byte("k"))
+
+	creds, ttl := pool.Issue("alice@example.com", "", "US", nil)
+	if ttl != time.Minute || len(creds) != 3 {
+		t.Fatalf("unexpected issue result: %d creds, ttl %s", len(creds), ttl)
+	}
+	if creds[0].Region != "us" || creds[1].Region != "us" || creds[2].Region != "eu" {
+		t.Fatalf("region order wrong: %s %s %s", creds[0].Region, creds[1].Region, creds[2].Region)
+	}
+
+	pool.servers[1].healthy = false
+	pool.servers[2].healthy = false
+	creds, _ = pool.Issue("alice@example.com", "", "us", nil)
+	if len(creds) != 1 || !strings.Contains(creds[0].URLs[0], "eu1.example") {
+		t.Fatalf("expected fallback to the healthy eu server, got %+v", creds)
+	}
+
+	pool.servers[1].healthy = true
+	creds, _ = pool.Issue("alice@example.com", "", "us", []string{"tls"})
+	if len(creds) != 1 || creds[0].URLs[0] != "turns:us1.example:5349?transport=tcp" {
+		t.Fatalf("transport hint not honoured: %+v", creds)
+	}
+}
+
+func TestTurnCredsBoundToSession(t *testing.T) {
+	now := time.Now()
+	secrets := TurnSecrets{
+		{ID: "old", Secret: "first", ActiveFrom: now.Add(-time.Hour)},
+		{ID: "new", Secret: "second", ActiveFrom: now.Add(-time.Second)},
+	}
+	var (
+		pool    *TurnPool
+		revoked = map[string]bool{}
+		mu      sync.Mutex
+	)
+	ts := startTestTurnServer(t, 5, func(cfg *TurnConfig) {
+		cfg.Secrets = secrets
+		cfg.SecretOverlap = time.Minute
+		cfg.Authorize = func(tag string) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			_, sid, ok := pool.Binding(tag)
+			return ok && !revoked[sid]
+		}
+	})
+	mu.Lock()
+	pool = NewTurnPool([]TurnEndpoint{
+		{ID: "local", Host: "127.0.0.1", Port: ts.Port(), Secrets: secrets, Embedded: true},
+	}, time.Minute, time.Minute, []byte("k"))
+	mu.Unlock()
+
+	creds, _ := pool.Issue("alice@example.com", "sid-1", "", nil)
+	if !strings.Contains(creds[0].Username, ":new:") {
+		t.Fatalf("expected the newest secret to sign, got %s", creds[0].Username)
+	}
+	if _, err := allocateTurn(t, ts, creds[0].Username, creds[0].Credential); err != nil {
+		t.Fatalf("bound credentials rejected: %v", err)
+	}
+
+	// Credentials minted with the previous secret still work in the overlap.
+	old := strings.Replace(creds[0].Username, ":new:", ":old:", 1)
+	if _, err := allocateTurn(t, ts, old, turnPassword(old, "first")); err != nil {
+		t.Fatalf("credentials from the previous secret rejected: %v", err)
+	}
+
+	legacy, password := GenerateTurnCreds("alice@example.com", "second")
+	if _, err := allocateTurn(t, ts, legacy, password); err == nil {
+		t.Fatal("unbound credentials accepted while binding is enforced")
+	}
+
+	mu.Lock()
+	revoked["sid-1"] = true
+	mu.Unlock()
+	if _, err := allocateTurn(t, ts, creds[0].Username, creds[0].Credential); err == nil {
+		t.Fatal("credentials accepted after their session ended")
+	}
+}
+
+func TestTurnHealthChecks(t *testing.T) {
+	ts := startTestTurnServer(t, 5)
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPort := dead.LocalAddr().(*net.UDPAddr).Port
+	dead.Close()
+
+	secrets := TurnSecrets{{ID: "1", Secret: "turn-secret"}}
+	pool := NewTurnPool([]TurnEndpoint{
+		{ID: "up", Host: "127.0.0.1", Port: ts.Port(), Secrets: secrets},
+		{ID: "down", Host: "127.0.0.1", Port: deadPort, Secrets: secrets},
+	}, time.Minute, time.Minute, []byte("k"))
+	metrics := NewMetrics()
+
+	pool.checkHealth(metrics)
+	if !pool.servers[1].healthy {
+		t.Fatal("server marked unhealthy after a single failed probe")
+	}
+	pool.checkHealth(metrics)
+	if !pool.servers[0].healthy || pool.servers[1].healthy {
+		t.Fatalf("unexpected health: up=%v down=%v", pool.servers[0].healthy, pool.servers[1].healthy)
+	}
+	if got := metrics.Counter("relay_turn_health_check_failures_total", "server", "down"); got != 2 {
+		t.Fatalf("expected 2 probe failures, got %d", got)
+	}
+}
+
+func TestGetTurnCredsRequiresSessionMembership(t *testing.T) {
+	s := newTestServer(WithTurnPool(NewTurnPool([]TurnEndpoint{
+		{ID: "eu1", Region: "eu", Host: "turn.example", Port: 3478, Secrets: TurnSecrets{{ID: "1", Secret: "s"}}},
+	}, time.Minute, time.Minute, testSecret)))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	alice, err := connectClient(url, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	alice.WriteJSON(Frame{T: "GET_TURN_CREDS", SID: "not-mine"})
+	resp, err := readMSG(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.T != "ERROR" {
+		t.Fatalf("expected ERROR for a foreign session, got %s", resp.T)
+	}
+
+	alice.WriteJSON(Frame{T: "GET_TURN_CREDS", Data: json.RawMessage(`{"region":"eu"}`)})
+	if resp, err = readMSG(alice); err != nil {
+		t.Fatal(err)
+	}
+	var creds struct {
+		Username   string      `json:"username"`
+		TTL        int         `json:"ttl"`
+		IceServers []TurnCreds `json:"iceServers"`
+	}
+	json.Unmarshal(resp.Data, &creds)
+	if resp.T != "TURN_CREDS" || len(creds.IceServers) != 1 || creds.TTL != 60 {
+		t.Fatalf("unexpected response: %s %s", resp.T, resp.Data)
+	}
+	if creds.Username != creds.IceServers[0].Username {
+		t.Fatal("legacy top-level fields do not mirror the first server")
+	}
+}
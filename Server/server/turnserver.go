@@ -0,0 +1,471 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/turn/v4"
+)
+
+// TurnConfig configures the optional built-in TURN/STUN server. It accepts
+// the same time-limited HMAC credentials GenerateTurnCreds hands out, so it
+// is a drop-in replacement for coturn with use-auth-secret.
+type TurnConfig struct {
+	Listen             string
+	PublicIP           net.IP
+	Realm              string
+	Secrets            TurnSecrets
+	SecretOverlap      time.Duration
+	MinPort, MaxPort   uint16
+	MaxAllocsPerUser   int
+	UserBandwidthBytes int // bytes/s per user in each direction, 0 = unlimited
+
+	// Authorize, if set, is asked whether a credential's session binding is
+	// still live; unbound credentials are then refused.
+	Authorize func(binding string) bool
+}
+
+func loadTurnConfig() (*TurnConfig, error) {
+	if os.Getenv("TURN_EMBEDDED") != "true" {
+		return nil, nil
+	}
+	cfg := &TurnConfig{
+		Listen:           envOr("TURN_LISTEN", "0.0.0.0:3478"),
+		Realm:            envOr("TURN_REALM", "relay"),
+		MinPort:          49152,
+		MaxPort:          65535,
+		MaxAllocsPerUser: 10,
+	}
+	ipStr := envOr("TURN_PUBLIC_IP", os.Getenv("TURN_HOST"))
+	if cfg.PublicIP = net.ParseIP(ipStr); cfg.PublicIP == nil {
+		return nil, fmt.Errorf("TURN_PUBLIC_IP must be an IP address, got %q", ipStr)
+	}
+	for name, dst := range map[string]*uint16{"TURN_RELAY_MIN_PORT": &cfg.MinPort, "TURN_RELAY_MAX_PORT": &cfg.MaxPort} {
+		if v := os.Getenv(name); v != "" {
+			p, err := strconv.ParseUint(v, 10, 16)
+			if err != nil || p == 0 {
+				return nil, fmt.Errorf("invalid %s: %q", name, v)
+			}
+			*dst = uint16(p)
+		}
+	}
+	if v := os.Getenv("TURN_MAX_ALLOCATIONS_PER_USER"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid TURN_MAX_ALLOCATIONS_PER_USER: %q", v)
+		}
+		cfg.MaxAllocsPerUser = n
+	}
+	if v := os.Getenv("TURN_USER_BANDWIDTH_KBPS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid TURN_USER_BANDWIDTH_KBPS: %q", v)
+		}
+		cfg.UserBandwidthBytes = n * 1000 / 8
+	}
+	return cfg, nil
+}
+
+func envOr(name, fallback string) string {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// turnReservationTTL bounds how long a slot granted by the quota check
+// waits for its allocation. pion creates the allocation right after the
+// check, so an older reservation belongs to a request that failed.
+const turnReservationTTL = 10 * time.Second
+
+// turnFlushInterval is how often the per-allocation byte counts are added
+// to the relay_turn_*bytes_total metrics.
+const turnFlushInterval = 5 * time.Second
+
+type turnUser struct {
+	allocations int
+	reserved    int // quota slots granted but not yet allocated
+
+	bw       sync.Mutex // guards up and down, so relaying never takes ts.mu
+	up, down bucket
+}
+
+type turnReservation struct {
+	user string
+	at   time.Time
+}
+
+type turnAllocation struct {
+	user string
+}
+
+// TurnServer wraps a pion TURN server with per-user allocation quotas,
+// bandwidth caps and usage metrics.
+type TurnServer struct {
+	cfg     TurnConfig
+	server  *turn.Server
+	metrics *Metrics
+	port    int
+
+	users       map[string]*turnUser
+	allocations map[string]turnAllocation  // keyed by client 5-tuple
+	relayConns  map[int]*meteredPacketConn // relay port -> open relay socket
+	pending     map[string]turnReservation // client address -> reserved slot
+	mu          sync.Mutex
+	stop        chan struct{}
+}
+
+func StartTurnServer(cfg TurnConfig, metrics *Metrics) (*TurnServer, error) {
+	ts := &TurnServer{
+		cfg:         cfg,
+		metrics:     metrics,
+		users:       make(map[string]*turnUser),
+		allocations: make(map[string]turnAllocation),
+		relayConns:  make(map[int]*meteredPacketConn),
+		pending:     make(map[string]turnReservation),
+		stop:        make(chan struct{}),
+	}
+
+	udp, err := net.ListenPacket("udp", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("turn udp listen: %w", err)
+	}
+	ts.port = udp.LocalAddr().(*net.UDPAddr).Port
+	host, _, _ := net.SplitHostPort(cfg.Listen)
+	tcp, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(ts.port)))
+	if err != nil {
+		udp.Close()
+		return nil, fmt.Errorf("turn tcp listen: %w", err)
+	}
+
+	relayGen := func() turn.RelayAddressGenerator {
+		return &meteredRelayGenerator{
+			RelayAddressGenerator: &turn.RelayAddressGeneratorPortRange{
+				RelayAddress: cfg.PublicIP,
+				Address:      "0.0.0.0",
+				MinPort:      cfg.MinPort,
+				MaxPort:      cfg.MaxPort,
+			},
+			ts: ts,
+		}
+	}
+
+	ts.server, err = turn.NewServer(turn.ServerConfig{
+		Realm:        cfg.Realm,
+		AuthHandler:  ts.authenticate,
+		QuotaHandler: ts.allowAllocation,
+		EventHandler: turn.EventHandler{
+			OnAllocationCreated: ts.onAllocationCreated,
+			OnAllocationDeleted: ts.onAllocationDeleted,
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{PacketConn: udp, RelayAddressGenerator: relayGen()}},
+		ListenerConfigs:   []turn.ListenerConfig{{Listener: tcp, RelayAddressGenerator: relayGen()}},
+	})
+	if err != nil {
+		udp.Close()
+		tcp.Close()
+		return nil, err
+	}
+
+	metrics.Gauge("relay_turn_allocations", func() float64 { return float64(ts.server.AllocationCount()) })
+	go ts.flushLoop()
+	log.Printf("✅ Embedded TURN server on udp/tcp %d (relay %s, ports %d-%d)", ts.port, cfg.PublicIP, cfg.MinPort, cfg.MaxPort)
+	return ts, nil
+}
+
+func (ts *TurnServer) Port() int {
+	return ts.port
+}
+
+func (ts *TurnServer) Close() error {
+	close(ts.stop)
+	err := ts.server.Close()
+	ts.flushBytes()
+	return err
+}
+
+type turnUsername struct {
+	expires  int64
+	secretID string
+	binding  string
+	user     string
+}
+
+// parseTurnUsername accepts both "<expiry>:<user>" and the pool's
+// "<expiry>:<secretID>:<binding>:<user>" form.
+func parseTurnUsername(username string) (turnUsername, bool) {
+	expStr, rest, ok := strings.Cut(username, ":")
+	if !ok || rest == "" {
+		return turnUsername{}, false
+	}
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	if err != nil {
+		return turnUsername{}, false
+	}
+	u := turnUsername{expires: exp, user: rest}
+	if parts := strings.SplitN(rest, ":", 3); len(parts) == 3 {
+		u.secretID, u.binding, u.user = parts[0], parts[1], parts[2]
+	}
+	return u, u.user != ""
+}
+
+func turnAccount(username string) string {
+	u, _ := parseTurnUsername(username)
+	return u.user
+}
+
+func (ts *TurnServer) authenticate(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	now := time.Now()
+	u, ok := parseTurnUsername(username)
+	if !ok || now.Unix() > u.expires {
+		ts.metrics.Inc("relay_turn_auth_failures_total")
+		return nil, false
+	}
+	secret, ok := ts.cfg.Secrets.Lookup(u.secretID, now, ts.cfg.SecretOverlap)
+	if !ok || (ts.cfg.Authorize != nil && (u.binding == "" || !ts.cfg.Authorize(u.binding))) {
+		ts.metrics.Inc("relay_turn_auth_failures_total")
+		return nil, false
+	}
+	return turn.GenerateAuthKey(username, realm, turnPassword(username, secret.Secret)), true
+}
+
+// allowAllocation is pion's quota check. It reserves the slot it grants so
+// concurrent requests from one user cannot all pass before any of them is
+// counted; onAllocationCreated turns the reservation into an allocation.
+func (ts *TurnServer) allowAllocation(username, realm string, srcAddr net.Addr) bool {
+	user := turnAccount(username)
+	key := srcAddr.String()
+	now := time.Now()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for k, r := range ts.pending {
+		if now.Sub(r.at) >= turnReservationTTL {
+			ts.unreserve(k)
+		}
+	}
+	if r, ok := ts.pending[key]; ok {
+		if r.user == user {
+			// A retry from the same address reuses its slot.
+			ts.pending[key] = turnReservation{user: user, at: now}
+			return true
+		}
+		ts.unreserve(key)
+	}
+	u := ts.users[user]
+	if u != nil && u.allocations+u.reserved >= ts.cfg.MaxAllocsPerUser {
+		ts.metrics.Inc("relay_turn_quota_rejections_total")
+		return false
+	}
+	if u == nil {
+		u = &turnUser{}
+		ts.users[user] = u
+	}
+	u.reserved++
+	ts.pending[key] = turnReservation{user: user, at: now}
+	return true
+}
+
+// unreserve releases the slot reserved for key. Callers hold ts.mu.
+func (ts *TurnServer) unreserve(key string) {
+	r, ok := ts.pending[key]
+	if !ok {
+		return
+	}
+	delete(ts.pending, key)
+	if u := ts.users[r.user]; u != nil {
+		u.reserved--
+		if u.allocations <= 0 && u.reserved <= 0 {
+			delete(ts.users, r.user)
+		}
+	}
+}
+
+func allocationKey(srcAddr, dstAddr net.Addr, protocol string) string {
+	return protocol + "|" + srcAddr.String() + "|" + dstAddr.String()
+}
+
+func (ts *TurnServer) onAllocationCreated(srcAddr, dstAddr net.Addr, protocol, username, realm string, relayAddr net.Addr, requestedPort int) {
+	user := turnAccount(username)
+	port := 0
+	if a, ok := relayAddr.(*net.UDPAddr); ok {
+		port = a.Port
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	u := ts.users[user]
+	if u == nil {
+		u = &turnUser{}
+		ts.users[user] = u
+	}
+	if r, ok := ts.pending[srcAddr.String()]; ok && r.user == user {
+		delete(ts.pending, srcAddr.String())
+		u.reserved--
+	}
+	u.allocations++
+	ts.allocations[allocationKey(srcAddr, dstAddr, protocol)] = turnAllocation{user: user}
+	if c := ts.relayConns[port]; c != nil {
+		c.user.Store(u)
+	}
+	ts.metrics.Inc("relay_turn_allocations_total")
+}
+
+func (ts *TurnServer) onAllocationDeleted(srcAddr, dstAddr net.Addr, protocol, username, realm string) {
+	key := allocationKey(srcAddr, dstAddr, protocol)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	a, ok := ts.allocations[key]
+	if !ok {
+		return
+	}
+	delete(ts.allocations, key)
+	if u := ts.users[a.user]; u != nil {
+		u.allocations--
+		if u.allocations <= 0 && u.reserved <= 0 {
+			delete(ts.users, a.user)
+		}
+	}
+}
+
+// flushLoop adds the byte counts of open relay sockets to the metrics
+// every turnFlushInterval until the server is closed.
+func (ts *TurnServer) flushLoop() {
+	t := time.NewTicker(turnFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ts.stop:
+			return
+		case <-t.C:
+			ts.flushBytes()
+		}
+	}
+}
+
+func (ts *TurnServer) flushBytes() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, c := range ts.relayConns {
+		c.flush()
+	}
+}
+
+type meteredRelayGenerator struct {
+	turn.RelayAddressGenerator
+	ts *TurnServer
+}
+
+func (g *meteredRelayGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	port := 0
+	if a, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		port = a.Port
+	}
+	mc := &meteredPacketConn{PacketConn: conn, ts: g.ts, port: port}
+	g.ts.mu.Lock()
+	g.ts.relayConns[port] = mc
+	g.ts.mu.Unlock()
+	return mc, addr, nil
+}
+
+const (
+	turnUp = iota
+	turnDown
+)
+
+var turnDirections = [...]string{turnUp: "up", turnDown: "down"}
+
+// meteredPacketConn is an allocation's relay socket. Writes go from the
+// user to a peer (upstream) and reads from a peer to the user (downstream).
+// Packets over the user's budget are dropped, as a congested UDP path would.
+// Byte counts stay in the socket's own atomics until flush adds them to the
+// metrics, so a packet takes no lock shared with other allocations.
+type meteredPacketConn struct {
+	net.PacketConn
+	ts   *TurnServer
+	port int
+	user atomic.Pointer[turnUser] // set by onAllocationCreated; nil means uncapped
+
+	relayed, dropped [2]atomic.Uint64 // by turnUp and turnDown
+}
+
+// allow charges n bytes to the socket's user in one direction.
+func (c *meteredPacketConn) allow(n int, direction int) bool {
+	if rate := float64(c.ts.cfg.UserBandwidthBytes); rate > 0 {
+		if u := c.user.Load(); u != nil {
+			b := &u.up
+			if direction == turnDown {
+				b = &u.down
+			}
+			now := time.Now()
+			u.bw.Lock()
+			if b.last.IsZero() {
+				b.tokens = rate
+			} else {
+				b.tokens = min(rate, b.tokens+now.Sub(b.last).Seconds()*rate)
+			}
+			b.last = now
+			ok := b.tokens >= float64(n)
+			if ok {
+				b.tokens -= float64(n)
+			}
+			u.bw.Unlock()
+			if !ok {
+				c.dropped[direction].Add(uint64(n))
+				return false
+			}
+		}
+	}
+	c.relayed[direction].Add(uint64(n))
+	return true
+}
+
+// flush moves the socket's byte counts into the metrics.
+func (c *meteredPacketConn) flush() {
+	for d, name := range turnDirections {
+		if n := c.relayed[d].Swap(0); n > 0 {
+			c.ts.metrics.Add(n, "relay_turn_bytes_total", "direction", name)
+		}
+		if n := c.dropped[d].Swap(0); n > 0 {
+			c.ts.metrics.Add(n, "relay_turn_dropped_bytes_total", "direction", name)
+		}
+	}
+}
+
+func (c *meteredPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.allow(len(p), turnUp) {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *meteredPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.allow(n, turnDown) {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *meteredPacketConn) Close() error {
+	c.ts.mu.Lock()
+	if c.ts.relayConns[c.port] == c {
+		delete(c.ts.relayConns, c.port)
+	}
+	c.ts.mu.Unlock()
+	c.flush()
+	return c.PacketConn.Close()
+}
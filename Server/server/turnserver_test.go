@@ -0,0 +1,208 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v4"
+)
+
+func startTestTurnServer(t *testing.T, maxAllocs int, opts ...func(*TurnConfig)) *TurnServer {
+	t.Helper()
+	cfg := TurnConfig{
+		Listen:           "127.0.0.1:0",
+		PublicIP:         net.ParseIP("127.0.0.1"),
+		Realm:            "test",
+		Secrets:          TurnSecrets{{ID: "0", Secret: "turn-secret"}},
+		MinPort:          41000,
+		MaxPort:          41999,
+		MaxAllocsPerUser: maxAllocs,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	ts, err := StartTurnServer(cfg, NewMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ts.Close() })
+	return ts
+}
+
+func allocateTurn(t *testing.T, ts *TurnServer, username, password string) (net.PacketConn, error) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := turn.NewClient(&turn.ClientConfig{
+		TURNServerAddr: fmt.Sprintf("127.0.0.1:%d", ts.Port()),
+		STUNServerAddr: fmt.Sprintf("127.0.0.1:%d", ts.Port()),
+		Username:       username,
+		Password:       password,
+		Conn:           conn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		conn.Close()
+	})
+	if err := c.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	return c.Allocate()
+}
+
+func TestEmbeddedTurnAcceptsRESTCredentials(t *testing.T) {
+	ts := startTestTurnServer(t, 5)
+	username, password := GenerateTurnCreds("alice@example.com", "turn-secret")
+
+	relay, err := allocateTurn(t, ts, username, password)
+	if err != nil {
+		t.Fatalf("allocation with valid credentials failed: %v", err)
+	}
+	if relay.LocalAddr().(*net.UDPAddr).Port < 41000 {
+		t.Fatalf("relay port outside configured range: %v", relay.LocalAddr())
+	}
+
+	if _, err := allocateTurn(t, ts, username, "wrong"); err == nil {
+		t.Fatal("allocation with a bad password succeeded")
+	}
+	stale := "1:alice@example.com"
+	mac := hmac.New(sha1.New, []byte("turn-secret"))
+	mac.Write([]byte(stale))
+	if _, err := allocateTurn(t, ts, stale, base64.StdEncoding.EncodeToString(mac.Sum(nil))); err == nil {
+		t.Fatal("allocation with expired credentials succeeded")
+	}
+}
+
+func TestEmbeddedTurnAllocationQuota(t *testing.T) {
+	ts := startTestTurnServer(t, 1)
+	username, password := GenerateTurnCreds("alice@example.com", "turn-secret")
+
+	if _, err := allocateTurn(t, ts, username, password); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := allocateTurn(t, ts, username, password); err == nil {
+		t.Fatal("allocation beyond per-user quota succeeded")
+	}
+	if got := ts.metrics.Counter("relay_turn_quota_rejections_total"); got != 1 {
+		t.Fatalf("expected 1 quota rejection, got %d", got)
+	}
+
+	bobUser, bobPass := GenerateTurnCreds("bob@example.com", "turn-secret")
+	if _, err := allocateTurn(t, ts, bobUser, bobPass); err != nil {
+		t.Fatalf("quota leaked across users: %v", err)
+	}
+}
+
+func TestTurnQuotaReservesConcurrentAllocations(t *testing.T) {
+	ts := startTestTurnServer(t, 2)
+	username, _ := GenerateTurnCreds("alice@example.com", "turn-secret")
+
+	var granted atomic.Int32
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000 + i}
+			if ts.allowAllocation(username, "test", src) {
+				granted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := granted.Load(); got != 2 {
+		t.Fatalf("expected 2 of 20 concurrent allocations to pass the quota, got %d", got)
+	}
+	if got := ts.metrics.Counter("relay_turn_quota_rejections_total"); got != 18 {
+		t.Fatalf("expected 18 quota rejections, got %d", got)
+	}
+
+	// A reservation whose allocation never arrived frees its slot.
+	ts.mu.Lock()
+	for k, r := range ts.pending {
+		r.at = r.at.Add(-turnReservationTTL)
+		ts.pending[k] = r
+		break
+	}
+	ts.mu.Unlock()
+	if !ts.allowAllocation(username, "test", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 60000}) {
+		t.Fatal("stale reservation still held its quota slot")
+	}
+}
+
+func TestTurnBandwidthCap(t *testing.T) {
+	ts := startTestTurnServer(t, 5, func(cfg *TurnConfig) { cfg.UserBandwidthBytes = 1000 })
+	u := &turnUser{allocations: 1}
+	alice := &meteredPacketConn{ts: ts, port: 41000}
+	alice.user.Store(u)
+	unowned := &meteredPacketConn{ts: ts, port: 42000}
+	ts.mu.Lock()
+	ts.users["alice@example.com"] = u
+	ts.relayConns[alice.port] = alice
+	ts.relayConns[unowned.port] = unowned
+	ts.mu.Unlock()
+
+	if !alice.allow(600, turnUp) {
+		t.Fatal("first upstream packet within the cap was dropped")
+	}
+	if alice.allow(600, turnUp) {
+		t.Fatal("upstream packet beyond the cap was relayed")
+	}
+	if !alice.allow(600, turnDown) {
+		t.Fatal("downstream shares the upstream budget")
+	}
+	if !unowned.allow(5000, turnUp) {
+		t.Fatal("bytes on an unowned relay port were capped")
+	}
+
+	u.bw.Lock()
+	u.up.last = time.Now().Add(-time.Second)
+	u.bw.Unlock()
+	if !alice.allow(600, turnUp) {
+		t.Fatal("bucket did not refill after a second")
+	}
+
+	if got := ts.metrics.Counter("relay_turn_bytes_total", "direction", "up"); got != 0 {
+		t.Fatalf("relay_turn_bytes_total{direction=\"up\"} = %d before a flush, want 0", got)
+	}
+	ts.flushBytes()
+	for _, tc := range []struct {
+		name, direction string
+		want            uint64
+	}{
+		{"relay_turn_bytes_total", "up", 600 + 5000 + 600},
+		{"relay_turn_bytes_total", "down", 600},
+		{"relay_turn_dropped_bytes_total", "up", 600},
+		{"relay_turn_dropped_bytes_total", "down", 0},
+	} {
+		if got := ts.metrics.Counter(tc.name, "direction", tc.direction); got != tc.want {
+			t.Errorf("%s{direction=%q} = %d, want %d", tc.name, tc.direction, got, tc.want)
+		}
+	}
+}
+
+func TestTurnUnlimitedBandwidthIsMetered(t *testing.T) {
+	ts := startTestTurnServer(t, 5)
+	c := &meteredPacketConn{ts: ts, port: 41000}
+	for range 10 {
+		if !c.allow(1500, turnDown) {
+			t.Fatal("packet dropped without a bandwidth cap")
+		}
+	}
+	c.flush()
+	if got := ts.metrics.Counter("relay_turn_bytes_total", "direction", "down"); got != 15000 {
+		t.Fatalf("relay_turn_bytes_total{direction=\"down\"} = %d, want 15000", got)
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestUnicastSignalingReachesOnlyTarget(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	alice, err := connectClient(url, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := connectClient(url, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	carol, err := connectClient(url, "carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer carol.Close()
+
+	// A group is a session keyed by an ID its members share.
+	sid := "unicast-group"
+	alice.WriteJSON(Frame{T: "REATTACH", SID: sid})
+	bob.WriteJSON(Frame{T: "REATTACH", SID: sid})
+	for _, c := range []*websocket.Conn{alice, bob} {
+		if err := expectNext(c, "PEER_ONLINE"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	carol.WriteJSON(Frame{T: "REATTACH", SID: sid})
+
+	// Alice learns carol's peer ID from PEER_ONLINE.
+	online, err := readMSG(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if online.T != "PEER_ONLINE" || online.SH == "" {
+		t.Fatalf("expected PEER_ONLINE with a peer ID, got %+v", online)
+	}
+	if _, err := readMSG(bob); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if _, err := readMSG(carol); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	alice.WriteJSON(Frame{T: "RTC_OFFER", SID: sid, To: online.SH, Data: json.RawMessage(`{"sdp":"x"}`)})
+	got, err := readMSG(carol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.T != "RTC_OFFER" || got.SH == "" || got.To != "" {
+		t.Fatalf("unexpected frame at target: %+v", got)
+	}
+	aliceForCarol := got.SH
+
+	// Bob's next frame is the broadcast, not the unicast offer.
+	alice.WriteJSON(Frame{T: "MSG", SID: sid, Data: json.RawMessage(`{"payload":"hi"}`)})
+	if got, err = readMSG(bob); err != nil {
+		t.Fatal(err)
+	}
+	if got.T != "MSG" {
+		t.Fatalf("non-target received %s", got.T)
+	}
+
+	// Carol replies to alice by the peer ID the offer carried.
+	if _, err := readMSG(carol); err != nil {
+		t.Fatal(err)
+	}
+	carol.WriteJSON(Frame{T: "MSG", SID: sid, To: aliceForCarol, Data: json.RawMessage(`{"payload":"just you"}`)})
+	if got, err = readMSG(alice); err != nil {
+		t.Fatal(err)
+	}
+	if got.T != "MSG" || !strings.Contains(string(got.Data), "just you") {
+		t.Fatalf("expected unicast MSG at alice, got %+v", got)
+	}
+
+	alice.WriteJSON(Frame{T: "MSG", SID: sid, To: "nobody", C: true, Data: json.RawMessage(`{"payload":"x"}`)})
+	if got, err = readMSG(alice); err != nil {
+		t.Fatal(err)
+	}
+	if got.T != "ERROR" || got.To != "nobody" || !strings.Contains(string(got.Data), "Recipient is not a member") {
+		t.Fatalf("expected recipient error, got %+v", got)
+	}
+}
@@ -0,0 +1,210 @@
+// Package transparency implements the append-only key log the relay keeps of
+// every public key it forwards, along with the helpers clients and auditors
+// need to check signed tree heads, inclusion proofs and consistency proofs.
+//
+// Hashing follows RFC 6962: leaves are SHA-256(0x00 || leaf) and interior
+// nodes are SHA-256(0x01 || left || right).
+package transparency
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"sync"
+)
+
+type Hash [sha256.Size]byte
+
+// Entry is a single logged key. AccountID is an opaque hex identifier the
+// operator assigns to each account; it stays the same across key changes
+// but cannot be derived from an email without the operator's key.
+// Timestamp is in Unix milliseconds.
+type Entry struct {
+	AccountID string `json:"accountId"`
+	PublicKey string `json:"publicKey"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// LeafData is the canonical byte encoding of an entry. Fields are separated
+// by NUL, which cannot appear in a hex ID, base64 key or decimal number.
+func (e Entry) LeafData() []byte {
+	b := make([]byte, 0, len(e.AccountID)+len(e.PublicKey)+24)
+	b = append(b, e.AccountID...)
+	b = append(b, 0)
+	b = append(b, e.PublicKey...)
+	b = append(b, 0)
+	b = strconv.AppendInt(b, e.Timestamp, 10)
+	return b
+}
+
+func LeafHash(data []byte) Hash {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(data)
+	var out Hash
+	h.Sum(out[:0])
+	return out
+}
+
+func nodeHash(left, right Hash) Hash {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left[:])
+	h.Write(right[:])
+	var out Hash
+	h.Sum(out[:0])
+	return out
+}
+
+func emptyRoot() Hash {
+	return sha256.Sum256(nil)
+}
+
+// splitPoint returns the largest power of two strictly less than n.
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// Log is an in-memory Merkle tree over appended entries.
+//
+// levels[h][i] caches the hash of the perfect subtree over leaves
+// [i<<h, (i+1)<<h), so levels[0] holds the leaf hashes. Every subtree the
+// RFC 6962 recursion visits is either one of those or splits into them,
+// which keeps roots and proofs at O(log n) hashes.
+type Log struct {
+	entries []Entry
+	levels  [][]Hash
+	mu      sync.RWMutex
+}
+
+func NewLog() *Log {
+	return &Log{levels: make([][]Hash, 1)}
+}
+
+func (l *Log) Append(e Entry) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, e)
+	l.levels[0] = append(l.levels[0], LeafHash(e.LeafData()))
+	for h := 0; len(l.levels[h])%2 == 0; h++ {
+		if h+1 == len(l.levels) {
+			l.levels = append(l.levels, nil)
+		}
+		n := len(l.levels[h])
+		l.levels[h+1] = append(l.levels[h+1], nodeHash(l.levels[h][n-2], l.levels[h][n-1]))
+	}
+	return len(l.entries) - 1
+}
+
+func (l *Log) Size() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.entries)
+}
+
+func (l *Log) Entry(index int) (Entry, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if index < 0 || index >= len(l.entries) {
+		return Entry{}, false
+	}
+	return l.entries[index], true
+}
+
+// Entries returns entries in [start, end), clamped to the current size.
+func (l *Log) Entries(start, end int) []Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if end > len(l.entries) {
+		end = len(l.entries)
+	}
+	if start < 0 || start >= end {
+		return nil
+	}
+	out := make([]Entry, end-start)
+	copy(out, l.entries[start:end])
+	return out
+}
+
+// Root returns the tree hash of the first size leaves.
+func (l *Log) Root(size int) (Hash, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if size < 0 || size > len(l.entries) {
+		return Hash{}, fmt.Errorf("tree size %d out of range", size)
+	}
+	if size == 0 {
+		return emptyRoot(), nil
+	}
+	return l.subtreeHash(0, size), nil
+}
+
+// InclusionProof returns the audit path for leaf index in the tree of the
+// given size.
+func (l *Log) InclusionProof(index, size int) ([]Hash, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if size < 1 || size > len(l.entries) || index < 0 || index >= size {
+		return nil, fmt.Errorf("index %d not in tree of size %d", index, size)
+	}
+	return l.inclusionPath(index, 0, size), nil
+}
+
+// ConsistencyProof proves the tree of size first is a prefix of the tree of
+// size second.
+func (l *Log) ConsistencyProof(first, second int) ([]Hash, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if first < 0 || first > second || second > len(l.entries) {
+		return nil, fmt.Errorf("invalid range %d..%d", first, second)
+	}
+	if first == 0 || first == second {
+		return []Hash{}, nil
+	}
+	return l.subproof(first, 0, second, true), nil
+}
+
+// subtreeHash returns the hash of leaves [lo, hi). The recursion only
+// reaches ranges whose start is a multiple of their size rounded up to a
+// power of two, so a perfect range is always a cached node.
+func (l *Log) subtreeHash(lo, hi int) Hash {
+	n := hi - lo
+	if n&(n-1) == 0 {
+		h := bits.TrailingZeros(uint(n))
+		return l.levels[h][lo>>h]
+	}
+	k := splitPoint(n)
+	return nodeHash(l.subtreeHash(lo, lo+k), l.subtreeHash(lo+k, hi))
+}
+
+func (l *Log) inclusionPath(m, lo, hi int) []Hash {
+	n := hi - lo
+	if n <= 1 {
+		return nil
+	}
+	k := splitPoint(n)
+	if m < k {
+		return append(l.inclusionPath(m, lo, lo+k), l.subtreeHash(lo+k, hi))
+	}
+	return append(l.inclusionPath(m-k, lo+k, hi), l.subtreeHash(lo, lo+k))
+}
+
+func (l *Log) subproof(m, lo, hi int, complete bool) []Hash {
+	n := hi - lo
+	if m == n {
+		if complete {
+			return nil
+		}
+		return []Hash{l.subtreeHash(lo, hi)}
+	}
+	k := splitPoint(n)
+	if m <= k {
+		return append(l.subproof(m, lo, lo+k, complete), l.subtreeHash(lo+k, hi))
+	}
+	return append(l.subproof(m-k, lo+k, hi, false), l.subtreeHash(lo, lo+k))
+}
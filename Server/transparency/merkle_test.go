@@ -0,0 +1,102 @@
+package transparency
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"testing"
+)
+
+func testLog(n int) *Log {
+	l := NewLog()
+	for i := 0; i < n; i++ {
+		l.Append(Entry{AccountID: fmt.Sprintf("%064x", i), PublicKey: fmt.Sprintf("key-%d", i), Timestamp: int64(i)})
+	}
+	return l
+}
+
+func naiveRoot(leaves []Hash) Hash {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := splitPoint(len(leaves))
+	return nodeHash(naiveRoot(leaves[:k]), naiveRoot(leaves[k:]))
+}
+
+func TestCachedRootsMatchRecomputation(t *testing.T) {
+	l := testLog(70)
+	var leaves []Hash
+	for size := 1; size <= l.Size(); size++ {
+		e, _ := l.Entry(size - 1)
+		leaves = append(leaves, LeafHash(e.LeafData()))
+		if root, _ := l.Root(size); root != naiveRoot(leaves) {
+			t.Fatalf("size %d: cached root differs from a full recomputation", size)
+		}
+	}
+}
+
+func TestInclusionProofs(t *testing.T) {
+	l := testLog(33)
+	for size := 1; size <= l.Size(); size++ {
+		root, _ := l.Root(size)
+		for i := 0; i < size; i++ {
+			proof, err := l.InclusionProof(i, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e, _ := l.Entry(i)
+			leaf := LeafHash(e.LeafData())
+			if err := VerifyInclusion(leaf, i, size, proof, root); err != nil {
+				t.Fatalf("size %d index %d: %v", size, i, err)
+			}
+			if size > 1 {
+				other, _ := l.Entry((i + 1) % size)
+				if VerifyInclusion(LeafHash(other.LeafData()), i, size, proof, root) == nil {
+					t.Fatalf("size %d index %d: wrong leaf accepted", size, i)
+				}
+			}
+		}
+	}
+}
+
+func TestConsistencyProofs(t *testing.T) {
+	l := testLog(33)
+	for second := 1; second <= l.Size(); second++ {
+		r2, _ := l.Root(second)
+		for first := 1; first <= second; first++ {
+			r1, _ := l.Root(first)
+			proof, err := l.ConsistencyProof(first, second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyConsistency(first, second, r1, r2, proof); err != nil {
+				t.Fatalf("%d -> %d: %v", first, second, err)
+			}
+			if first < second {
+				bad := r1
+				bad[0] ^= 1
+				if VerifyConsistency(first, second, bad, r2, proof) == nil {
+					t.Fatalf("%d -> %d: forged root accepted", first, second)
+				}
+			}
+		}
+	}
+}
+
+func TestSignedTreeHead(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	l := testLog(5)
+	root, _ := l.Root(5)
+	sth := SignTreeHead(priv, 5, 1700000000000, root)
+
+	proof, _ := l.InclusionProof(3, 5)
+	e, _ := l.Entry(3)
+	if err := VerifyEntry(pub, sth, e, 3, proof); err != nil {
+		t.Fatal(err)
+	}
+
+	sth.TreeSize = 6
+	if VerifyTreeHead(pub, sth) == nil {
+		t.Fatal("tampered tree head accepted")
+	}
+}
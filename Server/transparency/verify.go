@@ -0,0 +1,171 @@
+package transparency
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidProof     = errors.New("transparency: invalid proof")
+	ErrInvalidSignature = errors.New("transparency: invalid tree head signature")
+)
+
+// SignedTreeHead commits the log operator to a tree of TreeSize entries.
+// RootHash and Signature are standard base64.
+type SignedTreeHead struct {
+	TreeSize  int    `json:"treeSize"`
+	Timestamp int64  `json:"timestamp"`
+	RootHash  string `json:"rootHash"`
+	Signature string `json:"signature"`
+}
+
+func (sth SignedTreeHead) signedData() []byte {
+	return fmt.Appendf(nil, "kt-sth-v1\n%d\n%d\n%s", sth.TreeSize, sth.Timestamp, sth.RootHash)
+}
+
+// Root decodes RootHash.
+func (sth SignedTreeHead) Root() (Hash, error) {
+	var h Hash
+	raw, err := base64.StdEncoding.DecodeString(sth.RootHash)
+	if err != nil || len(raw) != len(h) {
+		return h, fmt.Errorf("transparency: invalid root hash")
+	}
+	copy(h[:], raw)
+	return h, nil
+}
+
+func SignTreeHead(key ed25519.PrivateKey, size int, timestamp int64, root Hash) SignedTreeHead {
+	sth := SignedTreeHead{
+		TreeSize:  size,
+		Timestamp: timestamp,
+		RootHash:  base64.StdEncoding.EncodeToString(root[:]),
+	}
+	sth.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, sth.signedData()))
+	return sth
+}
+
+func VerifyTreeHead(pub ed25519.PublicKey, sth SignedTreeHead) error {
+	sig, err := base64.StdEncoding.DecodeString(sth.Signature)
+	if err != nil || !ed25519.Verify(pub, sth.signedData(), sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// VerifyInclusion checks that leaf sits at index in the tree described by
+// size and root (RFC 9162, section 2.1.3.2).
+func VerifyInclusion(leaf Hash, index, size int, proof []Hash, root Hash) error {
+	if index < 0 || index >= size {
+		return ErrInvalidProof
+	}
+	fn, sn := index, size-1
+	r := leaf
+	for _, p := range proof {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || r != root {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// VerifyEntry is VerifyInclusion for a logged entry against a signed head.
+func VerifyEntry(pub ed25519.PublicKey, sth SignedTreeHead, e Entry, index int, proof []Hash) error {
+	if err := VerifyTreeHead(pub, sth); err != nil {
+		return err
+	}
+	root, err := sth.Root()
+	if err != nil {
+		return err
+	}
+	return VerifyInclusion(LeafHash(e.LeafData()), index, sth.TreeSize, proof, root)
+}
+
+// VerifyConsistency checks that the tree (first, firstRoot) is a prefix of
+// (second, secondRoot) (RFC 9162, section 2.1.4.2).
+func VerifyConsistency(first, second int, firstRoot, secondRoot Hash, proof []Hash) error {
+	switch {
+	case first < 0 || first > second:
+		return ErrInvalidProof
+	case first == second:
+		if len(proof) != 0 || firstRoot != secondRoot {
+			return ErrInvalidProof
+		}
+		return nil
+	case first == 0:
+		if len(proof) != 0 {
+			return ErrInvalidProof
+		}
+		return nil
+	case len(proof) == 0:
+		return ErrInvalidProof
+	}
+
+	if first&(first-1) == 0 {
+		proof = append([]Hash{firstRoot}, proof...)
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || fr != firstRoot || sr != secondRoot {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// EncodeProof and DecodeProof convert proofs to and from base64 strings for
+// JSON transport.
+func EncodeProof(proof []Hash) []string {
+	out := make([]string, len(proof))
+	for i, h := range proof {
+		out[i] = base64.StdEncoding.EncodeToString(h[:])
+	}
+	return out
+}
+
+func DecodeProof(encoded []string) ([]Hash, error) {
+	out := make([]Hash, len(encoded))
+	for i, s := range encoded {
+		raw, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(raw) != len(out[i]) {
+			return nil, ErrInvalidProof
+		}
+		copy(out[i][:], raw)
+	}
+	return out, nil
+}